@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const usage = `Usage: fake-gateway [flags]
+
+Plays a payment aggregator against a running billing server: sends signed
+Click or Payme webhooks for a test account, checks idempotent redelivery,
+cancellation and signature rejection, then reconciles the transactions it
+made. Exits with 1 when the server answers unexpectedly.
+
+  fake-gateway -kind click -gateway click -secret secret -service-id 1 -account test1
+  fake-gateway -kind payme -gateway payme -secret secret -account test1 -amount 5000
+
+Flags:
+`
+
+type fake struct {
+	baseURL string
+	gateway string
+	secret  string
+	failed  int
+	records []record
+}
+
+// record is a transaction for the reconciliation at the end
+type record struct {
+	ExternalID string    `json:"external_id"`
+	Amount     string    `json:"amount"`
+	State      string    `json:"state"`
+	Time       time.Time `json:"time"`
+}
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:8080/api/v1", "billing API base URL")
+	kind := flag.String("kind", "click", "provider protocol: click or payme")
+	gatewayName := flag.String("gateway", "", "gateway name in the server configuration (default: -kind)")
+	secret := flag.String("secret", "secret", "Click SECRET_KEY or Payme merchant key")
+	serviceID := flag.String("service-id", "1", "Click service_id")
+	account := flag.String("account", "", "login (or contract ID) of the test account")
+	amount := flag.String("amount", "1000", "payment amount in gateway currency units")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *account == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *gatewayName == "" {
+		*gatewayName = *kind
+	}
+
+	f := &fake{baseURL: *baseURL, gateway: *gatewayName, secret: *secret}
+	start := time.Now().Add(-time.Minute)
+
+	switch *kind {
+	case "click":
+		f.click(*serviceID, *account, *amount)
+	case "payme":
+		f.payme(*account, *amount)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown kind %q\n", *kind)
+		os.Exit(2)
+	}
+
+	f.reconcile(start, time.Now().Add(time.Minute))
+
+	if f.failed > 0 {
+		fmt.Printf("\n%d checks failed\n", f.failed)
+		os.Exit(1)
+	}
+	fmt.Println("\nall checks passed")
+}
+
+func (f *fake) click(serviceID, account, amount string) {
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	signTime := time.Now().Format("2006-01-02 15:04:05")
+
+	send := func(values url.Values) map[string]interface{} {
+		signed := values.Get("click_trans_id") + values.Get("service_id") + f.secret + values.Get("merchant_trans_id") +
+			values.Get("merchant_prepare_id") + values.Get("amount") + values.Get("action") + values.Get("sign_time")
+		if values.Get("sign_string") == "" {
+			sum := md5.Sum([]byte(signed))
+			values.Set("sign_string", hex.EncodeToString(sum[:]))
+		}
+		var resp map[string]interface{}
+		f.post("/gateways/"+f.gateway+"/webhook", "application/x-www-form-urlencoded", []byte(values.Encode()), nil, &resp)
+		return resp
+	}
+	request := func(transID, action, prepareID, errorCode string) url.Values {
+		return url.Values{
+			"click_trans_id":      {transID},
+			"service_id":          {serviceID},
+			"click_paydoc_id":     {transID},
+			"merchant_trans_id":   {account},
+			"merchant_prepare_id": {prepareID},
+			"amount":              {amount},
+			"action":              {action},
+			"error":               {errorCode},
+			"error_note":          {"Success"},
+			"sign_time":           {signTime},
+		}
+	}
+	code := func(resp map[string]interface{}) float64 {
+		c, _ := resp["error"].(float64)
+		return c
+	}
+
+	// Payment
+	prepare := send(request(id, "0", "", "0"))
+	f.expect("prepare", code(prepare) == 0, prepare)
+	prepareID := fmt.Sprint(prepare["merchant_prepare_id"])
+	complete := send(request(id, "1", prepareID, "0"))
+	f.expect("complete", code(complete) == 0 && complete["merchant_confirm_id"] != nil, complete)
+	again := send(request(id, "1", prepareID, "0"))
+	f.expect("complete redelivered", code(again) == 0 && again["merchant_confirm_id"] == complete["merchant_confirm_id"], again)
+	f.records = append(f.records, record{ExternalID: id, Amount: amount, State: "performed", Time: time.Now()})
+
+	// Payment failed on the provider side
+	failedID := id + "1"
+	prepare = send(request(failedID, "0", "", "0"))
+	f.expect("prepare", code(prepare) == 0, prepare)
+	cancelled := send(request(failedID, "1", fmt.Sprint(prepare["merchant_prepare_id"]), "-5017"))
+	f.expect("complete with provider error cancels", code(cancelled) == -9, cancelled)
+	f.records = append(f.records, record{ExternalID: failedID, Amount: amount, State: "cancelled", Time: time.Now()})
+
+	// Forged signature
+	forged := request(id+"2", "0", "", "0")
+	forged.Set("sign_string", "0123456789abcdef0123456789abcdef")
+	rejected := send(forged)
+	f.expect("forged signature rejected", code(rejected) == -1, rejected)
+}
+
+func (f *fake) payme(account, amount string) {
+	sum, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid amount %q\n", amount)
+		os.Exit(2)
+	}
+	tiyin := int64(sum * 100)
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("Paycom:"+f.secret))
+	accountParam := map[string]string{"login": account}
+	if _, err := strconv.Atoi(account); err == nil {
+		accountParam = map[string]string{"contract_id": account}
+	}
+
+	call := func(authorization, method string, params map[string]interface{}) map[string]interface{} {
+		body, _ := json.Marshal(map[string]interface{}{"id": time.Now().UnixNano(), "method": method, "params": params})
+		var resp map[string]interface{}
+		f.post("/gateways/"+f.gateway+"/webhook", "application/json", body, map[string]string{"Authorization": authorization}, &resp)
+		return resp
+	}
+	result := func(resp map[string]interface{}) map[string]interface{} {
+		r, _ := resp["result"].(map[string]interface{})
+		return r
+	}
+	errorCode := func(resp map[string]interface{}) float64 {
+		e, _ := resp["error"].(map[string]interface{})
+		c, _ := e["code"].(float64)
+		return c
+	}
+
+	id := fmt.Sprintf("fake%x", time.Now().UnixNano())
+	now := time.Now().UnixMilli()
+
+	// Payment
+	check := call(auth, "CheckPerformTransaction", map[string]interface{}{"amount": tiyin, "account": accountParam})
+	f.expect("CheckPerformTransaction", result(check)["allow"] == true, check)
+	created := call(auth, "CreateTransaction", map[string]interface{}{"id": id, "time": now, "amount": tiyin, "account": accountParam})
+	f.expect("CreateTransaction", result(created)["state"] == float64(1), created)
+	performed := call(auth, "PerformTransaction", map[string]interface{}{"id": id})
+	f.expect("PerformTransaction", result(performed)["state"] == float64(2), performed)
+	again := call(auth, "PerformTransaction", map[string]interface{}{"id": id})
+	f.expect("PerformTransaction redelivered", result(again)["perform_time"] == result(performed)["perform_time"], again)
+
+	// Refund after payment
+	refunded := call(auth, "CancelTransaction", map[string]interface{}{"id": id, "reason": 5})
+	f.expect("CancelTransaction after perform", result(refunded)["state"] == float64(-2), refunded)
+	state := call(auth, "CheckTransaction", map[string]interface{}{"id": id})
+	f.expect("CheckTransaction", result(state)["state"] == float64(-2) && result(state)["reason"] == float64(5), state)
+	f.records = append(f.records, record{ExternalID: id, Amount: amount, State: "cancelled", Time: time.Now()})
+
+	// Payment that stays performed
+	paidID := id + "p"
+	created = call(auth, "CreateTransaction", map[string]interface{}{"id": paidID, "time": now, "amount": tiyin, "account": accountParam})
+	f.expect("CreateTransaction", result(created)["state"] == float64(1), created)
+	performed = call(auth, "PerformTransaction", map[string]interface{}{"id": paidID})
+	f.expect("PerformTransaction", result(performed)["state"] == float64(2), performed)
+	f.records = append(f.records, record{ExternalID: paidID, Amount: amount, State: "performed", Time: time.Now()})
+
+	// Cancelled before perform
+	cancelID := id + "c"
+	call(auth, "CreateTransaction", map[string]interface{}{"id": cancelID, "time": now, "amount": tiyin, "account": accountParam})
+	cancelled := call(auth, "CancelTransaction", map[string]interface{}{"id": cancelID, "reason": 3})
+	f.expect("CancelTransaction before perform", result(cancelled)["state"] == float64(-1), cancelled)
+	late := call(auth, "PerformTransaction", map[string]interface{}{"id": cancelID})
+	f.expect("PerformTransaction of cancelled refused", errorCode(late) == -31008, late)
+	f.records = append(f.records, record{ExternalID: cancelID, Amount: amount, State: "cancelled", Time: time.Now()})
+
+	// Errors
+	unknown := call(auth, "CheckPerformTransaction", map[string]interface{}{"amount": tiyin, "account": map[string]string{"login": "no-such-login-" + id}})
+	f.expect("unknown account refused", errorCode(unknown) == -31050, unknown)
+	forged := call("Basic "+base64.StdEncoding.EncodeToString([]byte("Paycom:wrong")), "CheckTransaction", map[string]interface{}{"id": id})
+	f.expect("forged key rejected", errorCode(forged) == -32504, forged)
+
+	statement := call(auth, "GetStatement", map[string]interface{}{"from": now - 60000, "to": time.Now().UnixMilli() + 60000})
+	transactions, _ := result(statement)["transactions"].([]interface{})
+	f.expect("GetStatement", len(transactions) >= 3, statement)
+}
+
+// reconcile sends the transactions of the run as the provider report; expects no discrepancies
+// other than transactions of earlier runs in the period
+func (f *fake) reconcile(from, to time.Time) {
+	body, _ := json.Marshal(map[string]interface{}{"from": from, "to": to, "records": f.records})
+	var report struct {
+		Matched       int `json:"matched"`
+		Discrepancies []struct {
+			ExternalID string `json:"external_id"`
+			Problem    string `json:"problem"`
+		} `json:"discrepancies"`
+	}
+	f.post("/gateways/"+f.gateway+"/reconcile", "application/json", body, nil, &report)
+
+	ours := make(map[string]bool)
+	for _, r := range f.records {
+		ours[r.ExternalID] = true
+	}
+	ok := report.Matched == len(f.records)
+	for _, d := range report.Discrepancies {
+		if ours[d.ExternalID] {
+			ok = false
+		}
+	}
+	f.expect("reconcile", ok, report)
+}
+
+func (f *fake) expect(step string, ok bool, response interface{}) {
+	status := "ok  "
+	if !ok {
+		status = "FAIL"
+		f.failed++
+	}
+	out, _ := json.Marshal(response)
+	fmt.Printf("%s %-45s %s\n", status, step, out)
+}
+
+func (f *fake) post(path, contentType string, body []byte, headers map[string]string, out interface{}) {
+	req, err := http.NewRequest(http.MethodPost, f.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(data, out); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: HTTP %d: %s\n", path, resp.StatusCode, data)
+		os.Exit(1)
+	}
+}
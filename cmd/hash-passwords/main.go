@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	_ "github.com/lib/pq"
+	"gopkg.in/yaml.v2"
+
+	"isp-billing/internal/services/auth"
+)
+
+// Config структура конфигурации
+type Config struct {
+	Database struct {
+		Host     string `yaml:"host"`
+		Port     int    `yaml:"port"`
+		Name     string `yaml:"name"`
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+		SSLMode  string `yaml:"sslmode"`
+	} `yaml:"database"`
+}
+
+// Перевод открытых паролей accounts.password в хешированный вид.
+// nthash сохраняет поддержку PAP и MS-CHAPv2, bcrypt - только PAP. CHAP требует открытый пароль.
+func main() {
+	scheme := flag.String("scheme", auth.SchemeNTHash, "target scheme: nthash or bcrypt")
+	dryRun := flag.Bool("dry-run", false, "only count passwords to migrate")
+	flag.Usage = func() {
+		fmt.Println("Usage: hash-passwords [-scheme nthash|bcrypt] [-dry-run] <config.yaml>")
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *scheme != auth.SchemeNTHash && *scheme != auth.SchemeBcrypt {
+		log.Fatalf("Unsupported scheme: %s", *scheme)
+	}
+
+	configData, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to read config: %v", err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(configData, &cfg); err != nil {
+		log.Fatalf("Failed to parse config: %v", err)
+	}
+
+	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		cfg.Database.Host, cfg.Database.Port, cfg.Database.User,
+		cfg.Database.Password, cfg.Database.Name, cfg.Database.SSLMode)
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, password FROM accounts")
+	if err != nil {
+		log.Fatalf("Failed to fetch accounts: %v", err)
+	}
+
+	type account struct {
+		stored   string // Original column value, guards against concurrent changes
+		password string
+	}
+	pending := make(map[int]account)
+	for rows.Next() {
+		var id int
+		var password string
+		if err := rows.Scan(&id, &password); err != nil {
+			log.Fatalf("Failed to scan account: %v", err)
+		}
+		stored := auth.ParseStoredPassword(password)
+		if stored.Scheme == auth.SchemeCleartext {
+			pending[id] = account{stored: password, password: stored.Value}
+		}
+	}
+	rows.Close()
+
+	fmt.Printf("🔍 Accounts with cleartext passwords: %d\n", len(pending))
+	if *dryRun || len(pending) == 0 {
+		return
+	}
+
+	migrated := 0
+	for id, acc := range pending {
+		hashed, err := auth.HashPassword(*scheme, acc.password)
+		if err != nil {
+			log.Fatalf("Failed to hash password of account %d: %v", id, err)
+		}
+		res, err := db.Exec("UPDATE accounts SET password = $1 WHERE id = $2 AND password = $3", hashed, id, acc.stored)
+		if err != nil {
+			log.Fatalf("Failed to update account %d: %v", id, err)
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			migrated++
+		}
+	}
+
+	fmt.Printf("✅ Migrated %d passwords to %s\n", migrated, *scheme)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/services/billing"
+	"isp-billing/internal/services/currency"
+	"isp-billing/internal/services/simulator"
+)
+
+type Config struct {
+	Database database.Config `yaml:"database"`
+}
+
+const usage = `Usage: simulate-plan [flags] <config.yaml>
+
+Replays usage through the billing algorithms with a candidate plan and
+compares the charges with the current plans of the accounts.
+
+  simulate-plan -plan 7 config.yaml
+  simulate-plan -plan-data night.json -acct-algo algo_builtin:prepaid_auth -current-plan 3 config.yaml
+  simulate-plan -plan 7 -profile profile.json -accounts 12,15 config.yaml
+
+Flags:
+`
+
+func main() {
+	planID := flag.Int("plan", 0, "ID of the plan to simulate")
+	planDataFile := flag.String("plan-data", "", "JSON file with plan_data to simulate instead of -plan")
+	acctAlgo := flag.String("acct-algo", "", "acct algorithm for -plan-data (default: current algorithm of each account)")
+	accounts := flag.String("accounts", "", "comma separated account IDs (default: all active accounts)")
+	currentPlan := flag.Int("current-plan", 0, "only accounts now on this plan")
+	from := flag.String("from", "", "start of the period, YYYY-MM-DD (default: 30 days ago)")
+	to := flag.String("to", "", "end of the period, YYYY-MM-DD (default: now)")
+	profileFile := flag.String("profile", "", "JSON file with a synthetic traffic profile instead of history")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	req := simulator.Request{
+		PlanID:        *planID,
+		AcctAlgo:      *acctAlgo,
+		CurrentPlanID: *currentPlan,
+	}
+	if *planDataFile != "" {
+		readJSON(*planDataFile, &req.PlanData)
+	}
+	if *profileFile != "" {
+		req.Profile = &simulator.Profile{}
+		readJSON(*profileFile, req.Profile)
+	}
+	if *accounts != "" {
+		for _, field := range strings.Split(*accounts, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				log.Fatalf("Invalid account ID %q", field)
+			}
+			req.AccountIDs = append(req.AccountIDs, id)
+		}
+	}
+	req.From = parseDate(*from)
+	req.To = parseDate(*to)
+
+	// Load config
+	configData, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to read config: %v", err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(configData, &cfg); err != nil {
+		log.Fatalf("Failed to parse config: %v", err)
+	}
+
+	db, err := database.NewPostgreSQL(cfg.Database)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	logger := zap.NewNop()
+	currencyService, err := currency.New(db, logger, currency.Config{RateSource: currency.SourceDB})
+	if err != nil {
+		log.Fatalf("Failed to initialize currency service: %v", err)
+	}
+	billingService := billing.NewService(db, currencyService, map[string]interface{}{})
+	simulatorService := simulator.New(db, billingService, logger, simulator.Config{})
+
+	report, err := simulatorService.Simulate(req)
+	if err != nil {
+		log.Fatalf("❌ Simulation failed: %v", err)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			log.Fatalf("Failed to encode report: %v", err)
+		}
+		return
+	}
+
+	printReport(report)
+}
+
+func readJSON(path string, v interface{}) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		log.Fatalf("Failed to parse %s: %v", path, err)
+	}
+}
+
+func parseDate(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		log.Fatalf("Invalid date %q, expected YYYY-MM-DD", value)
+	}
+	return t
+}
+
+func printReport(report *simulator.Report) {
+	plan := report.Plan.Name
+	if plan == "" {
+		plan = "plan_data"
+	}
+	fmt.Printf("📊 Simulation of %s (%s) on %s usage %s .. %s\n\n", plan, report.Plan.AcctAlgo, report.Source,
+		report.From.Format("2006-01-02 15:04"), report.To.Format("2006-01-02 15:04"))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "account\tlogin\tplan\tcurrency\tsessions\tMB in\tMB out\trecorded\tcurrent\tsimulated\tdiff\t")
+	for _, a := range report.Accounts {
+		if a.Error != "" {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t\t\t\t\t\t❌ %s\t\n", a.AccountID, a.Login, a.PlanID, a.Currency, a.Sessions, a.Error)
+			continue
+		}
+		recorded := ""
+		if a.Recorded != nil {
+			recorded = a.Recorded.StringFixed(2)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%.1f\t%.1f\t%s\t%s\t%s\t%s\t\n",
+			a.AccountID, a.Login, a.PlanID, a.Currency, a.Sessions,
+			float64(a.OctetsIn)/1048576, float64(a.OctetsOut)/1048576, recorded,
+			a.Current.StringFixed(2), a.Simulated.StringFixed(2), a.Diff.StringFixed(2))
+	}
+	w.Flush()
+
+	fmt.Println("\n🔍 Totals by contract currency:")
+	for _, t := range report.Totals {
+		fmt.Printf("  currency %d: %d accounts, current %s, simulated %s, diff %s (cheaper %d, dearer %d, unchanged %d)\n",
+			t.Currency, t.Accounts, t.Current.StringFixed(2), t.Simulated.StringFixed(2), t.Diff.StringFixed(2),
+			t.Cheaper, t.Dearer, t.Unchanged)
+	}
+	if report.Failed > 0 {
+		fmt.Printf("⚠️  %d accounts could not be simulated\n", report.Failed)
+	}
+	if report.Truncated {
+		fmt.Println("⚠️  Account limit reached, narrow the selection with -accounts or -current-plan")
+	}
+}
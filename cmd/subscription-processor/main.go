@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"netspire-go/internal/database"
 	"netspire-go/internal/services/billing"
+	"netspire-go/internal/services/currency"
 
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
@@ -25,6 +31,7 @@ type Config struct {
 	} `yaml:"database"`
 
 	Subscription billing.SubscriptionConfig `yaml:"subscription"`
+	Currency     currency.Config            `yaml:"currency"`
 }
 
 func main() {
@@ -37,7 +44,17 @@ func main() {
 
 	switch command {
 	case "process":
-		processCommand()
+		processCommand(false)
+	case "due":
+		processCommand(true)
+	case "runs":
+		runsCommand()
+	case "run":
+		runCommand()
+	case "cancel":
+		cancelCommand()
+	case "resume":
+		resumeCommand()
 	case "history":
 		historyCommand()
 	case "stats":
@@ -59,6 +76,11 @@ USAGE:
 
 COMMANDS:
     process [date]           Process monthly charges (YYYY-MM-DD or current date)
+    due                      Charge accounts whose billing period starts today or is unpaid (daily cron)
+    runs                     List recent charge runs
+    run <run_id>             Show charge run progress and summary
+    cancel <run_id>          Cancel a charge run after its current batch
+    resume <run_id>          Resume a cancelled, failed or interrupted charge run
     history <account_id>     Show charge history for account
     stats                    Show billing statistics
     help                     Show this help message
@@ -66,12 +88,14 @@ COMMANDS:
 EXAMPLES:
     subscription-processor process                    # Process for current month
     subscription-processor process 2024-01-01        # Process for January 2024
+    subscription-processor due                       # Daily run for all billing cycles
+    subscription-processor resume 12                 # Continue run 12 from its checkpoint
     subscription-processor history 123               # Show history for account 123
     subscription-processor stats                     # Show statistics
 `)
 }
 
-func processCommand() {
+func processCommand(due bool) {
 	logger := createLogger()
 	config := loadConfig()
 
@@ -90,7 +114,21 @@ func processCommand() {
 	}
 
 	// Initialize subscription service
-	subscriptionService := billing.NewSubscriptionService(db, logger, &config.Subscription)
+	rates, err := currency.New(db, logger, config.Currency)
+	if err != nil {
+		log.Fatalf("Failed to initialize currency service: %v", err)
+	}
+	subscriptionService := billing.NewSubscriptionService(db, rates, logger, &config.Subscription)
+
+	if due {
+		fmt.Println("Processing due charges...")
+		run, err := subscriptionService.CreateRun(billing.ChargeRunDue, time.Now())
+		if err != nil {
+			log.Fatalf("Failed to process due charges: %v", err)
+		}
+		executeRun(subscriptionService, run)
+		return
+	}
 
 	// Determine target date
 	var targetDate time.Time
@@ -107,12 +145,157 @@ func processCommand() {
 	fmt.Printf("Processing monthly charges for %s...\n", targetDate.Format("2006-01-02"))
 
 	// Process charges
-	err = subscriptionService.ProcessMonthlyCharges(targetDate)
+	run, err := subscriptionService.CreateRun(billing.ChargeRunMonthly, targetDate)
 	if err != nil {
 		log.Fatalf("Failed to process monthly charges: %v", err)
 	}
+	executeRun(subscriptionService, run)
+}
+
+// executeRun executes the run until it is done; Ctrl+C cancels it after the current batch
+func executeRun(subscriptionService *billing.SubscriptionService, run *billing.ChargeRun) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("Charge run %d: %d accounts\n", run.ID, run.Total)
+	err := subscriptionService.ExecuteRun(ctx, run)
+	printRun(run)
+
+	switch {
+	case errors.Is(err, billing.ErrRunCancelled):
+		fmt.Printf("Run cancelled, continue with: subscription-processor resume %d\n", run.ID)
+		os.Exit(1)
+	case err != nil:
+		log.Fatalf("Charge run failed: %v", err)
+	case run.Errors > 0:
+		fmt.Printf("✗ %d accounts could not be processed, see: subscription-processor run %d\n", run.Errors, run.ID)
+		os.Exit(1)
+	}
+	fmt.Println("✓ Charges processed successfully")
+}
+
+func runsCommand() {
+	subscriptionService := newSubscriptionService()
+
+	runs, err := subscriptionService.ListRuns(20)
+	if err != nil {
+		log.Fatalf("Failed to list charge runs: %v", err)
+	}
+
+	fmt.Println("\nCharge runs:")
+	fmt.Println("============")
+	if len(runs) == 0 {
+		fmt.Println("No charge runs found")
+		return
+	}
+	for _, run := range runs {
+		fmt.Printf("%d %s %s %s: %d/%d processed, %d errors, started %s\n",
+			run.ID,
+			run.Kind,
+			run.TargetDate.Format("2006-01-02"),
+			run.State,
+			run.Processed,
+			run.Total,
+			run.Errors,
+			run.StartedAt.Format("2006-01-02 15:04:05"))
+	}
+}
+
+func runCommand() {
+	runID := parseRunID()
+	subscriptionService := newSubscriptionService()
+
+	report, err := subscriptionService.RunReport(runID)
+	if err != nil {
+		log.Fatalf("Failed to get charge run: %v", err)
+	}
+
+	printRun(report.Run)
+	for _, revenue := range report.Revenue {
+		fmt.Printf("Revenue (currency %d): %s\n", revenue.Currency, revenue.Amount.StringFixed(2))
+	}
+	for reason, count := range report.FailureReasons {
+		fmt.Printf("Failed (%s): %d\n", reason, count)
+	}
+	if len(report.AccountErrors) > 0 {
+		fmt.Println("\nAccount errors:")
+		for _, e := range report.AccountErrors {
+			fmt.Printf("%d: %s\n", e.AccountID, e.Error)
+		}
+	}
+}
+
+func cancelCommand() {
+	runID := parseRunID()
+	subscriptionService := newSubscriptionService()
+
+	run, err := subscriptionService.CancelRun(runID)
+	if err != nil {
+		log.Fatalf("Failed to cancel charge run: %v", err)
+	}
+
+	if run.State == billing.ChargeRunRunning {
+		fmt.Printf("Cancellation of run %d requested, it stops after the current batch\n", run.ID)
+		return
+	}
+	fmt.Printf("Run %d is %s\n", run.ID, run.State)
+}
+
+func resumeCommand() {
+	runID := parseRunID()
+	subscriptionService := newSubscriptionService()
+
+	run, err := subscriptionService.ClaimRun(runID)
+	if err != nil {
+		log.Fatalf("Failed to resume charge run: %v", err)
+	}
+	fmt.Printf("Resuming run %d after account %d...\n", run.ID, run.Checkpoint)
+	executeRun(subscriptionService, run)
+}
 
-	fmt.Println("✓ Monthly charges processed successfully")
+func printRun(run *billing.ChargeRun) {
+	fmt.Printf("\nCharge run %d (%s, %s): %s\n", run.ID, run.Kind, run.TargetDate.Format("2006-01-02"), run.State)
+	fmt.Printf("Processed: %d of %d\n", run.Processed, run.Total)
+	fmt.Printf("Charged: %d, failed: %d, skipped: %d, errors: %d\n", run.Succeeded, run.Failed, run.Skipped, run.Errors)
+	if run.Error != "" {
+		fmt.Printf("Error: %s\n", run.Error)
+	}
+}
+
+func parseRunID() int {
+	if len(os.Args) < 3 {
+		fmt.Printf("Usage: subscription-processor %s <run_id>\n", os.Args[1])
+		os.Exit(1)
+	}
+	runID, err := strconv.Atoi(os.Args[2])
+	if err != nil {
+		log.Fatalf("Invalid run ID: %s", os.Args[2])
+	}
+	return runID
+}
+
+func newSubscriptionService() *billing.SubscriptionService {
+	logger := createLogger()
+	config := loadConfig()
+
+	dbConfig := database.Config{
+		Host:     config.Database.Host,
+		Port:     config.Database.Port,
+		Name:     config.Database.Name,
+		User:     config.Database.User,
+		Password: config.Database.Password,
+		SSLMode:  config.Database.SSLMode,
+	}
+	db, err := database.NewPostgreSQL(dbConfig)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+
+	rates, err := currency.New(db, logger, config.Currency)
+	if err != nil {
+		log.Fatalf("Failed to initialize currency service: %v", err)
+	}
+	return billing.NewSubscriptionService(db, rates, logger, &config.Subscription)
 }
 
 func historyCommand() {
@@ -140,7 +323,11 @@ func historyCommand() {
 	}
 
 	// Initialize subscription service
-	subscriptionService := billing.NewSubscriptionService(db, logger, &config.Subscription)
+	rates, err := currency.New(db, logger, config.Currency)
+	if err != nil {
+		log.Fatalf("Failed to initialize currency service: %v", err)
+	}
+	subscriptionService := billing.NewSubscriptionService(db, rates, logger, &config.Subscription)
 
 	// Parse account ID
 	var accountIDInt int
@@ -161,16 +348,23 @@ func historyCommand() {
 	}
 
 	for _, charge := range charges {
-		fmt.Printf("%s - $%.2f (%s)\n",
-			charge.ChargeDate.Format("2006-01-02 15:04:05"),
-			charge.Amount,
-			charge.Status)
+		fmt.Printf("%s - %s (currency %d) %s, attempts %d",
+			charge.PeriodStart.Format("2006-01"),
+			charge.Amount.StringFixed(2),
+			charge.Currency,
+			charge.Status,
+			charge.Attempts)
+		if charge.FailureReason != "" {
+			fmt.Printf(": %s", charge.FailureReason)
+		}
+		fmt.Println()
 	}
 
 	fmt.Printf("\nTotal charges: %d\n", len(charges))
 }
 
 func statsCommand() {
+	logger := createLogger()
 	config := loadConfig()
 
 	// Initialize database
@@ -193,14 +387,28 @@ func statsCommand() {
 		log.Fatalf("Failed to get statistics: %v", err)
 	}
 
+	// Charges of the current period from the subscription_charges ledger
+	rates, err := currency.New(db, logger, config.Currency)
+	if err != nil {
+		log.Fatalf("Failed to initialize currency service: %v", err)
+	}
+	subscriptionService := billing.NewSubscriptionService(db, rates, logger, &config.Subscription)
+	charges, err := subscriptionService.GetChargeStats(time.Now())
+	if err != nil {
+		log.Fatalf("Failed to get charge statistics: %v", err)
+	}
+
 	fmt.Println("\nSubscription Billing Statistics:")
 	fmt.Println("=================================")
 	fmt.Printf("Total Accounts: %d\n", stats.TotalAccounts)
 	fmt.Printf("Active Accounts: %d\n", stats.ActiveAccounts)
-	fmt.Printf("Charges This Month: %d\n", stats.ChargesThisMonth)
-	fmt.Printf("Failed Charges: %d\n", stats.FailedCharges)
-	fmt.Printf("Total Revenue: $%.2f\n", stats.TotalRevenue)
-	fmt.Printf("Success Rate: %.1f%%\n", stats.SuccessRate)
+	fmt.Printf("Charges This Month: %d\n", charges.Success)
+	fmt.Printf("Failed Charges: %d\n", charges.Failed)
+	fmt.Printf("Pending Charges: %d\n", charges.Pending)
+	for _, revenue := range charges.Revenue {
+		fmt.Printf("Total Revenue (currency %d): %s\n", revenue.Currency, revenue.Amount.StringFixed(2))
+	}
+	fmt.Printf("Success Rate: %.1f%%\n", charges.SuccessRate)
 }
 
 func createLogger() *zap.Logger {
@@ -231,14 +439,10 @@ func loadConfig() *Config {
 	return &config
 }
 
-// SubscriptionStats статистика подписок
+// SubscriptionStats статистика аккаунтов (списания - в billing.ChargeStats)
 type SubscriptionStats struct {
-	TotalAccounts    int     `json:"total_accounts"`
-	ActiveAccounts   int     `json:"active_accounts"`
-	ChargesThisMonth int     `json:"charges_this_month"`
-	FailedCharges    int     `json:"failed_charges"`
-	TotalRevenue     float64 `json:"total_revenue"`
-	SuccessRate      float64 `json:"success_rate"`
+	TotalAccounts  int `json:"total_accounts"`
+	ActiveAccounts int `json:"active_accounts"`
 }
 
 func getSubscriptionStats(db *database.PostgreSQL) (*SubscriptionStats, error) {
@@ -256,30 +460,5 @@ func getSubscriptionStats(db *database.PostgreSQL) (*SubscriptionStats, error) {
 		return nil, err
 	}
 
-	// Charges this month
-	err = db.GetDB().QueryRow(`
-		SELECT COUNT(*) FROM fin_transactions ft
-		WHERE ft.comment LIKE 'Monthly subscription fee%'
-		AND ft.created_at >= date_trunc('month', CURRENT_DATE)
-		AND ft.amount < 0`).Scan(&stats.ChargesThisMonth)
-	if err != nil {
-		return nil, err
-	}
-
-	// Total revenue this month
-	err = db.GetDB().QueryRow(`
-		SELECT COALESCE(SUM(ABS(ft.amount)), 0) FROM fin_transactions ft
-		WHERE ft.comment LIKE 'Monthly subscription fee%'
-		AND ft.created_at >= date_trunc('month', CURRENT_DATE)
-		AND ft.amount < 0`).Scan(&stats.TotalRevenue)
-	if err != nil {
-		return nil, err
-	}
-
-	// Success rate calculation
-	if stats.ChargesThisMonth > 0 {
-		stats.SuccessRate = float64(stats.ChargesThisMonth-stats.FailedCharges) / float64(stats.ChargesThisMonth) * 100
-	}
-
 	return stats, nil
 }
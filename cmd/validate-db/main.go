@@ -2,12 +2,16 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 
 	_ "github.com/lib/pq"
 	"gopkg.in/yaml.v2"
+
+	"isp-billing/internal/models"
 )
 
 type Config struct {
@@ -23,11 +27,20 @@ type Config struct {
 
 func main() {
 	if len(os.Args) < 2 {
-		log.Fatal("Usage: go run main.go <config.yaml>")
+		log.Fatal("Usage: go run main.go [validate-plans] <config.yaml>")
+	}
+
+	// validate-plans mode checks plans.settings and accounts.plan_data only
+	mode, configPath := "schema", os.Args[1]
+	if os.Args[1] == "validate-plans" {
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: go run main.go validate-plans <config.yaml>")
+		}
+		mode, configPath = "validate-plans", os.Args[2]
 	}
 
 	// Load config
-	configData, err := os.ReadFile(os.Args[1])
+	configData, err := os.ReadFile(configPath)
 	if err != nil {
 		log.Fatalf("Failed to read config: %v", err)
 	}
@@ -54,6 +67,14 @@ func main() {
 
 	fmt.Println("✅ Database connection successful")
 
+	if mode == "validate-plans" {
+		if err := validatePlans(db); err != nil {
+			log.Fatalf("❌ Plan validation failed: %v", err)
+		}
+		fmt.Println("✅ All plan settings are valid")
+		return
+	}
+
 	// Validate schema
 	if err := validateSchema(db); err != nil {
 		log.Fatalf("❌ Schema validation failed: %v", err)
@@ -259,3 +280,70 @@ func isCompatibleType(actual, expected string) bool {
 
 	return actual == expected
 }
+
+// validatePlans strictly parses every plans.settings and accounts.plan_data
+func validatePlans(db *sql.DB) error {
+	fmt.Println("\n🔍 Validating plans.settings...")
+	planErrors, err := validatePlanDataRows(db, "plan", "SELECT id, COALESCE(settings, '') FROM plans ORDER BY id")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("\n🔍 Validating accounts.plan_data...")
+	accountErrors, err := validatePlanDataRows(db, "account", "SELECT id, COALESCE(plan_data, '') FROM accounts ORDER BY id")
+	if err != nil {
+		return err
+	}
+
+	if total := planErrors + accountErrors; total > 0 {
+		return fmt.Errorf("%d plans and %d accounts have invalid settings", planErrors, accountErrors)
+	}
+	return nil
+}
+
+func validatePlanDataRows(db *sql.DB, kind, query string) (int, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return 0, fmt.Errorf("query error: %w", err)
+	}
+	defer rows.Close()
+
+	checked, invalid := 0, 0
+	for rows.Next() {
+		var id int
+		var raw string
+		if err := rows.Scan(&id, &raw); err != nil {
+			return 0, fmt.Errorf("scan error: %w", err)
+		}
+		checked++
+
+		if raw == "" {
+			continue
+		}
+
+		var planData map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &planData); err != nil {
+			invalid++
+			fmt.Printf("  ❌ %s %d: invalid JSON: %v\n", kind, id, err)
+			continue
+		}
+
+		if _, err := models.ParsePlanSettings(planData); err != nil {
+			invalid++
+			var planErrs *models.PlanDataErrors
+			if errors.As(err, &planErrs) {
+				for _, e := range planErrs.Errors {
+					fmt.Printf("  ❌ %s %d: %s\n", kind, id, e.Error())
+				}
+			} else {
+				fmt.Printf("  ❌ %s %d: %v\n", kind, id, err)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("rows error: %w", err)
+	}
+
+	fmt.Printf("  📈 Checked %d, invalid %d\n", checked, invalid)
+	return invalid, nil
+}
@@ -88,7 +88,7 @@ func (p *PostgreSQL) FetchAccount(userName string) (*models.AccountWithRelations
 		return nil, fmt.Errorf("failed to fetch account: %w", err)
 	}
 
-	logrus.Infof("Account found for userName %s: ID=%d, Balance=%.2f", userName, account.ID, account.Balance)
+	logrus.Infof("Account found for userName %s: ID=%d, Balance=%s", userName, account.ID, account.Balance)
 	return &account, nil
 }
 
@@ -135,82 +135,6 @@ func (p *PostgreSQL) StartSession(userID int, ip, sid, cid string, startedAt tim
 	return nil
 }
 
-// SyncSession - точная копия sync_session из mod_iptraffic_pgsql.erl
-func (p *PostgreSQL) SyncSession(octetsIn, octetsOut int64, updatedAt time.Time, amount float64, sid string, userID int) error {
-	result, err := p.db.Exec(models.SyncSessionQuery,
-		octetsIn, octetsOut, updatedAt, amount, sid, userID)
-	if err != nil {
-		return fmt.Errorf("failed to sync session: %w", err)
-	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
-	}
-
-	if rowsAffected != 1 {
-		return fmt.Errorf("expected 1 row affected, got %d", rowsAffected)
-	}
-
-	return nil
-}
-
-// StopSession - точная копия stop_session из mod_iptraffic_pgsql.erl
-func (p *PostgreSQL) StopSession(sid string, userID int, octetsIn, octetsOut int64, amount float64, finishedAt time.Time, expired bool, planData map[string]interface{}, sessionDetails map[string]models.TrafficClass) error {
-	// Начинаем транзакцию
-	tx, err := p.db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback()
-
-	// Получаем ID сессии
-	var sessionID int
-	err = tx.QueryRow(models.StopSessionQuery, sid, userID).Scan(&sessionID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil // Сессия уже завершена или не найдена
-		}
-		return fmt.Errorf("failed to find session: %w", err)
-	}
-
-	// Списываем деньги с баланса
-	comment := fmt.Sprintf("session %d", sessionID)
-	var newBalance float64
-	err = tx.QueryRow(models.DebitTransactionQuery, userID, amount, comment, nil).Scan(&newBalance)
-	if err != nil {
-		return fmt.Errorf("failed to debit transaction: %w", err)
-	}
-
-	// Обновляем сессию
-	_, err = tx.Exec(models.FinishSessionQuery,
-		octetsIn, octetsOut, amount, finishedAt, expired, sessionID)
-	if err != nil {
-		return fmt.Errorf("failed to finish session: %w", err)
-	}
-
-	// Обновляем plan_data в accounts
-	planDataJSON, err := json.Marshal(planData)
-	if err != nil {
-		return fmt.Errorf("failed to marshal plan data: %w", err)
-	}
-	_, err = tx.Exec(models.UpdateAccountPlanDataQuery, string(planDataJSON), userID)
-	if err != nil {
-		return fmt.Errorf("failed to update account plan data: %w", err)
-	}
-
-	// Сохраняем детали сессии по классам трафика
-	for class, details := range sessionDetails {
-		_, err = tx.Exec(models.InsertSessionDetailQuery,
-			sessionID, class, details.OctetsIn, details.OctetsOut)
-		if err != nil {
-			return fmt.Errorf("failed to insert session detail for class %s: %w", class, err)
-		}
-	}
-
-	return tx.Commit()
-}
-
 // ================ ДОПОЛНИТЕЛЬНЫЕ МЕТОДЫ ДЛЯ GO СИСТЕМЫ ================
 
 // GetActiveSessions - получить активные сессии
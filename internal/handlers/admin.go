@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -8,15 +9,19 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/charges"
 )
 
 type AdminHandler struct {
-	db *database.PostgreSQL
+	db             *database.PostgreSQL
+	chargesService *charges.Service
 }
 
-func NewAdminHandler(db *database.PostgreSQL) *AdminHandler {
+func NewAdminHandler(db *database.PostgreSQL, chargesService *charges.Service) *AdminHandler {
 	return &AdminHandler{
-		db: db,
+		db:             db,
+		chargesService: chargesService,
 	}
 }
 
@@ -144,19 +149,25 @@ func (h *AdminHandler) GetPlans(c *gin.Context) {
 	})
 }
 
-// ChargeAccount - списать средства с аккаунта
+// ChargeAccount - списать средства с аккаунта (разовое списание через debit_transaction)
+// reason - код причины, по умолчанию adjustment; см. POST /accounts/:id/charges для зачислений
 func (h *AdminHandler) ChargeAccount(c *gin.Context) {
 	login := c.Param("id")
 
 	var req struct {
-		Amount      float64 `json:"amount" binding:"required"`
-		Description string  `json:"description"`
+		Amount      models.Money `json:"amount" binding:"required"`
+		Currency    int          `json:"currency"`
+		Reason      string       `json:"reason"`
+		Description string       `json:"description"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.Reason == "" {
+		req.Reason = models.ReasonAdjustment
+	}
 
 	// Получаем аккаунт
 	account, err := h.db.FetchAccount(login)
@@ -171,16 +182,34 @@ func (h *AdminHandler) ChargeAccount(c *gin.Context) {
 		return
 	}
 
-	// TODO: Реализовать обновление баланса в БД
-	// Пока что просто возвращаем успех
-	logrus.Infof("Charging account %s with amount %.2f: %s", login, req.Amount, req.Description)
+	charge, err := h.chargesService.Charge(charges.ChargeRequest{
+		AccountID:   account.ID,
+		Kind:        models.OneOffDebit,
+		Reason:      req.Reason,
+		Amount:      req.Amount,
+		Currency:    req.Currency,
+		Description: req.Description,
+	})
+	if errors.Is(err, charges.ErrInvalidCharge) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to charge account %s: %v", login, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message":     "Account charged successfully",
-		"account":     login,
-		"amount":      req.Amount,
-		"description": req.Description,
-		"new_balance": account.Balance - req.Amount,
+		"message":        "Account charged successfully",
+		"account":        login,
+		"charge_id":      charge.ID,
+		"amount":         charge.Amount,
+		"currency":       charge.Currency,
+		"reason":         charge.Reason,
+		"description":    charge.Description,
+		"transaction_id": charge.TransactionID,
+		"new_balance":    charge.Balance,
 	})
 }
 
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/services/binding"
+)
+
+// BindingHandler handles admin endpoints for account MAC / Calling-Station-Id bindings
+type BindingHandler struct {
+	bindingService *binding.Service
+	logger         *zap.Logger
+}
+
+// NewBindingHandler creates a new binding handler
+func NewBindingHandler(bindingService *binding.Service, logger *zap.Logger) *BindingHandler {
+	return &BindingHandler{
+		bindingService: bindingService,
+		logger:         logger,
+	}
+}
+
+// RegisterRoutes registers binding management routes
+func (h *BindingHandler) RegisterRoutes(router *gin.RouterGroup) {
+	bindings := router.Group("/accounts/:id/bindings")
+	{
+		bindings.GET("", h.ListBindings)
+		bindings.POST("", h.AddBinding)
+		bindings.DELETE("/:binding_id", h.RemoveBinding)
+		bindings.GET("/history", h.GetHistory)
+	}
+}
+
+// ListBindings returns bindings of an account
+// GET /api/v1/accounts/:id/bindings
+func (h *BindingHandler) ListBindings(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	bindings, err := h.bindingService.List(accountID)
+	if err != nil {
+		h.logger.Error("Failed to list bindings", zap.Int("account_id", accountID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"bindings": bindings,
+		"count":    len(bindings),
+	})
+}
+
+// AddBinding binds a MAC address or Calling-Station-Id to an account
+// POST /api/v1/accounts/:id/bindings
+func (h *BindingHandler) AddBinding(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var req struct {
+		Value string `json:"value" binding:"required"` // MAC address or Calling-Station-Id
+		Actor string `json:"actor"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	b, err := h.bindingService.Add(accountID, req.Value, req.Actor)
+	if err != nil {
+		h.logger.Error("Failed to add binding", zap.Int("account_id", accountID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, b)
+}
+
+// RemoveBinding deletes a binding of an account
+// DELETE /api/v1/accounts/:id/bindings/:binding_id
+func (h *BindingHandler) RemoveBinding(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+	bindingID, err := strconv.Atoi(c.Param("binding_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid binding ID"})
+		return
+	}
+
+	if err := h.bindingService.Remove(accountID, bindingID, c.Query("actor")); err != nil {
+		if errors.Is(err, binding.ErrBindingNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Binding not found"})
+			return
+		}
+		h.logger.Error("Failed to remove binding", zap.Int("account_id", accountID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Binding removed"})
+}
+
+// GetHistory returns binding changes and flagged/rejected logins of an account
+// GET /api/v1/accounts/:id/bindings/history?limit=100
+func (h *BindingHandler) GetHistory(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+
+	history, err := h.bindingService.History(accountID, limit)
+	if err != nil {
+		h.logger.Error("Failed to get binding history", zap.Int("account_id", accountID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"history": history,
+		"count":   len(history),
+	})
+}
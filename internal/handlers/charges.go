@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/billing"
+	"isp-billing/internal/services/charges"
+)
+
+// ChargesHandler handles one-off charge, add-on and discount endpoints
+type ChargesHandler struct {
+	chargesService *charges.Service
+	logger         *zap.Logger
+}
+
+// NewChargesHandler creates a new charges handler
+func NewChargesHandler(chargesService *charges.Service, logger *zap.Logger) *ChargesHandler {
+	return &ChargesHandler{
+		chargesService: chargesService,
+		logger:         logger,
+	}
+}
+
+// RegisterRoutes registers charges routes
+func (h *ChargesHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.POST("/accounts/:id/charges", h.CreateCharge)
+	router.GET("/accounts/:id/charges", h.GetAccountCharges)
+
+	router.GET("/addons", h.GetAddons)
+	router.POST("/addons", h.CreateAddon)
+	router.PUT("/addons/:id", h.UpdateAddon)
+	router.GET("/accounts/:id/addons", h.GetAccountAddons)
+	router.POST("/accounts/:id/addons", h.AddAccountAddon)
+	router.POST("/account-addons/:id/end", h.EndAccountAddon)
+
+	router.GET("/discounts", h.GetDiscounts)
+	router.POST("/discounts", h.CreateDiscount)
+	router.POST("/discounts/:id/end", h.EndDiscount)
+}
+
+// CreateCharge debits or credits an account once
+// POST /api/v1/accounts/:id/charges {"kind": "debit", "reason": "installation", "amount": "50"}
+func (h *ChargesHandler) CreateCharge(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+
+	var req charges.ChargeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.AccountID = accountID
+
+	charge, err := h.chargesService.Charge(req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, charge)
+}
+
+// GetAccountCharges returns one-off charges of an account
+// GET /api/v1/accounts/:id/charges?limit=20
+func (h *ChargesHandler) GetAccountCharges(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+
+	list, err := h.chargesService.AccountCharges(accountID, limit)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account_id": accountID,
+		"charges":    list,
+	})
+}
+
+// GetAddons returns the add-on catalog
+// GET /api/v1/addons
+func (h *ChargesHandler) GetAddons(c *gin.Context) {
+	addons, err := h.chargesService.Addons()
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"addons": addons})
+}
+
+// CreateAddon adds an add-on to the catalog
+// POST /api/v1/addons {"code": "static_ip", "name": "Static IP", "monthly_fee": "5", "currency": 1, "active": true}
+func (h *ChargesHandler) CreateAddon(c *gin.Context) {
+	var addon models.Addon
+	if err := c.ShouldBindJSON(&addon); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	addon.ID = 0
+
+	if err := h.chargesService.SaveAddon(&addon); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, addon)
+}
+
+// UpdateAddon changes a catalog add-on
+// PUT /api/v1/addons/:id
+func (h *ChargesHandler) UpdateAddon(c *gin.Context) {
+	addonID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid add-on ID"})
+		return
+	}
+
+	var addon models.Addon
+	if err := c.ShouldBindJSON(&addon); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	addon.ID = addonID
+
+	if err := h.chargesService.SaveAddon(&addon); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, addon)
+}
+
+// GetAccountAddons returns add-ons of an account
+// GET /api/v1/accounts/:id/addons?all=true
+func (h *ChargesHandler) GetAccountAddons(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+
+	addons, err := h.chargesService.AccountAddons(accountID, c.Query("all") == "true")
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account_id": accountID,
+		"addons":     addons,
+	})
+}
+
+// AddAccountAddon subscribes an account to a catalog add-on
+// POST /api/v1/accounts/:id/addons {"addon_id": 2, "quantity": 1}
+func (h *ChargesHandler) AddAccountAddon(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+
+	var req charges.AddonRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.AccountID = accountID
+
+	addon, charge, err := h.chargesService.AddAccountAddon(req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	response := gin.H{"addon": addon}
+	if charge != nil {
+		response["charge"] = charge
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// EndAccountAddon stops an account add-on
+// POST /api/v1/account-addons/:id/end {"ended_at": "2024-02-01T00:00:00Z"}
+func (h *ChargesHandler) EndAccountAddon(c *gin.Context) {
+	accountAddonID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account add-on ID"})
+		return
+	}
+
+	var req struct {
+		EndedAt time.Time `json:"ended_at"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	addon, err := h.chargesService.EndAccountAddon(accountAddonID, req.EndedAt)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, addon)
+}
+
+// GetDiscounts returns discounts of an account or a plan
+// GET /api/v1/discounts?account_id=123&plan_id=7&all=true
+func (h *ChargesHandler) GetDiscounts(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.DefaultQuery("account_id", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+	planID, err := strconv.Atoi(c.DefaultQuery("plan_id", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid plan ID"})
+		return
+	}
+
+	discounts, err := h.chargesService.Discounts(accountID, planID, c.Query("all") == "true")
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"discounts": discounts})
+}
+
+// CreateDiscount creates a discount of an account or a plan
+// POST /api/v1/discounts {"account_id": 123, "kind": "percent", "value": "10", "valid_until": "2024-12-31T00:00:00Z"}
+func (h *ChargesHandler) CreateDiscount(c *gin.Context) {
+	var discount models.Discount
+	if err := c.ShouldBindJSON(&discount); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	discount.ID = 0
+
+	if err := h.chargesService.CreateDiscount(&discount); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, discount)
+}
+
+// EndDiscount ends a discount
+// POST /api/v1/discounts/:id/end {"until": "2024-06-30T00:00:00Z"}
+func (h *ChargesHandler) EndDiscount(c *gin.Context) {
+	discountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid discount ID"})
+		return
+	}
+
+	var req struct {
+		Until time.Time `json:"until"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	discount, err := h.chargesService.EndDiscount(discountID, req.Until)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, discount)
+}
+
+func (h *ChargesHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, billing.ErrAccountNotFound), errors.Is(err, charges.ErrAddonNotFound),
+		errors.Is(err, charges.ErrAccountAddonNotFound), errors.Is(err, charges.ErrDiscountNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, charges.ErrAddonInactive):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, charges.ErrInvalidCharge), errors.Is(err, charges.ErrInvalidAddon),
+		errors.Is(err, charges.ErrInvalidDiscount):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		h.logger.Error("Charges request failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
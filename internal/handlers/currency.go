@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/currency"
+)
+
+// CurrencyHandler handles exchange rate endpoints
+type CurrencyHandler struct {
+	currencyService *currency.Service
+	logger          *zap.Logger
+}
+
+// NewCurrencyHandler creates a new currency handler
+func NewCurrencyHandler(currencyService *currency.Service, logger *zap.Logger) *CurrencyHandler {
+	return &CurrencyHandler{
+		currencyService: currencyService,
+		logger:          logger,
+	}
+}
+
+// RegisterRoutes registers currency routes
+func (h *CurrencyHandler) RegisterRoutes(router *gin.RouterGroup) {
+	currencies := router.Group("/currencies")
+	{
+		currencies.GET("/rates", h.ListRates)
+		currencies.POST("/rates", h.SetRate)
+		currencies.GET("/rates/history", h.GetRateHistory)
+		currencies.GET("/convert", h.Convert)
+	}
+}
+
+// ListRates returns current rates
+// GET /api/v1/currencies/rates
+func (h *CurrencyHandler) ListRates(c *gin.Context) {
+	rates, err := h.currencyService.Rates()
+	if err != nil {
+		h.logger.Error("Failed to list rates", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"rates": rates,
+		"count": len(rates),
+	})
+}
+
+// SetRate records a rate, effective now or from a given date
+// POST /api/v1/currencies/rates
+func (h *CurrencyHandler) SetRate(c *gin.Context) {
+	var req struct {
+		FromID        int          `json:"from_id" binding:"required"`
+		ToID          int          `json:"to_id" binding:"required"`
+		Rate          models.Money `json:"rate"`
+		EffectiveFrom string       `json:"effective_from"` // RFC 3339 or YYYY-MM-DD, default now
+		Comment       string       `json:"comment"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	effectiveFrom := time.Now()
+	if req.EffectiveFrom != "" {
+		var err error
+		if effectiveFrom, err = parseEffectiveDate(req.EffectiveFrom); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid effective_from, use RFC 3339 or YYYY-MM-DD"})
+			return
+		}
+	}
+
+	rate, err := h.currencyService.SetRate(req.FromID, req.ToID, req.Rate, effectiveFrom, req.Comment)
+	if errors.Is(err, currency.ErrReadOnlySource) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to set rate", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, rate)
+}
+
+// GetRateHistory returns rates of a currency pair, newest first
+// GET /api/v1/currencies/rates/history?from_id=2&to_id=1&limit=50
+func (h *CurrencyHandler) GetRateHistory(c *gin.Context) {
+	fromID, err1 := strconv.Atoi(c.Query("from_id"))
+	toID, err2 := strconv.Atoi(c.Query("to_id"))
+	if err1 != nil || err2 != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from_id and to_id are required"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	history, err := h.currencyService.History(fromID, toID, limit)
+	if err != nil {
+		h.logger.Error("Failed to get rate history", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from_id": fromID,
+		"to_id":   toID,
+		"history": history,
+	})
+}
+
+// Convert converts an amount at the current rate or at the rate of a given date
+// GET /api/v1/currencies/convert?amount=10&from_id=2&to_id=1&at=2024-01-01
+func (h *CurrencyHandler) Convert(c *gin.Context) {
+	amount, err := models.ParseMoney(c.Query("amount"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+		return
+	}
+	fromID, err1 := strconv.Atoi(c.Query("from_id"))
+	toID, err2 := strconv.Atoi(c.Query("to_id"))
+	if err1 != nil || err2 != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from_id and to_id are required"})
+		return
+	}
+
+	var converted models.Money
+	if at := c.Query("at"); at != "" {
+		var t time.Time
+		t, err = parseEffectiveDate(at)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid at, use RFC 3339 or YYYY-MM-DD"})
+			return
+		}
+		converted, err = h.currencyService.ConvertAt(amount, fromID, toID, t)
+	} else {
+		converted, err = h.currencyService.Convert(amount, fromID, toID)
+	}
+	if errors.Is(err, currency.ErrNoRate) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to convert amount", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"amount":    amount,
+		"from_id":   fromID,
+		"to_id":     toID,
+		"converted": converted,
+	})
+}
+
+func parseEffectiveDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/services/dunning"
+)
+
+// DunningHandler exposes dunning of failed subscription charges under the subscription API
+type DunningHandler struct {
+	dunningService *dunning.Service
+	logger         *zap.Logger
+}
+
+// NewDunningHandler creates a new dunning handler
+func NewDunningHandler(dunningService *dunning.Service, logger *zap.Logger) *DunningHandler {
+	return &DunningHandler{
+		dunningService: dunningService,
+		logger:         logger,
+	}
+}
+
+// RegisterRoutes registers dunning routes
+func (h *DunningHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/subscription/dunning", h.ListCases)
+	router.POST("/subscription/dunning/run", h.Run)
+	router.GET("/subscription/dunning/cases/:id", h.GetCase)
+	router.POST("/subscription/dunning/cases/:id/cancel", h.CancelCase)
+	router.GET("/subscription/account/:id/dunning", h.GetAccountCases)
+	router.POST("/subscription/account/:id/dunning/retry", h.RetryAccount)
+}
+
+// ListCases returns open dunning cases, all cases with ?all=true
+// GET /api/v1/subscription/dunning?all=true&limit=100
+func (h *DunningHandler) ListCases(c *gin.Context) {
+	all := c.Query("all") == "true"
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+
+	cases, err := h.dunningService.Cases(all, limit)
+	if err != nil {
+		h.logger.Error("Failed to list dunning cases", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"cases": cases,
+		"count": len(cases),
+	})
+}
+
+// Run opens, retries and escalates dunning cases right away
+// POST /api/v1/subscription/dunning/run
+func (h *DunningHandler) Run(c *gin.Context) {
+	result, err := h.dunningService.Run(time.Now())
+	if err != nil {
+		h.logger.Error("Dunning run failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// GetCase returns a dunning case with its state transitions
+// GET /api/v1/subscription/dunning/cases/:id
+func (h *DunningHandler) GetCase(c *gin.Context) {
+	caseID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid case ID"})
+		return
+	}
+
+	dunningCase, err := h.dunningService.Case(caseID)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, dunningCase)
+}
+
+// CancelCase closes a dunning case without payment and lifts its restrictions
+// POST /api/v1/subscription/dunning/cases/:id/cancel {"reason": "..."}
+func (h *DunningHandler) CancelCase(c *gin.Context) {
+	caseID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid case ID"})
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	dunningCase, err := h.dunningService.Cancel(caseID, req.Reason)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, dunningCase)
+}
+
+// GetAccountCases returns dunning cases of an account
+// GET /api/v1/subscription/account/:id/dunning
+func (h *DunningHandler) GetAccountCases(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+
+	cases, err := h.dunningService.AccountCases(accountID)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account_id": accountID,
+		"cases":      cases,
+	})
+}
+
+// RetryAccount retries the unpaid charge of an account, e.g. after a payment was booked
+// POST /api/v1/subscription/account/:id/dunning/retry
+func (h *DunningHandler) RetryAccount(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+
+	dunningCase, err := h.dunningService.OnPayment(accountID)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, dunningCase)
+}
+
+func (h *DunningHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, dunning.ErrCaseNotFound), errors.Is(err, dunning.ErrNoOpenCase):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, dunning.ErrCaseClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		h.logger.Error("Dunning request failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
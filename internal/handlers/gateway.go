@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/services/gateway"
+)
+
+// GatewayHandler handles payment gateway webhooks and reports
+type GatewayHandler struct {
+	gatewayService *gateway.Service
+	logger         *zap.Logger
+}
+
+// NewGatewayHandler creates a new gateway handler
+func NewGatewayHandler(gatewayService *gateway.Service, logger *zap.Logger) *GatewayHandler {
+	return &GatewayHandler{
+		gatewayService: gatewayService,
+		logger:         logger,
+	}
+}
+
+// RegisterRoutes registers gateway routes
+func (h *GatewayHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/gateways", h.GetGateways)
+	router.POST("/gateways/:name/webhook", h.Webhook)
+	router.GET("/gateways/:name/transactions", h.GetTransactions)
+	router.GET("/gateways/:name/summary", h.GetSummary)
+	router.POST("/gateways/:name/reconcile", h.Reconcile)
+}
+
+// GetGateways returns the configured gateways
+// GET /api/v1/gateways
+func (h *GatewayHandler) GetGateways(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"gateways": h.gatewayService.Gateways()})
+}
+
+// Webhook serves a provider request; the provider verifies and answers in its own format
+// POST /api/v1/gateways/:name/webhook
+func (h *GatewayHandler) Webhook(c *gin.Context) {
+	status, response, err := h.gatewayService.Handle(c.Param("name"), c.Request)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+	c.JSON(status, response)
+}
+
+// GetTransactions returns provider transactions of a period
+// GET /api/v1/gateways/:name/transactions?from=2024-01-01&to=2024-02-01
+func (h *GatewayHandler) GetTransactions(c *gin.Context) {
+	from, to, err := periodQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	list, err := h.gatewayService.Transactions(c.Param("name"), from, to)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"transactions": list})
+}
+
+// GetSummary counts provider transactions of a period by state
+// GET /api/v1/gateways/:name/summary?from=2024-01-01&to=2024-02-01
+func (h *GatewayHandler) GetSummary(c *gin.Context) {
+	from, to, err := periodQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	summary, err := h.gatewayService.Summarize(c.Param("name"), from, to)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
+
+// Reconcile compares the provider's report of a period with our transactions
+// POST /api/v1/gateways/:name/reconcile
+// {"from": "2024-01-01T00:00:00Z", "to": "2024-01-02T00:00:00Z", "records": [{"external_id": "123", "amount": "50000", "state": "performed"}]}
+func (h *GatewayHandler) Reconcile(c *gin.Context) {
+	var req struct {
+		From    time.Time                `json:"from" binding:"required"`
+		To      time.Time                `json:"to" binding:"required"`
+		Records []gateway.ProviderRecord `json:"records"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.To.After(req.From) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be after from"})
+		return
+	}
+
+	report, err := h.gatewayService.Reconcile(c.Param("name"), req.From, req.To, req.Records)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+func (h *GatewayHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gateway.ErrUnknownGateway):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, gateway.ErrInvalidRecord):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		h.logger.Error("Gateway request failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// periodQuery parses from (required) and to (default now) as dates or RFC 3339 times
+func periodQuery(c *gin.Context) (time.Time, time.Time, error) {
+	parse := func(name, value string) (time.Time, error) {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, nil
+		}
+		if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+			return t, nil
+		}
+		return time.Time{}, fmt.Errorf("invalid %s, expected YYYY-MM-DD or RFC 3339", name)
+	}
+
+	from, err := parse("from", c.Query("from"))
+	if err != nil {
+		return from, from, err
+	}
+	to := time.Now()
+	if v := c.Query("to"); v != "" {
+		if to, err = parse("to", v); err != nil {
+			return from, to, err
+		}
+	}
+	return from, to, nil
+}
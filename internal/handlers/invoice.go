@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/services/invoice"
+)
+
+// InvoiceHandler handles invoice endpoints
+type InvoiceHandler struct {
+	invoiceService *invoice.Service
+	logger         *zap.Logger
+}
+
+// NewInvoiceHandler creates a new invoice handler
+func NewInvoiceHandler(invoiceService *invoice.Service, logger *zap.Logger) *InvoiceHandler {
+	return &InvoiceHandler{
+		invoiceService: invoiceService,
+		logger:         logger,
+	}
+}
+
+// RegisterRoutes registers invoice routes
+func (h *InvoiceHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.POST("/invoices/issue", h.IssueInvoices)
+	router.GET("/invoices/:id", h.GetInvoice)
+	router.GET("/invoices/:id/pdf", h.GetInvoicePDF)
+	router.POST("/invoices/:id/void", h.VoidInvoice)
+	router.GET("/contracts/:id/invoices", h.GetContractInvoices)
+}
+
+// IssueInvoices issues invoices of a month for one contract or for all contracts
+// POST /api/v1/invoices/issue {"month": "2024-01", "contract_id": 42}
+func (h *InvoiceHandler) IssueInvoices(c *gin.Context) {
+	var req struct {
+		Month      string `json:"month" binding:"required"`
+		ContractID int    `json:"contract_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	month, err := time.ParseInLocation("2006-01", req.Month, time.Local)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid month, expected YYYY-MM"})
+		return
+	}
+
+	if req.ContractID != 0 {
+		inv, err := h.invoiceService.Issue(req.ContractID, month)
+		if err != nil {
+			h.respondError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, inv)
+		return
+	}
+
+	result, err := h.invoiceService.IssueMonth(month)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GetInvoice returns an invoice as JSON
+// GET /api/v1/invoices/:id
+func (h *InvoiceHandler) GetInvoice(c *gin.Context) {
+	invoiceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid invoice ID"})
+		return
+	}
+
+	inv, err := h.invoiceService.Get(invoiceID)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, inv)
+}
+
+// GetInvoicePDF returns an invoice rendered to PDF
+// GET /api/v1/invoices/:id/pdf
+func (h *InvoiceHandler) GetInvoicePDF(c *gin.Context) {
+	invoiceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid invoice ID"})
+		return
+	}
+
+	inv, err := h.invoiceService.Get(invoiceID)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", `inline; filename="`+inv.Number+`.pdf"`)
+	c.Data(http.StatusOK, "application/pdf", h.invoiceService.RenderPDF(inv))
+}
+
+// VoidInvoice cancels an issued invoice
+// POST /api/v1/invoices/:id/void {"reason": "wrong plan"}
+func (h *InvoiceHandler) VoidInvoice(c *gin.Context) {
+	invoiceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid invoice ID"})
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	inv, err := h.invoiceService.Void(invoiceID, req.Reason)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, inv)
+}
+
+// GetContractInvoices returns invoices of a contract
+// GET /api/v1/contracts/:id/invoices?limit=12
+func (h *InvoiceHandler) GetContractInvoices(c *gin.Context) {
+	contractID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid contract ID"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "12"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+
+	invoices, err := h.invoiceService.ContractInvoices(contractID, limit)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"contract_id": contractID,
+		"invoices":    invoices,
+	})
+}
+
+func (h *InvoiceHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, invoice.ErrInvoiceNotFound), errors.Is(err, invoice.ErrContractNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, invoice.ErrAlreadyIssued), errors.Is(err, invoice.ErrInvoiceVoid):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, invoice.ErrNothingToInvoice):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	default:
+		h.logger.Error("Invoice request failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
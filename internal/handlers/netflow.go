@@ -3,7 +3,9 @@ package handlers
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
 	"net"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -11,18 +13,21 @@ import (
 	"netspire-go/internal/database"
 	"netspire-go/internal/models"
 	"netspire-go/internal/services/billing"
+	"netspire-go/internal/services/session"
 )
 
 // NetFlowHandler обрабатывает NetFlow пакеты
 type NetFlowHandler struct {
-	db      *database.PostgreSQL
-	billing *billing.Service
+	db       *database.PostgreSQL
+	billing  *billing.Service
+	sessions *session.Service
 }
 
-func NewNetFlowHandler(db *database.PostgreSQL, billingService *billing.Service) *NetFlowHandler {
+func NewNetFlowHandler(db *database.PostgreSQL, billingService *billing.Service, sessionService *session.Service) *NetFlowHandler {
 	return &NetFlowHandler{
-		db:      db,
-		billing: billingService,
+		db:       db,
+		billing:  billingService,
+		sessions: sessionService,
 	}
 }
 
@@ -63,6 +68,19 @@ type NetFlowV5Record struct {
 	Pad2      uint16
 }
 
+// wallTime переводит uptime маршрутизатора (FirstTime / LastTime, мс) во время по часам
+// через время экспорта пакета: UnixSecs/UnixNanos соответствуют SysUptime
+func (h *NetFlowV5Header) wallTime(uptime uint32) time.Time {
+	exported := time.Unix(int64(h.UnixSecs), int64(h.UnixNanos))
+
+	// Разность uint32 корректна и при переполнении uptime (~49 дней)
+	age := h.SysUptime - uptime
+	if age > math.MaxInt32 {
+		age = 0 // Поток "из будущего" - считаем временем экспорта
+	}
+	return exported.Add(-time.Duration(age) * time.Millisecond)
+}
+
 // NetFlow v9 структуры (как в netflow_v9.hrl)
 type NetFlowV9Header struct {
 	Version    uint16
@@ -233,16 +251,22 @@ func (h *NetFlowHandler) processFlowRecord(record *NetFlowV5Record, header *NetF
 		targetIP = srcIP
 	}
 
-	// TODO: Находим активную сессию по IP
-	// session, err := h.db.FindActiveSessionByIP(targetIP)
-	// if err != nil {
-	//	logrus.Debugf("No active session found for IP %s: %v", targetIP, err)
-	//	return
-	// }
-
-	// TODO: Implement session lookup and billing
 	logrus.Debugf("NetFlow accounting for IP %s, direction %s, octets %d",
 		targetIP, direction, uint64(record.Octets))
+
+	if h.sessions == nil {
+		return
+	}
+
+	// Поток тарифицируется по своему времени, а не по времени обработки
+	first := header.wallTime(record.FirstTime)
+	last := header.wallTime(record.LastTime)
+
+	err := h.sessions.HandleNetFlow(direction, net.ParseIP(srcIP), net.ParseIP(dstIP),
+		uint64(record.Octets), uint64(record.Packets), first, last)
+	if err != nil {
+		logrus.Errorf("NetFlow accounting failed for IP %s: %v", targetIP, err)
+	}
 }
 
 // determineDirection - определение направления трафика
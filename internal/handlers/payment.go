@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/billing"
+	"isp-billing/internal/services/payment"
+)
+
+// PaymentHandler handles payment endpoints
+type PaymentHandler struct {
+	paymentService *payment.Service
+	logger         *zap.Logger
+}
+
+// NewPaymentHandler creates a new payment handler
+func NewPaymentHandler(paymentService *payment.Service, logger *zap.Logger) *PaymentHandler {
+	return &PaymentHandler{
+		paymentService: paymentService,
+		logger:         logger,
+	}
+}
+
+// RegisterRoutes registers payment routes
+func (h *PaymentHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.POST("/payments", h.CreatePayment)
+	router.GET("/payments", h.GetPayments)
+	router.POST("/payments/import", h.ImportPayments)
+	router.GET("/payments/:id", h.GetPayment)
+	router.POST("/payments/:id/refund", h.RefundPayment)
+	router.POST("/payments/:id/reverse", h.ReversePayment)
+}
+
+// CreatePayment books an incoming payment
+// POST /api/v1/payments (Idempotency-Key: 7f1c...) {"login": "user1", "amount": "25", "external_ref": "TX-1001"}
+// Repeating the request returns the booked payment with "duplicate": true.
+func (h *PaymentHandler) CreatePayment(c *gin.Context) {
+	var req payment.Request
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		req.IdempotencyKey = key
+	}
+
+	p, duplicate, err := h.paymentService.Record(req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	status := http.StatusCreated
+	if duplicate {
+		status = http.StatusOK
+	}
+	c.JSON(status, gin.H{"payment": p, "duplicate": duplicate})
+}
+
+// GetPayments returns payments, refunds and reversals
+// GET /api/v1/payments?account_id=123&contract_id=45&source=bank&limit=50
+func (h *PaymentHandler) GetPayments(c *gin.Context) {
+	var filter payment.Filter
+	var err error
+	if filter.AccountID, err = strconv.Atoi(c.DefaultQuery("account_id", "0")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+	if filter.ContractID, err = strconv.Atoi(c.DefaultQuery("contract_id", "0")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid contract ID"})
+		return
+	}
+	if filter.Limit, err = strconv.Atoi(c.DefaultQuery("limit", "50")); err != nil || filter.Limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+	filter.Source = c.Query("source")
+
+	payments, err := h.paymentService.Payments(filter)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payments": payments})
+}
+
+// ImportPayments books the payments of a CSV bank statement
+// POST /api/v1/payments/import?source=bank (multipart "file" or text/csv body)
+func (h *PaymentHandler) ImportPayments(c *gin.Context) {
+	var body io.Reader = c.Request.Body
+	if file, err := c.FormFile("file"); err == nil {
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	result, err := h.paymentService.Import(body, c.DefaultQuery("source", "import"))
+	if errors.Is(err, payment.ErrInvalidImport) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "result": result})
+		return
+	}
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// GetPayment returns a payment
+// GET /api/v1/payments/:id
+func (h *PaymentHandler) GetPayment(c *gin.Context) {
+	paymentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payment ID"})
+		return
+	}
+
+	p, err := h.paymentService.Get(paymentID)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, p)
+}
+
+// RefundPayment returns (part of) a payment to the customer
+// POST /api/v1/payments/:id/refund (Idempotency-Key: ...) {"amount": "10", "comment": "overpaid"}
+func (h *PaymentHandler) RefundPayment(c *gin.Context) {
+	paymentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payment ID"})
+		return
+	}
+
+	var req struct {
+		Amount         models.Money `json:"amount" binding:"required"`
+		IdempotencyKey string       `json:"idempotency_key"`
+		Comment        string       `json:"comment"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		req.IdempotencyKey = key
+	}
+
+	refund, duplicate, err := h.paymentService.Refund(paymentID, req.Amount, req.IdempotencyKey, req.Comment)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"refund": refund, "duplicate": duplicate})
+}
+
+// ReversePayment cancels a payment booked by mistake or returned by the bank
+// POST /api/v1/payments/:id/reverse {"comment": "chargeback"}
+func (h *PaymentHandler) ReversePayment(c *gin.Context) {
+	paymentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payment ID"})
+		return
+	}
+
+	var req struct {
+		Comment string `json:"comment"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	reversal, duplicate, err := h.paymentService.Reverse(paymentID, req.Comment)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reversal": reversal, "duplicate": duplicate})
+}
+
+func (h *PaymentHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, payment.ErrPaymentNotFound), errors.Is(err, billing.ErrAccountNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, payment.ErrIdempotencyConflict), errors.Is(err, payment.ErrNotRefundable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, payment.ErrInvalidPayment), errors.Is(err, payment.ErrInvalidImport):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		h.logger.Error("Payment request failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
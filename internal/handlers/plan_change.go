@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/billing"
+	"isp-billing/internal/services/planchange"
+)
+
+// PlanChangeHandler handles plan change endpoints
+type PlanChangeHandler struct {
+	planChangeService *planchange.Service
+	logger            *zap.Logger
+}
+
+// NewPlanChangeHandler creates a new plan change handler
+func NewPlanChangeHandler(planChangeService *planchange.Service, logger *zap.Logger) *PlanChangeHandler {
+	return &PlanChangeHandler{
+		planChangeService: planChangeService,
+		logger:            logger,
+	}
+}
+
+// RegisterRoutes registers plan change routes
+func (h *PlanChangeHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.POST("/accounts/:id/plan", h.ChangePlan)
+	router.GET("/accounts/:id/plan/changes", h.GetAccountChanges)
+	router.GET("/plan-changes/:id", h.GetChange)
+	router.POST("/plan-changes/:id/cancel", h.CancelChange)
+}
+
+// ChangePlan moves an account to another plan now or at the start of its next billing period
+// POST /api/v1/accounts/:id/plan {"plan_id": 7, "next_cycle": false}
+func (h *PlanChangeHandler) ChangePlan(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+
+	var req planchange.Request
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.AccountID = accountID
+
+	change, err := h.planChangeService.Change(req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, change)
+}
+
+// GetAccountChanges returns plan changes of an account
+// GET /api/v1/accounts/:id/plan/changes?limit=20
+func (h *PlanChangeHandler) GetAccountChanges(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+
+	changes, err := h.planChangeService.AccountChanges(accountID, limit)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account_id": accountID,
+		"changes":    changes,
+	})
+}
+
+// GetChange returns a plan change
+// GET /api/v1/plan-changes/:id
+func (h *PlanChangeHandler) GetChange(c *gin.Context) {
+	changeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid plan change ID"})
+		return
+	}
+
+	change, err := h.planChangeService.Get(changeID)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, change)
+}
+
+// CancelChange cancels a scheduled plan change
+// POST /api/v1/plan-changes/:id/cancel
+func (h *PlanChangeHandler) CancelChange(c *gin.Context) {
+	changeID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid plan change ID"})
+		return
+	}
+
+	change, err := h.planChangeService.Cancel(changeID)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, change)
+}
+
+func (h *PlanChangeHandler) respondError(c *gin.Context, err error) {
+	var planErrs *models.PlanDataErrors
+	switch {
+	case errors.Is(err, planchange.ErrChangeNotFound), errors.Is(err, billing.ErrAccountNotFound),
+		errors.Is(err, billing.ErrPlanNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, planchange.ErrAlreadyScheduled), errors.Is(err, billing.ErrPlanChangeNotScheduled),
+		errors.Is(err, billing.ErrSamePlan):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.As(err, &planErrs):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		h.logger.Error("Plan change request failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/promised"
+)
+
+// PromisedHandler handles promised payments (temporary credits)
+type PromisedHandler struct {
+	promisedService *promised.Service
+	logger          *zap.Logger
+}
+
+// NewPromisedHandler creates a new promised payment handler
+func NewPromisedHandler(promisedService *promised.Service, logger *zap.Logger) *PromisedHandler {
+	return &PromisedHandler{
+		promisedService: promisedService,
+		logger:          logger,
+	}
+}
+
+// RegisterRoutes registers promised payment routes
+func (h *PromisedHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/accounts/:id/promised-payment", h.GetOffer)
+	router.POST("/accounts/:id/promised-payment", h.Grant)
+	router.GET("/accounts/:id/promised-payments", h.GetAccountPromised)
+	router.GET("/promised-payments", h.GetActive)
+	router.POST("/promised-payments/expire", h.Expire)
+	router.GET("/promised-payments/:id", h.GetPromised)
+	router.POST("/promised-payments/:id/cancel", h.Cancel)
+}
+
+// GetOffer tells whether the account can take a promised payment, how much and for how long
+// GET /api/v1/accounts/:id/promised-payment
+func (h *PromisedHandler) GetOffer(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+
+	offer, err := h.promisedService.Offer(accountID)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, offer)
+}
+
+// Grant takes a promised payment; without amount and days the maximum is granted
+// POST /api/v1/accounts/:id/promised-payment
+// {"amount": "50", "days": 3}
+func (h *PromisedHandler) Grant(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+
+	var req struct {
+		Amount models.Money `json:"amount"`
+		Days   int          `json:"days"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	p, err := h.promisedService.Grant(accountID, req.Amount, req.Days)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, p)
+}
+
+// GetAccountPromised returns promised payments of the account
+// GET /api/v1/accounts/:id/promised-payments?limit=50
+func (h *PromisedHandler) GetAccountPromised(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid account ID"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+
+	list, err := h.promisedService.AccountPromised(accountID, limit)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"promised_payments": list,
+		"count":             len(list),
+	})
+}
+
+// GetActive returns active promised payments, soonest expiry first
+// GET /api/v1/promised-payments
+func (h *PromisedHandler) GetActive(c *gin.Context) {
+	list, err := h.promisedService.Active()
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"promised_payments": list,
+		"count":             len(list),
+	})
+}
+
+// Expire takes back expired credits right away
+// POST /api/v1/promised-payments/expire
+func (h *PromisedHandler) Expire(c *gin.Context) {
+	expired, err := h.promisedService.Expire(time.Now())
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"expired": expired})
+}
+
+// GetPromised returns a promised payment
+// GET /api/v1/promised-payments/:id
+func (h *PromisedHandler) GetPromised(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid promised payment ID"})
+		return
+	}
+
+	p, err := h.promisedService.Get(id)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, p)
+}
+
+// Cancel takes the credit back before the term ends
+// POST /api/v1/promised-payments/:id/cancel
+// {"reason": "granted by mistake"}
+func (h *PromisedHandler) Cancel(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid promised payment ID"})
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	p, err := h.promisedService.Cancel(id, req.Reason)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, p)
+}
+
+func (h *PromisedHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, promised.ErrPromisedNotFound), errors.Is(err, promised.ErrAccountNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, promised.ErrNotAllowed), errors.Is(err, promised.ErrNotActive):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, promised.ErrInvalidRequest):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		h.logger.Error("Promised payment request failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/services/quota"
+)
+
+// QuotaHandler handles volume quota endpoints
+type QuotaHandler struct {
+	quotaService *quota.Service
+	logger       *zap.Logger
+}
+
+// NewQuotaHandler creates a new quota handler
+func NewQuotaHandler(quotaService *quota.Service, logger *zap.Logger) *QuotaHandler {
+	return &QuotaHandler{
+		quotaService: quotaService,
+		logger:       logger,
+	}
+}
+
+// RegisterRoutes registers quota routes
+func (h *QuotaHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/accounts/:id/quota", h.GetQuota)
+	router.POST("/accounts/:id/quota/topup", h.TopUp)
+	router.GET("/quota/packs", h.ListPacks)
+}
+
+// GetQuota returns quota usage of the current cycle
+// GET /api/v1/accounts/:id/quota
+func (h *QuotaHandler) GetQuota(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	status, err := h.quotaService.Status(accountID)
+	if errors.Is(err, quota.ErrAccountNotFound) || errors.Is(err, quota.ErrNoQuota) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to get quota", zap.Int("account_id", accountID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// TopUp adds a top-up pack (or free volume) to the current cycle
+// POST /api/v1/accounts/:id/quota/topup (Idempotency-Key: 9b2e...) {"pack": "extra-10g"}
+// Repeating the request returns the quota with "duplicate": true and charges nothing.
+func (h *QuotaHandler) TopUp(c *gin.Context) {
+	accountID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
+		return
+	}
+
+	var req quota.TopUpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if key := c.GetHeader("Idempotency-Key"); key != "" {
+		req.IdempotencyKey = key
+	}
+
+	status, duplicate, err := h.quotaService.TopUp(accountID, req)
+	if errors.Is(err, quota.ErrAccountNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, quota.ErrIdempotencyConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to top up quota", zap.Int("account_id", accountID), zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"quota": status, "duplicate": duplicate})
+}
+
+// ListPacks returns configured top-up packs
+// GET /api/v1/quota/packs
+func (h *QuotaHandler) ListPacks(c *gin.Context) {
+	packs := h.quotaService.Packs()
+	c.JSON(http.StatusOK, gin.H{
+		"packs": packs,
+		"count": len(packs),
+	})
+}
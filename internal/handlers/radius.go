@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -10,8 +13,11 @@ import (
 
 	"isp-billing/internal/database"
 	"isp-billing/internal/models"
+	"isp-billing/internal/services/auth"
 	"isp-billing/internal/services/billing"
+	"isp-billing/internal/services/binding"
 	"isp-billing/internal/services/ippool"
+	"isp-billing/internal/services/realm"
 	"isp-billing/internal/services/session"
 )
 
@@ -21,16 +27,22 @@ type RADIUSHandler struct {
 	sessionService *session.Service
 	ipPoolService  *ippool.Service
 	billingService *billing.Service
+	bindingService *binding.Service
+	authService    *auth.Service
+	realmService   *realm.Service
 	db             *database.PostgreSQL
 }
 
 // NewRADIUSHandler creates a new RADIUS handler
-func NewRADIUSHandler(logger *zap.Logger, sessionService *session.Service, ipPoolService *ippool.Service, billingService *billing.Service, db *database.PostgreSQL) *RADIUSHandler {
+func NewRADIUSHandler(logger *zap.Logger, sessionService *session.Service, ipPoolService *ippool.Service, billingService *billing.Service, bindingService *binding.Service, authService *auth.Service, realmService *realm.Service, db *database.PostgreSQL) *RADIUSHandler {
 	return &RADIUSHandler{
 		logger:         logger,
 		sessionService: sessionService,
 		ipPoolService:  ipPoolService,
 		billingService: billingService,
+		bindingService: bindingService,
+		authService:    authService,
+		realmService:   realmService,
 		db:             db,
 	}
 }
@@ -64,7 +76,7 @@ type AccountingRequest struct {
 	NASPort            int               `json:"nas_port"`
 	FramedIPAddress    string            `json:"framed_ip_address"`
 	CallingStationID   string            `json:"calling_station_id"`
-	AcctStatusType     string            `json:"acct_status_type"` // Start, Stop, Interim-Update
+	AcctStatusType     string            `json:"acct_status_type"` // Start, Stop, Interim-Update, Accounting-On, Accounting-Off
 	AcctInputOctets    int64             `json:"acct_input_octets"`
 	AcctOutputOctets   int64             `json:"acct_output_octets"`
 	AcctSessionTime    int               `json:"acct_session_time"`
@@ -117,14 +129,105 @@ func (h *RADIUSHandler) Authorize(c *gin.Context) {
 		zap.String("nas_ip", req.NASIPAddress),
 		zap.String("auth_type", req.AuthType))
 
-	// Get user data from database (placeholder - need to implement)
+	// Realm routing: proxy partner logins upstream, strip realm for local ones if configured
+	route, err := h.realmService.Route(req.Username)
+	if err != nil {
+		h.logger.Info("Realm routing rejected login", zap.String("username", req.Username), zap.Error(err))
+		c.JSON(http.StatusOK, AuthorizeResponse{
+			Result:  "reject",
+			Message: err.Error(),
+		})
+		return
+	}
+	if route.IsProxy() {
+		h.proxyAuthorize(c, route, req)
+		return
+	}
+	req.Username = route.Username
+
+	// Get user data from database (only active accounts are returned)
+	account, err := h.db.FetchAccount(req.Username)
+	if err != nil {
+		h.logger.Error("Failed to fetch account", zap.String("username", req.Username), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch account"})
+		return
+	}
+	if account == nil {
+		h.logger.Info("Account not found", zap.String("username", req.Username))
+		c.JSON(http.StatusOK, AuthorizeResponse{
+			Result:  "reject",
+			Message: "Account not found",
+		})
+		return
+	}
+
+	// Verify PAP / CHAP / MS-CHAPv2 here instead of FreeRADIUS
+	var authResult *auth.Result
+	if h.authService.VerifyEnabled() {
+		authResult, err = h.authService.Verify(auth.Credentials{
+			Username:   req.Username,
+			Password:   req.Password,
+			AuthType:   req.AuthType,
+			Attributes: req.Attributes,
+		}, account.Password)
+		if err != nil {
+			h.logger.Info("Credential verification failed",
+				zap.String("username", req.Username),
+				zap.String("auth_type", req.AuthType),
+				zap.Error(err))
+			c.JSON(http.StatusOK, AuthorizeResponse{
+				Result:  "reject",
+				Message: "Authentication failed",
+			})
+			return
+		}
+	}
+
 	userData := &UserData{
 		Username: req.Username,
-		Password: "test123", // From database
+		Password: account.Password,
 		Enabled:  true,
+		PlanData: account.PData,
 	}
 
-	// Removed undefined err check
+	planData, err := database.ParsePlanDataFromJSON(account.PData)
+	if err != nil {
+		h.logger.Error("Invalid plan data", zap.String("username", req.Username), zap.Error(err))
+		c.JSON(http.StatusOK, AuthorizeResponse{
+			Result:  "reject",
+			Message: "Invalid plan data",
+		})
+		return
+	}
+
+	// Check MAC / Calling-Station-Id binding
+	bindResult, err := h.bindingService.Check(account.ID, planData, req.CallingStationID)
+	if err != nil {
+		h.logger.Error("Failed to check device binding", zap.String("username", req.Username), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check device binding"})
+		return
+	}
+	if !bindResult.Allowed {
+		c.JSON(http.StatusOK, AuthorizeResponse{
+			Result:  "reject",
+			Message: bindResult.Reason,
+		})
+		return
+	}
+
+	// Enforce Simultaneous-Use before accepting
+	if err := h.sessionService.CheckSimultaneousUse(req.Username, account.ID, planData); err != nil {
+		if errors.Is(err, session.ErrSimultaneousUse) {
+			c.JSON(http.StatusOK, AuthorizeResponse{
+				Result:  "reject",
+				Message: err.Error(),
+			})
+			return
+		}
+		h.logger.Error("Failed to check simultaneous use", zap.String("username", req.Username), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check simultaneous use"})
+		return
+	}
 
 	// Check user status
 	if !userData.Enabled {
@@ -136,11 +239,51 @@ func (h *RADIUSHandler) Authorize(c *gin.Context) {
 		return
 	}
 
+	// Plan algorithm decides on balance and time of day and adds its replies (shaper, Session-Timeout)
+	billingResult, err := h.billingService.Authorize(account, models.RADIUSAuthorizeRequest{
+		Username:         req.Username,
+		NASIPAddress:     req.NASIPAddress,
+		NASPort:          strconv.Itoa(req.NASPort),
+		CallingStationId: req.CallingStationID,
+		CalledStationId:  req.CalledStationID,
+	})
+	if err != nil {
+		h.logger.Error("Billing authorization failed", zap.String("username", req.Username), zap.Error(err))
+		c.JSON(http.StatusOK, AuthorizeResponse{
+			Result:  "reject",
+			Message: "Billing authorization failed",
+		})
+		return
+	}
+	if billingResult.Decision != "accept" {
+		h.logger.Info("Rejected by billing",
+			zap.String("username", req.Username),
+			zap.String("reason", billingResult.Reason))
+		c.JSON(http.StatusOK, AuthorizeResponse{
+			Result:  "reject",
+			Message: billingResult.Reason,
+		})
+		return
+	}
+
 	// Prepare response attributes
 	attributes := map[string]string{
-		"Cleartext-Password": userData.Password, // For FreeRADIUS to handle auth
-		"Service-Type":       "Framed-User",
-		"Framed-Protocol":    "PPP",
+		"Service-Type":    "Framed-User",
+		"Framed-Protocol": "PPP",
+	}
+	if authResult != nil {
+		for name, value := range authResult.Replies {
+			attributes[name] = value
+		}
+	} else {
+		// Known good password for FreeRADIUS to handle auth (Cleartext-Password, NT-Password or Crypt-Password)
+		for name, value := range h.authService.ControlAttributes(userData.Password) {
+			attributes[name] = value
+		}
+	}
+
+	for _, reply := range billingResult.Replies {
+		attributes[reply.Name] = reply.Value
 	}
 
 	// Add IP pool if configured
@@ -179,6 +322,21 @@ func (h *RADIUSHandler) Accounting(c *gin.Context) {
 		zap.String("session_id", req.SessionID),
 		zap.String("status_type", req.AcctStatusType))
 
+	route, err := h.realmService.Route(req.Username)
+	if err != nil {
+		c.JSON(http.StatusOK, AccountingResponse{
+			Result:  "reject",
+			Message: err.Error(),
+		})
+		return
+	}
+	if route.IsProxy() {
+		h.proxyAccounting(c, route, req)
+		return
+	}
+	h.recordPartnerSession(route, req)
+	req.Username = route.Username
+
 	switch req.AcctStatusType {
 	case "Start":
 		err := h.handleAccountingStart(req)
@@ -213,6 +371,17 @@ func (h *RADIUSHandler) Accounting(c *gin.Context) {
 			return
 		}
 
+	case "Accounting-On", "Accounting-Off":
+		err := h.handleAccountingOnOff(req)
+		if err != nil {
+			h.logger.Error("Failed to handle NAS accounting on/off", zap.Error(err))
+			c.JSON(http.StatusOK, AccountingResponse{
+				Result:  "reject",
+				Message: err.Error(),
+			})
+			return
+		}
+
 	default:
 		h.logger.Warn("Unknown accounting status type", zap.String("status_type", req.AcctStatusType))
 	}
@@ -223,6 +392,87 @@ func (h *RADIUSHandler) Accounting(c *gin.Context) {
 	})
 }
 
+// proxyAuthorize forwards authorization of a partner login to the realm's upstream server
+func (h *RADIUSHandler) proxyAuthorize(c *gin.Context, route *realm.Route, req AuthorizeRequest) {
+	reply, err := h.realmService.ProxyAuthorize(route, realm.AccessRequest{
+		Password:         req.Password,
+		NASIPAddress:     req.NASIPAddress,
+		NASPort:          req.NASPort,
+		CallingStationID: req.CallingStationID,
+		CalledStationID:  req.CalledStationID,
+		Attributes:       req.Attributes,
+	})
+	if err != nil {
+		h.logger.Error("Proxy authorization failed",
+			zap.String("username", req.Username),
+			zap.String("realm", route.Realm),
+			zap.Error(err))
+		c.JSON(http.StatusOK, AuthorizeResponse{
+			Result:  "reject",
+			Message: "Upstream server unavailable",
+		})
+		return
+	}
+
+	result := "reject"
+	if reply.Accept {
+		result = "accept"
+	}
+	c.JSON(http.StatusOK, AuthorizeResponse{
+		Result:     result,
+		Attributes: reply.Attributes,
+		Message:    reply.Message,
+	})
+}
+
+// proxyAccounting forwards accounting of a partner session and records it for settlement
+func (h *RADIUSHandler) proxyAccounting(c *gin.Context, route *realm.Route, req AccountingRequest) {
+	rec := accountingRecord(req)
+	if err := h.realmService.ProxyAccounting(route, rec); err != nil {
+		h.logger.Error("Proxy accounting failed",
+			zap.String("username", req.Username),
+			zap.String("realm", route.Realm),
+			zap.Error(err))
+		c.JSON(http.StatusOK, AccountingResponse{
+			Result:  "reject",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	h.recordPartnerSession(route, req)
+
+	c.JSON(http.StatusOK, AccountingResponse{
+		Result:  "accept",
+		Message: "Accounting proxied",
+	})
+}
+
+// recordPartnerSession stores partner session totals; failures do not block accounting
+func (h *RADIUSHandler) recordPartnerSession(route *realm.Route, req AccountingRequest) {
+	if err := h.realmService.RecordSession(route, accountingRecord(req)); err != nil {
+		h.logger.Error("Failed to record partner session",
+			zap.String("partner", route.Partner),
+			zap.String("session_id", req.SessionID),
+			zap.Error(err))
+	}
+}
+
+func accountingRecord(req AccountingRequest) realm.AccountingRecord {
+	return realm.AccountingRecord{
+		StatusType:       req.AcctStatusType,
+		SessionID:        req.SessionID,
+		NASIPAddress:     req.NASIPAddress,
+		NASPort:          req.NASPort,
+		FramedIPAddress:  req.FramedIPAddress,
+		CallingStationID: req.CallingStationID,
+		InputOctets:      req.AcctInputOctets,
+		OutputOctets:     req.AcctOutputOctets,
+		SessionTime:      req.AcctSessionTime,
+		TerminateCause:   req.AcctTerminateCause,
+	}
+}
+
 // handleAccountingStart processes accounting start requests
 func (h *RADIUSHandler) handleAccountingStart(req AccountingRequest) error {
 	// Parse IP address
@@ -233,7 +483,20 @@ func (h *RADIUSHandler) handleAccountingStart(req AccountingRequest) error {
 
 	// Start session - fixed method signature
 	err := h.sessionService.StartSession(req.Username, req.SessionID, req.CallingStationID, ip)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// Remember the NAS so the session can be closed on Accounting-On/Off
+	if req.NASIPAddress != "" {
+		if err := h.sessionService.SetNASSpec(req.SessionID, req.NASIPAddress, req.NASPort); err != nil {
+			h.logger.Warn("Failed to store NAS for session",
+				zap.String("session_id", req.SessionID),
+				zap.Error(err))
+		}
+	}
+
+	return nil
 }
 
 // handleAccountingStop processes accounting stop requests
@@ -264,6 +527,23 @@ func (h *RADIUSHandler) handleAccountingStop(req AccountingRequest) error {
 	return nil
 }
 
+// handleAccountingOnOff processes Accounting-On/Off sent by a rebooting NAS
+// All sessions of that NAS are gone, so they are closed in bulk
+func (h *RADIUSHandler) handleAccountingOnOff(req AccountingRequest) error {
+	if req.NASIPAddress == "" {
+		return fmt.Errorf("%s without NAS-IP-Address", req.AcctStatusType)
+	}
+
+	closed, err := h.sessionService.StopNASSessions(req.NASIPAddress)
+
+	h.logger.Info("NAS accounting on/off processed",
+		zap.String("status_type", req.AcctStatusType),
+		zap.String("nas_ip", req.NASIPAddress),
+		zap.Int("closed_sessions", closed))
+
+	return err
+}
+
 // handleAccountingUpdate processes accounting interim updates
 func (h *RADIUSHandler) handleAccountingUpdate(req AccountingRequest) error {
 	// Update session with interim counters - use correct method
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/services/realm"
+)
+
+// RealmHandler handles realm routing and partner settlement endpoints
+type RealmHandler struct {
+	realmService *realm.Service
+	logger       *zap.Logger
+}
+
+// NewRealmHandler creates a new realm handler
+func NewRealmHandler(realmService *realm.Service, logger *zap.Logger) *RealmHandler {
+	return &RealmHandler{
+		realmService: realmService,
+		logger:       logger,
+	}
+}
+
+// RegisterRoutes registers realm routes
+func (h *RealmHandler) RegisterRoutes(router *gin.RouterGroup) {
+	realms := router.Group("/realms")
+	{
+		realms.GET("", h.ListRealms)
+		realms.GET("/settlement", h.GetSettlement)
+	}
+}
+
+// ListRealms returns configured realms (secrets omitted)
+// GET /api/v1/realms
+func (h *RealmHandler) ListRealms(c *gin.Context) {
+	realms := h.realmService.Realms()
+	c.JSON(http.StatusOK, gin.H{
+		"realms": realms,
+		"count":  len(realms),
+	})
+}
+
+// GetSettlement returns per-partner totals for sessions started in [from, to)
+// GET /api/v1/realms/settlement?from=2024-01-01&to=2024-02-01
+func (h *RealmHandler) GetSettlement(c *gin.Context) {
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	to := from.AddDate(0, 1, 0)
+
+	var err error
+	if v := c.Query("from"); v != "" {
+		if from, err = time.ParseInLocation("2006-01-02", v, now.Location()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date, use YYYY-MM-DD"})
+			return
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if to, err = time.ParseInLocation("2006-01-02", v, now.Location()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date, use YYYY-MM-DD"})
+			return
+		}
+	}
+
+	totals, err := h.realmService.Settlement(from, to)
+	if err != nil {
+		h.logger.Error("Failed to get settlement", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":     from.Format("2006-01-02"),
+		"to":       to.Format("2006-01-02"),
+		"partners": totals,
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"isp-billing/internal/models"
 	"isp-billing/internal/services/session"
@@ -86,7 +87,7 @@ func (h *SessionHandler) PrepareSession(c *gin.Context) {
 		PlanID      int                    `json:"plan_id" binding:"required"`
 		PlanData    map[string]interface{} `json:"plan_data"`
 		Currency    int                    `json:"currency"`
-		Balance     float64                `json:"balance"`
+		Balance     models.Money           `json:"balance"`
 		AuthAlgo    string                 `json:"auth_algo"`
 		AcctAlgo    string                 `json:"acct_algo"`
 		Replies     []models.RADIUSReply   `json:"replies"`
@@ -383,6 +384,8 @@ func (h *SessionHandler) HandleNetFlow(c *gin.Context) {
 		DstIP     string `json:"dst_ip" binding:"required"`
 		Octets    uint64 `json:"octets" binding:"required"`
 		Packets   uint64 `json:"packets" binding:"required"`
+		First     int64  `json:"first"`     // Unix time the flow started, default timestamp
+		Timestamp int64  `json:"timestamp"` // Unix time the flow was last seen, default now
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -397,7 +400,15 @@ func (h *SessionHandler) HandleNetFlow(c *gin.Context) {
 		return
 	}
 
-	if err := h.sessionService.HandleNetFlow(req.Direction, srcIP, dstIP, req.Octets, req.Packets); err != nil {
+	var first, last time.Time
+	if req.First > 0 {
+		first = time.Unix(req.First, 0)
+	}
+	if req.Timestamp > 0 {
+		last = time.Unix(req.Timestamp, 0)
+	}
+
+	if err := h.sessionService.HandleNetFlow(req.Direction, srcIP, dstIP, req.Octets, req.Packets, first, last); err != nil {
 		h.logger.Error("Failed to handle NetFlow", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/services/simulator"
+)
+
+// SimulatorHandler handles billing dry-run endpoints
+type SimulatorHandler struct {
+	simulatorService *simulator.Service
+	logger           *zap.Logger
+}
+
+// NewSimulatorHandler creates a new simulator handler
+func NewSimulatorHandler(simulatorService *simulator.Service, logger *zap.Logger) *SimulatorHandler {
+	return &SimulatorHandler{
+		simulatorService: simulatorService,
+		logger:           logger,
+	}
+}
+
+// RegisterRoutes registers simulator routes
+func (h *SimulatorHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.POST("/billing/simulate", h.Simulate)
+}
+
+// Simulate replays usage with a candidate plan and compares it to the current plans
+// POST /api/v1/billing/simulate
+func (h *SimulatorHandler) Simulate(c *gin.Context) {
+	var req simulator.Request
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report, err := h.simulatorService.Simulate(req)
+	if errors.Is(err, simulator.ErrPlanNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, simulator.ErrInvalidRequest) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		h.logger.Error("Billing simulation failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
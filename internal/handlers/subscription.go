@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -33,6 +34,13 @@ func (h *SubscriptionHandler) RegisterRoutes(router *gin.Engine) {
 	v1.POST("/subscription/process", h.ProcessMonthlyCharges)
 	v1.POST("/subscription/process/:date", h.ProcessChargesForDate)
 
+	// Charge runs
+	v1.POST("/subscription/runs", h.StartRun)
+	v1.GET("/subscription/runs", h.ListRuns)
+	v1.GET("/subscription/runs/:id", h.GetRunReport)
+	v1.POST("/subscription/runs/:id/cancel", h.CancelRun)
+	v1.POST("/subscription/runs/:id/resume", h.ResumeRun)
+
 	// Account history
 	v1.GET("/subscription/account/:id/history", h.GetAccountHistory)
 
@@ -45,50 +53,156 @@ func (h *SubscriptionHandler) RegisterRoutes(router *gin.Engine) {
 	v1.GET("/subscription/preview/:account_id", h.PreviewAccountCharge)
 }
 
-// ProcessMonthlyCharges manually triggers monthly charges processing
+// ProcessMonthlyCharges starts a monthly charge run for today in background
 // POST /api/v1/subscription/process
 func (h *SubscriptionHandler) ProcessMonthlyCharges(c *gin.Context) {
+	h.startRun(c, billing.ChargeRunMonthly, time.Now())
+}
+
+// ProcessChargesForDate starts a monthly charge run for specific date in background
+// POST /api/v1/subscription/process/2024-01-01
+func (h *SubscriptionHandler) ProcessChargesForDate(c *gin.Context) {
+	targetDate, err := time.Parse("2006-01-02", c.Param("date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+		return
+	}
+
+	h.startRun(c, billing.ChargeRunMonthly, targetDate)
+}
+
+// StartRun starts a charge run in background
+// POST /api/v1/subscription/runs {"kind": "monthly", "date": "2024-01-01"}
+func (h *SubscriptionHandler) StartRun(c *gin.Context) {
+	var req struct {
+		Kind string `json:"kind"`
+		Date string `json:"date"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = billing.ChargeRunMonthly
+	}
+	if req.Kind != billing.ChargeRunMonthly && req.Kind != billing.ChargeRunDue {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid kind. Use monthly or due"})
+		return
+	}
+
 	targetDate := time.Now()
+	if req.Date != "" {
+		var err error
+		targetDate, err = time.Parse("2006-01-02", req.Date)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+			return
+		}
+	}
 
-	err := h.service.ProcessMonthlyCharges(targetDate)
+	h.startRun(c, req.Kind, targetDate)
+}
+
+// ListRuns returns recent charge runs
+// GET /api/v1/subscription/runs?limit=20
+func (h *SubscriptionHandler) ListRuns(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	runs, err := h.service.ListRuns(limit)
 	if err != nil {
-		h.logger.Error("Failed to process monthly charges", zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		h.respondRunError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Monthly charges processed successfully",
-		"date":    targetDate.Format("2006-01-02"),
+		"runs":  runs,
+		"count": len(runs),
 	})
 }
 
-// ProcessChargesForDate manually triggers charges for specific date
-// POST /api/v1/subscription/process/2024-01-01
-func (h *SubscriptionHandler) ProcessChargesForDate(c *gin.Context) {
-	dateStr := c.Param("date")
+// GetRunReport returns progress and summary of a charge run
+// GET /api/v1/subscription/runs/12
+func (h *SubscriptionHandler) GetRunReport(c *gin.Context) {
+	runID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+		return
+	}
 
-	targetDate, err := time.Parse("2006-01-02", dateStr)
+	report, err := h.service.RunReport(runID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+		h.respondRunError(c, err)
 		return
 	}
 
-	err = h.service.ProcessMonthlyCharges(targetDate)
+	c.JSON(http.StatusOK, report)
+}
+
+// CancelRun stops a charge run after its current batch
+// POST /api/v1/subscription/runs/12/cancel
+func (h *SubscriptionHandler) CancelRun(c *gin.Context) {
+	runID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		h.logger.Error("Failed to process charges for date",
-			zap.String("date", dateStr),
-			zap.Error(err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Monthly charges processed successfully",
-		"date":    dateStr,
+	run, err := h.service.CancelRun(runID)
+	if err != nil {
+		h.respondRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"run": run})
+}
+
+// ResumeRun continues a cancelled, failed or interrupted charge run from its checkpoint
+// POST /api/v1/subscription/runs/12/resume
+func (h *SubscriptionHandler) ResumeRun(c *gin.Context) {
+	runID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid run ID"})
+		return
+	}
+
+	run, err := h.service.ResumeRun(runID)
+	if err != nil {
+		h.respondRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"run": run})
+}
+
+func (h *SubscriptionHandler) startRun(c *gin.Context, kind string, targetDate time.Time) {
+	run, err := h.service.StartRun(kind, targetDate)
+	if err != nil {
+		h.respondRunError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Charge run started",
+		"date":    targetDate.Format("2006-01-02"),
+		"run":     run,
 	})
 }
 
+func (h *SubscriptionHandler) respondRunError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, billing.ErrRunNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, billing.ErrRunNotResumable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		h.logger.Error("Charge run request failed", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
 // GetAccountHistory returns subscription charge history for account
 // GET /api/v1/subscription/account/123/history?limit=10
 func (h *SubscriptionHandler) GetAccountHistory(c *gin.Context) {
@@ -121,16 +235,24 @@ func (h *SubscriptionHandler) GetAccountHistory(c *gin.Context) {
 	})
 }
 
-// GetSubscriptionStats returns subscription billing statistics
-// GET /api/v1/subscription/stats
+// GetSubscriptionStats returns subscription billing statistics of a billing period
+// GET /api/v1/subscription/stats?date=2024-01-01
 func (h *SubscriptionHandler) GetSubscriptionStats(c *gin.Context) {
-	// This would be implemented with actual stats queries
-	stats := gin.H{
-		"total_accounts":     0,
-		"active_accounts":    0,
-		"charges_this_month": 0,
-		"failed_charges":     0,
-		"total_revenue":      0.0,
+	targetDate := time.Now()
+	if dateStr := c.Query("date"); dateStr != "" {
+		var err error
+		targetDate, err = time.Parse("2006-01-02", dateStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+			return
+		}
+	}
+
+	stats, err := h.service.GetChargeStats(targetDate)
+	if err != nil {
+		h.logger.Error("Failed to get subscription stats", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -138,7 +260,7 @@ func (h *SubscriptionHandler) GetSubscriptionStats(c *gin.Context) {
 	})
 }
 
-// GetFailedCharges returns list of failed subscription charges
+// GetFailedCharges returns list of failed and unfinished subscription charges
 // GET /api/v1/subscription/failed?limit=20
 func (h *SubscriptionHandler) GetFailedCharges(c *gin.Context) {
 	limitStr := c.DefaultQuery("limit", "20")
@@ -147,15 +269,11 @@ func (h *SubscriptionHandler) GetFailedCharges(c *gin.Context) {
 		limit = 20
 	}
 
-	// This would query failed charges from database
-	failedCharges := []gin.H{
-		{
-			"account_id":     123,
-			"login":          "user123",
-			"amount":         25.0,
-			"failure_reason": "insufficient_funds",
-			"charge_date":    time.Now().Format("2006-01-02 15:04:05"),
-		},
+	failedCharges, err := h.service.GetFailedCharges(limit)
+	if err != nil {
+		h.logger.Error("Failed to get failed charges", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -184,26 +302,36 @@ func (h *SubscriptionHandler) TestAccountCharge(c *gin.Context) {
 }
 
 // PreviewAccountCharge previews what would be charged for account
-// GET /api/v1/subscription/preview/123
+// GET /api/v1/subscription/preview/123?date=2024-01-01
 func (h *SubscriptionHandler) PreviewAccountCharge(c *gin.Context) {
-	accountIDStr := c.Param("id")
+	accountIDStr := c.Param("account_id")
 	accountID, err := strconv.Atoi(accountIDStr)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid account ID"})
 		return
 	}
 
-	// This would calculate what would be charged without actually charging
-	preview := gin.H{
-		"account_id":   accountID,
-		"monthly_fee":  25.0,
-		"prorated":     false,
-		"amount":       25.0,
-		"period_start": time.Now().Format("2006-01-01"),
-		"period_end":   time.Now().AddDate(0, 1, -1).Format("2006-01-31"),
-		"can_charge":   true,
-		"balance":      100.0,
-		"credit":       0.0,
+	targetDate := time.Now()
+	if dateStr := c.Query("date"); dateStr != "" {
+		targetDate, err = time.Parse("2006-01-02", dateStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+			return
+		}
+	}
+
+	// Calculate what would be charged without actually charging
+	preview, err := h.service.PreviewCharge(accountID, targetDate)
+	if errors.Is(err, billing.ErrAccountNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to preview account charge",
+			zap.Int("account_id", accountID),
+			zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
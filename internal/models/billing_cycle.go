@@ -0,0 +1,135 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Billing cycles of BILLING_CYCLE (plan_data) and contracts.billing_cycle
+// Anniversary cycles count from the billing anchor: contracts.billing_anchor or the
+// account activation date. Days cycles are written as "days:N".
+const (
+	CycleCalendarMonth = "monthly"     // Calendar month from the 1st
+	CycleAnniversary   = "anniversary" // Month from the anchor day
+	CycleQuarterly     = "quarterly"   // 3 months from the anchor day
+	CycleYearly        = "yearly"      // 12 months from the anchor day
+	CycleDays          = "days"        // N days from the anchor day
+)
+
+// daysPerMonth prices days cycles: the fee of N days is MONTHLY_FEE * N / 30
+const daysPerMonth = 30
+
+// BillingCycle is a parsed billing cycle definition
+type BillingCycle struct {
+	Kind string
+	Days int // Length of CycleDays
+}
+
+// DefaultBillingCycle is used when neither the contract nor the plan sets a cycle
+var DefaultBillingCycle = BillingCycle{Kind: CycleCalendarMonth}
+
+// ParseBillingCycle parses "monthly", "anniversary", "quarterly", "yearly" or "days:N"
+func ParseBillingCycle(s string) (BillingCycle, error) {
+	switch s {
+	case CycleCalendarMonth, CycleAnniversary, CycleQuarterly, CycleYearly:
+		return BillingCycle{Kind: s}, nil
+	}
+
+	if strings.HasPrefix(s, CycleDays+":") {
+		n, err := strconv.Atoi(strings.TrimPrefix(s, CycleDays+":"))
+		if err != nil || n < 1 || n > 366 {
+			return BillingCycle{}, fmt.Errorf("billing cycle %q: days must be within 1..366", s)
+		}
+		return BillingCycle{Kind: CycleDays, Days: n}, nil
+	}
+
+	return BillingCycle{}, fmt.Errorf("unknown billing cycle %q", s)
+}
+
+// String returns the definition ParseBillingCycle accepts
+func (c BillingCycle) String() string {
+	if c.Kind == CycleDays {
+		return fmt.Sprintf("%s:%d", CycleDays, c.Days)
+	}
+	return c.Kind
+}
+
+// months is the length of month based cycles, 0 for days cycles
+func (c BillingCycle) months() int {
+	switch c.Kind {
+	case CycleQuarterly:
+		return 3
+	case CycleYearly:
+		return 12
+	case CycleDays:
+		return 0
+	}
+	return 1
+}
+
+// Period returns the cycle period containing t; end is the last second of the period
+// Periods start at midnight in t's location on the anchor's calendar date (TIMESTAMP columns
+// carry wall clock time). Anchor days past the end of a shorter month fall on its last day:
+// an account activated on the 31st is billed on Feb 28.
+func (c BillingCycle) Period(t, anchor time.Time) (time.Time, time.Time) {
+	loc := t.Location()
+	anchorDate := time.Date(anchor.Year(), anchor.Month(), anchor.Day(), 0, 0, 0, 0, loc)
+
+	var start, next time.Time
+	switch {
+	case c.Kind == CycleCalendarMonth:
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		next = start.AddDate(0, 1, 0)
+
+	case c.Kind == CycleDays:
+		// Whole calendar days between the anchor and t, immune to DST changes
+		days := int(civilDays(t) - civilDays(anchorDate))
+		n := days / c.Days
+		if days < 0 && days%c.Days != 0 {
+			n--
+		}
+		start = anchorDate.AddDate(0, 0, n*c.Days)
+		next = start.AddDate(0, 0, c.Days)
+
+	default:
+		step := c.months()
+		months := (t.Year()-anchorDate.Year())*12 + int(t.Month()-anchorDate.Month())
+		n := months / step
+		if months < 0 && months%step != 0 {
+			n--
+		}
+		start = addMonthsClamped(anchorDate, n*step)
+		if t.Before(start) {
+			n--
+			start = addMonthsClamped(anchorDate, n*step)
+		}
+		next = addMonthsClamped(anchorDate, (n+1)*step)
+	}
+
+	return start, next.Add(-time.Second)
+}
+
+// Fee returns the fee of one cycle priced from the monthly fee
+func (c BillingCycle) Fee(monthlyFee Money) Money {
+	if c.Kind == CycleDays {
+		return monthlyFee.MulDiv(uint64(c.Days), daysPerMonth)
+	}
+	return monthlyFee.Mul(int64(c.months()))
+}
+
+// addMonthsClamped adds months keeping the day of month, clamped to the month length
+func addMonthsClamped(date time.Time, months int) time.Time {
+	first := time.Date(date.Year(), date.Month()+time.Month(months), 1, 0, 0, 0, 0, date.Location())
+	day := date.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, date.Location())
+}
+
+// civilDays is the number of calendar days since the epoch of t's local date
+func civilDays(t time.Time) int64 {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / secondsPerDay
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tariff calendar keys of plan_data
+// Intervals are taken in TIMEZONE (server local time when not set). On weekends
+// (WEEKEND_DAYS, Saturday and Sunday by default) and HOLIDAYS the WEEKEND_INTERVALS and
+// WEEKEND_ACCESS_INTERVALS apply, falling back to INTERVALS and ACCESS_INTERVALS.
+//
+//	TIMEZONE                  string - IANA name, e.g. "Europe/Moscow"
+//	WEEKEND_INTERVALS         same layout as INTERVALS
+//	WEEKEND_ACCESS_INTERVALS  same layout as ACCESS_INTERVALS
+//	WEEKEND_DAYS              [weekday, ...] - 0 Sunday .. 6 Saturday
+//	HOLIDAYS                  ["YYYY-MM-DD", ...]
+
+// defaultWeekendDays apply when WEEKEND_DAYS is not set
+var defaultWeekendDays = map[time.Weekday]bool{time.Saturday: true, time.Sunday: true}
+
+// locations caches loaded time zones, plan_data is parsed on every flow
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// Location returns the time zone intervals of the plan are defined in
+func (p *PlanSettings) Location() *time.Location {
+	if p.location != nil {
+		return p.location
+	}
+	return time.Local
+}
+
+// IsWeekend reports whether weekend intervals apply on the day of t
+func (p *PlanSettings) IsWeekend(t time.Time) bool {
+	t = t.In(p.Location())
+	if p.Holidays[t.Format(planDateLayout)] {
+		return true
+	}
+
+	weekendDays := p.WeekendDays
+	if weekendDays == nil {
+		weekendDays = defaultWeekendDays
+	}
+	return weekendDays[t.Weekday()]
+}
+
+// CheckAccessAt returns whether access is allowed at t and the shaper to apply
+// Like CheckAccess, with the calendar and time zone of the plan.
+func (p *PlanSettings) CheckAccessAt(t time.Time) (bool, string) {
+	intervals := p.AccessIntervals
+	if p.IsWeekend(t) && p.WeekendAccessIntervals != nil {
+		intervals = p.WeekendAccessIntervals
+	}
+	return p.checkAccess(intervals, p.SecondOfDay(t))
+}
+
+// ShaperAt returns the shaper a running session of the plan gets at t
+// DUNNING_SHAPER overrides everything, FUP_SHAPER applies over quota, otherwise the access interval shaper.
+func (p *PlanSettings) ShaperAt(t time.Time) string {
+	if p.DunningShaper != "" {
+		return p.DunningShaper
+	}
+	if p.FUPShaper != "" && p.QuotaExceeded() {
+		return p.FUPShaper
+	}
+	_, shaper := p.CheckAccessAt(t)
+	return shaper
+}
+
+// PriceAt returns the price per MB of class/direction at t and its currency
+// Like Price, with the calendar and time zone of the plan.
+func (p *PlanSettings) PriceAt(t time.Time, class string, currency int, direction string) (Money, int, bool) {
+	return p.price(p.intervalsAt(t), p.SecondOfDay(t), class, currency, direction)
+}
+
+// SecondOfDay returns seconds since midnight of t in the plan time zone, the unit of interval boundaries
+func (p *PlanSettings) SecondOfDay(t time.Time) int {
+	t = t.In(p.Location())
+	return t.Hour()*3600 + t.Minute()*60 + t.Second()
+}
+
+// TariffBoundaries returns the moments within (from, to) where the price or access interval
+// may change: interval boundaries of each day and midnights, in the plan time zone
+func (p *PlanSettings) TariffBoundaries(from, to time.Time) []time.Time {
+	var boundaries []time.Time
+
+	from = from.In(p.Location())
+	for day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location()); day.Before(to); day = day.AddDate(0, 0, 1) {
+		access := p.AccessIntervals
+		if p.IsWeekend(day) && p.WeekendAccessIntervals != nil {
+			access = p.WeekendAccessIntervals
+		}
+
+		seconds := []int{secondsPerDay}
+		for _, interval := range p.intervalsAt(day) {
+			seconds = append(seconds, interval.Until)
+		}
+		for _, interval := range access {
+			seconds = append(seconds, interval.Until)
+		}
+		sort.Ints(seconds)
+
+		for i, second := range seconds {
+			if i > 0 && second == seconds[i-1] {
+				continue
+			}
+			boundary := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, second, 0, day.Location())
+			if boundary.After(from) && boundary.Before(to) {
+				boundaries = append(boundaries, boundary)
+			}
+		}
+	}
+
+	return boundaries
+}
+
+func (p *PlanSettings) intervalsAt(t time.Time) []TariffInterval {
+	if p.IsWeekend(t) && p.WeekendIntervals != nil {
+		return p.WeekendIntervals
+	}
+	return p.Intervals
+}
+
+func parseTimezone(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+	p.Timezone = errs.str(v, path)
+	if p.Timezone == "" {
+		return
+	}
+	loc, err := loadLocation(p.Timezone)
+	if err != nil {
+		errs.add(path, "unknown time zone %q", p.Timezone)
+		return
+	}
+	p.location = loc
+}
+
+func parseWeekendDays(v interface{}, path string, errs *PlanDataErrors) map[time.Weekday]bool {
+	days := make(map[time.Weekday]bool)
+
+	list, ok := v.([]interface{})
+	if !ok {
+		errs.add(path, "expected array, got %s", jsonType(v))
+		return days
+	}
+	for i, item := range list {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		day := errs.nonNegativeInt(item, itemPath)
+		if day > 6 {
+			errs.add(itemPath, "weekday must be within 0..6 (0 is Sunday)")
+			continue
+		}
+		days[time.Weekday(day)] = true
+	}
+	return days
+}
+
+func parseHolidays(v interface{}, path string, errs *PlanDataErrors) map[string]bool {
+	holidays := make(map[string]bool)
+
+	list, ok := v.([]interface{})
+	if !ok {
+		errs.add(path, "expected array, got %s", jsonType(v))
+		return holidays
+	}
+	for i, item := range list {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		date := errs.str(item, itemPath)
+		if _, err := time.Parse(planDateLayout, date); err != nil {
+			if _, isString := item.(string); isString {
+				errs.add(itemPath, "expected date YYYY-MM-DD")
+			}
+			continue
+		}
+		holidays[date] = true
+	}
+	return holidays
+}
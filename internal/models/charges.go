@@ -0,0 +1,128 @@
+package models
+
+import "time"
+
+// One-off charge kinds of account_charges
+const (
+	OneOffDebit  = "debit"  // debit_transaction
+	OneOffCredit = "credit" // credit_transaction
+)
+
+// Reason codes of one-off charges and credits (account_charges.reason)
+const (
+	ReasonInstallation = "installation" // Connection, installation works
+	ReasonEquipment    = "equipment"    // Router, ONT, cable sold or rented
+	ReasonService      = "service"      // Paid service: technician visit, reconnection
+	ReasonPenalty      = "penalty"
+	ReasonAddon        = "addon"        // Add-on activated in an already charged period
+	ReasonCompensation = "compensation" // Downtime compensation
+	ReasonRefund       = "refund"
+	ReasonAdjustment   = "adjustment" // Manual balance correction
+)
+
+var chargeReasons = map[string]bool{
+	ReasonInstallation: true,
+	ReasonEquipment:    true,
+	ReasonService:      true,
+	ReasonPenalty:      true,
+	ReasonAddon:        true,
+	ReasonCompensation: true,
+	ReasonRefund:       true,
+	ReasonAdjustment:   true,
+}
+
+// ValidChargeReason reports whether reason is a known reason code
+func ValidChargeReason(reason string) bool {
+	return chargeReasons[reason]
+}
+
+// OneOffCharge is a one-off debit or credit of an account
+// Amount is positive for both kinds, in Currency; fin_transactions keeps the balance change.
+type OneOffCharge struct {
+	ID            int       `json:"id"`
+	AccountID     int       `json:"account_id"`
+	Kind          string    `json:"kind"`
+	Reason        string    `json:"reason"`
+	Amount        Money     `json:"amount"`
+	Currency      int       `json:"currency"`
+	Description   string    `json:"description,omitempty"`
+	TransactionID int       `json:"transaction_id"`
+	Balance       Money     `json:"balance"` // Contract balance after the transaction
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Addon is a recurring service of the add-on catalog (static IP, TV package)
+// MonthlyFee is priced in Currency and billed per billing cycle like MONTHLY_FEE.
+type Addon struct {
+	ID         int    `json:"id"`
+	Code       string `json:"code"`
+	Name       string `json:"name"`
+	MonthlyFee Money  `json:"monthly_fee"`
+	Currency   int    `json:"currency"`
+	Active     bool   `json:"active"` // Inactive add-ons cannot be added to accounts
+}
+
+// AccountAddon is an add-on subscribed by an account
+// MonthlyFee is the account's fee override or the catalog fee.
+type AccountAddon struct {
+	ID         int        `json:"id"`
+	AccountID  int        `json:"account_id"`
+	AddonID    int        `json:"addon_id"`
+	Code       string     `json:"code"`
+	Name       string     `json:"name"`
+	Quantity   int        `json:"quantity"`
+	MonthlyFee Money      `json:"monthly_fee"`
+	Currency   int        `json:"currency"`
+	StartedAt  time.Time  `json:"started_at"`
+	EndedAt    *time.Time `json:"ended_at,omitempty"`
+}
+
+// Discount kinds of discounts
+const (
+	DiscountPercent = "percent" // Value percent off the period charge
+	DiscountFixed   = "fixed"   // Value off every period charge, in Currency
+)
+
+// Discount lowers subscription charges of an account or of every account of a plan
+// It applies to billing periods starting within ValidFrom..ValidUntil (dates, inclusive).
+type Discount struct {
+	ID          int        `json:"id"`
+	AccountID   *int       `json:"account_id,omitempty"`
+	PlanID      *int       `json:"plan_id,omitempty"`
+	Kind        string     `json:"kind"`
+	Value       Money      `json:"value"`
+	Currency    int        `json:"currency,omitempty"` // Fixed discounts; 0 - currency of the charge
+	Description string     `json:"description,omitempty"`
+	ValidFrom   time.Time  `json:"valid_from"`
+	ValidUntil  *time.Time `json:"valid_until,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// PercentOff returns amount less percent, percent within 0..100
+// Computed exactly as amount * (100 - percent) / 100, rounded once to MoneyScale.
+func PercentOff(amount, percent Money) Money {
+	hundred := NewMoney(100)
+	if percent.Sign() <= 0 {
+		return amount
+	}
+	if percent.Cmp(hundred) >= 0 {
+		return Money{}
+	}
+	return amount.MulDiv(hundred.Sub(percent).int().Uint64(), hundred.int().Uint64())
+}
+
+// Charge item kinds of a subscription charge breakdown
+const (
+	ChargeItemPlan       = "plan"
+	ChargeItemAddon      = "addon"
+	ChargeItemDiscount   = "discount"    // Negative amount
+	ChargeItemPlanChange = "plan_change" // Unused part returned on a plan change, negative
+)
+
+// ChargeItem is a line of a subscription charge, in the currency of the charge
+type ChargeItem struct {
+	Kind        string `json:"kind"`
+	RefID       int    `json:"ref_id,omitempty"` // Plan, add-on or discount ID
+	Description string `json:"description"`
+	Amount      Money  `json:"amount"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import "testing"
+
+func TestPercentOff(t *testing.T) {
+	tests := []struct {
+		amount, percent string
+		want            string
+	}{
+		{"100", "12.5", "87.5"},
+		{"100", "0", "100"},
+		{"100", "-5", "100"},
+		{"100", "100", "0"},
+		{"100", "150", "0"},
+		{"0.0000000003", "50", "0.0000000002"},
+		// A percent with more than two decimals is not cut to hundredths
+		{"300", "33.3333333333", "200.0000000001"},
+		{"19.99", "0.01", "19.988001"},
+	}
+	for _, tt := range tests {
+		got := PercentOff(MustParseMoney(tt.amount), MustParseMoney(tt.percent))
+		if got.String() != tt.want {
+			t.Errorf("PercentOff(%s, %s) = %s, want %s", tt.amount, tt.percent, got, tt.want)
+		}
+	}
+}
@@ -15,11 +15,22 @@ type DBCurrency struct {
 	Description string `json:"description" db:"description"`
 }
 
-// DBCurrencyRate - таблица currencies_rate
+// DBCurrencyRate - таблица currencies_rate (1 from_id = rate to_id)
 type DBCurrencyRate struct {
-	FromID int     `json:"from_id" db:"from_id"`
-	ToID   int     `json:"to_id" db:"to_id"`
-	Rate   float64 `json:"rate" db:"rate"`
+	FromID int   `json:"from_id" db:"from_id"`
+	ToID   int   `json:"to_id" db:"to_id"`
+	Rate   Money `json:"rate" db:"rate"` // NUMERIC, точное значение
+}
+
+// DBCurrencyRateHistory - таблица currency_rate_history (migrations/003_currency_rate_history.sql)
+type DBCurrencyRateHistory struct {
+	ID            int       `json:"id" db:"id"`
+	FromID        int       `json:"from_id" db:"from_id"`
+	ToID          int       `json:"to_id" db:"to_id"`
+	Rate          Money     `json:"rate" db:"rate"`
+	EffectiveFrom time.Time `json:"effective_from" db:"effective_from"`
+	Comment       string    `json:"comment" db:"comment"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
 }
 
 // DBPlan - таблица plans (ТОЧНОЕ СООТВЕТСТВИЕ СХЕМЕ)
@@ -46,7 +57,7 @@ type DBContractKind struct {
 type DBContract struct {
 	ID         int       `json:"id" db:"id"`
 	KindID     int       `json:"kind_id" db:"kind_id"`
-	Balance    float64   `json:"balance" db:"balance"`
+	Balance    Money     `json:"balance" db:"balance"`
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
 	CurrencyID int       `json:"currency_id" db:"currency_id"`
@@ -58,10 +69,10 @@ type DBFinTransaction struct {
 	KindID                   int       `json:"kind_id" db:"kind_id"`
 	ContractID               int       `json:"contract_id" db:"contract_id"`
 	CurrencyID               int       `json:"currency_id" db:"currency_id"`
-	Amount                   float64   `json:"amount" db:"amount"`
-	AmountInContractCurrency float64   `json:"amount_in_contract_currency" db:"amount_in_contract_currency"`
+	Amount                   Money     `json:"amount" db:"amount"`
+	AmountInContractCurrency Money     `json:"amount_in_contract_currency" db:"amount_in_contract_currency"`
 	CreatedAt                time.Time `json:"created_at" db:"created_at"`
-	BalanceAfter             float64   `json:"balance_after" db:"balance_after"`
+	BalanceAfter             Money     `json:"balance_after" db:"balance_after"`
 	Comment                  string    `json:"comment" db:"comment"`
 }
 
@@ -107,7 +118,7 @@ type DBIPTrafficSession struct {
 	IP         string     `json:"ip" db:"ip"`
 	OctetsIn   int64      `json:"octets_in" db:"octets_in"`   // BIGINT
 	OctetsOut  int64      `json:"octets_out" db:"octets_out"` // BIGINT
-	Amount     float64    `json:"amount" db:"amount"`         // NUMERIC(20,10)
+	Amount     Money      `json:"amount" db:"amount"`         // NUMERIC(20,10)
 	StartedAt  *time.Time `json:"started_at" db:"started_at"`
 	UpdatedAt  *time.Time `json:"updated_at" db:"updated_at"`
 	FinishedAt *time.Time `json:"finished_at" db:"finished_at"`
@@ -151,25 +162,46 @@ type DBContractInfo struct {
 	InfoValue  string `json:"info_value" db:"info_value"`
 }
 
+// DBAccountBinding - таблица account_bindings (migrations/001_account_bindings.sql)
+type DBAccountBinding struct {
+	ID        int       `json:"id" db:"id"`
+	AccountID int       `json:"account_id" db:"account_id"`
+	Kind      string    `json:"kind" db:"kind"`   // mac | cid
+	Value     string    `json:"value" db:"value"` // Нормализованное значение
+	Learned   bool      `json:"learned" db:"learned"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// DBAccountBindingHistory - таблица account_binding_history
+type DBAccountBindingHistory struct {
+	ID        int       `json:"id" db:"id"`
+	AccountID int       `json:"account_id" db:"account_id"`
+	Action    string    `json:"action" db:"action"` // added | removed | learned | rejected | flagged
+	Kind      string    `json:"kind" db:"kind"`
+	Value     string    `json:"value" db:"value"`
+	Actor     string    `json:"actor" db:"actor"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
 // ================ ЗАПРОСЫ ДЛЯ СОВМЕСТИМОСТИ С ERLANG КОДОМ ================
 
 // AccountWithRelations - результат запроса fetch_account (точно как в Erlang)
 type AccountWithRelations struct {
-	ID       int     `db:"id"`
-	Password string  `db:"password"`
-	PData    string  `db:"plan_data"` // JSON как VARCHAR
-	PId      int     `db:"plan_id"`
-	Auth     string  `db:"auth_algo"`
-	Acct     string  `db:"acct_algo"`
-	Balance  float64 `db:"balance"`
-	Currency int     `db:"currency_id"`
-	Credit   float64 `db:"credit"` // COALESCE(sp.credit, 0.0)
+	ID       int    `db:"id"`
+	Password string `db:"password"`
+	PData    string `db:"plan_data"` // JSON как VARCHAR
+	PId      int    `db:"plan_id"`
+	Auth     string `db:"auth_algo"`
+	Acct     string `db:"acct_algo"`
+	Balance  Money  `db:"balance"`
+	Currency int    `db:"currency_id"`
+	Credit   Money  `db:"credit"` // COALESCE(sp.credit, 0.0)
 }
 
 // ServiceParams - для получения кредита (как в Erlang коде)
 type ServiceParams struct {
-	AccountID int     `db:"account_id"`
-	Credit    float64 `db:"credit"`
+	AccountID int   `db:"account_id"`
+	Credit    Money `db:"credit"`
 }
 
 // AccountWithSubscription - для обработки подписок
@@ -181,9 +213,14 @@ type AccountWithSubscription struct {
 	CreatedAt time.Time `db:"created_at"`
 	Auth      string    `db:"auth_algo"`
 	Acct      string    `db:"acct_algo"`
-	Balance   float64   `db:"balance"`
+	Balance   Money     `db:"balance"`
 	Currency  int       `db:"currency_id"`
-	Credit    float64   `db:"credit"`
+	Credit    Money     `db:"credit"`
+
+	PlanCurrency int `db:"plan_currency_id"` // Валюта цен плана (plans.currency_id)
+
+	BillingCycle  string    `db:"billing_cycle"`  // contracts.billing_cycle, пусто - BILLING_CYCLE плана
+	BillingAnchor time.Time `db:"billing_anchor"` // contracts.billing_anchor или дата активации аккаунта
 }
 
 // ================ HELPER МЕТОДЫ ================
@@ -233,33 +270,10 @@ const (
 		INSERT INTO iptraffic_sessions(account_id, ip, sid, cid, started_at)
 		VALUES ($1, $2, $3, $4, $5)`
 
-	// Запрос sync_session из mod_iptraffic_pgsql.erl
-	SyncSessionQuery = `
-		UPDATE iptraffic_sessions SET octets_in = $1, octets_out = $2,
-		updated_at = $3, amount = $4
-		WHERE sid = $5 AND account_id = $6`
-
-	// Запрос stop_session из mod_iptraffic_pgsql.erl
-	StopSessionQuery = `
-		SELECT id FROM iptraffic_sessions
-		WHERE sid = $1 AND finished_at IS NULL AND account_id = $2 LIMIT 1`
-
-	// Обновление сессии при завершении
-	FinishSessionQuery = `
-		UPDATE iptraffic_sessions
-		SET octets_in = $1, octets_out = $2, amount = $3,
-		finished_at = $4, expired = $5
-		WHERE id = $6`
-
 	// Обновление plan_data в accounts
 	UpdateAccountPlanDataQuery = `
 		UPDATE accounts SET plan_data = $1 WHERE id = $2`
 
-	// Вставка детализации сессии
-	InsertSessionDetailQuery = `
-		INSERT INTO session_details (id, traffic_class, octets_in, octets_out) 
-		VALUES ($1, $2, $3, $4)`
-
 	// Вызов функций транзакций (как в Erlang)
 	DebitTransactionQuery  = `SELECT debit_transaction($1, $2, $3, $4)`
 	CreditTransactionQuery = `SELECT credit_transaction($1, $2, $3, $4)`
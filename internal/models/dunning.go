@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// DunningShaperKey is the plan_data key with the shaper of a subscriber throttled for an unpaid fee
+// It overrides the shaper of any plan at authorization until the debt is paid.
+const DunningShaperKey = "DUNNING_SHAPER"
+
+// Dunning states of an unpaid subscription charge, in escalation order
+const (
+	DunningGrace     = "grace"     // Charge failed, retried on payments
+	DunningWarned    = "warned"    // Subscriber notified
+	DunningThrottled = "throttled" // DUNNING_SHAPER (captive portal) applied
+	DunningSuspended = "suspended" // Account disabled, sessions disconnected
+	DunningResolved  = "resolved"  // Charge paid, restrictions lifted
+	DunningCancelled = "cancelled" // Closed by an operator without payment
+)
+
+// DunningCase follows one failed subscription charge of an account until it is paid
+type DunningCase struct {
+	ID           int            `json:"id"`
+	AccountID    int            `json:"account_id"`
+	Login        string         `json:"login"`
+	ChargeID     int            `json:"charge_id"`
+	Amount       Money          `json:"amount"`
+	Currency     int            `json:"currency"`
+	ChargeStatus string         `json:"charge_status"` // subscription_charges status
+	State        string         `json:"state"`
+	OpenedAt     time.Time      `json:"opened_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+	ClosedAt     *time.Time     `json:"closed_at,omitempty"`
+	Events       []DunningEvent `json:"events,omitempty"`
+}
+
+// DunningEvent is a recorded state transition of a dunning case
+type DunningEvent struct {
+	ID        int       `json:"id"`
+	CaseID    int       `json:"case_id"`
+	FromState string    `json:"from_state"`
+	ToState   string    `json:"to_state"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SetDunningShaper returns a copy of plan data with DUNNING_SHAPER set, or removed for ""
+func SetDunningShaper(planData map[string]interface{}, shaper string) map[string]interface{} {
+	result := copyPlanData(planData)
+	if shaper == "" {
+		delete(result, DunningShaperKey)
+	} else {
+		result[DunningShaperKey] = shaper
+	}
+	return result
+}
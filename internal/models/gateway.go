@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Gateway transaction states (gateway_transactions.state)
+const (
+	GatewayCreated   = "created"   // Checked and reserved by the provider, no money yet
+	GatewayPerformed = "performed" // Paid, Payment booked
+	GatewayCancelled = "cancelled" // Cancelled before it was performed
+	GatewayReversed  = "reversed"  // Cancelled after it was performed, Payment reversed
+)
+
+// GatewayTransaction is a payment of a payment aggregator (Click, Payme) going through
+// the check / perform / cancel protocol
+// Amount is in Currency, the currency of the gateway; ExternalID is the provider's transaction ID.
+type GatewayTransaction struct {
+	ID           int        `json:"id"`
+	Gateway      string     `json:"gateway"`
+	ExternalID   string     `json:"external_id"`
+	AccountID    int        `json:"account_id"`
+	Login        string     `json:"login"`
+	ContractID   int        `json:"contract_id"`
+	Amount       Money      `json:"amount"`
+	Currency     int        `json:"currency"`
+	State        string     `json:"state"`
+	PaymentID    int        `json:"payment_id,omitempty"`
+	ProviderTime time.Time  `json:"provider_time"` // When the provider created the transaction
+	CreatedAt    time.Time  `json:"created_at"`
+	PerformedAt  *time.Time `json:"performed_at,omitempty"`
+	CancelledAt  *time.Time `json:"cancelled_at,omitempty"`
+	CancelReason string     `json:"cancel_reason,omitempty"`
+}
@@ -0,0 +1,63 @@
+package models
+
+import "time"
+
+// Invoice states of invoices
+const (
+	InvoiceIssued = "issued"
+	InvoiceVoid   = "void" // Cancelled; the period can be invoiced again under a new number
+)
+
+// Invoice line kinds
+const (
+	InvoiceLineSubscription = "subscription" // Subscription fee of a billing period
+	InvoiceLineTraffic      = "traffic"      // iptraffic_sessions amounts of an account
+	InvoiceLineCharge       = "charge"       // One-off debit
+	InvoiceLineCredit       = "credit"       // One-off credit or plan change refund, negative
+)
+
+// Invoice is an issued invoice of a contract for a calendar month
+// Everything but the state is a snapshot taken at issue time and never changes:
+// amounts are in the contract currency, Customer holds the contract_info fields.
+type Invoice struct {
+	ID           int            `json:"id"`
+	Number       string         `json:"number"`
+	ContractID   int            `json:"contract_id"`
+	PeriodStart  time.Time      `json:"period_start"`
+	PeriodEnd    time.Time      `json:"period_end"` // Last second of the period
+	IssuedAt     time.Time      `json:"issued_at"`
+	DueAt        time.Time      `json:"due_at"`
+	Currency     int            `json:"currency"`
+	CurrencyCode string         `json:"currency_code"`
+	Issuer       InvoiceIssuer  `json:"issuer"`
+	Customer     []InvoiceField `json:"customer"`
+	Lines        []InvoiceLine  `json:"lines"`
+	Total        Money          `json:"total"`
+	TaxRate      float64        `json:"tax_rate,omitempty"` // Percent included in Total
+	Tax          Money          `json:"tax"`
+	State        string         `json:"state"`
+	VoidedAt     *time.Time     `json:"voided_at,omitempty"`
+	VoidReason   string         `json:"void_reason,omitempty"`
+}
+
+// InvoiceIssuer is the company issuing invoices
+type InvoiceIssuer struct {
+	Name    string   `json:"name"`
+	Details []string `json:"details,omitempty"` // Address, tax ID, bank account
+}
+
+// InvoiceField is a contract_info value with its contract_info_items description
+type InvoiceField struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Value       string `json:"value"`
+}
+
+// InvoiceLine is one line of an invoice, Amount in the contract currency
+type InvoiceLine struct {
+	Kind        string `json:"kind"`
+	AccountID   int    `json:"account_id,omitempty"`
+	Login       string `json:"login,omitempty"`
+	Description string `json:"description"`
+	Amount      Money  `json:"amount"`
+}
@@ -0,0 +1,259 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MoneyScale is the number of decimal places kept by Money
+// Matches NUMERIC(20,10) of iptraffic_sessions.amount and the Erlang billing.
+const MoneyScale = 10
+
+var moneyUnit = new(big.Int).Exp(big.NewInt(10), big.NewInt(MoneyScale), nil)
+
+// moneySyntax is plain decimal notation with an optional exponent, as in JSON and NUMERIC
+// big.Rat alone would also take fractions ("1/3"), hex ("0x10") and separators ("1_000").
+var moneySyntax = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]{1,3})?$`)
+
+// Money is a fixed-point decimal amount with MoneyScale decimal places
+// Arithmetic is exact; the only rounding happens in MulDiv and when parsing
+// values with more than MoneyScale decimals, always half away from zero
+// like PostgreSQL NUMERIC. The zero value is 0. Money values are immutable.
+type Money struct {
+	units *big.Int // Amount * 10^MoneyScale, nil means zero
+}
+
+// ZeroMoney is the zero amount
+var ZeroMoney = Money{}
+
+// NewMoney returns a whole amount
+func NewMoney(amount int64) Money {
+	return Money{units: new(big.Int).Mul(big.NewInt(amount), moneyUnit)}
+}
+
+// ParseMoney parses a decimal string like "-12.5", "0.0000001" or "1.5e3"
+// Digits beyond MoneyScale are rounded half away from zero.
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if !moneySyntax.MatchString(s) {
+		return Money{}, fmt.Errorf("invalid money value %q", s)
+	}
+
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return Money{}, fmt.Errorf("invalid money value %q", s)
+	}
+	return moneyFromRat(r), nil
+}
+
+// MustParseMoney is like ParseMoney but panics on error, for constants
+func MustParseMoney(s string) Money {
+	m, err := ParseMoney(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// MoneyFromFloat converts a float64, e.g. a number decoded from plan_data JSON
+// The shortest decimal representation of f is used, so 0.1 becomes exactly 0.1.
+func MoneyFromFloat(f float64) Money {
+	m, err := ParseMoney(strconv.FormatFloat(f, 'f', -1, 64))
+	if err != nil {
+		return Money{} // NaN or Inf
+	}
+	return m
+}
+
+func moneyFromRat(r *big.Rat) Money {
+	num := new(big.Int).Mul(r.Num(), moneyUnit)
+	return Money{units: divRound(num, r.Denom())}
+}
+
+// divRound divides rounding half away from zero
+func divRound(num, den *big.Int) *big.Int {
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() == 0 {
+		return q
+	}
+
+	// |2*rem| >= |den| means round away from zero
+	twice := new(big.Int).Abs(rem)
+	twice.Lsh(twice, 1)
+	if twice.Cmp(new(big.Int).Abs(den)) >= 0 {
+		if num.Sign()*den.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+func (m Money) int() *big.Int {
+	if m.units == nil {
+		return new(big.Int)
+	}
+	return m.units
+}
+
+// Add returns m + o
+func (m Money) Add(o Money) Money {
+	return Money{units: new(big.Int).Add(m.int(), o.int())}
+}
+
+// Sub returns m - o
+func (m Money) Sub(o Money) Money {
+	return Money{units: new(big.Int).Sub(m.int(), o.int())}
+}
+
+// Neg returns -m
+func (m Money) Neg() Money {
+	return Money{units: new(big.Int).Neg(m.int())}
+}
+
+// Mul returns m * n
+func (m Money) Mul(n int64) Money {
+	return Money{units: new(big.Int).Mul(m.int(), big.NewInt(n))}
+}
+
+// MulDiv returns m * num / den rounded to MoneyScale, e.g. price * octets / (1024*1024)
+func (m Money) MulDiv(num, den uint64) Money {
+	if den == 0 {
+		panic("models: Money.MulDiv division by zero")
+	}
+	n := new(big.Int).Mul(m.int(), new(big.Int).SetUint64(num))
+	return Money{units: divRound(n, new(big.Int).SetUint64(den))}
+}
+
+// MulRat returns m * r rounded to MoneyScale, e.g. an amount converted by an exchange rate
+func (m Money) MulRat(r *big.Rat) Money {
+	n := new(big.Int).Mul(m.int(), r.Num())
+	return Money{units: divRound(n, r.Denom())}
+}
+
+// Cmp compares m and o and returns -1, 0 or +1
+func (m Money) Cmp(o Money) int {
+	return m.int().Cmp(o.int())
+}
+
+// Sign returns -1, 0 or +1
+func (m Money) Sign() int {
+	return m.int().Sign()
+}
+
+// IsZero reports whether m is 0
+func (m Money) IsZero() bool {
+	return m.Sign() == 0
+}
+
+// Rat returns m as an exact rational
+func (m Money) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(m.int(), moneyUnit)
+}
+
+// Float64 returns the nearest float64, for logging and metrics only
+func (m Money) Float64() float64 {
+	f, _ := m.Rat().Float64()
+	return f
+}
+
+// Round returns m rounded to places decimals (half away from zero)
+func (m Money) Round(places int) Money {
+	if places >= MoneyScale {
+		return m
+	}
+	step := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(MoneyScale-places)), nil)
+	q := divRound(m.int(), step)
+	return Money{units: q.Mul(q, step)}
+}
+
+// StringFixed formats m with exactly places decimals
+func (m Money) StringFixed(places int) string {
+	return m.Rat().FloatString(places)
+}
+
+// String formats m without trailing zeros, e.g. "12.5", "-0.0000000001", "3"
+func (m Money) String() string {
+	s := m.StringFixed(MoneyScale)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// MarshalJSON encodes m as a JSON number keeping all decimals
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a quoted decimal string
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		*m = Money{}
+		return nil
+	}
+	parsed, err := ParseMoney(strings.Trim(s, `"`))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// UnmarshalYAML accepts a number or a decimal string in config files
+func (m *Money) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// MarshalBinary stores m as a decimal string (Redis hash fields)
+func (m Money) MarshalBinary() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalBinary parses a decimal string stored by MarshalBinary
+func (m *Money) UnmarshalBinary(data []byte) error {
+	parsed, err := ParseMoney(string(data))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Value implements driver.Valuer; NUMERIC columns receive the exact decimal string
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan implements sql.Scanner for NUMERIC columns
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = Money{}
+		return nil
+	case []byte:
+		return m.UnmarshalBinary(v)
+	case string:
+		return m.UnmarshalBinary([]byte(v))
+	case int64:
+		*m = NewMoney(v)
+		return nil
+	case float64:
+		*m = MoneyFromFloat(v)
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into Money", src)
+}
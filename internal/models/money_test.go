@@ -0,0 +1,166 @@
+package models
+
+import (
+	"math"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+const octetsPerMB = 1024 * 1024
+
+// flowCount returns n, or n/20 with -short
+func flowCount(n int) int {
+	if testing.Short() {
+		return n / 20
+	}
+	return n
+}
+
+// exactCharge is price * octets / 1048576 without any rounding
+func exactCharge(price Money, octets uint64) *big.Rat {
+	r := new(big.Rat).SetFrac(new(big.Int).SetUint64(octets), big.NewInt(octetsPerMB))
+	return r.Mul(r, price.Rat())
+}
+
+func TestMoneyTotalOfUniformFlows(t *testing.T) {
+	// 0.1 per MB has no exact float64 form; every flow is exactly one MB
+	price := MustParseMoney("0.1")
+	n := flowCount(2000000)
+
+	var total Money
+	var floatTotal float64
+	for i := 0; i < n; i++ {
+		total = total.Add(price.MulDiv(octetsPerMB, octetsPerMB))
+		floatTotal += price.Float64() * octetsPerMB / octetsPerMB
+	}
+
+	want := price.Mul(int64(n))
+	if total.Cmp(want) != 0 {
+		t.Fatalf("total of %d flows = %s, want exactly %s", n, total, want)
+	}
+
+	wantFloat, _ := want.Rat().Float64()
+	floatErr := math.Abs(floatTotal - wantFloat)
+	if floatErr == 0 {
+		t.Fatalf("float64 total %v unexpectedly exact", floatTotal)
+	}
+	t.Logf("%d flows: fixed-point %s, float64 %.10f (off by %g)", n, total, floatTotal, floatErr)
+}
+
+func TestMoneyTotalOfSmallFlows(t *testing.T) {
+	prices := []Money{
+		MustParseMoney("0.0123456789"),
+		MustParseMoney("1.5"),
+		MustParseMoney("0.0000000007"), // below half a unit for every flow here, always rounded off
+		MustParseMoney("2.9999999999"),
+		MustParseMoney("0.33"),
+	}
+	rng := rand.New(rand.NewSource(1))
+	n := flowCount(1000000)
+
+	var total Money
+	var floatTotal float64
+	exact := new(big.Rat)
+	for i := 0; i < n; i++ {
+		price := prices[i%len(prices)]
+		octets := uint64(rng.Intn(64 * 1024)) // small flows, mostly fractions of a MB
+
+		total = total.Add(price.MulDiv(octets, octetsPerMB))
+		floatTotal += price.Float64() * float64(octets) / octetsPerMB
+		exact.Add(exact, exactCharge(price, octets))
+	}
+
+	// Each flow is rounded once to MoneyScale, by at most half a unit
+	diff := new(big.Rat).Sub(total.Rat(), exact)
+	diff.Abs(diff)
+	bound := new(big.Rat).SetFrac(big.NewInt(int64(n)), new(big.Int).Mul(big.NewInt(2), moneyUnit))
+	if diff.Cmp(bound) > 0 {
+		t.Fatalf("total %s differs from exact %s by %s, more than %d half units",
+			total, exact.FloatString(MoneyScale), diff.FloatString(MoneyScale+2), n)
+	}
+
+	exactFloat, _ := exact.Float64()
+	t.Logf("%d flows: fixed-point off by %s, float64 off by %g",
+		n, diff.FloatString(MoneyScale+2), math.Abs(floatTotal-exactFloat))
+}
+
+func TestParseMoneyRounding(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"12.5", "12.5"},
+		{" 12.5 ", "12.5"},
+		{"-0.0000000001", "-0.0000000001"},
+		{"0.00000000005", "0.0000000001"},
+		{"0.00000000004999", "0"},
+		{"-0.00000000005", "-0.0000000001"},
+		{"1.23456789015", "1.2345678902"},
+		{"1.5e3", "1500"},
+		{"1e-11", "0"},
+		{"5e-11", "0.0000000001"},
+		{"100", "100"},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if err != nil {
+			t.Errorf("ParseMoney(%q): %v", tt.in, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("ParseMoney(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseMoneyRejectsNonDecimal(t *testing.T) {
+	for _, in := range []string{"", "1/3", "0x10", "1_000", "1.", ".5", "1e", "1,5", "+-1", "NaN", "Inf", "1e1000"} {
+		if m, err := ParseMoney(in); err == nil {
+			t.Errorf("ParseMoney(%q) = %s, want error", in, m)
+		}
+	}
+}
+
+func TestMoneyMulDiv(t *testing.T) {
+	tests := []struct {
+		m        string
+		num, den uint64
+		want     string
+	}{
+		{"1", 1, 3, "0.3333333333"},
+		{"1", 2, 3, "0.6666666667"},
+		{"-1", 2, 3, "-0.6666666667"},
+		{"0.0000000001", 1, 2, "0.0000000001"}, // half a unit rounds away from zero
+		{"-0.0000000001", 1, 2, "-0.0000000001"},
+		{"0.0000000001", 1, 3, "0"},
+		{"0.5", 3 * octetsPerMB, octetsPerMB, "1.5"},
+		{"0.0123456789", 1500, octetsPerMB, "0.0000176606"},
+		{"1000000000", math.MaxUint32, math.MaxUint32, "1000000000"},
+	}
+	for _, tt := range tests {
+		got := MustParseMoney(tt.m).MulDiv(tt.num, tt.den)
+		if got.String() != tt.want {
+			t.Errorf("%s.MulDiv(%d, %d) = %s, want %s", tt.m, tt.num, tt.den, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyRound(t *testing.T) {
+	tests := []struct {
+		m      string
+		places int
+		want   string
+	}{
+		{"2.345", 2, "2.35"},
+		{"-2.345", 2, "-2.35"},
+		{"2.3449999999", 2, "2.34"},
+		{"0.0000000001", 10, "0.0000000001"},
+		{"0.00000000015", 10, "0.0000000002"},
+	}
+	for _, tt := range tests {
+		if got := MustParseMoney(tt.m).Round(tt.places); got.String() != tt.want {
+			t.Errorf("%s.Round(%d) = %s, want %s", tt.m, tt.places, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// Payment kinds; refunds and reversals point at the payment they take back
+const (
+	PaymentIncoming = "payment"  // credit_transaction
+	PaymentRefund   = "refund"   // Money returned to the customer, debit_transaction, may be partial
+	PaymentReversal = "reversal" // Payment cancelled by the bank or gateway, debit_transaction of the rest
+)
+
+// Payment states of incoming payments
+const (
+	PaymentPosted   = "posted"
+	PaymentReversed = "reversed"
+)
+
+// Payment is money received from (or returned to) a customer
+// Amount is positive for all kinds, in Currency. Source and ExternalRef identify the payment at
+// the bank or gateway; IdempotencyKey makes retried requests return the payment already recorded.
+type Payment struct {
+	ID             int        `json:"id"`
+	Kind           string     `json:"kind"`
+	State          string     `json:"state"`
+	AccountID      int        `json:"account_id"`
+	ContractID     int        `json:"contract_id"`
+	Amount         Money      `json:"amount"`
+	Currency       int        `json:"currency"`
+	Refunded       Money      `json:"refunded"` // Refunds and reversal of an incoming payment so far
+	Source         string     `json:"source"`   // api, import, bank name, gateway
+	ExternalRef    string     `json:"external_ref,omitempty"`
+	IdempotencyKey string     `json:"idempotency_key"`
+	OriginalID     int        `json:"original_id,omitempty"` // Refunded or reversed payment
+	Comment        string     `json:"comment,omitempty"`
+	TransactionID  int        `json:"transaction_id"`
+	Balance        Money      `json:"balance"`    // Contract balance after the transaction
+	PaidAt         time.Time  `json:"paid_at"`    // When the customer paid, from the bank
+	CreatedAt      time.Time  `json:"created_at"` // When the payment was booked
+	ReversedAt     *time.Time `json:"reversed_at,omitempty"`
+}
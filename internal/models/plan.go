@@ -0,0 +1,705 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PlanSettings is the typed form of accounts.plan_data / plans.settings
+// Keys and layouts follow algo_builtin.erl:
+//
+//	CREDIT            number
+//	SHAPER            string
+//	DROP_SPEED        number (0 or 1)
+//	ACCESS_INTERVALS  [[until_second, "accept"|"reject", shaper?], ...]
+//	INTERVALS         [[until_second, {class: [[currency, in, out], ...] | {"in": x, "out": y}}], ...]
+//	PREPAID           number - default prepaid counter (bytes)
+//	PREPAID_<class>_<dir>  string - name of the counter used for class/direction
+//	<counter>         number - counters referenced by PREPAID_* links
+//	QUOTA, QUOTA_USED, QUOTA_TOPUP  {class|"all": bytes} - volume quota, see quota.go
+//	QUOTA_RESET_DAY   number 1..28, QUOTA_CYCLE_START "YYYY-MM-DD", FUP_SHAPER string
+//	TIME_INTERVALS    [[until_second, price_per_hour], ...] - online time prices, see time_billing.go
+//	TIME_INCREMENT, TIME_MINIMUM  number (seconds), TIME_DAY_CAP number
+//	TIME_DAY          "YYYY-MM-DD", TIME_DAY_CHARGED decimal string - daily cap counter
+//	TIMEZONE, WEEKEND_INTERVALS, WEEKEND_ACCESS_INTERVALS, WEEKEND_DAYS, HOLIDAYS - see calendar.go
+//	DUNNING_SHAPER    string - shaper while a subscription fee is unpaid, see dunning.go
+//	BILLING_CYCLE     string - "monthly", "anniversary", "quarterly", "yearly", "days:N", see billing_cycle.go
+//	BILLING_CYCLE_DISCOUNT  number 0..100 - percent off the fee of a cycle
+type PlanSettings struct {
+	Credit          Money
+	Shaper          string
+	DropSpeed       bool
+	AccessIntervals []AccessInterval
+	Intervals       []TariffInterval
+
+	// PrepaidLinks maps "PREPAID_<class>_<dir>" to a counter name
+	PrepaidLinks map[string]string
+	// Counters holds prepaid counters in bytes, including PREPAID
+	Counters map[string]float64
+
+	// Limits; nil and empty values leave the service defaults
+	SimultaneousUse       *int
+	SimultaneousUsePolicy string
+	BindPolicy            string
+	BindAutoLearn         *bool
+	MonthlyFee            Money
+
+	// Volume quota (fair use policy)
+	Quota           map[string]float64
+	QuotaUsed       map[string]float64
+	QuotaTopUp      map[string]float64
+	QuotaResetDay   int
+	QuotaCycleStart string
+	FUPShaper       string
+
+	// Online time billing
+	TimeIntervals  []TimeInterval
+	TimeIncrement  int
+	TimeMinimum    int
+	TimeDayCap     Money
+	TimeDay        string
+	TimeDayCharged Money
+
+	// Tariff calendar
+	Timezone               string
+	WeekendIntervals       []TariffInterval
+	WeekendAccessIntervals []AccessInterval
+	WeekendDays            map[time.Weekday]bool
+	Holidays               map[string]bool
+
+	// Unpaid subscription fee
+	DunningShaper string
+
+	// Subscription billing cycle, Kind is empty when not set
+	BillingCycle  BillingCycle
+	CycleDiscount Money
+
+	location *time.Location
+}
+
+// AccessInterval is one ACCESS_INTERVALS entry, valid until Until seconds of day
+type AccessInterval struct {
+	Until  int
+	Accept bool
+	Shaper string // Empty means plan SHAPER
+}
+
+// TariffInterval is one INTERVALS entry, valid until Until seconds of day
+type TariffInterval struct {
+	Until   int
+	Classes map[string]ClassPrices
+}
+
+// ClassPrices holds prices per MB of a traffic class
+// Either per currency ([[currency, in, out], ...]) or currency independent ({"in": x, "out": y}).
+type ClassPrices struct {
+	ByCurrency map[int]DirectionPrices
+	Any        *DirectionPrices
+}
+
+// DirectionPrices holds prices per MB for both directions
+type DirectionPrices struct {
+	In  Money
+	Out Money
+}
+
+// DefaultPrepaidCounter is the counter used when no PREPAID_<class>_<dir> link is set
+const DefaultPrepaidCounter = "PREPAID"
+
+const secondsPerDay = 86400
+
+// planDateLayout is the layout of dates in plan_data
+const planDateLayout = "2006-01-02"
+
+// knownPlanKeys are scalar keys with their parsers; INTERVALS, links and counters are handled separately
+var knownPlanKeys = map[string]func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors){
+	"CREDIT": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.Credit = errs.money(v, path)
+	},
+	"SHAPER": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.Shaper = errs.str(v, path)
+	},
+	"DROP_SPEED": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		switch n := errs.number(v, path); n {
+		case 0, 1:
+			p.DropSpeed = n == 1
+		default:
+			errs.add(path, "must be 0 or 1")
+		}
+	},
+	"SIMULTANEOUS_USE": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		n := errs.nonNegativeInt(v, path)
+		p.SimultaneousUse = &n
+	},
+	"SIMULTANEOUS_USE_POLICY": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.SimultaneousUsePolicy = errs.oneOf(v, path, "reject", "kick_oldest")
+	},
+	"BIND_POLICY": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.BindPolicy = errs.oneOf(v, path, "off", "reject", "flag")
+	},
+	"BIND_AUTOLEARN": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		b, ok := v.(bool)
+		if !ok {
+			errs.add(path, "expected boolean, got %s", jsonType(v))
+		}
+		p.BindAutoLearn = &b
+	},
+	"MONTHLY_FEE": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.MonthlyFee = errs.nonNegativeMoney(v, path)
+	},
+	"SUBSCRIPTION_FEE": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		if p.MonthlyFee.IsZero() {
+			p.MonthlyFee = errs.nonNegativeMoney(v, path)
+		}
+	},
+	"QUOTA": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.Quota = parseVolumes(v, path, errs)
+	},
+	"QUOTA_USED": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.QuotaUsed = parseVolumes(v, path, errs)
+	},
+	"QUOTA_TOPUP": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.QuotaTopUp = parseVolumes(v, path, errs)
+	},
+	"QUOTA_RESET_DAY": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.QuotaResetDay = errs.nonNegativeInt(v, path)
+		if p.QuotaResetDay < 1 || p.QuotaResetDay > 28 {
+			errs.add(path, "must be within 1..28")
+		}
+	},
+	"QUOTA_CYCLE_START": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.QuotaCycleStart = errs.str(v, path)
+		if _, err := time.Parse(planDateLayout, p.QuotaCycleStart); err != nil && p.QuotaCycleStart != "" {
+			errs.add(path, "expected date YYYY-MM-DD")
+		}
+	},
+	"FUP_SHAPER": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.FUPShaper = errs.str(v, path)
+	},
+	"TIME_INTERVALS": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.TimeIntervals = parseTimeIntervals(v, path, errs)
+	},
+	"TIME_INCREMENT": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.TimeIncrement = errs.nonNegativeInt(v, path)
+	},
+	"TIME_MINIMUM": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.TimeMinimum = errs.nonNegativeInt(v, path)
+	},
+	"TIME_DAY_CAP": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.TimeDayCap = errs.nonNegativeMoney(v, path)
+	},
+	"TIME_DAY": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.TimeDay = errs.str(v, path)
+		if _, err := time.Parse(planDateLayout, p.TimeDay); err != nil && p.TimeDay != "" {
+			errs.add(path, "expected date YYYY-MM-DD")
+		}
+	},
+	"TIME_DAY_CHARGED": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		// Stored as a decimal string by SetTimeDayCharged; numbers are written by older versions
+		s, ok := v.(string)
+		if !ok {
+			p.TimeDayCharged = errs.nonNegativeMoney(v, path)
+			return
+		}
+		charged, err := ParseMoney(s)
+		if err != nil || charged.Sign() < 0 {
+			errs.add(path, "expected non-negative decimal, got %q", s)
+		}
+		p.TimeDayCharged = charged
+	},
+	"TIMEZONE": parseTimezone,
+	"WEEKEND_INTERVALS": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.WeekendIntervals = parseTariffIntervals(v, path, errs)
+	},
+	"WEEKEND_ACCESS_INTERVALS": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.WeekendAccessIntervals = parseAccessIntervals(v, path, errs)
+	},
+	"WEEKEND_DAYS": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.WeekendDays = parseWeekendDays(v, path, errs)
+	},
+	"HOLIDAYS": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.Holidays = parseHolidays(v, path, errs)
+	},
+	"DUNNING_SHAPER": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.DunningShaper = errs.str(v, path)
+	},
+	"BILLING_CYCLE": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		name, ok := v.(string)
+		if !ok {
+			errs.str(v, path)
+			return
+		}
+		cycle, err := ParseBillingCycle(name)
+		if err != nil {
+			errs.add(path, "%v", err)
+		}
+		p.BillingCycle = cycle
+	},
+	"BILLING_CYCLE_DISCOUNT": func(p *PlanSettings, v interface{}, path string, errs *PlanDataErrors) {
+		p.CycleDiscount = errs.nonNegativeMoney(v, path)
+		if p.CycleDiscount.Cmp(NewMoney(100)) > 0 {
+			errs.add(path, "must be within 0..100")
+		}
+	},
+}
+
+// ParsePlanSettings strictly parses plan_data
+// Wrong types, malformed intervals and unknown keys are reported as PlanDataErrors
+// with the path of every offending value.
+func ParsePlanSettings(planData map[string]interface{}) (*PlanSettings, error) {
+	p := &PlanSettings{
+		PrepaidLinks: make(map[string]string),
+		Counters:     make(map[string]float64),
+	}
+	errs := &PlanDataErrors{}
+
+	keys := make([]string, 0, len(planData))
+	for k := range planData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// Links first: they decide which other keys are counters
+	for _, k := range keys {
+		if name, ok := planData[k].(string); ok && isPrepaidLink(k) {
+			p.PrepaidLinks[k] = name
+		}
+	}
+
+	for _, k := range keys {
+		v := planData[k]
+		path := planPath(k)
+
+		switch {
+		case k == "ACCESS_INTERVALS":
+			p.AccessIntervals = parseAccessIntervals(v, path, errs)
+		case k == "INTERVALS":
+			p.Intervals = parseTariffIntervals(v, path, errs)
+		case p.isLink(k):
+			if p.PrepaidLinks[k] == "" {
+				errs.add(path, "counter name must not be empty")
+			}
+		case k == DefaultPrepaidCounter || p.isCounter(k):
+			p.Counters[k] = errs.nonNegative(v, path)
+		case isPrepaidLink(k):
+			errs.add(path, "expected counter name string, got %s", jsonType(v))
+		case knownPlanKeys[k] != nil:
+			knownPlanKeys[k](p, v, path, errs)
+		default:
+			errs.add(path, "unknown key")
+		}
+	}
+
+	for _, k := range keys {
+		counter, ok := p.PrepaidLinks[k]
+		if !ok || counter == "" || counter == DefaultPrepaidCounter {
+			continue
+		}
+		if _, defined := planData[counter]; !defined {
+			errs.add(planPath(k), "counter %q is not defined", counter)
+		}
+	}
+
+	if len(errs.Errors) > 0 {
+		return nil, errs
+	}
+	return p, nil
+}
+
+// Prepaid returns the default PREPAID counter
+func (p *PlanSettings) Prepaid() float64 {
+	return p.Counters[DefaultPrepaidCounter]
+}
+
+// CheckAccess returns whether access is allowed at the given second of day and the shaper to apply
+// Without ACCESS_INTERVALS access is always allowed with plan SHAPER.
+func (p *PlanSettings) CheckAccess(secondOfDay int) (bool, string) {
+	return p.checkAccess(p.AccessIntervals, secondOfDay)
+}
+
+func (p *PlanSettings) checkAccess(intervals []AccessInterval, secondOfDay int) (bool, string) {
+	if len(intervals) == 0 {
+		return true, p.Shaper
+	}
+
+	for _, interval := range intervals {
+		if secondOfDay < interval.Until {
+			if !interval.Accept {
+				return false, ""
+			}
+			if interval.Shaper != "" {
+				return true, interval.Shaper
+			}
+			return true, p.Shaper
+		}
+	}
+
+	return false, ""
+}
+
+// Price returns the price per MB of class/direction at the given second of day
+// and the currency of that price. A price in the contract currency is preferred,
+// then a currency independent one, then the lowest configured currency, which
+// the caller has to convert. The boolean is false when no interval or class
+// price applies (free traffic).
+func (p *PlanSettings) Price(secondOfDay int, class string, currency int, direction string) (Money, int, bool) {
+	return p.price(p.Intervals, secondOfDay, class, currency, direction)
+}
+
+func (p *PlanSettings) price(intervals []TariffInterval, secondOfDay int, class string, currency int, direction string) (Money, int, bool) {
+	for _, interval := range intervals {
+		if secondOfDay >= interval.Until {
+			continue
+		}
+
+		prices, ok := interval.Classes[class]
+		if !ok {
+			return Money{}, 0, false
+		}
+
+		dp, priceCurrency := prices.Any, currency
+		if byCurrency, ok := prices.ByCurrency[currency]; ok {
+			dp = &byCurrency
+		} else if dp == nil && len(prices.ByCurrency) > 0 {
+			priceCurrency = -1
+			for c := range prices.ByCurrency {
+				if priceCurrency < 0 || c < priceCurrency {
+					priceCurrency = c
+				}
+			}
+			byCurrency := prices.ByCurrency[priceCurrency]
+			dp = &byCurrency
+		}
+		if dp == nil {
+			return Money{}, 0, false
+		}
+
+		if direction == "in" {
+			return dp.In, priceCurrency, true
+		}
+		return dp.Out, priceCurrency, true
+	}
+
+	return Money{}, 0, false
+}
+
+// AffordableOctets returns how much traffic budget buys at t
+// Traffic is priced at the most expensive class/direction of the interval, after the
+// PREPAID counter. The boolean is false when traffic is free or priced in another
+// currency than the contract one, so no limit can be given.
+func (p *PlanSettings) AffordableOctets(t time.Time, currency int, budget Money) (uint64, bool) {
+	intervals, secondOfDay := p.intervalsAt(t), p.SecondOfDay(t)
+
+	var maxPrice Money
+	for _, interval := range intervals {
+		if secondOfDay >= interval.Until {
+			continue
+		}
+		for class := range interval.Classes {
+			for _, direction := range []string{"in", "out"} {
+				price, priceCurrency, ok := p.price(intervals, secondOfDay, class, currency, direction)
+				if !ok {
+					continue
+				}
+				if priceCurrency != currency && price.Sign() > 0 {
+					return 0, false
+				}
+				if price.Cmp(maxPrice) > 0 {
+					maxPrice = price
+				}
+			}
+		}
+		break
+	}
+	if maxPrice.Sign() <= 0 {
+		return 0, false
+	}
+
+	octets := uint64(p.Prepaid())
+	if budget.Sign() > 0 {
+		paid := new(big.Int).Mul(budget.int(), big.NewInt(1024*1024))
+		octets += paid.Quo(paid, maxPrice.int()).Uint64()
+	}
+	return octets, true
+}
+
+// PrepaidCounter returns the counter name and value used for class/direction
+func (p *PlanSettings) PrepaidCounter(class, direction string) (string, float64) {
+	name := DefaultPrepaidCounter
+	if link, ok := p.PrepaidLinks[fmt.Sprintf("PREPAID_%s_%s", class, direction)]; ok {
+		name = link
+	}
+	return name, p.Counters[name]
+}
+
+func (p *PlanSettings) isLink(key string) bool {
+	_, ok := p.PrepaidLinks[key]
+	return ok
+}
+
+func (p *PlanSettings) isCounter(key string) bool {
+	for _, counter := range p.PrepaidLinks {
+		if counter == key {
+			return true
+		}
+	}
+	return false
+}
+
+func parseAccessIntervals(v interface{}, path string, errs *PlanDataErrors) []AccessInterval {
+	list, ok := v.([]interface{})
+	if !ok {
+		errs.add(path, "expected array, got %s", jsonType(v))
+		return nil
+	}
+
+	intervals := make([]AccessInterval, 0, len(list))
+	prev := 0
+	for i, item := range list {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		entry, ok := item.([]interface{})
+		if !ok || len(entry) < 2 || len(entry) > 3 {
+			errs.add(itemPath, "expected [until_second, \"accept\"|\"reject\", shaper?]")
+			continue
+		}
+
+		interval := AccessInterval{
+			Until:  errs.boundary(entry[0], itemPath+"[0]", prev),
+			Accept: errs.oneOf(entry[1], itemPath+"[1]", "accept", "reject") == "accept",
+		}
+		if len(entry) == 3 {
+			interval.Shaper = errs.str(entry[2], itemPath+"[2]")
+		}
+		prev = interval.Until
+		intervals = append(intervals, interval)
+	}
+
+	return intervals
+}
+
+func parseTariffIntervals(v interface{}, path string, errs *PlanDataErrors) []TariffInterval {
+	list, ok := v.([]interface{})
+	if !ok {
+		errs.add(path, "expected array, got %s", jsonType(v))
+		return nil
+	}
+
+	intervals := make([]TariffInterval, 0, len(list))
+	prev := 0
+	for i, item := range list {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		entry, ok := item.([]interface{})
+		if !ok || len(entry) != 2 {
+			errs.add(itemPath, "expected [until_second, {class: prices}]")
+			continue
+		}
+
+		interval := TariffInterval{
+			Until:   errs.boundary(entry[0], itemPath+"[0]", prev),
+			Classes: make(map[string]ClassPrices),
+		}
+		prev = interval.Until
+
+		classes, ok := entry[1].(map[string]interface{})
+		if !ok {
+			errs.add(itemPath+"[1]", "expected object, got %s", jsonType(entry[1]))
+			continue
+		}
+		names := make([]string, 0, len(classes))
+		for class := range classes {
+			names = append(names, class)
+		}
+		sort.Strings(names)
+		for _, class := range names {
+			interval.Classes[class] = parseClassPrices(classes[class], fmt.Sprintf("%s[1].%s", itemPath, class), errs)
+		}
+		intervals = append(intervals, interval)
+	}
+
+	return intervals
+}
+
+func parseClassPrices(v interface{}, path string, errs *PlanDataErrors) ClassPrices {
+	var cp ClassPrices
+
+	switch prices := v.(type) {
+	case []interface{}:
+		cp.ByCurrency = make(map[int]DirectionPrices)
+		for i, item := range prices {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			entry, ok := item.([]interface{})
+			if !ok || len(entry) != 3 {
+				errs.add(itemPath, "expected [currency, in_price, out_price]")
+				continue
+			}
+			currency := errs.nonNegativeInt(entry[0], itemPath+"[0]")
+			if _, dup := cp.ByCurrency[currency]; dup {
+				errs.add(itemPath+"[0]", "duplicate currency %d", currency)
+			}
+			cp.ByCurrency[currency] = DirectionPrices{
+				In:  errs.nonNegativeMoney(entry[1], itemPath+"[1]"),
+				Out: errs.nonNegativeMoney(entry[2], itemPath+"[2]"),
+			}
+		}
+	case map[string]interface{}:
+		dp := &DirectionPrices{}
+		for k, price := range prices {
+			switch k {
+			case "in":
+				dp.In = errs.nonNegativeMoney(price, path+".in")
+			case "out":
+				dp.Out = errs.nonNegativeMoney(price, path+".out")
+			default:
+				errs.add(path+"."+k, "unknown key, expected \"in\" or \"out\"")
+			}
+		}
+		cp.Any = dp
+	default:
+		errs.add(path, "expected array of [currency, in, out] or {\"in\", \"out\"}, got %s", jsonType(v))
+	}
+
+	return cp
+}
+
+func isPrepaidLink(key string) bool {
+	return strings.HasPrefix(key, "PREPAID_") && strings.Count(key, "_") >= 2
+}
+
+func planPath(key string) string {
+	return "plan_data." + key
+}
+
+// PlanDataError is a validation error of a single plan_data value
+type PlanDataError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e PlanDataError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// PlanDataErrors collects all validation errors of plan_data
+type PlanDataErrors struct {
+	Errors []PlanDataError `json:"errors"`
+}
+
+func (e *PlanDataErrors) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return "invalid plan_data: " + strings.Join(msgs, "; ")
+}
+
+func (e *PlanDataErrors) add(path, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, PlanDataError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *PlanDataErrors) number(v interface{}, path string) float64 {
+	switch n := v.(type) {
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	case json.Number:
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	}
+	e.add(path, "expected number, got %s", jsonType(v))
+	return 0
+}
+
+func (e *PlanDataErrors) nonNegative(v interface{}, path string) float64 {
+	n := e.number(v, path)
+	if n < 0 {
+		e.add(path, "must not be negative")
+	}
+	return n
+}
+
+// money parses a price or amount without going through float arithmetic for json.Number
+func (e *PlanDataErrors) money(v interface{}, path string) Money {
+	switch n := v.(type) {
+	case float64:
+		return MoneyFromFloat(n)
+	case int:
+		return NewMoney(int64(n))
+	case json.Number:
+		if m, err := ParseMoney(n.String()); err == nil {
+			return m
+		}
+	}
+	e.add(path, "expected number, got %s", jsonType(v))
+	return Money{}
+}
+
+func (e *PlanDataErrors) nonNegativeMoney(v interface{}, path string) Money {
+	m := e.money(v, path)
+	if m.Sign() < 0 {
+		e.add(path, "must not be negative")
+	}
+	return m
+}
+
+func (e *PlanDataErrors) nonNegativeInt(v interface{}, path string) int {
+	n := e.nonNegative(v, path)
+	if n != math.Trunc(n) {
+		e.add(path, "expected integer, got %v", n)
+	}
+	return int(n)
+}
+
+func (e *PlanDataErrors) boundary(v interface{}, path string, prev int) int {
+	n := e.nonNegativeInt(v, path)
+	if n <= prev || n > secondsPerDay {
+		e.add(path, "interval boundary must be increasing and within (%d, %d]", prev, secondsPerDay)
+	}
+	return n
+}
+
+func (e *PlanDataErrors) str(v interface{}, path string) string {
+	s, ok := v.(string)
+	if !ok {
+		e.add(path, "expected string, got %s", jsonType(v))
+	}
+	return s
+}
+
+func (e *PlanDataErrors) oneOf(v interface{}, path string, allowed ...string) string {
+	s := e.str(v, path)
+	for _, a := range allowed {
+		if s == a {
+			return s
+		}
+	}
+	if _, ok := v.(string); ok {
+		e.add(path, "must be one of %s, got %q", strings.Join(allowed, ", "), s)
+	}
+	return s
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64, int, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
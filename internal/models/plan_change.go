@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// Plan change states of plan_changes
+const (
+	PlanChangeScheduled = "scheduled" // Waits for EffectiveAt (start of the next billing period)
+	PlanChangeApplied   = "applied"
+	PlanChangeCancelled = "cancelled"
+	PlanChangeFailed    = "failed"
+)
+
+// carriedPlanKeys are plan_data keys of the account kept when it moves to another plan
+var carriedPlanKeys = []string{DunningShaperKey}
+
+// PlanChange moves an account to another plan at EffectiveAt
+// Credit is the unused part of the old plan's period returned to the contract, Charge the
+// new plan's fee for the rest of its period (both in their fee currency).
+type PlanChange struct {
+	ID             int                    `json:"id"`
+	AccountID      int                    `json:"account_id"`
+	FromPlanID     int                    `json:"from_plan_id"`
+	ToPlanID       int                    `json:"to_plan_id"`
+	PlanData       map[string]interface{} `json:"plan_data,omitempty"` // Overrides plans.settings of the new plan
+	State          string                 `json:"state"`
+	EffectiveAt    time.Time              `json:"effective_at"`
+	CreatedAt      time.Time              `json:"created_at"`
+	AppliedAt      *time.Time             `json:"applied_at,omitempty"`
+	Credit         Money                  `json:"credit"`
+	CreditCurrency int                    `json:"credit_currency,omitempty"`
+	Charge         Money                  `json:"charge"`
+	ChargeCurrency int                    `json:"charge_currency,omitempty"`
+	ChargeID       *int                   `json:"charge_id,omitempty"` // subscription_charges row of the new plan
+	ChargeStatus   string                 `json:"charge_status,omitempty"`
+	Error          string                 `json:"error,omitempty"`
+}
+
+// CarryPlanData returns a copy of the new plan data with account keys of the old one that
+// survive a plan change, such as DUNNING_SHAPER of an unpaid fee
+func CarryPlanData(oldPlanData, newPlanData map[string]interface{}) map[string]interface{} {
+	result := copyPlanData(newPlanData)
+	for _, key := range carriedPlanKeys {
+		if v, ok := oldPlanData[key]; ok {
+			result[key] = v
+		}
+	}
+	return result
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// Promised payment states
+const (
+	PromisedActive    = "active"    // Amount added to service_params.credit
+	PromisedExpired   = "expired"   // Credit taken back at ExpiresAt
+	PromisedCancelled = "cancelled" // Credit taken back early by an operator
+)
+
+// PromisedPayment is a temporary credit a subscriber takes until the next payment
+// While active, Amount (in the contract currency) is part of service_params.credit, so
+// authorization and the balance check of sessions count it with the balance.
+type PromisedPayment struct {
+	ID          int        `json:"id"`
+	AccountID   int        `json:"account_id"`
+	Login       string     `json:"login"`
+	ContractID  int        `json:"contract_id"`
+	Amount      Money      `json:"amount"`
+	Currency    int        `json:"currency"`
+	State       string     `json:"state"`
+	GrantedAt   time.Time  `json:"granted_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	ClosedAt    *time.Time `json:"closed_at,omitempty"`
+	CloseReason string     `json:"close_reason,omitempty"`
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Volume quota keys of plan_data
+// QUOTA holds full speed bytes per traffic class for a billing cycle, QUOTA_TOPUP
+// bytes added by top-up packs in the current cycle and QUOTA_USED bytes counted so far.
+// The class "all" counts traffic of every class. After any quota is used up the
+// session gets FUP_SHAPER until the next cycle or a top-up.
+const (
+	QuotaKey           = "QUOTA"
+	QuotaUsedKey       = "QUOTA_USED"
+	QuotaTopUpKey      = "QUOTA_TOPUP"
+	QuotaCycleStartKey = "QUOTA_CYCLE_START"
+
+	// QuotaAllClasses is the quota class matching all traffic
+	QuotaAllClasses = "all"
+)
+
+// QuotaClassStatus is the usage of one quota class in the current cycle
+type QuotaClassStatus struct {
+	Class     string  `json:"class"`
+	Quota     float64 `json:"quota"`
+	TopUp     float64 `json:"topup"`
+	Used      float64 `json:"used"`
+	Remaining float64 `json:"remaining"`
+	Exceeded  bool    `json:"exceeded"`
+}
+
+// HasQuota reports whether the plan limits full speed volume
+func (p *PlanSettings) HasQuota() bool {
+	return len(p.Quota) > 0
+}
+
+// QuotaExceeded reports whether any quota class is used up
+func (p *PlanSettings) QuotaExceeded() bool {
+	for _, status := range p.QuotaStatus() {
+		if status.Exceeded {
+			return true
+		}
+	}
+	return false
+}
+
+// QuotaStatus returns usage of every quota class ordered by class
+func (p *PlanSettings) QuotaStatus() []QuotaClassStatus {
+	classes := make([]string, 0, len(p.Quota))
+	for class := range p.Quota {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	statuses := make([]QuotaClassStatus, 0, len(classes))
+	for _, class := range classes {
+		status := QuotaClassStatus{
+			Class: class,
+			Quota: p.Quota[class],
+			TopUp: p.QuotaTopUp[class],
+			Used:  p.QuotaUsed[class],
+		}
+		limit := status.Quota + status.TopUp
+		status.Exceeded = status.Used >= limit
+		if !status.Exceeded {
+			status.Remaining = limit - status.Used
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// QuotaCycleExpired reports whether counters belong to a cycle before the one containing now
+func (p *PlanSettings) QuotaCycleExpired(now time.Time) bool {
+	if p.QuotaCycleStart == "" {
+		return false
+	}
+	start, err := time.ParseInLocation(planDateLayout, p.QuotaCycleStart, now.Location())
+	if err != nil {
+		return true
+	}
+	return start.Before(QuotaCycleStart(now, p.QuotaResetDay))
+}
+
+// QuotaCycleStart returns the start of the monthly cycle containing now
+// Cycles start on resetDay (1 when not set) of each month at local midnight.
+func QuotaCycleStart(now time.Time, resetDay int) time.Time {
+	if resetDay < 1 {
+		resetDay = 1
+	}
+	start := time.Date(now.Year(), now.Month(), resetDay, 0, 0, 0, 0, now.Location())
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// ResetQuotaCycle returns a copy of plan data with counters and top-ups of a new cycle
+func ResetQuotaCycle(planData map[string]interface{}, now time.Time, resetDay int) map[string]interface{} {
+	result := copyPlanData(planData)
+	result[QuotaUsedKey] = map[string]interface{}{}
+	delete(result, QuotaTopUpKey)
+	result[QuotaCycleStartKey] = QuotaCycleStart(now, resetDay).Format(planDateLayout)
+	return result
+}
+
+// AddQuotaVolume returns a copy of plan data with bytes added to class of QUOTA_USED or QUOTA_TOPUP
+func AddQuotaVolume(planData map[string]interface{}, key, class string, bytes float64) map[string]interface{} {
+	result := copyPlanData(planData)
+
+	volumes := make(map[string]interface{})
+	if current, ok := planData[key].(map[string]interface{}); ok {
+		for k, v := range current {
+			volumes[k] = v
+		}
+	}
+
+	var value float64
+	switch n := volumes[class].(type) {
+	case float64:
+		value = n
+	case int:
+		value = float64(n)
+	}
+	volumes[class] = value + bytes
+	result[key] = volumes
+
+	return result
+}
+
+func copyPlanData(planData map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(planData)+2)
+	for k, v := range planData {
+		result[k] = v
+	}
+	return result
+}
+
+func parseVolumes(v interface{}, path string, errs *PlanDataErrors) map[string]float64 {
+	volumes := make(map[string]float64)
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		errs.add(path, "expected object {class: bytes}, got %s", jsonType(v))
+		return volumes
+	}
+
+	for class, value := range m {
+		if class == "" {
+			errs.add(path, "class name must not be empty")
+			continue
+		}
+		volumes[class] = errs.nonNegative(value, fmt.Sprintf("%s.%s", path, class))
+	}
+	return volumes
+}
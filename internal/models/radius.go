@@ -41,10 +41,13 @@ type RADIUSAccountingRequest struct {
 
 // BillingResult represents billing decision result
 type BillingResult struct {
-	Decision     string                 `json:"decision"`      // Accept/Reject
-	Reason       string                 `json:"reason"`        // Rejection reason
-	Amount       float64                `json:"amount"`        // Amount to charge
-	Replies      []RADIUSReply          `json:"replies"`       // RADIUS replies
-	PlanData     map[string]interface{} `json:"plan_data"`     // Updated plan data
-	TrafficClass string                 `json:"traffic_class"` // Traffic classification
+	Decision     string                 `json:"decision"`          // Accept/Reject
+	Reason       string                 `json:"reason"`            // Rejection reason
+	Amount       Money                  `json:"amount"`            // Amount to charge
+	Currency     int                    `json:"currency"`          // Currency of Amount, 0 - contract currency
+	Replies      []RADIUSReply          `json:"replies"`           // RADIUS replies
+	PlanData     map[string]interface{} `json:"plan_data"`         // Updated plan data
+	TrafficClass string                 `json:"traffic_class"`     // Traffic classification
+	Shaper       string                 `json:"shaper,omitempty"`  // Shaper to apply to the running session (FUP)
+	Seconds      int64                  `json:"seconds,omitempty"` // Online seconds paid so far (time billing)
 }
@@ -48,9 +48,10 @@ type IPTrafficSession struct {
 	DBSessionID int64 `json:"db_session_id" redis:"db_session_id"`
 
 	// Billing data
-	Amount      float64 `json:"amount" redis:"amount"`             // Total amount charged
-	LastSync    int64   `json:"last_sync" redis:"last_sync"`       // Last sync to DB
-	LastTraffic int64   `json:"last_traffic" redis:"last_traffic"` // Last traffic update
+	Amount      Money `json:"amount" redis:"amount"`             // Total amount charged
+	LastSync    int64 `json:"last_sync" redis:"last_sync"`       // Last sync to DB
+	LastTraffic int64 `json:"last_traffic" redis:"last_traffic"` // Last traffic update
+	BilledTime  int64 `json:"billed_time" redis:"billed_time"`   // Online seconds paid (time billing)
 
 	// Session timeout management (like in Erlang)
 	TimeoutRef    string `json:"timeout_ref" redis:"timeout_ref"`       // Timer reference
@@ -60,7 +61,7 @@ type IPTrafficSession struct {
 	PlanID   int                    `json:"plan_id" redis:"plan_id"`
 	PlanData map[string]interface{} `json:"plan_data" redis:"plan_data"`
 	Currency int                    `json:"currency" redis:"currency"`
-	Balance  float64                `json:"balance" redis:"balance"`
+	Balance  Money                  `json:"balance" redis:"balance"`
 	AuthAlgo string                 `json:"auth_algo" redis:"auth_algo"`
 	AcctAlgo string                 `json:"acct_algo" redis:"acct_algo"`
 
@@ -71,12 +72,12 @@ type IPTrafficSession struct {
 // TrafficClassDetail represents traffic details for a specific class
 // Equivalent to session_details table record
 type TrafficClassDetail struct {
-	Class      string  `json:"class"`
-	InOctets   uint64  `json:"in_octets"`
-	OutOctets  uint64  `json:"out_octets"`
-	InPackets  uint64  `json:"in_packets"`
-	OutPackets uint64  `json:"out_packets"`
-	Amount     float64 `json:"amount"`
+	Class      string `json:"class"`
+	InOctets   uint64 `json:"in_octets"`
+	OutOctets  uint64 `json:"out_octets"`
+	InPackets  uint64 `json:"in_packets"`
+	OutPackets uint64 `json:"out_packets"`
+	Amount     Money  `json:"amount"`
 }
 
 // SessionContext represents session initialization context
@@ -88,7 +89,7 @@ type SessionContext struct {
 	PlanID    int                    `json:"plan_id"`
 	PlanData  map[string]interface{} `json:"plan_data"`
 	Currency  int                    `json:"currency"`
-	Balance   float64                `json:"balance"`
+	Balance   Money                  `json:"balance"`
 	AuthAlgo  string                 `json:"auth_algo"`
 	AcctAlgo  string                 `json:"acct_algo"`
 	Replies   []RADIUSReply          `json:"replies"`
@@ -134,6 +135,13 @@ func (s *IPTrafficSession) Prepare(ctx *SessionContext) error {
 	s.AcctAlgo = ctx.AcctAlgo
 	s.NASSpec = ctx.NASSpec
 
+	// Remember the shaper sent in Access-Accept so it can be changed by CoA
+	for _, reply := range ctx.Replies {
+		if reply.Name == "Netspire-Shapers" {
+			s.Shaper = reply.Value
+		}
+	}
+
 	// Set context data for billing algorithms
 	s.Data["account_id"] = ctx.AccountID
 	s.Data["plan_id"] = ctx.PlanID
@@ -205,7 +213,7 @@ func (s *IPTrafficSession) UpdateTraffic(direction string, octets, packets uint6
 }
 
 // UpdateTrafficByClass updates traffic counters for specific class
-func (s *IPTrafficSession) UpdateTrafficByClass(class, direction string, octets, packets uint64, amount float64) {
+func (s *IPTrafficSession) UpdateTrafficByClass(class, direction string, octets, packets uint64, amount Money) {
 	if s.TrafficDetails == nil {
 		s.TrafficDetails = make(map[string]*TrafficClassDetail)
 	}
@@ -227,13 +235,32 @@ func (s *IPTrafficSession) UpdateTrafficByClass(class, direction string, octets,
 		detail.OutPackets += packets
 	}
 
-	detail.Amount += amount
-	s.Amount += amount
+	detail.Amount = detail.Amount.Add(amount)
+	s.Amount = s.Amount.Add(amount)
 
 	// Update total counters
 	s.UpdateTraffic(direction, octets, packets)
 }
 
+// AddCharge adds a charge not tied to traffic volume, like online time, under class
+func (s *IPTrafficSession) AddCharge(class string, amount Money) {
+	if s.TrafficDetails == nil {
+		s.TrafficDetails = make(map[string]*TrafficClassDetail)
+	}
+
+	detail, exists := s.TrafficDetails[class]
+	if !exists {
+		detail = &TrafficClassDetail{
+			Class: class,
+		}
+		s.TrafficDetails[class] = detail
+	}
+
+	detail.Amount = detail.Amount.Add(amount)
+	s.Amount = s.Amount.Add(amount)
+	s.LastTraffic = time.Now().Unix()
+}
+
 // SetShaper updates current shaper
 func (s *IPTrafficSession) SetShaper(shaper string) {
 	s.Shaper = shaper
@@ -276,7 +303,7 @@ func (s *IPTrafficSession) NeedsSync() bool {
 	}
 
 	// Sync if amount has changed significantly
-	if s.Amount > 0 {
+	if s.Amount.Sign() > 0 {
 		return true
 	}
 
@@ -312,6 +339,7 @@ func (s *IPTrafficSession) ToRedisHash() map[string]interface{} {
 	hash["amount"] = s.Amount
 	hash["last_sync"] = s.LastSync
 	hash["last_traffic"] = s.LastTraffic
+	hash["billed_time"] = s.BilledTime
 	hash["timeout_ref"] = s.TimeoutRef
 	hash["session_expiry"] = s.SessionExpiry
 	hash["plan_id"] = s.PlanID
@@ -398,6 +426,12 @@ func (s *IPTrafficSession) FromRedisHash(hash map[string]string) error {
 		}
 	}
 
+	if val := hash["billed_time"]; val != "" {
+		if parsed, err := parseint64(val); err == nil {
+			s.BilledTime = parsed
+		}
+	}
+
 	if val := hash["session_expiry"]; val != "" {
 		if parsed, err := parseint64(val); err == nil {
 			s.SessionExpiry = parsed
@@ -417,13 +451,13 @@ func (s *IPTrafficSession) FromRedisHash(hash map[string]string) error {
 	}
 
 	if val := hash["amount"]; val != "" {
-		if parsed, err := parsefloat64(val); err == nil {
+		if parsed, err := ParseMoney(val); err == nil {
 			s.Amount = parsed
 		}
 	}
 
 	if val := hash["balance"]; val != "" {
-		if parsed, err := parsefloat64(val); err == nil {
+		if parsed, err := ParseMoney(val); err == nil {
 			s.Balance = parsed
 		}
 	}
@@ -500,9 +534,3 @@ func parseuint64(s string) (uint64, error) {
 	_, err := fmt.Sscanf(s, "%d", &result)
 	return result, err
 }
-
-func parsefloat64(s string) (float64, error) {
-	var result float64
-	_, err := fmt.Sscanf(s, "%f", &result)
-	return result, err
-}
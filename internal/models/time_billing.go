@@ -0,0 +1,187 @@
+package models
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Online time keys of plan_data
+// TIME_INTERVALS holds prices per hour online with the same until_second boundaries
+// as ACCESS_INTERVALS and INTERVALS. Time is billed in TIME_INCREMENT steps, at least
+// TIME_MINIMUM seconds per session; TIME_DAY_CAP limits the charge per calendar day
+// (a day pass), counted in TIME_DAY / TIME_DAY_CHARGED.
+const (
+	TimeDayKey        = "TIME_DAY"
+	TimeDayChargedKey = "TIME_DAY_CHARGED"
+)
+
+// TimeInterval is one TIME_INTERVALS entry, valid until Until seconds of day
+type TimeInterval struct {
+	Until        int
+	PricePerHour Money
+}
+
+// HasTimePrices reports whether the plan charges online time
+func (p *PlanSettings) HasTimePrices() bool {
+	return len(p.TimeIntervals) > 0
+}
+
+// TimePrice returns the price per hour at the given second of day and the second its interval ends
+// Past the last interval online time is free until midnight.
+func (p *PlanSettings) TimePrice(secondOfDay int) (Money, int) {
+	for _, interval := range p.TimeIntervals {
+		if secondOfDay < interval.Until {
+			return interval.PricePerHour, interval.Until
+		}
+	}
+	return Money{}, secondsPerDay
+}
+
+// BillableSeconds rounds online seconds up to whole TIME_INCREMENTs, but not below TIME_MINIMUM
+func (p *PlanSettings) BillableSeconds(online int64) int64 {
+	if online <= 0 {
+		return 0
+	}
+
+	billable := online
+	if increment := int64(p.TimeIncrement); increment > 1 {
+		billable = (online + increment - 1) / increment * increment
+	}
+	if minimum := int64(p.TimeMinimum); billable < minimum {
+		billable = minimum
+	}
+	return billable
+}
+
+// TimeCharge returns the charge for online time between from and to
+// Time is split at interval boundaries and midnight; every day is capped by TIME_DAY_CAP.
+// The returned day and charged amount are the new TIME_DAY / TIME_DAY_CHARGED.
+func (p *PlanSettings) TimeCharge(from, to time.Time) (Money, string, Money) {
+	var total Money
+	day, charged := p.TimeDay, p.TimeDayCharged
+
+	p.walkTime(from, to, func(d string, price Money, seconds int64) bool {
+		if d != day {
+			day, charged = d, Money{}
+		}
+		cost := p.capCost(price.MulDiv(uint64(seconds), 3600), charged)
+		charged = charged.Add(cost)
+		total = total.Add(cost)
+		return true
+	})
+
+	return total, day, charged
+}
+
+// AffordableSeconds returns how long budget pays for online time starting at now, at most limit
+// The result is whole TIME_INCREMENTs and 0 when the budget does not cover TIME_MINIMUM.
+func (p *PlanSettings) AffordableSeconds(now time.Time, budget Money, limit int64) int64 {
+	if budget.Sign() < 0 {
+		budget = Money{}
+	}
+
+	var affordable int64
+	day, charged := p.TimeDay, p.TimeDayCharged
+
+	p.walkTime(now, now.Add(time.Duration(limit)*time.Second), func(d string, price Money, seconds int64) bool {
+		if d != day {
+			day, charged = d, Money{}
+		}
+		cost := p.capCost(price.MulDiv(uint64(seconds), 3600), charged)
+		if cost.Cmp(budget) <= 0 {
+			budget = budget.Sub(cost)
+			charged = charged.Add(cost)
+			affordable += seconds
+			return true
+		}
+
+		// The budget runs out inside this interval
+		paid := new(big.Int).Mul(budget.int(), big.NewInt(3600))
+		affordable += paid.Quo(paid, price.int()).Int64()
+		return false
+	})
+
+	if affordable > limit {
+		affordable = limit
+	}
+	if increment := int64(p.TimeIncrement); increment > 1 {
+		affordable = affordable / increment * increment
+	}
+	if affordable < int64(p.TimeMinimum) {
+		return 0
+	}
+	return affordable
+}
+
+// SetTimeDayCharged returns a copy of plan data with the daily cap counter
+// The counter is kept as a decimal string so that it does not drift through float rounding.
+func SetTimeDayCharged(planData map[string]interface{}, day string, charged Money) map[string]interface{} {
+	result := copyPlanData(planData)
+	result[TimeDayKey] = day
+	result[TimeDayChargedKey] = charged.String()
+	return result
+}
+
+// capCost limits cost so that the day total does not exceed TIME_DAY_CAP
+func (p *PlanSettings) capCost(cost, charged Money) Money {
+	if p.TimeDayCap.IsZero() {
+		return cost
+	}
+	left := p.TimeDayCap.Sub(charged)
+	if left.Sign() <= 0 {
+		return Money{}
+	}
+	if cost.Cmp(left) > 0 {
+		return left
+	}
+	return cost
+}
+
+// walkTime calls fn for every stretch of [from, to) with a single hourly price, until fn returns false
+func (p *PlanSettings) walkTime(from, to time.Time, fn func(day string, price Money, seconds int64) bool) {
+	for t := from.In(p.Location()); t.Before(to); {
+		price, until := p.TimePrice(p.SecondOfDay(t))
+
+		end := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, until, 0, t.Location())
+		if !end.After(t) {
+			end = t.Add(time.Hour) // Repeated wall clock hour at DST change
+		}
+		if end.After(to) {
+			end = to
+		}
+
+		if !fn(t.Format(planDateLayout), price, int64(end.Sub(t)/time.Second)) {
+			return
+		}
+		t = end
+	}
+}
+
+func parseTimeIntervals(v interface{}, path string, errs *PlanDataErrors) []TimeInterval {
+	list, ok := v.([]interface{})
+	if !ok {
+		errs.add(path, "expected array, got %s", jsonType(v))
+		return nil
+	}
+
+	intervals := make([]TimeInterval, 0, len(list))
+	prev := 0
+	for i, item := range list {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		entry, ok := item.([]interface{})
+		if !ok || len(entry) != 2 {
+			errs.add(itemPath, "expected [until_second, price_per_hour]")
+			continue
+		}
+
+		interval := TimeInterval{
+			Until:        errs.boundary(entry[0], itemPath+"[0]", prev),
+			PricePerHour: errs.nonNegativeMoney(entry[1], itemPath+"[1]"),
+		}
+		prev = interval.Until
+		intervals = append(intervals, interval)
+	}
+
+	return intervals
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"crypto/des"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/md4"
+)
+
+// RFC 2759 / RFC 3079 constants
+var (
+	authMagic1 = []byte("Magic server to client signing constant")
+	authMagic2 = []byte("Pad to make it do more than one iteration")
+
+	mppeMasterMagic = []byte("This is the MPPE Master Key")
+	mppeSendMagic   = []byte("On the client side, this is the receive key; on the server side, it is the send key.")
+	mppeRecvMagic   = []byte("On the client side, this is the send key; on the server side, it is the receive key.")
+)
+
+// verifyCHAP checks CHAP-Password (ident + 16 byte MD5 response) against the cleartext password
+func verifyCHAP(chapPassword, challenge []byte, password string) (bool, error) {
+	if len(chapPassword) != 17 {
+		return false, fmt.Errorf("invalid CHAP-Password length %d", len(chapPassword))
+	}
+	if len(challenge) == 0 {
+		return false, fmt.Errorf("CHAP-Challenge is missing")
+	}
+
+	h := md5.New()
+	h.Write(chapPassword[:1])
+	h.Write([]byte(password))
+	h.Write(challenge)
+
+	return subtle.ConstantTimeCompare(h.Sum(nil), chapPassword[1:]) == 1, nil
+}
+
+// mschapv2Result holds reply values of a successful MS-CHAPv2 exchange
+type mschapv2Result struct {
+	Ident                 byte
+	AuthenticatorResponse string // "S=<40 hex digits>"
+	SendKey               []byte // MS-MPPE-Send-Key (server side)
+	RecvKey               []byte // MS-MPPE-Recv-Key (server side)
+}
+
+// verifyMSCHAPv2 checks MS-CHAP2-Response against the NT-hash of the password
+// response layout: Ident(1) Flags(1) Peer-Challenge(16) Reserved(8) NT-Response(24)
+func verifyMSCHAPv2(userName string, authChallenge, response, passwordHash []byte) (*mschapv2Result, error) {
+	if len(authChallenge) != 16 {
+		return nil, fmt.Errorf("invalid MS-CHAP-Challenge length %d", len(authChallenge))
+	}
+	if len(response) != 50 {
+		return nil, fmt.Errorf("invalid MS-CHAP2-Response length %d", len(response))
+	}
+
+	ident := response[0]
+	peerChallenge := response[2:18]
+	ntResponse := response[26:50]
+
+	// The user name used in the hash has no domain part (DOMAIN\user)
+	if i := strings.LastIndex(userName, "\\"); i >= 0 {
+		userName = userName[i+1:]
+	}
+
+	challenge := challengeHash(peerChallenge, authChallenge, userName)
+	expected, err := challengeResponse(challenge, passwordHash)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(expected, ntResponse) != 1 {
+		return nil, nil
+	}
+
+	passwordHashHash := md4Sum(passwordHash)
+
+	digest := sha1Sum(passwordHashHash, ntResponse, authMagic1)
+	digest = sha1Sum(digest, challenge, authMagic2)
+
+	masterKey := sha1Sum(passwordHashHash, ntResponse, mppeMasterMagic)[:16]
+
+	return &mschapv2Result{
+		Ident:                 ident,
+		AuthenticatorResponse: fmt.Sprintf("S=%X", digest),
+		SendKey:               asymmetricStartKey(masterKey, mppeSendMagic),
+		RecvKey:               asymmetricStartKey(masterKey, mppeRecvMagic),
+	}, nil
+}
+
+// challengeHash is ChallengeHash() from RFC 2759
+func challengeHash(peerChallenge, authChallenge []byte, userName string) []byte {
+	return sha1Sum(peerChallenge, authChallenge, []byte(userName))[:8]
+}
+
+// challengeResponse is ChallengeResponse() from RFC 2759: three DES blocks keyed by the padded hash
+func challengeResponse(challenge, passwordHash []byte) ([]byte, error) {
+	padded := make([]byte, 21)
+	copy(padded, passwordHash)
+
+	response := make([]byte, 24)
+	for i := 0; i < 3; i++ {
+		block, err := des.NewCipher(desKey(padded[i*7 : i*7+7]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create DES cipher: %w", err)
+		}
+		block.Encrypt(response[i*8:i*8+8], challenge)
+	}
+
+	return response, nil
+}
+
+// desKey expands 7 key bytes into an 8 byte DES key (parity bits left zero)
+func desKey(b []byte) []byte {
+	return []byte{
+		b[0] & 0xFE,
+		(b[0]<<7 | b[1]>>1) & 0xFE,
+		(b[1]<<6 | b[2]>>2) & 0xFE,
+		(b[2]<<5 | b[3]>>3) & 0xFE,
+		(b[3]<<4 | b[4]>>4) & 0xFE,
+		(b[4]<<3 | b[5]>>5) & 0xFE,
+		(b[5]<<2 | b[6]>>6) & 0xFE,
+		b[6] << 1,
+	}
+}
+
+// asymmetricStartKey is GetAsymmetricStartKey() from RFC 3079 for 128-bit keys
+func asymmetricStartKey(masterKey, magic []byte) []byte {
+	pad1 := make([]byte, 40)
+	pad2 := make([]byte, 40)
+	for i := range pad2 {
+		pad2[i] = 0xF2
+	}
+	return sha1Sum(masterKey, pad1, magic, pad2)[:16]
+}
+
+func md4Sum(data []byte) []byte {
+	h := md4.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func sha1Sum(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/md4"
+)
+
+// Password storage schemes of accounts.password
+const (
+	SchemeCleartext = "cleartext" // Plain password (legacy, optionally prefixed with {CLEAR})
+	SchemeNTHash    = "nthash"    // {NT}<32 hex digits> - MD4 of UTF-16LE password
+	SchemeBcrypt    = "bcrypt"    // $2a$ / $2b$ / $2y$ modular crypt format
+)
+
+const (
+	prefixCleartext = "{CLEAR}"
+	prefixNTHash    = "{NT}"
+)
+
+// ErrUnsupportedScheme is returned when the stored scheme cannot serve the auth method
+// (e.g. CHAP needs the cleartext password, MS-CHAPv2 needs cleartext or NT-hash).
+var ErrUnsupportedScheme = errors.New("password storage scheme does not support this auth method")
+
+// StoredPassword is a parsed accounts.password value
+type StoredPassword struct {
+	Scheme string
+	Value  string // Cleartext password, hex NT-hash or bcrypt hash
+}
+
+// ParseStoredPassword detects the storage scheme of accounts.password
+func ParseStoredPassword(stored string) StoredPassword {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return StoredPassword{Scheme: SchemeBcrypt, Value: stored}
+	case strings.HasPrefix(strings.ToUpper(stored), prefixNTHash):
+		return StoredPassword{Scheme: SchemeNTHash, Value: strings.ToLower(stored[len(prefixNTHash):])}
+	case strings.HasPrefix(strings.ToUpper(stored), prefixCleartext):
+		return StoredPassword{Scheme: SchemeCleartext, Value: stored[len(prefixCleartext):]}
+	default:
+		return StoredPassword{Scheme: SchemeCleartext, Value: stored}
+	}
+}
+
+// HashPassword encodes a cleartext password for storage in accounts.password
+func HashPassword(scheme, password string) (string, error) {
+	switch scheme {
+	case SchemeCleartext:
+		return password, nil
+	case SchemeNTHash:
+		return prefixNTHash + hex.EncodeToString(NTHash(password)), nil
+	case SchemeBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %w", err)
+		}
+		return string(hash), nil
+	default:
+		return "", fmt.Errorf("unknown password scheme: %s", scheme)
+	}
+}
+
+// NTHash returns MD4 of the UTF-16LE encoded password (RFC 2759 NtPasswordHash)
+func NTHash(password string) []byte {
+	units := utf16.Encode([]rune(password))
+	buf := make([]byte, 0, len(units)*2)
+	for _, u := range units {
+		buf = append(buf, byte(u), byte(u>>8))
+	}
+
+	h := md4.New()
+	h.Write(buf)
+	return h.Sum(nil)
+}
+
+// VerifyPlain checks a cleartext password (PAP) against the stored value
+func (p StoredPassword) VerifyPlain(password string) bool {
+	switch p.Scheme {
+	case SchemeBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(p.Value), []byte(password)) == nil
+	case SchemeNTHash:
+		stored, err := hex.DecodeString(p.Value)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare(stored, NTHash(password)) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(p.Value), []byte(password)) == 1
+	}
+}
+
+// NTHash returns the NT-hash of the stored password, if the scheme allows it
+func (p StoredPassword) NTHash() ([]byte, error) {
+	switch p.Scheme {
+	case SchemeCleartext:
+		return NTHash(p.Value), nil
+	case SchemeNTHash:
+		hash, err := hex.DecodeString(p.Value)
+		if err != nil || len(hash) != 16 {
+			return nil, fmt.Errorf("invalid stored NT-hash")
+		}
+		return hash, nil
+	default:
+		return nil, ErrUnsupportedScheme
+	}
+}
+
+// ControlAttributes returns the "known good" password attribute for FreeRADIUS
+// so it can still verify credentials itself when passwords are hashed.
+func (p StoredPassword) ControlAttributes() map[string]string {
+	switch p.Scheme {
+	case SchemeNTHash:
+		return map[string]string{"NT-Password": "0x" + p.Value}
+	case SchemeBcrypt:
+		return map[string]string{"Crypt-Password": p.Value}
+	default:
+		return map[string]string{"Cleartext-Password": p.Value}
+	}
+}
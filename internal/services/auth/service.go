@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Credential check modes
+const (
+	// ModeFreeRADIUS returns the known good password to FreeRADIUS, which verifies it itself
+	ModeFreeRADIUS = "freeradius"
+	// ModeVerify verifies PAP / CHAP / MS-CHAPv2 in the billing service
+	ModeVerify = "verify"
+)
+
+// Auth methods
+const (
+	MethodPAP      = "PAP"
+	MethodCHAP     = "CHAP"
+	MethodMSCHAPv2 = "MS-CHAP-v2"
+)
+
+// ErrInvalidCredentials is returned when the password does not match
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrMissingCredentials is returned when the request carries no supported credentials
+var ErrMissingCredentials = errors.New("no supported credentials in request")
+
+// Service verifies user credentials against accounts.password
+type Service struct {
+	logger *zap.Logger
+	config Config
+}
+
+// Config holds credential verification settings
+type Config struct {
+	Mode string `yaml:"mode"` // freeradius or verify
+}
+
+// Credentials are the authentication attributes of an Access-Request
+// Binary attributes (CHAP-Password, MS-CHAP2-Response, ...) are hex encoded, optionally with 0x prefix
+// as FreeRADIUS rest module sends them.
+type Credentials struct {
+	Username   string
+	Password   string // User-Password (PAP)
+	AuthType   string
+	Attributes map[string]string
+}
+
+// Result describes a successful verification
+type Result struct {
+	Method  string
+	Replies map[string]string // Reply attributes (MS-CHAP2-Success, MS-MPPE keys)
+}
+
+// New creates a new credential verification service
+func New(logger *zap.Logger, config Config) *Service {
+	if config.Mode == "" {
+		config.Mode = ModeFreeRADIUS
+	}
+
+	return &Service{
+		logger: logger,
+		config: config,
+	}
+}
+
+// VerifyEnabled reports whether the billing service verifies credentials itself
+func (s *Service) VerifyEnabled() bool {
+	return s.config.Mode == ModeVerify
+}
+
+// ControlAttributes returns the known good password for FreeRADIUS mode
+func (s *Service) ControlAttributes(storedPassword string) map[string]string {
+	return ParseStoredPassword(storedPassword).ControlAttributes()
+}
+
+// Verify checks credentials against the stored password
+// The method is detected from the attributes: MS-CHAPv2, then CHAP, then PAP.
+// For EAP-MSCHAPv2 FreeRADIUS eap module unwraps the inner MS-CHAPv2 attributes.
+func (s *Service) Verify(cred Credentials, storedPassword string) (*Result, error) {
+	stored := ParseStoredPassword(storedPassword)
+
+	if response, ok := cred.Attributes["MS-CHAP2-Response"]; ok {
+		return s.verifyMSCHAPv2(cred, stored, response)
+	}
+	if chapPassword, ok := cred.Attributes["CHAP-Password"]; ok {
+		return s.verifyCHAP(cred, stored, chapPassword)
+	}
+	if cred.Password != "" {
+		if !stored.VerifyPlain(cred.Password) {
+			return nil, ErrInvalidCredentials
+		}
+		return &Result{Method: MethodPAP, Replies: map[string]string{}}, nil
+	}
+
+	return nil, ErrMissingCredentials
+}
+
+func (s *Service) verifyCHAP(cred Credentials, stored StoredPassword, chapPassword string) (*Result, error) {
+	if stored.Scheme != SchemeCleartext {
+		return nil, fmt.Errorf("CHAP: %w (%s)", ErrUnsupportedScheme, stored.Scheme)
+	}
+
+	response, err := decodeOctets(chapPassword)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CHAP-Password: %w", err)
+	}
+	challenge, err := decodeOctets(cred.Attributes["CHAP-Challenge"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid CHAP-Challenge: %w", err)
+	}
+
+	ok, err := verifyCHAP(response, challenge, stored.Value)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Result{Method: MethodCHAP, Replies: map[string]string{}}, nil
+}
+
+func (s *Service) verifyMSCHAPv2(cred Credentials, stored StoredPassword, responseAttr string) (*Result, error) {
+	passwordHash, err := stored.NTHash()
+	if err != nil {
+		return nil, fmt.Errorf("MS-CHAPv2: %w", err)
+	}
+
+	response, err := decodeOctets(responseAttr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MS-CHAP2-Response: %w", err)
+	}
+	challenge, err := decodeOctets(cred.Attributes["MS-CHAP-Challenge"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid MS-CHAP-Challenge: %w", err)
+	}
+
+	userName := cred.Username
+	if v, ok := cred.Attributes["MS-CHAP-User-Name"]; ok && v != "" {
+		userName = v
+	}
+
+	result, err := verifyMSCHAPv2(userName, challenge, response, passwordHash)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	success := append([]byte{result.Ident}, []byte(result.AuthenticatorResponse)...)
+
+	return &Result{
+		Method: MethodMSCHAPv2,
+		Replies: map[string]string{
+			"MS-CHAP2-Success": "0x" + hex.EncodeToString(success),
+			"MS-MPPE-Send-Key": "0x" + hex.EncodeToString(result.SendKey),
+			"MS-MPPE-Recv-Key": "0x" + hex.EncodeToString(result.RecvKey),
+			// Allow 128-bit MPPE like FreeRADIUS mschap defaults
+			"MS-MPPE-Encryption-Policy": "Encryption-Allowed",
+			"MS-MPPE-Encryption-Types":  "RC4-128bit-Allowed",
+		},
+	}, nil
+}
+
+// decodeOctets decodes a hex attribute value with optional 0x prefix
+func decodeOctets(value string) ([]byte, error) {
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+	return hex.DecodeString(value)
+}
@@ -1,8 +1,6 @@
 package billing
 
 import (
-	"encoding/json"
-	"fmt"
 	"log"
 	"net"
 	"strconv"
@@ -12,8 +10,9 @@ import (
 )
 
 // BillingAlgorithm interface for all billing algorithms
+// Implementations are registered by name with RegisterAlgorithm.
 type BillingAlgorithm interface {
-	Authorize(currency int, balance float64, planData map[string]interface{}) (*models.BillingResult, error)
+	Authorize(currency int, balance models.Money, planData map[string]interface{}) (*models.BillingResult, error)
 	Account(currency int, planData map[string]interface{}, sessionData map[string]interface{}, direction string, targetIP string, octets uint64) (*models.BillingResult, error)
 }
 
@@ -24,16 +23,16 @@ func NewPrepaidAlgorithm() *PrepaidAlgorithm {
 	return &PrepaidAlgorithm{}
 }
 
-func (a *PrepaidAlgorithm) Authorize(currency int, balance float64, planData map[string]interface{}) (*models.BillingResult, error) {
-	// Get credit from plan data
-	credit := getFloatFromPlanData(planData, "CREDIT", 0.0)
-
-	// Get default shaper
-	defaultShaper := getStringFromPlanData(planData, "SHAPER", "")
+func (a *PrepaidAlgorithm) Authorize(currency int, balance models.Money, planData map[string]interface{}) (*models.BillingResult, error) {
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return nil, err
+	}
 
 	// Check access intervals
-	accessResult := checkAccessIntervals(planData, defaultShaper)
-	if accessResult.Decision != "accept" {
+	now := time.Now()
+	accept, shaper := settings.CheckAccessAt(now)
+	if !accept {
 		return &models.BillingResult{
 			Decision: "reject",
 			Reason:   "time_of_day",
@@ -41,18 +40,10 @@ func (a *PrepaidAlgorithm) Authorize(currency int, balance float64, planData map
 	}
 
 	// Check balance + credit
-	if balance+credit >= 0 {
-		replies := []models.RADIUSReply{}
-		if accessResult.Shaper != "" {
-			replies = append(replies, models.RADIUSReply{
-				Name:  "Netspire-Shapers",
-				Value: accessResult.Shaper,
-			})
-		}
-
+	if balance.Add(settings.Credit).Sign() >= 0 {
 		return &models.BillingResult{
 			Decision: "accept",
-			Replies:  replies,
+			Replies:  append(shaperReplies(shaper), limitReplies(settings, now, currency, balance)...),
 		}, nil
 	}
 
@@ -63,133 +54,31 @@ func (a *PrepaidAlgorithm) Authorize(currency int, balance float64, planData map
 }
 
 func (a *PrepaidAlgorithm) Account(currency int, planData map[string]interface{}, sessionData map[string]interface{}, direction string, targetIP string, octets uint64) (*models.BillingResult, error) {
-	// Full prepaid accounting implementation like in Erlang
-	now := time.Now()
-	todaySeconds := now.Hour()*3600 + now.Minute()*60 + now.Second()
-
-	// Get intervals from plan data
-	intervals, ok := planData["INTERVALS"].([]interface{})
-	if !ok || len(intervals) == 0 {
-		// No intervals defined, free traffic
-		class := classifyTraffic(targetIP)
-		return &models.BillingResult{
-			Decision:     "accept",
-			Amount:       0.0,
-			TrafficClass: class,
-			PlanData:     planData,
-		}, nil
-	}
-
-	// Find current interval
-	var currentPrices map[string]interface{}
-	for _, interval := range intervals {
-		intervalData, ok := interval.([]interface{})
-		if !ok || len(intervalData) < 2 {
-			continue
-		}
-
-		boundary, ok := intervalData[0].(float64)
-		if !ok {
-			continue
-		}
-
-		if float64(todaySeconds) < boundary {
-			prices, ok := intervalData[1].(map[string]interface{})
-			if ok {
-				currentPrices = prices
-				break
-			}
-		}
-	}
-
-	if currentPrices == nil {
-		// No applicable interval found
-		class := classifyTraffic(targetIP)
-		return &models.BillingResult{
-			Decision:     "accept",
-			Amount:       0.0,
-			TrafficClass: class,
-			PlanData:     planData,
-		}, nil
-	}
-
-	// Classify traffic
-	class := classifyTraffic(targetIP)
-
-	// Get class prices
-	classPrices, ok := currentPrices[class]
-	if !ok {
-		// No prices for this class
-		return &models.BillingResult{
-			Decision:     "accept",
-			Amount:       0.0,
-			TrafficClass: class,
-			PlanData:     planData,
-		}, nil
-	}
-
-	// Extract prices for currency
-	var inPrice, outPrice float64
-	switch prices := classPrices.(type) {
-	case []interface{}:
-		// [[currency, in_price, out_price], ...] format
-		for _, priceData := range prices {
-			priceArray, ok := priceData.([]interface{})
-			if !ok || len(priceArray) < 3 {
-				continue
-			}
-
-			curr, ok := priceArray[0].(float64)
-			if !ok || int(curr) != currency {
-				continue
-			}
-
-			if in, ok := priceArray[1].(float64); ok {
-				inPrice = in
-			}
-			if out, ok := priceArray[2].(float64); ok {
-				outPrice = out
-			}
-			break
-		}
-	case map[string]interface{}:
-		// {in: price, out: price} format
-		if in, ok := prices["in"].(float64); ok {
-			inPrice = in
-		}
-		if out, ok := prices["out"].(float64); ok {
-			outPrice = out
-		}
-	}
-
-	// Get current price based on direction
-	var price float64
-	if direction == "in" {
-		price = inPrice
-	} else {
-		price = outPrice
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return nil, err
 	}
 
-	if price == 0 {
-		// Free traffic
+	// Classify traffic and find the price of the current interval
+	class := trafficClass(sessionData, targetIP)
+	price, priceCurrency, ok := settings.PriceAt(flowTime(sessionData), class, currency, direction)
+	if !ok || price.IsZero() {
+		// No interval or price for this class - free traffic
 		return &models.BillingResult{
 			Decision:     "accept",
-			Amount:       0.0,
 			TrafficClass: class,
 			PlanData:     planData,
 		}, nil
 	}
 
 	// Get prepaid counter
-	linkName := fmt.Sprintf("PREPAID_%s_%s", class, direction)
-	counterName := getStringFromPlanData(planData, linkName, "PREPAID")
-	prepaidBytes := getFloatFromPlanData(planData, counterName, 0.0)
+	counterName, prepaidBytes := settings.PrepaidCounter(class, direction)
 
 	// Calculate overlimit
 	payableOctets, remainingPrepaid := calculateOverlimit(octets, uint64(prepaidBytes))
 
-	// Calculate amount
-	amount := price * float64(payableOctets) / (1024 * 1024)
+	// Calculate amount: price is per MB, rounded once per portion of traffic
+	amount := price.MulDiv(payableOctets, 1024*1024)
 
 	// Update plan data if prepaid changed
 	newPlanData := make(map[string]interface{})
@@ -204,6 +93,7 @@ func (a *PrepaidAlgorithm) Account(currency int, planData map[string]interface{}
 	return &models.BillingResult{
 		Decision:     "accept",
 		Amount:       amount,
+		Currency:     priceCurrency,
 		TrafficClass: class,
 		PlanData:     newPlanData,
 	}, nil
@@ -216,44 +106,27 @@ func NewLimitedPrepaidAlgorithm() *LimitedPrepaidAlgorithm {
 	return &LimitedPrepaidAlgorithm{}
 }
 
-func (a *LimitedPrepaidAlgorithm) Authorize(currency int, balance float64, planData map[string]interface{}) (*models.BillingResult, error) {
-	// Get credit and prepaid from plan data
-	credit := getFloatFromPlanData(planData, "CREDIT", 0.0)
-	prepaid := getFloatFromPlanData(planData, "PREPAID", 0.0)
-
-	// Get default shaper
-	defaultShaper := getStringFromPlanData(planData, "SHAPER", "")
+func (a *LimitedPrepaidAlgorithm) Authorize(currency int, balance models.Money, planData map[string]interface{}) (*models.BillingResult, error) {
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return nil, err
+	}
 
 	// Check access intervals
-	accessResult := checkAccessIntervals(planData, defaultShaper)
-	if accessResult.Decision != "accept" {
+	now := time.Now()
+	accept, shaper := settings.CheckAccessAt(now)
+	if !accept {
 		return &models.BillingResult{
 			Decision: "reject",
 			Reason:   "time_of_day",
 		}, nil
 	}
 
-	// Check balance + credit
-	if balance+credit >= 0 {
-		// Also check prepaid
-		if prepaid > 0 {
-			replies := []models.RADIUSReply{}
-			if accessResult.Shaper != "" {
-				replies = append(replies, models.RADIUSReply{
-					Name:  "Netspire-Shapers",
-					Value: accessResult.Shaper,
-				})
-			}
-
-			return &models.BillingResult{
-				Decision: "accept",
-				Replies:  replies,
-			}, nil
-		}
-
+	// Check balance + credit and remaining prepaid
+	if balance.Add(settings.Credit).Sign() >= 0 && settings.Prepaid() > 0 {
 		return &models.BillingResult{
-			Decision: "reject",
-			Reason:   "low_balance",
+			Decision: "accept",
+			Replies:  append(shaperReplies(shaper), limitReplies(settings, now, currency, balance)...),
 		}, nil
 	}
 
@@ -276,39 +149,32 @@ func NewOnAuthAlgorithm() *OnAuthAlgorithm {
 	return &OnAuthAlgorithm{}
 }
 
-func (a *OnAuthAlgorithm) Authorize(currency int, balance float64, planData map[string]interface{}) (*models.BillingResult, error) {
-	// Get default shaper
-	defaultShaper := getStringFromPlanData(planData, "SHAPER", "")
+func (a *OnAuthAlgorithm) Authorize(currency int, balance models.Money, planData map[string]interface{}) (*models.BillingResult, error) {
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return nil, err
+	}
 
 	// Check access intervals
-	accessResult := checkAccessIntervals(planData, defaultShaper)
-	if accessResult.Decision != "accept" {
+	accept, shaper := settings.CheckAccessAt(time.Now())
+	if !accept {
 		return &models.BillingResult{
 			Decision: "reject",
 			Reason:   "time_of_day",
 		}, nil
 	}
 
-	replies := []models.RADIUSReply{}
-	if accessResult.Shaper != "" {
-		replies = append(replies, models.RADIUSReply{
-			Name:  "Netspire-Shapers",
-			Value: accessResult.Shaper,
-		})
-	}
-
 	return &models.BillingResult{
 		Decision: "accept",
-		Replies:  replies,
+		Replies:  shaperReplies(shaper),
 	}, nil
 }
 
 func (a *OnAuthAlgorithm) Account(currency int, planData map[string]interface{}, sessionData map[string]interface{}, direction string, targetIP string, octets uint64) (*models.BillingResult, error) {
 	// No charging for on_auth
-	class := classifyTraffic(targetIP)
+	class := trafficClass(sessionData, targetIP)
 	return &models.BillingResult{
 		Decision:     "accept",
-		Amount:       0.0,
 		TrafficClass: class,
 		PlanData:     planData,
 	}, nil
@@ -321,17 +187,15 @@ func NewNoOverlimitAlgorithm() *NoOverlimitAlgorithm {
 	return &NoOverlimitAlgorithm{}
 }
 
-func (a *NoOverlimitAlgorithm) Authorize(currency int, balance float64, planData map[string]interface{}) (*models.BillingResult, error) {
-	// Get credit from plan data
-	credit := getFloatFromPlanData(planData, "CREDIT", 0.0)
-
-	// Get default shaper and drop speed
-	defaultShaper := getStringFromPlanData(planData, "SHAPER", "")
-	dropSpeed := getFloatFromPlanData(planData, "DROP_SPEED", 0.0)
+func (a *NoOverlimitAlgorithm) Authorize(currency int, balance models.Money, planData map[string]interface{}) (*models.BillingResult, error) {
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return nil, err
+	}
 
 	// Check access intervals
-	accessResult := checkAccessIntervals(planData, defaultShaper)
-	if accessResult.Decision != "accept" {
+	accept, shaper := settings.CheckAccessAt(time.Now())
+	if !accept {
 		return &models.BillingResult{
 			Decision: "reject",
 			Reason:   "time_of_day",
@@ -339,30 +203,15 @@ func (a *NoOverlimitAlgorithm) Authorize(currency int, balance float64, planData
 	}
 
 	// Check balance + credit
-	if balance+credit >= 0 {
-		replies := []models.RADIUSReply{}
-
-		if dropSpeed == 1 {
-			// Use default shaper when dropped
-			if defaultShaper != "" {
-				replies = append(replies, models.RADIUSReply{
-					Name:  "Netspire-Shapers",
-					Value: defaultShaper,
-				})
-			}
-		} else {
-			// Use interval shaper
-			if accessResult.Shaper != "" {
-				replies = append(replies, models.RADIUSReply{
-					Name:  "Netspire-Shapers",
-					Value: accessResult.Shaper,
-				})
-			}
+	if balance.Add(settings.Credit).Sign() >= 0 {
+		// Use default shaper when dropped, interval shaper otherwise
+		if settings.DropSpeed {
+			shaper = settings.Shaper
 		}
 
 		return &models.BillingResult{
 			Decision: "accept",
-			Replies:  replies,
+			Replies:  shaperReplies(shaper),
 		}, nil
 	}
 
@@ -381,7 +230,7 @@ func (a *NoOverlimitAlgorithm) Account(currency int, planData map[string]interfa
 	}
 
 	// If amount > 0, set DROP_SPEED and zero amount
-	if result.Amount > 0 {
+	if result.Amount.Sign() > 0 {
 		newPlanData := make(map[string]interface{})
 		for k, v := range result.PlanData {
 			newPlanData[k] = v
@@ -390,7 +239,6 @@ func (a *NoOverlimitAlgorithm) Account(currency int, planData map[string]interfa
 
 		return &models.BillingResult{
 			Decision:     "accept",
-			Amount:       0.0,
 			TrafficClass: result.TrafficClass,
 			PlanData:     newPlanData,
 		}, nil
@@ -399,72 +247,55 @@ func (a *NoOverlimitAlgorithm) Account(currency int, planData map[string]interfa
 	return result, nil
 }
 
-// AccessResult represents the result of access interval checking
-type AccessResult struct {
-	Decision string
-	Shaper   string
-}
-
-// checkAccessIntervals checks if access is allowed based on time intervals
-func checkAccessIntervals(planData map[string]interface{}, defaultShaper string) *AccessResult {
-	accessIntervals, ok := planData["ACCESS_INTERVALS"].([]interface{})
-	if !ok || len(accessIntervals) == 0 {
-		return &AccessResult{
-			Decision: "accept",
-			Shaper:   defaultShaper,
-		}
+// shaperReplies returns the Netspire-Shapers reply for a non-empty shaper
+func shaperReplies(shaper string) []models.RADIUSReply {
+	replies := []models.RADIUSReply{}
+	if shaper != "" {
+		replies = append(replies, models.RADIUSReply{
+			Name:  "Netspire-Shapers",
+			Value: shaper,
+		})
 	}
+	return replies
+}
 
-	now := time.Now()
-	todaySeconds := now.Hour()*3600 + now.Minute()*60 + now.Second()
+// OctetsLimitAttribute carries the traffic the balance buys, like Session-Timeout for time
+const OctetsLimitAttribute = "Netspire-Octets-Limit"
 
-	for _, interval := range accessIntervals {
-		intervalData, ok := interval.([]interface{})
-		if !ok || len(intervalData) < 2 {
-			continue
-		}
+// limitReplies returns the traffic limit balance + credit buys at now, if traffic is charged
+func limitReplies(settings *models.PlanSettings, now time.Time, currency int, balance models.Money) []models.RADIUSReply {
+	octets, ok := settings.AffordableOctets(now, currency, balance.Add(settings.Credit))
+	if !ok {
+		return nil
+	}
+	return []models.RADIUSReply{{
+		Name:  OctetsLimitAttribute,
+		Value: strconv.FormatUint(octets, 10),
+	}}
+}
 
-		boundary, ok := intervalData[0].(float64)
-		if !ok {
-			continue
-		}
+// FlowTimeKey is the sessionData key with the time.Time the traffic was seen at
+// Prices and shapers are taken at that time; without it at time.Now().
+const FlowTimeKey = "flow_time"
 
-		if float64(todaySeconds) < boundary {
-			access, ok := intervalData[1].(string)
-			if !ok {
-				continue
-			}
-
-			var shaper string
-			if len(intervalData) > 2 {
-				if s, ok := intervalData[2].(string); ok {
-					shaper = s
-				} else {
-					shaper = defaultShaper
-				}
-			} else {
-				shaper = defaultShaper
-			}
-
-			if access == "accept" {
-				return &AccessResult{
-					Decision: "accept",
-					Shaper:   shaper,
-				}
-			} else {
-				return &AccessResult{
-					Decision: "reject",
-					Shaper:   "",
-				}
-			}
-		}
+func flowTime(sessionData map[string]interface{}) time.Time {
+	if t, ok := sessionData[FlowTimeKey].(time.Time); ok && !t.IsZero() {
+		return t
 	}
+	return time.Now()
+}
 
-	// Default to reject if no matching interval
-	return &AccessResult{
-		Decision: "reject",
-		Shaper:   "",
+// TrafficClassKey is the sessionData key with a traffic class decided by the caller
+// Live accounting leaves it unset and the remote address is classified here; replays of
+// recorded usage pass the class kept in session details, which is the one returned in
+// BillingResult.TrafficClass when the traffic was accounted live.
+const TrafficClassKey = "traffic_class"
+
+func trafficClass(sessionData map[string]interface{}, targetIP string) string {
+	if class, ok := sessionData[TrafficClassKey].(string); ok && class != "" {
+		return class
 	}
+	return classifyTraffic(targetIP)
 }
 
 // TrafficClassifier defines traffic classification rules
@@ -545,36 +376,3 @@ func calculateOverlimit(octets uint64, limit uint64) (payableOctets uint64, rema
 	}
 	return octets - limit, 0
 }
-
-// Helper functions for plan data extraction
-func getFloatFromPlanData(planData map[string]interface{}, key string, defaultValue float64) float64 {
-	if value, exists := planData[key]; exists {
-		switch v := value.(type) {
-		case float64:
-			return v
-		case int:
-			return float64(v)
-		case string:
-			if f, err := strconv.ParseFloat(v, 64); err == nil {
-				return f
-			}
-		case json.Number:
-			if f, err := v.Float64(); err == nil {
-				return f
-			}
-		}
-	}
-	return defaultValue
-}
-
-func getStringFromPlanData(planData map[string]interface{}, key string, defaultValue string) string {
-	if value, exists := planData[key]; exists {
-		switch v := value.(type) {
-		case string:
-			return v
-		case []byte:
-			return string(v)
-		}
-	}
-	return defaultValue
-}
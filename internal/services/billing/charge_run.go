@@ -0,0 +1,562 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/models"
+)
+
+// Charge run kinds
+const (
+	ChargeRunMonthly = "monthly" // All accounts for the period containing the target date, failed charges retried
+	ChargeRunDue     = "due"     // Daily run: periods not charged yet
+)
+
+// Charge run states of charge_runs
+const (
+	ChargeRunRunning   = "running"
+	ChargeRunCompleted = "completed"
+	ChargeRunCancelled = "cancelled"
+	ChargeRunFailed    = "failed"
+)
+
+// ErrRunNotFound is returned for unknown charge run IDs
+var ErrRunNotFound = errors.New("charge run not found")
+
+// ErrRunNotResumable is returned when a run is completed or still running elsewhere
+var ErrRunNotResumable = errors.New("charge run cannot be resumed")
+
+// ErrRunCancelled is returned by ExecuteRun when the run was cancelled
+var ErrRunCancelled = errors.New("charge run cancelled")
+
+// ErrRunErrors is returned when some accounts of a run could not be processed
+var ErrRunErrors = errors.New("charge run finished with errors")
+
+// ChargeRun is one pass of subscription charges over active accounts
+// Accounts are processed in ID order by a bounded worker pool, batch by batch; after every
+// batch the counters and Checkpoint (last account ID of the batch) are saved, so a restarted
+// run resumes after it. Charges are idempotent in subscription_charges, a batch interrupted
+// by a crash is simply processed again.
+type ChargeRun struct {
+	ID          int        `json:"id"`
+	Kind        string     `json:"kind"`
+	TargetDate  time.Time  `json:"target_date"`
+	State       string     `json:"state"`
+	Total       int        `json:"total"` // Active accounts when the run was created
+	Processed   int        `json:"processed"`
+	Succeeded   int        `json:"succeeded"` // Charged
+	Failed      int        `json:"failed"`    // Charge recorded failed (insufficient funds, ...)
+	Skipped     int        `json:"skipped"`   // No fee or the period is already charged
+	Errors      int        `json:"errors"`    // Accounts that could not be processed
+	Checkpoint  int        `json:"checkpoint"`
+	StartedAt   time.Time  `json:"started_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	retryFailed bool
+}
+
+// ChargeRunError is an account a run could not process
+type ChargeRunError struct {
+	AccountID int       `json:"account_id"`
+	Error     string    `json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ChargeRunReport summarizes a charge run
+type ChargeRunReport struct {
+	Run            *ChargeRun       `json:"run"`
+	Revenue        []CurrencyAmount `json:"revenue"`         // Successful charges by fee currency
+	FailureReasons map[string]int   `json:"failure_reasons"` // Failed charges of the run by reason
+	AccountErrors  []ChargeRunError `json:"account_errors"`  // Last 100
+}
+
+// batchResult counts the outcome of one batch
+type batchResult struct {
+	mu        sync.Mutex
+	succeeded int
+	failed    int
+	skipped   int
+	errors    []ChargeRunError
+}
+
+// CreateRun records a new charge run of kind for targetDate
+func (s *SubscriptionService) CreateRun(kind string, targetDate time.Time) (*ChargeRun, error) {
+	if kind != ChargeRunMonthly && kind != ChargeRunDue {
+		return nil, fmt.Errorf("unknown charge run kind %q", kind)
+	}
+
+	run := &ChargeRun{Kind: kind, TargetDate: targetDate, State: ChargeRunRunning, retryFailed: kind == ChargeRunMonthly}
+	err := s.db.GetDB().QueryRow(`
+		INSERT INTO charge_runs (kind, target_date, state, total)
+		VALUES ($1, $2, $3, (SELECT COUNT(*) FROM accounts WHERE active = true))
+		RETURNING id, total, started_at, updated_at`,
+		run.Kind, run.TargetDate, run.State,
+	).Scan(&run.ID, &run.Total, &run.StartedAt, &run.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create charge run: %w", err)
+	}
+
+	s.logger.Info("Charge run created",
+		zap.Int("run_id", run.ID),
+		zap.String("kind", run.Kind),
+		zap.Time("target_date", run.TargetDate),
+		zap.Int("accounts", run.Total))
+	return run, nil
+}
+
+// StartRun creates a charge run and executes it in background
+func (s *SubscriptionService) StartRun(kind string, targetDate time.Time) (*ChargeRun, error) {
+	run, err := s.CreateRun(kind, targetDate)
+	if err != nil {
+		return nil, err
+	}
+	s.executeAsync(run)
+	return run, nil
+}
+
+// ResumeRun continues a cancelled, failed or interrupted run from its checkpoint in background
+func (s *SubscriptionService) ResumeRun(runID int) (*ChargeRun, error) {
+	run, err := s.ClaimRun(runID)
+	if err != nil {
+		return nil, err
+	}
+	s.executeAsync(run)
+	return run, nil
+}
+
+// ClaimRun marks a cancelled, failed or interrupted run running again for ExecuteRun
+// A running run is interrupted when its updated_at, refreshed at every checkpoint and by a
+// heartbeat while a batch is processed, is older than StaleAfter (its process died).
+func (s *SubscriptionService) ClaimRun(runID int) (*ChargeRun, error) {
+	s.runsMux.Lock()
+	_, local := s.running[runID]
+	s.runsMux.Unlock()
+	if local {
+		return nil, fmt.Errorf("%w: %d is running", ErrRunNotResumable, runID)
+	}
+
+	res, err := s.db.GetDB().Exec(`
+		UPDATE charge_runs SET state = 'running', cancel_requested = false, error = '',
+			finished_at = NULL, updated_at = NOW()
+		WHERE id = $1 AND (state IN ('cancelled', 'failed')
+			OR (state = 'running' AND updated_at < NOW() - $2 * INTERVAL '1 second'))`,
+		runID, int(s.staleAfter().Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim charge run: %w", err)
+	}
+
+	run, err := s.GetRun(runID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("%w: %d is %s", ErrRunNotResumable, runID, run.State)
+	}
+
+	s.logger.Info("Charge run resumed",
+		zap.Int("run_id", run.ID),
+		zap.Int("checkpoint", run.Checkpoint),
+		zap.Int("processed", run.Processed))
+	return run, nil
+}
+
+// CancelRun stops a run after its current batch
+// Runs of other processes see the request at their next checkpoint; a run without progress
+// for StaleAfter is cancelled right away.
+func (s *SubscriptionService) CancelRun(runID int) (*ChargeRun, error) {
+	res, err := s.db.GetDB().Exec(`UPDATE charge_runs SET cancel_requested = true WHERE id = $1 AND state = 'running'`, runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel charge run: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := s.GetRun(runID); err != nil {
+			return nil, err
+		}
+	}
+
+	s.runsMux.Lock()
+	cancel, local := s.running[runID]
+	s.runsMux.Unlock()
+	if local {
+		cancel()
+	} else {
+		_, err = s.db.GetDB().Exec(`
+			UPDATE charge_runs SET state = 'cancelled', finished_at = NOW()
+			WHERE id = $1 AND state = 'running' AND updated_at < NOW() - $2 * INTERVAL '1 second'`,
+			runID, int(s.staleAfter().Seconds()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to cancel charge run: %w", err)
+		}
+	}
+
+	return s.GetRun(runID)
+}
+
+// ExecuteRun processes the run from its checkpoint until all accounts are done, ctx is
+// cancelled or cancellation is requested through CancelRun
+func (s *SubscriptionService) ExecuteRun(ctx context.Context, run *ChargeRun) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.runsMux.Lock()
+	s.running[run.ID] = cancel
+	s.runsMux.Unlock()
+	defer func() {
+		s.runsMux.Lock()
+		delete(s.running, run.ID)
+		s.runsMux.Unlock()
+	}()
+
+	s.logger.Info("Executing charge run",
+		zap.Int("run_id", run.ID),
+		zap.Int("workers", s.workers()),
+		zap.Int("checkpoint", run.Checkpoint))
+
+	for {
+		// Cancellation takes effect between batches, so counters always match the checkpoint
+		if ctx.Err() != nil {
+			return s.finishRun(run, ChargeRunCancelled, ErrRunCancelled)
+		}
+
+		accounts, err := s.fetchAccountsForBilling(s.db.GetDB(),
+			`WHERE a.active = true AND a.id > $1 ORDER BY a.id LIMIT $2`, run.Checkpoint, s.batchSize())
+		if err != nil {
+			return s.finishRun(run, ChargeRunFailed, fmt.Errorf("failed to get active accounts: %w", err))
+		}
+		if len(accounts) == 0 {
+			break
+		}
+
+		result := s.processBatch(run, accounts)
+
+		cancelRequested, err := s.saveProgress(run, accounts[len(accounts)-1].ID, result)
+		if err != nil {
+			return s.finishRun(run, ChargeRunFailed, err)
+		}
+		if cancelRequested {
+			cancel()
+		}
+	}
+
+	if err := s.finishRun(run, ChargeRunCompleted, nil); err != nil {
+		return err
+	}
+
+	s.logger.Info("Charge run completed",
+		zap.Int("run_id", run.ID),
+		zap.Int("processed", run.Processed),
+		zap.Int("succeeded", run.Succeeded),
+		zap.Int("failed", run.Failed),
+		zap.Int("skipped", run.Skipped),
+		zap.Int("errors", run.Errors))
+	return nil
+}
+
+// GetRun returns a charge run
+func (s *SubscriptionService) GetRun(runID int) (*ChargeRun, error) {
+	runs, err := s.queryRuns(`WHERE id = $1`, runID)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrRunNotFound, runID)
+	}
+	return runs[0], nil
+}
+
+// ListRuns returns recent charge runs, newest first
+func (s *SubscriptionService) ListRuns(limit int) ([]*ChargeRun, error) {
+	return s.queryRuns(`ORDER BY id DESC LIMIT $1`, limit)
+}
+
+// RunReport summarizes the outcome of a charge run
+func (s *SubscriptionService) RunReport(runID int) (*ChargeRunReport, error) {
+	run, err := s.GetRun(runID)
+	if err != nil {
+		return nil, err
+	}
+	report := &ChargeRunReport{
+		Run:            run,
+		Revenue:        []CurrencyAmount{},
+		FailureReasons: map[string]int{},
+		AccountErrors:  []ChargeRunError{},
+	}
+
+	rows, err := s.db.GetDB().Query(`
+		SELECT status, failure_reason, currency_id, COUNT(*), COALESCE(SUM(amount), 0)
+		FROM subscription_charges WHERE run_id = $1
+		GROUP BY status, failure_reason, currency_id
+		ORDER BY currency_id`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status, reason string
+		var currencyID, count int
+		var amount models.Money
+		if err := rows.Scan(&status, &reason, &currencyID, &count, &amount); err != nil {
+			return nil, err
+		}
+		switch status {
+		case ChargeStatusSuccess:
+			report.Revenue = append(report.Revenue, CurrencyAmount{Currency: currencyID, Amount: amount})
+		case ChargeStatusFailed:
+			report.FailureReasons[reason] += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	errRows, err := s.db.GetDB().Query(`
+		SELECT account_id, error, created_at FROM charge_run_errors
+		WHERE run_id = $1 ORDER BY id DESC LIMIT 100`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer errRows.Close()
+	for errRows.Next() {
+		var e ChargeRunError
+		if err := errRows.Scan(&e.AccountID, &e.Error, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		report.AccountErrors = append(report.AccountErrors, e)
+	}
+	return report, errRows.Err()
+}
+
+// executeAsync executes the run in background, its outcome is recorded in charge_runs
+func (s *SubscriptionService) executeAsync(run *ChargeRun) {
+	go func() {
+		if err := s.ExecuteRun(context.Background(), run); err != nil && !errors.Is(err, ErrRunCancelled) {
+			s.logger.Error("Charge run failed", zap.Int("run_id", run.ID), zap.Error(err))
+		}
+	}()
+}
+
+// processBatch charges accounts of one batch with the worker pool
+func (s *SubscriptionService) processBatch(run *ChargeRun, accounts []*models.AccountWithSubscription) *batchResult {
+	result := &batchResult{}
+	jobs := make(chan *models.AccountWithSubscription)
+
+	stopHeartbeat := s.heartbeat(run)
+	defer stopHeartbeat()
+
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for account := range jobs {
+				s.processRunAccount(run, account, result)
+			}
+		}()
+	}
+
+	for _, account := range accounts {
+		jobs <- account
+	}
+	close(jobs)
+	wg.Wait()
+
+	return result
+}
+
+// heartbeat keeps updated_at of the run fresh until the returned stop is called, so a batch
+// taking longer than StaleAfter is not mistaken for an interrupted run and claimed elsewhere
+func (s *SubscriptionService) heartbeat(run *ChargeRun) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(s.staleAfter() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := s.db.GetDB().Exec(`UPDATE charge_runs SET updated_at = NOW() WHERE id = $1 AND state = 'running'`, run.ID)
+				if err != nil {
+					s.logger.Warn("Failed to update charge run heartbeat", zap.Int("run_id", run.ID), zap.Error(err))
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func (s *SubscriptionService) processRunAccount(run *ChargeRun, account *models.AccountWithSubscription, result *batchResult) {
+	charge, claimed, err := s.processAccountCharge(account, run.TargetDate, run.retryFailed, run.ID)
+
+	result.mu.Lock()
+	defer result.mu.Unlock()
+
+	switch {
+	case err != nil:
+		s.logger.Error("Failed to process account charge",
+			zap.Int("run_id", run.ID),
+			zap.Int("account_id", account.ID),
+			zap.String("login", account.Login),
+			zap.Error(err))
+		result.errors = append(result.errors, ChargeRunError{AccountID: account.ID, Error: err.Error()})
+	case !claimed:
+		result.skipped++
+	case charge.Status == ChargeStatusSuccess:
+		result.succeeded++
+	default:
+		result.failed++
+	}
+
+	if err == nil && claimed {
+		s.logger.Debug("Processed account charge",
+			zap.Int("run_id", run.ID),
+			zap.Int("account_id", account.ID),
+			zap.String("status", charge.Status),
+			zap.Time("period_start", charge.PeriodStart),
+			zap.Stringer("amount", charge.Amount))
+	}
+}
+
+// saveProgress stores batch counters and the checkpoint; returns whether cancellation was requested
+func (s *SubscriptionService) saveProgress(run *ChargeRun, checkpoint int, result *batchResult) (bool, error) {
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, e := range result.errors {
+		message := e.Error
+		if len(message) > 255 {
+			message = message[:255]
+		}
+		if _, err := tx.Exec(`INSERT INTO charge_run_errors (run_id, account_id, error) VALUES ($1, $2, $3)`,
+			run.ID, e.AccountID, message); err != nil {
+			return false, fmt.Errorf("failed to record account error: %w", err)
+		}
+	}
+
+	processed := result.succeeded + result.failed + result.skipped + len(result.errors)
+	var cancelRequested bool
+	err = tx.QueryRow(`
+		UPDATE charge_runs SET processed = processed + $1, succeeded = succeeded + $2, failed = failed + $3,
+			skipped = skipped + $4, errors = errors + $5, checkpoint = $6, updated_at = NOW()
+		WHERE id = $7
+		RETURNING cancel_requested, updated_at`,
+		processed, result.succeeded, result.failed, result.skipped, len(result.errors), checkpoint, run.ID,
+	).Scan(&cancelRequested, &run.UpdatedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to save run progress: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to save run progress: %w", err)
+	}
+
+	run.Processed += processed
+	run.Succeeded += result.succeeded
+	run.Failed += result.failed
+	run.Skipped += result.skipped
+	run.Errors += len(result.errors)
+	run.Checkpoint = checkpoint
+
+	s.logger.Info("Charge run progress",
+		zap.Int("run_id", run.ID),
+		zap.Int("processed", run.Processed),
+		zap.Int("total", run.Total),
+		zap.Int("checkpoint", checkpoint))
+	return cancelRequested, nil
+}
+
+// finishRun records the final state of the run and returns cause
+func (s *SubscriptionService) finishRun(run *ChargeRun, state string, cause error) error {
+	now := time.Now()
+	run.State = state
+	run.FinishedAt = &now
+	if cause != nil {
+		run.Error = cause.Error()
+	}
+
+	message := run.Error
+	if len(message) > 255 {
+		message = message[:255]
+	}
+	_, err := s.db.GetDB().Exec(`
+		UPDATE charge_runs SET state = $1, finished_at = $2, updated_at = $2, error = $3 WHERE id = $4`,
+		state, now, message, run.ID)
+	if err != nil {
+		s.logger.Error("Failed to record charge run state", zap.Int("run_id", run.ID), zap.Error(err))
+		if cause == nil {
+			return fmt.Errorf("failed to record charge run state: %w", err)
+		}
+	}
+	if state == ChargeRunCancelled {
+		s.logger.Info("Charge run cancelled", zap.Int("run_id", run.ID), zap.Int("checkpoint", run.Checkpoint))
+	}
+	return cause
+}
+
+func (s *SubscriptionService) queryRuns(where string, args ...interface{}) ([]*ChargeRun, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT id, kind, target_date, state, total, processed, succeeded, failed, skipped, errors,
+			checkpoint, started_at, updated_at, finished_at, error
+		FROM charge_runs
+		`+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch charge runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []*ChargeRun{}
+	for rows.Next() {
+		run := &ChargeRun{}
+		var finishedAt sql.NullTime
+		err := rows.Scan(&run.ID, &run.Kind, &run.TargetDate, &run.State, &run.Total, &run.Processed,
+			&run.Succeeded, &run.Failed, &run.Skipped, &run.Errors, &run.Checkpoint, &run.StartedAt,
+			&run.UpdatedAt, &finishedAt, &run.Error)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan charge run: %w", err)
+		}
+		if finishedAt.Valid {
+			run.FinishedAt = &finishedAt.Time
+		}
+		run.retryFailed = run.Kind == ChargeRunMonthly
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (s *SubscriptionService) workers() int {
+	if s.config.Workers > 0 {
+		return s.config.Workers
+	}
+	return 8
+}
+
+func (s *SubscriptionService) batchSize() int {
+	if s.config.BatchSize > 0 {
+		return s.config.BatchSize
+	}
+	return 500
+}
+
+func (s *SubscriptionService) staleAfter() time.Duration {
+	if s.config.StaleAfter > 0 {
+		return s.config.StaleAfter
+	}
+	return 10 * time.Minute
+}
@@ -0,0 +1,212 @@
+package billing
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"isp-billing/internal/models"
+)
+
+// periodFee prices the account's billing period from `from` to periodEnd in feeCurrency
+// The charge is the plan cycle fee plus the cycle fees of add-ons active in the period, both
+// prorated from `from` (add-ons from their start when later), less discounts valid at
+// periodStart: percent discounts one after another, then fixed ones, never below zero.
+func (s *SubscriptionService) periodFee(account *models.AccountWithSubscription, settings *models.PlanSettings, cycle models.BillingCycle, from, periodStart, periodEnd time.Time) (models.Money, []models.ChargeItem, error) {
+	var total models.Money
+	var items []models.ChargeItem
+
+	monthlyFee, feeCurrency := s.getMonthlyFee(account, settings)
+	if monthlyFee.Sign() > 0 {
+		fee := s.calculateProratedAmount(cycleFee(cycle, monthlyFee, settings.CycleDiscount), from, periodStart, periodEnd)
+		if fee.Sign() > 0 {
+			items = append(items, models.ChargeItem{
+				Kind:        models.ChargeItemPlan,
+				RefID:       account.PId,
+				Description: fmt.Sprintf("Subscription fee (%s)", cycle),
+				Amount:      fee,
+			})
+			total = total.Add(fee)
+		}
+	}
+
+	addons, err := s.periodAddons(account.ID, periodStart, periodEnd)
+	if err != nil {
+		return models.Money{}, nil, fmt.Errorf("failed to fetch add-ons: %w", err)
+	}
+	for _, addon := range addons {
+		addonFrom := from
+		if addon.StartedAt.After(addonFrom) {
+			addonFrom = addon.StartedAt
+		}
+		fee, err := s.rates.Convert(cycle.Fee(addon.MonthlyFee).Mul(int64(addon.Quantity)), addon.Currency, feeCurrency)
+		if err != nil {
+			return models.Money{}, nil, fmt.Errorf("failed to convert add-on %s fee: %w", addon.Code, err)
+		}
+		fee = s.calculateProratedAmount(fee, addonFrom, periodStart, periodEnd)
+		if fee.Sign() <= 0 {
+			continue
+		}
+		description := addon.Name
+		if addon.Quantity > 1 {
+			description = fmt.Sprintf("%s x%d", addon.Name, addon.Quantity)
+		}
+		items = append(items, models.ChargeItem{
+			Kind:        models.ChargeItemAddon,
+			RefID:       addon.AddonID,
+			Description: description,
+			Amount:      fee,
+		})
+		total = total.Add(fee)
+	}
+
+	if total.Sign() <= 0 {
+		return models.Money{}, items, nil
+	}
+
+	discounts, err := s.periodDiscounts(account, periodStart)
+	if err != nil {
+		return models.Money{}, nil, fmt.Errorf("failed to fetch discounts: %w", err)
+	}
+	for _, discount := range discounts {
+		if total.Sign() <= 0 {
+			break
+		}
+
+		var off models.Money
+		switch discount.Kind {
+		case models.DiscountPercent:
+			off = total.Sub(models.PercentOff(total, discount.Value))
+		case models.DiscountFixed:
+			if off, err = s.rates.Convert(discount.Value, discount.Currency, feeCurrency); err != nil {
+				return models.Money{}, nil, fmt.Errorf("failed to convert discount %d: %w", discount.ID, err)
+			}
+			if off.Cmp(total) > 0 {
+				off = total
+			}
+		}
+		if off.Sign() <= 0 {
+			continue
+		}
+
+		description := discount.Description
+		if description == "" {
+			description = fmt.Sprintf("Discount %s", discount.Value)
+			if discount.Kind == models.DiscountPercent {
+				description += "%"
+			}
+		}
+		items = append(items, models.ChargeItem{
+			Kind:        models.ChargeItemDiscount,
+			RefID:       discount.ID,
+			Description: description,
+			Amount:      off.Neg(),
+		})
+		total = total.Sub(off)
+	}
+
+	return total, items, nil
+}
+
+// periodAddons returns add-ons of the account active at some point of the period
+func (s *SubscriptionService) periodAddons(accountID int, periodStart, periodEnd time.Time) ([]models.AccountAddon, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT aa.id, aa.account_id, aa.addon_id, ad.code, ad.name, aa.quantity,
+			COALESCE(aa.monthly_fee, ad.monthly_fee), ad.currency_id, aa.started_at, aa.ended_at
+		FROM account_addons aa
+		JOIN addons ad ON ad.id = aa.addon_id
+		WHERE aa.account_id = $1 AND aa.started_at <= $3 AND (aa.ended_at IS NULL OR aa.ended_at > $2)
+		ORDER BY aa.id`, accountID, periodStart, periodEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var addons []models.AccountAddon
+	for rows.Next() {
+		var a models.AccountAddon
+		var endedAt sql.NullTime
+		err := rows.Scan(&a.ID, &a.AccountID, &a.AddonID, &a.Code, &a.Name, &a.Quantity,
+			&a.MonthlyFee, &a.Currency, &a.StartedAt, &endedAt)
+		if err != nil {
+			return nil, err
+		}
+		if endedAt.Valid {
+			a.EndedAt = &endedAt.Time
+		}
+		addons = append(addons, a)
+	}
+	return addons, rows.Err()
+}
+
+// periodDiscounts returns discounts of the account and of its plan valid at periodStart,
+// percent discounts first
+func (s *SubscriptionService) periodDiscounts(account *models.AccountWithSubscription, periodStart time.Time) ([]models.Discount, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT id, kind, value, COALESCE(currency_id, 0), description
+		FROM discounts
+		WHERE (account_id = $1 OR plan_id = $2)
+		AND valid_from <= $3::date AND (valid_until IS NULL OR valid_until >= $3::date)
+		ORDER BY kind = 'fixed', id`, account.ID, account.PId, periodStart)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var discounts []models.Discount
+	for rows.Next() {
+		var d models.Discount
+		if err := rows.Scan(&d.ID, &d.Kind, &d.Value, &d.Currency, &d.Description); err != nil {
+			return nil, err
+		}
+		discounts = append(discounts, d)
+	}
+	return discounts, rows.Err()
+}
+
+// AddonCharge prices an add-on started at `at` for the rest of the account's current period
+// when that period is already charged; the caller debits it as a one-off ReasonAddon charge.
+// Returns zero when the period is not charged yet: the period charge will include the add-on.
+func (s *SubscriptionService) AddonCharge(accountID int, addon models.AccountAddon, at time.Time) (models.Money, time.Time, error) {
+	account, err := s.getAccountForBilling(s.db.GetDB(), accountID)
+	if err != nil {
+		return models.Money{}, time.Time{}, err
+	}
+	settings, err := s.planSettings(account)
+	if err != nil {
+		return models.Money{}, time.Time{}, err
+	}
+	cycle, err := s.billingCycle(account, settings)
+	if err != nil {
+		return models.Money{}, time.Time{}, err
+	}
+	periodStart, periodEnd := cycle.Period(at, account.BillingAnchor)
+
+	var charged bool
+	err = s.db.GetDB().QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM subscription_charges
+			WHERE account_id = $1 AND status = 'success' AND period_start <= $2 AND period_end >= $2)`,
+		accountID, at).Scan(&charged)
+	if err != nil {
+		return models.Money{}, time.Time{}, fmt.Errorf("failed to check ledger: %w", err)
+	}
+	if !charged {
+		return models.Money{}, periodEnd, nil
+	}
+
+	fee := cycle.Fee(addon.MonthlyFee).Mul(int64(addon.Quantity))
+	return s.calculateProratedAmount(fee, at, periodStart, periodEnd), periodEnd, nil
+}
+
+// marshalChargeItems encodes a charge breakdown for subscription_charges.items
+func marshalChargeItems(items []models.ChargeItem) (string, error) {
+	if len(items) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal charge items: %w", err)
+	}
+	return string(data), nil
+}
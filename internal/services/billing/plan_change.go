@@ -0,0 +1,444 @@
+package billing
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+)
+
+// ErrPlanNotFound is returned for unknown plan IDs
+var ErrPlanNotFound = errors.New("plan not found")
+
+// ErrSamePlan is returned when an account is moved to the plan it is on
+var ErrSamePlan = errors.New("account is already on this plan")
+
+// ErrPlanChangeNotScheduled is returned when a scheduled plan change was applied or cancelled meanwhile
+var ErrPlanChangeNotScheduled = errors.New("plan change is not scheduled")
+
+// periodCharge is the subscription_charges row of the period a plan change falls into
+type periodCharge struct {
+	id          int
+	amount      models.Money
+	currency    int
+	status      string
+	periodStart time.Time
+	periodEnd   time.Time
+	items       string
+}
+
+// ChangePlan moves an account to change.ToPlanID at change.EffectiveAt in one transaction
+// The old plan's ledger charge of the period containing EffectiveAt is cut at it and the
+// unused part is credited back if it was paid (a period not charged yet is charged up to
+// EffectiveAt); the new plan is charged from EffectiveAt to
+// the end of its own period (prorated, its cycle and discount) and accounts.plan_id/plan_data
+// are replaced. A new charge the balance does not cover is recorded failed and left to dunning.
+// With change.ID the scheduled plan_changes row is applied, otherwise an applied row is added.
+// Returns the new plan data for running sessions.
+func (s *SubscriptionService) ChangePlan(change *models.PlanChange) (map[string]interface{}, error) {
+	at := change.EffectiveAt
+
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the account and its contract: balance checks below must see our own credit only
+	var oldPlanID int
+	var oldPlanDataJSON string
+	err = tx.QueryRow(`
+		SELECT a.plan_id, a.plan_data FROM accounts a
+		JOIN contracts c ON c.id = a.contract_id
+		WHERE a.id = $1 FOR UPDATE OF a, c`, change.AccountID).Scan(&oldPlanID, &oldPlanDataJSON)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrAccountNotFound, change.AccountID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock account: %w", err)
+	}
+	if oldPlanID == change.ToPlanID && change.PlanData == nil {
+		return nil, fmt.Errorf("%w: %d", ErrSamePlan, change.ToPlanID)
+	}
+	change.FromPlanID = oldPlanID
+
+	oldPlanData, err := database.ParsePlanDataFromJSON(oldPlanDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse plan data: %w", err)
+	}
+	newPlanData, err := s.newPlanData(tx, change)
+	if err != nil {
+		return nil, err
+	}
+	newPlanData = models.CarryPlanData(oldPlanData, newPlanData)
+	newPlanDataJSON, err := json.Marshal(newPlanData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal plan data: %w", err)
+	}
+
+	// Close the old plan's period at the change
+	old, err := s.periodChargeAt(tx, change.AccountID, at)
+	if err != nil {
+		return nil, err
+	}
+	reuse := false
+	if old != nil {
+		unused := s.calculateProratedAmount(old.amount, at, old.periodStart, old.periodEnd)
+		if old.status == ChargeStatusSuccess && unused.Sign() > 0 {
+			comment := fmt.Sprintf("Plan change: unused part of period %s - %s",
+				old.periodStart.Format("2006-01-02"), old.periodEnd.Format("2006-01-02"))
+			if _, _, err := s.rates.CreditTx(tx, change.AccountID, unused, old.currency, comment); err != nil {
+				return nil, fmt.Errorf("failed to credit unused period: %w", err)
+			}
+			change.Credit = unused
+			change.CreditCurrency = old.currency
+		}
+
+		if old.periodStart.Equal(at) {
+			// Nothing of the period was used: the row is taken over by the new plan
+			reuse = true
+		} else {
+			items, err := shrunkChargeItems(old.items, unused)
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.Exec(`
+				UPDATE subscription_charges SET period_end = $1, amount = $2, items = $3, updated_at = NOW()
+				WHERE id = $4`, at.Add(-time.Second), old.amount.Sub(unused), items, old.id)
+			if err != nil {
+				return nil, fmt.Errorf("failed to close old period: %w", err)
+			}
+		}
+	} else {
+		// The period was not charged yet, and the new plan's charge will make the charge run
+		// skip it: charge the old plan's used part now
+		account, err := s.getAccountForBilling(tx, change.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		used, err := s.usedPeriodCharge(account, at)
+		if err != nil {
+			return nil, err
+		}
+		if used != nil {
+			comment := fmt.Sprintf("Subscription fee before plan change for period %s - %s",
+				used.PeriodStart.Format("2006-01-02"), used.PeriodEnd.Format("2006-01-02"))
+			if err := s.chargeTx(tx, used, account.Currency, comment); err != nil {
+				return nil, err
+			}
+			s.logger.Info("Charged used part of uncharged period before plan change",
+				zap.Int("account_id", change.AccountID),
+				zap.Stringer("amount", used.Amount),
+				zap.String("status", used.Status))
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE accounts SET plan_id = $1, plan_data = $2 WHERE id = $3`,
+		change.ToPlanID, string(newPlanDataJSON), change.AccountID); err != nil {
+		return nil, fmt.Errorf("failed to update account plan: %w", err)
+	}
+
+	// Charge the new plan from the change to the end of its period
+	account, err := s.getAccountForBilling(tx, change.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	charge, err := s.planChangeCharge(account, at)
+	if err != nil {
+		return nil, err
+	}
+	if reuse {
+		charge.ID = old.id
+	}
+	comment := fmt.Sprintf("Subscription fee after plan change for period %s - %s",
+		charge.PeriodStart.Format("2006-01-02"), charge.PeriodEnd.Format("2006-01-02"))
+	if err := s.chargeTx(tx, charge, account.Currency, comment); err != nil {
+		return nil, err
+	}
+	change.Charge = charge.Amount
+	change.ChargeCurrency = charge.Currency
+	change.ChargeID = &charge.ID
+	change.ChargeStatus = charge.Status
+
+	if err := recordPlanChange(tx, change); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit plan change: %w", err)
+	}
+
+	s.logger.Info("Account plan changed",
+		zap.Int("account_id", change.AccountID),
+		zap.Int("from_plan_id", change.FromPlanID),
+		zap.Int("to_plan_id", change.ToPlanID),
+		zap.Time("effective_at", at),
+		zap.Stringer("credit", change.Credit),
+		zap.Stringer("charge", change.Charge),
+		zap.String("charge_status", charge.Status))
+
+	return newPlanData, nil
+}
+
+// CurrentPeriod returns the billing period of the account containing at
+func (s *SubscriptionService) CurrentPeriod(accountID int, at time.Time) (time.Time, time.Time, error) {
+	account, err := s.getAccountForBilling(s.db.GetDB(), accountID)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	settings, err := s.planSettings(account)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	cycle, err := s.billingCycle(account, settings)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	start, end := cycle.Period(at, account.BillingAnchor)
+	return start, end, nil
+}
+
+// newPlanData returns plan data of the new plan: change.PlanData or plans.settings
+func (s *SubscriptionService) newPlanData(tx *sql.Tx, change *models.PlanChange) (map[string]interface{}, error) {
+	var settingsJSON string
+	err := tx.QueryRow(`SELECT COALESCE(settings, '') FROM plans WHERE id = $1`, change.ToPlanID).Scan(&settingsJSON)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrPlanNotFound, change.ToPlanID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch plan: %w", err)
+	}
+
+	planData := change.PlanData
+	if planData == nil {
+		if planData, err = database.ParsePlanDataFromJSON(settingsJSON); err != nil {
+			return nil, fmt.Errorf("failed to parse plan settings: %w", err)
+		}
+	}
+	if _, err := models.ParsePlanSettings(planData); err != nil {
+		return nil, err
+	}
+	return planData, nil
+}
+
+// periodChargeAt locks the ledger charge whose period contains at
+func (s *SubscriptionService) periodChargeAt(tx *sql.Tx, accountID int, at time.Time) (*periodCharge, error) {
+	c := &periodCharge{}
+	err := tx.QueryRow(`
+		SELECT id, amount, currency_id, status, period_start, period_end, items
+		FROM subscription_charges
+		WHERE account_id = $1 AND period_start <= $2 AND period_end >= $2
+		ORDER BY period_start DESC LIMIT 1
+		FOR UPDATE`, accountID, at).Scan(&c.id, &c.amount, &c.currency, &c.status, &c.periodStart, &c.periodEnd, &c.items)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch period charge: %w", err)
+	}
+	return c, nil
+}
+
+// planChangeCharge computes the new plan's charge from at to the end of its period
+func (s *SubscriptionService) planChangeCharge(account *models.AccountWithSubscription, at time.Time) (*SubscriptionCharge, error) {
+	settings, err := s.planSettings(account)
+	if err != nil {
+		return nil, err
+	}
+	cycle, err := s.billingCycle(account, settings)
+	if err != nil {
+		return nil, err
+	}
+	periodStart, periodEnd := cycle.Period(at, account.BillingAnchor)
+
+	_, feeCurrency := s.getMonthlyFee(account, settings)
+	charge := &SubscriptionCharge{
+		AccountID:   account.ID,
+		Login:       account.Login,
+		PlanID:      account.PId,
+		Currency:    feeCurrency,
+		ChargeDate:  time.Now(),
+		PeriodStart: at,
+		PeriodEnd:   periodEnd,
+		Status:      ChargeStatusPending,
+	}
+	charge.Amount, charge.Items, err = s.periodFee(account, settings, cycle, at, periodStart, periodEnd)
+	if err != nil {
+		return nil, err
+	}
+	return charge, nil
+}
+
+// usedPeriodCharge computes the charge of the account's current plan from the start of its
+// period containing at up to at, as the charge run would have charged the period and the
+// change then cut it. Returns nil when nothing of the period is payable.
+func (s *SubscriptionService) usedPeriodCharge(account *models.AccountWithSubscription, at time.Time) (*SubscriptionCharge, error) {
+	charge, cycle, _, err := s.buildCharge(account, at)
+	if err != nil {
+		return nil, err
+	}
+	if !charge.PeriodStart.Before(at) {
+		return nil, nil
+	}
+	settings, err := s.planSettings(account)
+	if err != nil {
+		return nil, err
+	}
+	unused, _, err := s.periodFee(account, settings, *cycle, at, charge.PeriodStart, charge.PeriodEnd)
+	if err != nil {
+		return nil, err
+	}
+	if unused.Cmp(charge.Amount) > 0 {
+		unused = charge.Amount
+	}
+	if charge.Amount.Sub(unused).Sign() <= 0 {
+		return nil, nil
+	}
+
+	if unused.Sign() > 0 {
+		charge.Items = append(charge.Items, models.ChargeItem{
+			Kind:        models.ChargeItemPlanChange,
+			Description: "Unused part after plan change",
+			Amount:      unused.Neg(),
+		})
+	}
+	charge.Amount = charge.Amount.Sub(unused)
+	charge.PeriodEnd = at.Add(-time.Second)
+	return charge, nil
+}
+
+// shrunkChargeItems adds the unused part cut off by a plan change to a charge breakdown
+func shrunkChargeItems(items string, unused models.Money) (string, error) {
+	if items == "" || unused.Sign() <= 0 {
+		return items, nil
+	}
+	var parsed []models.ChargeItem
+	if err := json.Unmarshal([]byte(items), &parsed); err != nil {
+		return "", fmt.Errorf("failed to parse charge items: %w", err)
+	}
+	parsed = append(parsed, models.ChargeItem{
+		Kind:        models.ChargeItemPlanChange,
+		Description: "Unused part after plan change",
+		Amount:      unused.Neg(),
+	})
+	return marshalChargeItems(parsed)
+}
+
+// chargeTx records the charge in the ledger (charge.ID takes over that row) and debits it
+// within tx when the contract balance + credit covers it, otherwise it is recorded failed
+func (s *SubscriptionService) chargeTx(tx *sql.Tx, charge *SubscriptionCharge, contractCurrency int, comment string) error {
+	items, err := marshalChargeItems(charge.Items)
+	if err != nil {
+		return err
+	}
+	if charge.ID != 0 {
+		_, err = tx.Exec(`
+			UPDATE subscription_charges SET plan_id = $1, period_start = $2, period_end = $3,
+				amount = $4, currency_id = $5, items = $6, status = 'pending', failure_reason = '',
+				transaction_id = NULL, attempts = attempts + 1, updated_at = NOW()
+			WHERE id = $7`,
+			charge.PlanID, charge.PeriodStart, charge.PeriodEnd, charge.Amount, charge.Currency, items, charge.ID)
+	} else {
+		err = tx.QueryRow(`
+			INSERT INTO subscription_charges (account_id, plan_id, period_start, period_end, amount, currency_id, status, attempts, items)
+			VALUES ($1, $2, $3, $4, $5, $6, 'pending', 1, $7)
+			RETURNING id`,
+			charge.AccountID, charge.PlanID, charge.PeriodStart, charge.PeriodEnd, charge.Amount, charge.Currency, items,
+		).Scan(&charge.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record charge: %w", err)
+	}
+
+	if charge.Amount.Sign() <= 0 {
+		charge.Status = ChargeStatusSuccess
+		_, err := tx.Exec(`UPDATE subscription_charges SET status = 'success' WHERE id = $1`, charge.ID)
+		return err
+	}
+
+	var available models.Money
+	err = tx.QueryRow(`
+		SELECT c.balance + COALESCE(sp.credit, 0.0)
+		FROM accounts a
+		LEFT OUTER JOIN service_params sp ON a.id = sp.account_id
+		JOIN contracts c ON a.contract_id = c.id
+		WHERE a.id = $1`, charge.AccountID).Scan(&available)
+	if err != nil {
+		return fmt.Errorf("failed to fetch balance: %w", err)
+	}
+	contractAmount, err := s.rates.Convert(charge.Amount, charge.Currency, contractCurrency)
+	if err != nil {
+		return fmt.Errorf("failed to convert fee: %w", err)
+	}
+
+	if available.Cmp(contractAmount) < 0 {
+		charge.Status = ChargeStatusFailed
+		charge.FailureReason = "insufficient_funds"
+		_, err := tx.Exec(`
+			UPDATE subscription_charges SET status = 'failed', failure_reason = $1, updated_at = NOW()
+			WHERE id = $2`, charge.FailureReason, charge.ID)
+		return err
+	}
+
+	_, transactionID, err := s.rates.DebitTx(tx, charge.AccountID, charge.Amount, charge.Currency, comment)
+	if err != nil {
+		return err
+	}
+	charge.Status = ChargeStatusSuccess
+	charge.TransactionID = &transactionID
+	_, err = tx.Exec(`
+		UPDATE subscription_charges SET status = 'success', transaction_id = $1, updated_at = NOW()
+		WHERE id = $2`, transactionID, charge.ID)
+	return err
+}
+
+// recordPlanChange stores an applied change, a scheduled row (change.ID) must still be scheduled
+func recordPlanChange(tx *sql.Tx, change *models.PlanChange) error {
+	planData := ""
+	if change.PlanData != nil {
+		data, err := json.Marshal(change.PlanData)
+		if err != nil {
+			return fmt.Errorf("failed to marshal plan data: %w", err)
+		}
+		planData = string(data)
+	}
+
+	now := time.Now()
+	change.State = models.PlanChangeApplied
+	change.AppliedAt = &now
+
+	if change.ID == 0 {
+		err := tx.QueryRow(`
+			INSERT INTO plan_changes (account_id, from_plan_id, to_plan_id, plan_data, state, effective_at,
+				created_at, applied_at, credit, credit_currency, charge, charge_currency, charge_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $7, $8, NULLIF($9, 0), $10, NULLIF($11, 0), $12)
+			RETURNING id`,
+			change.AccountID, change.FromPlanID, change.ToPlanID, planData, change.State, change.EffectiveAt,
+			now, change.Credit, change.CreditCurrency, change.Charge, change.ChargeCurrency, change.ChargeID,
+		).Scan(&change.ID)
+		if err != nil {
+			return fmt.Errorf("failed to record plan change: %w", err)
+		}
+		change.CreatedAt = now
+		return nil
+	}
+
+	res, err := tx.Exec(`
+		UPDATE plan_changes SET from_plan_id = $1, state = $2, applied_at = $3, credit = $4,
+			credit_currency = NULLIF($5, 0), charge = $6, charge_currency = NULLIF($7, 0), charge_id = $8
+		WHERE id = $9 AND state = 'scheduled'`,
+		change.FromPlanID, change.State, now, change.Credit, change.CreditCurrency,
+		change.Charge, change.ChargeCurrency, change.ChargeID, change.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record plan change: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: %d", ErrPlanChangeNotScheduled, change.ID)
+	}
+	return nil
+}
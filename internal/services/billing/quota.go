@@ -0,0 +1,103 @@
+package billing
+
+import (
+	"time"
+
+	"netspire-go/internal/models"
+)
+
+// QuotaAlgorithm implements volume quota plans: full speed until QUOTA is used up,
+// then FUP_SHAPER until the next cycle or a top-up. Traffic is charged like
+// PrepaidAlgorithm when INTERVALS prices are set, otherwise it is free.
+type QuotaAlgorithm struct{}
+
+func NewQuotaAlgorithm() *QuotaAlgorithm {
+	return &QuotaAlgorithm{}
+}
+
+func (a *QuotaAlgorithm) Authorize(currency int, balance models.Money, planData map[string]interface{}) (*models.BillingResult, error) {
+	now := time.Now()
+
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check access intervals
+	accept, shaper := settings.CheckAccessAt(now)
+	if !accept {
+		return &models.BillingResult{
+			Decision: "reject",
+			Reason:   "time_of_day",
+		}, nil
+	}
+
+	// Check balance + credit (the subscription fee is paid from the balance)
+	if balance.Add(settings.Credit).Sign() < 0 {
+		return &models.BillingResult{
+			Decision: "reject",
+			Reason:   "low_balance",
+		}, nil
+	}
+
+	// Counters of a finished cycle are reset by the first accounting of the session
+	if !settings.QuotaCycleExpired(now) && settings.QuotaExceeded() && settings.FUPShaper != "" {
+		shaper = settings.FUPShaper
+	}
+
+	return &models.BillingResult{
+		Decision: "accept",
+		Replies:  append(shaperReplies(shaper), limitReplies(settings, now, currency, balance)...),
+	}, nil
+}
+
+func (a *QuotaAlgorithm) Account(currency int, planData map[string]interface{}, sessionData map[string]interface{}, direction string, targetIP string, octets uint64) (*models.BillingResult, error) {
+	now := flowTime(sessionData)
+
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return nil, err
+	}
+
+	// New cycle: start counting from zero
+	wasExceeded := settings.QuotaExceeded()
+	if settings.QuotaCycleStart == "" || settings.QuotaCycleExpired(now) {
+		planData = models.ResetQuotaCycle(planData, now, settings.QuotaResetDay)
+		if settings, err = models.ParsePlanSettings(planData); err != nil {
+			return nil, err
+		}
+	}
+
+	// Charge by INTERVALS prices, if any
+	prepaidAlgo := NewPrepaidAlgorithm()
+	result, err := prepaidAlgo.Account(currency, planData, sessionData, direction, targetIP, octets)
+	if err != nil {
+		return nil, err
+	}
+
+	// Count volume of the class and of "all"
+	newPlanData := result.PlanData
+	for _, class := range []string{result.TrafficClass, models.QuotaAllClasses} {
+		if _, limited := settings.Quota[class]; limited {
+			newPlanData = models.AddQuotaVolume(newPlanData, models.QuotaUsedKey, class, float64(octets))
+		}
+	}
+	result.PlanData = newPlanData
+
+	updated, err := models.ParsePlanSettings(newPlanData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ask for a shaper change when the session crosses the threshold in either direction
+	isExceeded := updated.QuotaExceeded()
+	if isExceeded != wasExceeded && updated.FUPShaper != "" {
+		if isExceeded {
+			result.Shaper = updated.FUPShaper
+		} else if _, shaper := updated.CheckAccessAt(now); shaper != "" {
+			result.Shaper = shaper
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,81 @@
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"isp-billing/internal/database"
+)
+
+// ErrUnknownAlgorithm is returned when plans reference an algorithm nobody registered
+var ErrUnknownAlgorithm = errors.New("unknown billing algorithm")
+
+var (
+	algorithmsMu sync.RWMutex
+	algorithms   = make(map[string]BillingAlgorithm)
+)
+
+// Builtin algorithms from algo_builtin.erl
+func init() {
+	RegisterAlgorithm("algo_builtin:prepaid_auth", NewPrepaidAlgorithm())
+	RegisterAlgorithm("algo_builtin:limited_prepaid_auth", NewLimitedPrepaidAlgorithm())
+	RegisterAlgorithm("algo_builtin:on_auth", NewOnAuthAlgorithm())
+	RegisterAlgorithm("algo_builtin:no_overlimit_auth", NewNoOverlimitAlgorithm())
+	RegisterAlgorithm("algo_builtin:quota_auth", NewQuotaAlgorithm())
+	RegisterAlgorithm("algo_builtin:time_auth", NewTimeAlgorithm())
+}
+
+// RegisterAlgorithm makes an algorithm available under its plans.auth_algo / acct_algo name
+// Names without module are registered in algo_builtin, like SplitAlgoName resolves them.
+// Algorithm packages call it from init(); duplicate names panic like database/sql.Register.
+func RegisterAlgorithm(name string, algo BillingAlgorithm) {
+	if algo == nil {
+		panic("billing: RegisterAlgorithm algorithm is nil")
+	}
+
+	key := AlgorithmKey(name)
+
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+
+	if _, exists := algorithms[key]; exists {
+		panic("billing: RegisterAlgorithm called twice for " + key)
+	}
+	algorithms[key] = algo
+}
+
+// LookupAlgorithm returns the algorithm registered for a plans.auth_algo / acct_algo name
+func LookupAlgorithm(name string) (BillingAlgorithm, error) {
+	key := AlgorithmKey(name)
+
+	algorithmsMu.RLock()
+	algo, ok := algorithms[key]
+	algorithmsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, key)
+	}
+	return algo, nil
+}
+
+// Algorithms returns the sorted names of all registered algorithms
+func Algorithms() []string {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AlgorithmKey normalizes an algorithm name to "module:function"
+func AlgorithmKey(name string) string {
+	module, function := database.SplitAlgoName(strings.TrimSpace(name))
+	return module + ":" + function
+}
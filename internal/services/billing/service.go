@@ -1,53 +1,78 @@
 package billing
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
 	"isp-billing/internal/database"
 	"isp-billing/internal/models"
+	"isp-billing/internal/services/currency"
 )
 
 type Service struct {
 	db     *database.PostgreSQL
+	rates  *currency.Service
 	config map[string]interface{}
 }
 
-func NewService(db *database.PostgreSQL, config map[string]interface{}) *Service {
+// currencyService может быть nil - тогда цены в другой валюте не конвертируются и учет завершается ошибкой
+func NewService(db *database.PostgreSQL, currencyService *currency.Service, config map[string]interface{}) *Service {
 	return &Service{
 		db:     db,
+		rates:  currencyService,
 		config: config,
 	}
 }
 
-// Authorize - выполняет авторизацию пользователя (как в Erlang)
+// Authorize - выполняет авторизацию пользователя алгоритмом плана (как в Erlang)
 func (s *Service) Authorize(account *models.AccountWithRelations, req models.RADIUSAuthorizeRequest) (*models.BillingResult, error) {
 	// Парсим plan_data
 	planData, err := database.ParsePlanDataFromJSON(account.PData)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse plan data: %w", err)
 	}
+	// Ошибочный plan_data отклоняет только этот аккаунт, какой бы алгоритм ни был у плана
+	if _, err := models.ParsePlanSettings(planData); err != nil {
+		return nil, fmt.Errorf("invalid plan data: %w", err)
+	}
+
+	// Алгоритм авторизации из реестра (module:function как в Erlang)
+	algo, err := LookupAlgorithm(account.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := algo.Authorize(account.Currency, account.Balance.Add(account.Credit), planData)
+	if err != nil {
+		return nil, fmt.Errorf("auth algorithm %s failed: %w", AlgorithmKey(account.Auth), err)
+	}
+	if result.PlanData == nil {
+		result.PlanData = planData
+	}
+	applyDunningShaper(result, planData)
 
-	// Определяем алгоритм авторизации (module:function как в Erlang)
-	module, function := database.SplitAlgoName(account.Auth)
-
-	switch function {
-	case "prepaid_auth":
-		return s.prepaidAuth(account, planData, req)
-	case "limited_prepaid_auth":
-		return s.limitedPrepaidAuth(account, planData, req)
-	case "on_auth":
-		return s.onAuth(account, planData, req)
-	case "no_overlimit_auth":
-		return s.noOverlimitAuth(account, planData, req)
-	default:
-		return &models.BillingResult{
-			Decision: "Reject",
-			Reason:   fmt.Sprintf("Unknown auth algorithm: %s:%s", module, function),
-		}, nil
+	return result, nil
+}
+
+// applyDunningShaper - при неоплаченной абонплате DUNNING_SHAPER заменяет шейпер любого плана
+func applyDunningShaper(result *models.BillingResult, planData map[string]interface{}) {
+	shaper, _ := planData[models.DunningShaperKey].(string)
+	if shaper == "" || result.Decision != "accept" {
+		return
+	}
+
+	replies := make([]models.RADIUSReply, 0, len(result.Replies)+1)
+	for _, reply := range result.Replies {
+		if reply.Name != "Netspire-Shapers" {
+			replies = append(replies, reply)
+		}
 	}
+	result.Replies = append(replies, models.RADIUSReply{Name: "Netspire-Shapers", Value: shaper})
 }
 
-// ProcessAccounting - обрабатывает accounting запросы
+// ProcessAccounting - обрабатывает accounting запросы алгоритмом учета плана
 func (s *Service) ProcessAccounting(account *models.AccountWithRelations, req models.RADIUSAccountingRequest) (*models.BillingResult, error) {
 	// Парсим plan_data
 	planData, err := database.ParsePlanDataFromJSON(account.PData)
@@ -55,192 +80,178 @@ func (s *Service) ProcessAccounting(account *models.AccountWithRelations, req mo
 		return nil, fmt.Errorf("failed to parse plan data: %w", err)
 	}
 
-	// Определяем алгоритм учета
-	module, function := database.SplitAlgoName(account.Acct)
-
-	switch function {
-	case "prepaid_auth":
-		return s.prepaidAccounting(account, planData, req)
-	case "limited_prepaid_auth":
-		return s.limitedPrepaidAccounting(account, planData, req)
-	case "on_auth":
-		return s.onAuthAccounting(account, planData, req)
-	case "no_overlimit_auth":
-		return s.noOverlimitAccounting(account, planData, req)
-	default:
-		return &models.BillingResult{
-			Decision: "Accept",
-			Reason:   fmt.Sprintf("Unknown acct algorithm: %s:%s", module, function),
-		}, nil
+	sessionData := map[string]interface{}{
+		"sid":      req.AcctSessionId,
+		"username": req.Username,
 	}
-}
-
-// ================ АЛГОРИТМЫ АВТОРИЗАЦИИ (как в algo_builtin.erl) ================
-
-func (s *Service) prepaidAuth(account *models.AccountWithRelations, planData map[string]interface{}, req models.RADIUSAuthorizeRequest) (*models.BillingResult, error) {
-	// Проверяем баланс + кредит
-	availableBalance := account.Balance + account.Credit
 
-	if availableBalance <= 0 {
-		return &models.BillingResult{
-			Decision: "Reject",
-			Reason:   "Insufficient balance",
-		}, nil
+	// Входящий и исходящий трафик учитываются отдельно, как в netflow.
+	// Удаленный адрес в RADIUS accounting неизвестен - трафик классифицируется как internet
+	in, err := s.Account(account.Acct, account.Currency, planData, sessionData, "in", "", req.AcctInputOctets)
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.Account(account.Acct, account.Currency, in.PlanData, sessionData, "out", "", req.AcctOutputOctets)
+	if err != nil {
+		return nil, err
 	}
 
-	return &models.BillingResult{
-		Decision: "Accept",
-		Replies: []models.RADIUSReply{
-			{Name: "Session-Timeout", Value: "3600"}, // 1 час по умолчанию
-		},
-		PlanData: planData,
-	}, nil
+	out.Amount = out.Amount.Add(in.Amount)
+	return out, nil
 }
 
-func (s *Service) limitedPrepaidAuth(account *models.AccountWithRelations, planData map[string]interface{}, req models.RADIUSAuthorizeRequest) (*models.BillingResult, error) {
-	// Аналогично prepaid_auth но с лимитами
-	availableBalance := account.Balance + account.Credit
-
-	if availableBalance <= 0 {
-		return &models.BillingResult{
-			Decision: "Reject",
-			Reason:   "Insufficient balance",
-		}, nil
+// Account - учет порции трафика алгоритмом acct_algo (вызывается из сессий на каждый netflow)
+func (s *Service) Account(acctAlgo string, currency int, planData, sessionData map[string]interface{}, direction, targetIP string, octets uint64) (*models.BillingResult, error) {
+	algo, err := LookupAlgorithm(acctAlgo)
+	if err != nil {
+		return nil, err
 	}
 
-	// Вычисляем лимит сессии
-	sessionLimit := s.calculateSessionLimit(account, planData)
+	result, err := algo.Account(currency, planData, sessionData, direction, targetIP, octets)
+	if err != nil {
+		return nil, fmt.Errorf("acct algorithm %s failed: %w", AlgorithmKey(acctAlgo), err)
+	}
+	if result.PlanData == nil {
+		result.PlanData = planData
+	}
 
-	return &models.BillingResult{
-		Decision: "Accept",
-		Replies: []models.RADIUSReply{
-			{Name: "Session-Timeout", Value: fmt.Sprintf("%d", sessionLimit)},
-		},
-		PlanData: planData,
-	}, nil
+	if err := s.toContractCurrency(result, currency); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (s *Service) onAuth(account *models.AccountWithRelations, planData map[string]interface{}, req models.RADIUSAuthorizeRequest) (*models.BillingResult, error) {
-	// Списываем фиксированную сумму при авторизации
-	sessionCost := s.getSessionCost(planData)
-
-	if account.Balance < sessionCost {
-		return &models.BillingResult{
-			Decision: "Reject",
-			Reason:   "Insufficient balance for session cost",
-		}, nil
+// AccountTime - учет времени онлайн (interim и stop сессии) алгоритмом acct_algo
+// Для алгоритмов без учета времени (TimeAccounting) возвращает nil
+func (s *Service) AccountTime(acctAlgo string, currency int, planData, sessionData map[string]interface{}, startedAt, now time.Time, billedSeconds int64) (*models.BillingResult, error) {
+	algo, err := LookupAlgorithm(acctAlgo)
+	if err != nil {
+		return nil, err
+	}
+	timeAlgo, ok := algo.(TimeAccounting)
+	if !ok {
+		return nil, nil
 	}
 
-	return &models.BillingResult{
-		Decision: "Accept",
-		Amount:   sessionCost,
-		PlanData: planData,
-	}, nil
-}
-
-func (s *Service) noOverlimitAuth(account *models.AccountWithRelations, planData map[string]interface{}, req models.RADIUSAuthorizeRequest) (*models.BillingResult, error) {
-	// Проверяем строгие лимиты без превышения
-	if account.Balance <= 0 {
-		return &models.BillingResult{
-			Decision: "Reject",
-			Reason:   "Zero balance - no overlimit allowed",
-		}, nil
+	result, err := timeAlgo.AccountTime(currency, planData, sessionData, startedAt, now, billedSeconds)
+	if err != nil {
+		return nil, fmt.Errorf("acct algorithm %s failed: %w", AlgorithmKey(acctAlgo), err)
+	}
+	if result.PlanData == nil {
+		result.PlanData = planData
 	}
 
-	return &models.BillingResult{
-		Decision: "Accept",
-		PlanData: planData,
-	}, nil
+	if err := s.toContractCurrency(result, currency); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-// ================ АЛГОРИТМЫ УЧЕТА (как в algo_builtin.erl) ================
-
-func (s *Service) prepaidAccounting(account *models.AccountWithRelations, planData map[string]interface{}, req models.RADIUSAccountingRequest) (*models.BillingResult, error) {
-	// Вычисляем стоимость трафика
-	totalTraffic := req.AcctInputOctets + req.AcctOutputOctets
-	costPerMB := s.getCostPerMB(planData)
-	amount := float64(totalTraffic) / 1024 / 1024 * costPerMB
-
-	return &models.BillingResult{
-		Decision:     "Accept",
-		Amount:       amount,
-		TrafficClass: "default",
-		PlanData:     planData,
-	}, nil
+// toContractCurrency - цена могла быть задана в другой валюте, сумма всегда возвращается в валюте договора
+func (s *Service) toContractCurrency(result *models.BillingResult, currency int) error {
+	if result.Currency != 0 && result.Currency != currency && !result.Amount.IsZero() {
+		if s.rates == nil {
+			return fmt.Errorf("price in currency %d, contract currency %d: currency conversion is not configured", result.Currency, currency)
+		}
+		converted, err := s.rates.Convert(result.Amount, result.Currency, currency)
+		if err != nil {
+			return fmt.Errorf("failed to convert amount: %w", err)
+		}
+		result.Amount = converted
+	}
+	result.Currency = currency
+	return nil
 }
 
-func (s *Service) limitedPrepaidAccounting(account *models.AccountWithRelations, planData map[string]interface{}, req models.RADIUSAccountingRequest) (*models.BillingResult, error) {
-	// Аналогично prepaid с проверкой лимитов
-	return s.prepaidAccounting(account, planData, req)
-}
+// ValidatePlans - проверка при старте: все алгоритмы из plans зарегистрированы. Без алгоритма
+// не работает ни один аккаунт плана, поэтому сервер не запускается.
+func (s *Service) ValidatePlans() error {
+	rows, err := s.db.GetDB().Query("SELECT id, name, auth_algo, acct_algo FROM plans ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("failed to fetch plans: %w", err)
+	}
+	defer rows.Close()
 
-func (s *Service) onAuthAccounting(account *models.AccountWithRelations, planData map[string]interface{}, req models.RADIUSAccountingRequest) (*models.BillingResult, error) {
-	// При on_auth учет только при завершении сессии
-	if req.AcctStatusType == "Stop" {
-		sessionCost := s.getSessionCost(planData)
-		return &models.BillingResult{
-			Decision: "Accept",
-			Amount:   sessionCost,
-			PlanData: planData,
-		}, nil
-	}
-
-	return &models.BillingResult{
-		Decision: "Accept",
-		Amount:   0,
-		PlanData: planData,
-	}, nil
-}
+	var problems []string
+	for rows.Next() {
+		var plan models.DBPlan
+		if err := rows.Scan(&plan.ID, &plan.Name, &plan.AuthAlgo, &plan.AcctAlgo); err != nil {
+			return fmt.Errorf("failed to scan plan: %w", err)
+		}
+		for _, name := range []string{plan.AuthAlgo, plan.AcctAlgo} {
+			if _, err := LookupAlgorithm(name); err != nil {
+				problems = append(problems, fmt.Sprintf("plan %d (%s): %v", plan.ID, plan.Name, err))
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read plans: %w", err)
+	}
 
-func (s *Service) noOverlimitAccounting(account *models.AccountWithRelations, planData map[string]interface{}, req models.RADIUSAccountingRequest) (*models.BillingResult, error) {
-	// Строгий учет без превышений
-	return s.prepaidAccounting(account, planData, req)
+	if len(problems) > 0 {
+		return fmt.Errorf("%d plan problems (registered algorithms: %s): %s",
+			len(problems), strings.Join(Algorithms(), ", "), strings.Join(problems, "; "))
+	}
+	return nil
 }
 
-// ================ ВСПОМОГАТЕЛЬНЫЕ МЕТОДЫ ================
-
-func (s *Service) calculateSessionLimit(account *models.AccountWithRelations, planData map[string]interface{}) int {
-	// Вычисляем лимит времени сессии на основе баланса
-	availableBalance := account.Balance + account.Credit
-	costPerMB := s.getCostPerMB(planData)
+// PlanDataProblems - plans.settings и accounts.plan_data активных аккаунтов, не проходящие строгий
+// разбор. Такие аккаунты отклоняются при авторизации (Authorize), остальные работают; полная
+// проверка с ненулевым кодом выхода - validate-db validate-plans.
+func (s *Service) PlanDataProblems() ([]string, error) {
+	var problems []string
 
-	if costPerMB <= 0 {
-		return 3600 // 1 час по умолчанию
+	plans, err := s.db.GetDB().Query("SELECT id, name, COALESCE(settings, '') FROM plans ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch plans: %w", err)
 	}
+	defer plans.Close()
 
-	// Простая формула: доступные мегабайты * время на мегабайт
-	availableMB := availableBalance / costPerMB
-	timePerMB := 60 // секунд на MB (примерно)
-
-	sessionLimit := int(availableMB * float64(timePerMB))
-	if sessionLimit > 86400 { // максимум 24 часа
-		sessionLimit = 86400
+	for plans.Next() {
+		var id int
+		var name, settings string
+		if err := plans.Scan(&id, &name, &settings); err != nil {
+			return nil, fmt.Errorf("failed to scan plan: %w", err)
+		}
+		if err := validatePlanData(settings); err != nil {
+			problems = append(problems, fmt.Sprintf("plan %d (%s) settings: %v", id, name, err))
+		}
 	}
-	if sessionLimit < 300 { // минимум 5 минут
-		sessionLimit = 300
+	if err := plans.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read plans: %w", err)
 	}
 
-	return sessionLimit
-}
-
-func (s *Service) getCostPerMB(planData map[string]interface{}) float64 {
-	if cost, exists := planData["cost_per_mb"]; exists {
-		if costFloat, ok := cost.(float64); ok {
-			return costFloat
-		}
+	accounts, err := s.db.GetDB().Query("SELECT id, login, COALESCE(plan_data, '') FROM accounts WHERE active ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch accounts: %w", err)
 	}
-	return 0.01 // по умолчанию
-}
+	defer accounts.Close()
 
-func (s *Service) getSessionCost(planData map[string]interface{}) float64 {
-	if cost, exists := planData["session_cost"]; exists {
-		if costFloat, ok := cost.(float64); ok {
-			return costFloat
+	for accounts.Next() {
+		var id int
+		var login, planData string
+		if err := accounts.Scan(&id, &login, &planData); err != nil {
+			return nil, fmt.Errorf("failed to scan account: %w", err)
+		}
+		if err := validatePlanData(planData); err != nil {
+			problems = append(problems, fmt.Sprintf("account %d (%s) plan_data: %v", id, login, err))
 		}
 	}
-	return 5.0 // по умолчанию
+	if err := accounts.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read accounts: %w", err)
+	}
+	return problems, nil
 }
 
-func (s *Service) updatePlanData(planData map[string]interface{}, key string, value interface{}) {
-	planData[key] = value
+// validatePlanData - строгий разбор plan_data в том виде, как его читает учет; пустое значение допустимо
+func validatePlanData(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	var planData map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &planData); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	_, err := models.ParsePlanSettings(planData)
+	return err
 }
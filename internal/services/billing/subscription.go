@@ -1,11 +1,17 @@
 package billing
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"netspire-go/internal/database"
 	"netspire-go/internal/models"
+	"netspire-go/internal/services/currency"
 
 	"go.uber.org/zap"
 )
@@ -14,208 +20,378 @@ import (
 // Новая функциональность для автоматических списаний абонентской платы
 type SubscriptionService struct {
 	db     *database.PostgreSQL
+	rates  *currency.Service
 	logger *zap.Logger
 	config *SubscriptionConfig
+
+	// Charge runs executed by this process, for cancellation
+	runsMux sync.Mutex
+	running map[int]context.CancelFunc
 }
 
 // SubscriptionConfig configuration for subscription billing
 type SubscriptionConfig struct {
-	Enabled                    bool    `yaml:"enabled"`
-	DefaultMonthlyFee          float64 `yaml:"default_monthly_fee"`
-	GracePeriodDays            int     `yaml:"grace_period_days"`
-	DisableOnInsufficientFunds bool    `yaml:"disable_on_insufficient_funds"`
-	ProcessingTime             string  `yaml:"processing_time"` // "02:00" - время обработки
-	EnableProration            bool    `yaml:"enable_proration"`
+	Enabled                    bool          `yaml:"enabled"`
+	DefaultMonthlyFee          models.Money  `yaml:"default_monthly_fee"` // В валюте договора
+	GracePeriodDays            int           `yaml:"grace_period_days"`
+	DisableOnInsufficientFunds bool          `yaml:"disable_on_insufficient_funds"`
+	ProcessingTime             string        `yaml:"processing_time"` // "02:00" - время обработки
+	EnableProration            bool          `yaml:"enable_proration"`
+	Workers                    int           `yaml:"workers"`     // Параллельных обработчиков в прогоне, по умолчанию 8
+	BatchSize                  int           `yaml:"batch_size"`  // Аккаунтов между контрольными точками, по умолчанию 500
+	StaleAfter                 time.Duration `yaml:"stale_after"` // Прогон без отметки (heartbeat) дольше считается прерванным, по умолчанию 10m
 }
 
+// ErrChargeNotFound is returned for unknown subscription charge IDs
+var ErrChargeNotFound = errors.New("subscription charge not found")
+
+// ErrAccountNotFound is returned for unknown account IDs
+var ErrAccountNotFound = errors.New("account not found")
+
+// Subscription charge statuses of subscription_charges
+const (
+	ChargeStatusPending = "pending" // Claimed, not debited yet (or interrupted)
+	ChargeStatusSuccess = "success"
+	ChargeStatusFailed  = "failed"
+)
+
 // SubscriptionCharge represents a subscription charge record
+// Charges are kept in subscription_charges, one row per account and period.
 type SubscriptionCharge struct {
-	AccountID     int       `json:"account_id"`
-	PlanID        int       `json:"plan_id"`
-	Amount        float64   `json:"amount"`
-	ChargeDate    time.Time `json:"charge_date"`
-	PeriodStart   time.Time `json:"period_start"`
-	PeriodEnd     time.Time `json:"period_end"`
-	Status        string    `json:"status"` // "success", "failed", "pending"
-	FailureReason string    `json:"failure_reason,omitempty"`
-	TransactionID *int      `json:"transaction_id,omitempty"`
+	ID            int          `json:"id,omitempty"`
+	AccountID     int          `json:"account_id"`
+	Login         string       `json:"login,omitempty"`
+	PlanID        int          `json:"plan_id"`
+	Amount        models.Money `json:"amount"`
+	Currency      int          `json:"currency"` // Currency of Amount: plan currency or contract currency for the default fee
+	ChargeDate    time.Time    `json:"charge_date"`
+	PeriodStart   time.Time    `json:"period_start"`
+	PeriodEnd     time.Time    `json:"period_end"`
+	Status        string       `json:"status"` // "success", "failed", "pending"
+	FailureReason string       `json:"failure_reason,omitempty"`
+	TransactionID *int         `json:"transaction_id,omitempty"`
+	Attempts      int          `json:"attempts"`
+
+	Items []models.ChargeItem `json:"items,omitempty"` // Plan fee, add-ons and discounts making up Amount
+}
+
+// ChargeStats summarizes subscription charges of periods starting in one month
+type ChargeStats struct {
+	PeriodStart time.Time        `json:"period_start"`
+	Success     int              `json:"success"`
+	Failed      int              `json:"failed"`
+	Pending     int              `json:"pending"`
+	Revenue     []CurrencyAmount `json:"revenue"` // Successful charges by fee currency
+	SuccessRate float64          `json:"success_rate"`
+}
+
+// ChargePreview is what charging an account for a period would do, nothing is recorded
+type ChargePreview struct {
+	Charge       *SubscriptionCharge `json:"charge"`
+	BillingCycle string              `json:"billing_cycle"`
+	Prorated     bool                `json:"prorated"`
+	Charged      bool                `json:"charged"`   // The period is already charged successfully
+	Available    models.Money        `json:"available"` // Balance + credit, contract currency
+	CanCharge    bool                `json:"can_charge"`
+}
+
+// CurrencyAmount is an amount in one currency
+type CurrencyAmount struct {
+	Currency int          `json:"currency"`
+	Amount   models.Money `json:"amount"`
 }
 
 // NewSubscriptionService creates a new subscription service
-func NewSubscriptionService(db *database.PostgreSQL, logger *zap.Logger, config *SubscriptionConfig) *SubscriptionService {
+func NewSubscriptionService(db *database.PostgreSQL, rates *currency.Service, logger *zap.Logger, config *SubscriptionConfig) *SubscriptionService {
 	return &SubscriptionService{
-		db:     db,
-		logger: logger,
-		config: config,
+		db:      db,
+		rates:   rates,
+		logger:  logger,
+		config:  config,
+		running: make(map[int]context.CancelFunc),
 	}
 }
 
-// ProcessMonthlyCharges processes monthly subscription charges for all active accounts
-// Основная функция для ежемесячных списаний
-func (s *SubscriptionService) ProcessMonthlyCharges(targetDate time.Time) error {
+// ProcessMonthlyCharges charges every active account for its billing period containing targetDate
+// Основная функция для ежемесячных списаний. Неудачные списания периода повторяются.
+// Runs as a charge run (see charge_run.go) and waits for it; accounts that could not be
+// processed make it return ErrRunErrors.
+func (s *SubscriptionService) ProcessMonthlyCharges(targetDate time.Time) (*ChargeRun, error) {
 	s.logger.Info("Starting monthly subscription charges processing",
 		zap.Time("target_date", targetDate))
 
-	// Получаем всех активных пользователей
-	accounts, err := s.getActiveAccountsForBilling(targetDate)
+	return s.processRun(ChargeRunMonthly, targetDate)
+}
+
+// ProcessDueCharges charges accounts whose current billing period is not charged yet
+// The daily scheduler calls it: calendar, anniversary, quarterly, yearly and N-days cycles
+// start on different days, so every account is billed on the first run of its period.
+// Failed charges of the period are left to dunning.
+func (s *SubscriptionService) ProcessDueCharges(now time.Time) (*ChargeRun, error) {
+	s.logger.Info("Starting due subscription charges processing",
+		zap.Time("now", now))
+
+	return s.processRun(ChargeRunDue, now)
+}
+
+func (s *SubscriptionService) processRun(kind string, targetDate time.Time) (*ChargeRun, error) {
+	run, err := s.CreateRun(kind, targetDate)
 	if err != nil {
-		return fmt.Errorf("failed to get active accounts: %w", err)
+		return nil, err
+	}
+	if err := s.ExecuteRun(context.Background(), run); err != nil {
+		return run, err
 	}
+	if run.Errors > 0 {
+		return run, fmt.Errorf("%w: %d of %d accounts", ErrRunErrors, run.Errors, run.Processed)
+	}
+	return run, nil
+}
 
-	s.logger.Info("Found accounts for billing", zap.Int("count", len(accounts)))
+// processAccountCharge processes subscription charge for single account
+// Returns false when nothing was charged: no fee, the period is already paid or, without
+// retryFailed, its charge already failed.
+func (s *SubscriptionService) processAccountCharge(account *models.AccountWithSubscription, targetDate time.Time, retryFailed bool, runID int) (*SubscriptionCharge, bool, error) {
+	charge, _, _, err := s.buildCharge(account, targetDate)
+	if err != nil {
+		return nil, false, err
+	}
+	if charge.Amount.Sign() <= 0 {
+		// No subscription fee for this account or the period is covered by a previous cycle
+		charge.Status = ChargeStatusSuccess
+		return charge, false, nil
+	}
 
-	successCount := 0
-	failureCount := 0
+	// Claim the period in the ledger, a successful charge is never repeated
+	claimed, err := s.claimCharge(charge, retryFailed, runID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to record charge: %w", err)
+	}
+	if !claimed {
+		s.logger.Debug("Account already charged for this period",
+			zap.Int("account_id", account.ID),
+			zap.Time("period_start", charge.PeriodStart))
+		return charge, false, nil
+	}
 
-	for _, account := range accounts {
-		charge, err := s.processAccountCharge(account, targetDate)
-		if err != nil {
-			s.logger.Error("Failed to process account charge",
-				zap.Int("account_id", account.ID),
-				zap.String("login", account.Login),
-				zap.Error(err))
-			failureCount++
-			continue
-		}
+	charge, err = s.attemptCharge(charge, account.Balance.Add(account.Credit), account.Currency)
+	return charge, true, err
+}
 
-		if charge.Status == "success" {
-			successCount++
-		} else {
-			failureCount++
-		}
+// buildCharge computes the charge of the account's billing period containing targetDate
+// The period fee (see periodFee) is prorated for accounts activated during the period and
+// for the part of the period already paid under a previous cycle (the contract or plan
+// cycle changed); the returned flag reports it.
+func (s *SubscriptionService) buildCharge(account *models.AccountWithSubscription, targetDate time.Time) (*SubscriptionCharge, *models.BillingCycle, bool, error) {
+	settings, err := s.planSettings(account)
+	if err != nil {
+		return nil, nil, false, err
+	}
 
-		s.logger.Info("Processed account charge",
-			zap.Int("account_id", account.ID),
-			zap.String("login", account.Login),
-			zap.String("status", charge.Status),
-			zap.Float64("amount", charge.Amount))
+	cycle, err := s.billingCycle(account, settings)
+	if err != nil {
+		return nil, nil, false, err
 	}
+	periodStart, periodEnd := cycle.Period(targetDate, account.BillingAnchor)
 
-	s.logger.Info("Monthly charges processing completed",
-		zap.Int("success", successCount),
-		zap.Int("failures", failureCount),
-		zap.Int("total", len(accounts)))
+	_, feeCurrency := s.getMonthlyFee(account, settings)
+	charge := &SubscriptionCharge{
+		AccountID:   account.ID,
+		Login:       account.Login,
+		PlanID:      account.PId,
+		Currency:    feeCurrency,
+		ChargeDate:  time.Now(),
+		PeriodStart: periodStart,
+		PeriodEnd:   periodEnd,
+		Status:      ChargeStatusPending,
+	}
 
-	return nil
+	// Apply proration if enabled and account is new
+	from := periodStart
+	if s.config.EnableProration && account.CreatedAt.After(from) {
+		from = account.CreatedAt
+	}
+	paidUntil, err := s.paidUntil(account.ID, periodStart, periodEnd)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to check previous periods: %w", err)
+	}
+	if !paidUntil.IsZero() && !paidUntil.Before(from) {
+		from = paidUntil.Add(time.Second)
+	}
+
+	charge.Amount, charge.Items, err = s.periodFee(account, settings, cycle, from, periodStart, periodEnd)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return charge, &cycle, from.After(periodStart), nil
 }
 
-// processAccountCharge processes subscription charge for single account
-func (s *SubscriptionService) processAccountCharge(account *models.AccountWithSubscription, targetDate time.Time) (*SubscriptionCharge, error) {
-	// Parse plan data
-	planData, err := database.ParsePlanDataFromJSON(account.PData)
+// PreviewCharge computes the charge of the account's billing period containing targetDate
+func (s *SubscriptionService) PreviewCharge(accountID int, targetDate time.Time) (*ChargePreview, error) {
+	account, err := s.getAccountForBilling(s.db.GetDB(), accountID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse plan data: %w", err)
+		return nil, err
+	}
+	charge, cycle, prorated, err := s.buildCharge(account, targetDate)
+	if err != nil {
+		return nil, err
 	}
 
-	// Get subscription fee from plan data or use default
-	monthlyFee := s.getMonthlyFee(planData)
-	if monthlyFee <= 0 {
-		// No subscription fee for this account
-		return &SubscriptionCharge{
-			AccountID:  account.ID,
-			PlanID:     account.PId,
-			Amount:     0,
-			ChargeDate: targetDate,
-			Status:     "success",
-		}, nil
+	preview := &ChargePreview{
+		Charge:       charge,
+		BillingCycle: cycle.String(),
+		Prorated:     prorated && charge.Amount.Sign() > 0,
+		Available:    account.Balance.Add(account.Credit),
 	}
 
-	// Calculate billing period
-	periodStart, periodEnd := s.calculateBillingPeriod(targetDate)
+	err = s.db.GetDB().QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM subscription_charges
+			WHERE account_id = $1 AND period_start = $2 AND status = 'success')`,
+		accountID, charge.PeriodStart).Scan(&preview.Charged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check ledger: %w", err)
+	}
 
-	// Check if already charged for this period
-	alreadyCharged, err := s.isAlreadyCharged(account.ID, periodStart, periodEnd)
+	contractAmount, err := s.rates.Convert(charge.Amount, charge.Currency, account.Currency)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check existing charges: %w", err)
+		return nil, fmt.Errorf("failed to convert fee: %w", err)
 	}
+	preview.CanCharge = preview.Available.Cmp(contractAmount) >= 0
+	return preview, nil
+}
 
-	if alreadyCharged {
-		s.logger.Debug("Account already charged for this period",
-			zap.Int("account_id", account.ID))
-		return &SubscriptionCharge{
-			AccountID: account.ID,
-			Status:    "success", // Already processed
-		}, nil
+// RetryCharge charges a failed or interrupted ledger charge again, e.g. after a payment
+// A charge that is already successful is returned as is.
+func (s *SubscriptionService) RetryCharge(chargeID int) (*SubscriptionCharge, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT `+chargeColumns+`
+		FROM subscription_charges sc
+		JOIN accounts a ON a.id = sc.account_id
+		WHERE sc.id = $1`, chargeID)
+	if err != nil {
+		return nil, err
+	}
+	charges, err := scanCharges(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(charges) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrChargeNotFound, chargeID)
+	}
+	charge := charges[0]
+	if charge.Status == ChargeStatusSuccess {
+		return charge, nil
 	}
 
-	// Apply proration if enabled and account is new
-	finalAmount := monthlyFee
-	if s.config.EnableProration {
-		finalAmount = s.calculateProratedAmount(monthlyFee, account.CreatedAt, periodStart, periodEnd)
+	var available models.Money
+	var contractCurrency int
+	err = s.db.GetDB().QueryRow(`
+		SELECT c.balance + COALESCE(sp.credit, 0.0), c.currency_id
+		FROM accounts a
+		LEFT OUTER JOIN service_params sp ON a.id = sp.account_id
+		JOIN contracts c ON a.contract_id = c.id
+		WHERE a.id = $1`, charge.AccountID).Scan(&available, &contractCurrency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch balance: %w", err)
 	}
 
-	// Create charge record
-	charge := &SubscriptionCharge{
-		AccountID:   account.ID,
-		PlanID:      account.PId,
-		Amount:      finalAmount,
-		ChargeDate:  time.Now(),
-		PeriodStart: periodStart,
-		PeriodEnd:   periodEnd,
-		Status:      "pending",
-	}
-
-	// Check if account has sufficient balance (including credit)
-	availableBalance := account.Balance + account.Credit
-	if availableBalance < finalAmount {
-		charge.Status = "failed"
-		charge.FailureReason = "insufficient_funds"
-
-		// Disable account if configured
-		if s.config.DisableOnInsufficientFunds {
-			err = s.disableAccount(account.ID)
-			if err != nil {
-				s.logger.Error("Failed to disable account",
-					zap.Int("account_id", account.ID),
-					zap.Error(err))
-			}
-		}
+	err = s.db.GetDB().QueryRow(`
+		UPDATE subscription_charges SET status = 'pending', failure_reason = '',
+			attempts = attempts + 1, updated_at = NOW()
+		WHERE id = $1 AND status <> 'success'
+		RETURNING attempts`, charge.ID).Scan(&charge.Attempts)
+	if err == sql.ErrNoRows {
+		charge.Status = ChargeStatusSuccess // Charged concurrently
+		return charge, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to record charge: %w", err)
+	}
+	charge.Status = ChargeStatusPending
+	charge.FailureReason = ""
+
+	s.logger.Info("Retrying subscription charge",
+		zap.Int("charge_id", charge.ID),
+		zap.Int("account_id", charge.AccountID),
+		zap.Int("attempt", charge.Attempts))
 
+	return s.attemptCharge(charge, available, contractCurrency)
+}
+
+// attemptCharge debits a claimed charge if balance + credit covers it, otherwise marks it failed
+// Failed charges are followed up by dunning (see the dunning service), not here.
+func (s *SubscriptionService) attemptCharge(charge *SubscriptionCharge, available models.Money, contractCurrency int) (*SubscriptionCharge, error) {
+	// Check if account has sufficient balance (including credit) in contract currency
+	contractAmount, err := s.rates.Convert(charge.Amount, charge.Currency, contractCurrency)
+	if err != nil {
+		s.failCharge(charge, fmt.Sprintf("conversion_failed: %v", err))
+		return nil, fmt.Errorf("failed to convert fee: %w", err)
+	}
+	if available.Cmp(contractAmount) < 0 {
+		s.failCharge(charge, "insufficient_funds")
 		return charge, nil
 	}
 
 	// Perform debit transaction
 	comment := fmt.Sprintf("Monthly subscription fee for period %s - %s",
-		periodStart.Format("2006-01-02"),
-		periodEnd.Format("2006-01-02"))
+		charge.PeriodStart.Format("2006-01-02"),
+		charge.PeriodEnd.Format("2006-01-02"))
 
-	var newBalance float64
-	err = s.db.GetDB().QueryRow(models.DebitTransactionQuery,
-		account.ID, finalAmount, comment, nil).Scan(&newBalance)
-	if err != nil {
-		charge.Status = "failed"
-		charge.FailureReason = fmt.Sprintf("transaction_failed: %v", err)
+	if err := s.debitCharge(charge, comment); err != nil {
+		s.failCharge(charge, fmt.Sprintf("transaction_failed: %v", err))
 		return charge, nil
 	}
 
-	// Update charge record
-	charge.Status = "success"
+	return charge, nil
+}
+
+// GracePeriod is how long a failed charge may stay unpaid before the account is suspended
+func (s *SubscriptionService) GracePeriod() time.Duration {
+	return time.Duration(s.config.GracePeriodDays) * 24 * time.Hour
+}
+
+// SuspendOnInsufficientFunds reports whether unpaid accounts are disabled after the grace period
+func (s *SubscriptionService) SuspendOnInsufficientFunds() bool {
+	return s.config.DisableOnInsufficientFunds
+}
 
-	// Save charge record to database
-	err = s.saveChargeRecord(charge)
+// getActiveAccountsForBilling gets all active accounts that need billing
+func (s *SubscriptionService) getActiveAccountsForBilling() ([]*models.AccountWithSubscription, error) {
+	return s.fetchAccountsForBilling(s.db.GetDB(), `WHERE a.active = true ORDER BY a.id`)
+}
+
+// getAccountForBilling gets one account with its billing settings, active or not
+func (s *SubscriptionService) getAccountForBilling(q queryer, accountID int) (*models.AccountWithSubscription, error) {
+	accounts, err := s.fetchAccountsForBilling(q, `WHERE a.id = $1`, accountID)
 	if err != nil {
-		s.logger.Error("Failed to save charge record",
-			zap.Int("account_id", account.ID),
-			zap.Error(err))
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrAccountNotFound, accountID)
 	}
+	return accounts[0], nil
+}
 
-	return charge, nil
+// queryer is *sql.DB or *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
 }
 
-// getActiveAccountsForBilling gets all active accounts that need billing
-func (s *SubscriptionService) getActiveAccountsForBilling(targetDate time.Time) ([]*models.AccountWithSubscription, error) {
+func (s *SubscriptionService) fetchAccountsForBilling(q queryer, where string, args ...interface{}) ([]*models.AccountWithSubscription, error) {
 	query := `
 		SELECT a.id, a.login, a.plan_data, a.plan_id, a.created_at,
 			p.auth_algo, p.acct_algo, c.balance, c.currency_id, 
-			COALESCE(sp.credit, 0.0) as credit
+			COALESCE(sp.credit, 0.0) as credit, p.currency_id as plan_currency_id,
+			COALESCE(c.billing_cycle, '') as billing_cycle,
+			COALESCE(c.billing_anchor::timestamp, a.created_at) as billing_anchor
 		FROM accounts a 
 		LEFT OUTER JOIN service_params sp ON a.id=sp.account_id
 		JOIN plans p ON a.plan_id = p.id
 		JOIN contracts c ON a.contract_id = c.id
-		WHERE a.active = true
-		ORDER BY a.id`
+		` + where
 
-	rows, err := s.db.GetDB().Query(query)
+	rows, err := q.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -235,6 +411,9 @@ func (s *SubscriptionService) getActiveAccountsForBilling(targetDate time.Time)
 			&account.Balance,
 			&account.Currency,
 			&account.Credit,
+			&account.PlanCurrency,
+			&account.BillingCycle,
+			&account.BillingAnchor,
 		)
 		if err != nil {
 			return nil, err
@@ -245,124 +424,285 @@ func (s *SubscriptionService) getActiveAccountsForBilling(targetDate time.Time)
 	return accounts, rows.Err()
 }
 
-// getMonthlyFee extracts monthly fee from plan data
-func (s *SubscriptionService) getMonthlyFee(planData map[string]interface{}) float64 {
-	// Check for monthly_fee in plan data
-	if fee, exists := planData["MONTHLY_FEE"]; exists {
-		if feeFloat, ok := fee.(float64); ok {
-			return feeFloat
-		}
-		if feeInt, ok := fee.(int); ok {
-			return float64(feeInt)
-		}
+// planSettings parses plan data of the account
+func (s *SubscriptionService) planSettings(account *models.AccountWithSubscription) (*models.PlanSettings, error) {
+	planData, err := database.ParsePlanDataFromJSON(account.PData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse plan data: %w", err)
 	}
+	return models.ParsePlanSettings(planData)
+}
 
-	// Check for subscription_fee
-	if fee, exists := planData["SUBSCRIPTION_FEE"]; exists {
-		if feeFloat, ok := fee.(float64); ok {
-			return feeFloat
-		}
+// getMonthlyFee extracts monthly fee (MONTHLY_FEE or SUBSCRIPTION_FEE) from plan settings and its currency
+// Plan fees are priced in the plan currency, the configured default in the contract currency.
+func (s *SubscriptionService) getMonthlyFee(account *models.AccountWithSubscription, settings *models.PlanSettings) (models.Money, int) {
+	if settings.MonthlyFee.Sign() > 0 {
+		return settings.MonthlyFee, account.PlanCurrency
 	}
 
 	// Use default from config
-	return s.config.DefaultMonthlyFee
+	return s.config.DefaultMonthlyFee, account.Currency
 }
 
-// calculateBillingPeriod calculates billing period for given date
-func (s *SubscriptionService) calculateBillingPeriod(targetDate time.Time) (time.Time, time.Time) {
-	// Start of the month
-	periodStart := time.Date(targetDate.Year(), targetDate.Month(), 1, 0, 0, 0, 0, targetDate.Location())
+// billingCycle returns the cycle of the account: contract billing_cycle, plan BILLING_CYCLE or calendar month
+func (s *SubscriptionService) billingCycle(account *models.AccountWithSubscription, settings *models.PlanSettings) (models.BillingCycle, error) {
+	if account.BillingCycle != "" {
+		cycle, err := models.ParseBillingCycle(account.BillingCycle)
+		if err != nil {
+			return models.BillingCycle{}, fmt.Errorf("contract billing cycle: %w", err)
+		}
+		return cycle, nil
+	}
+	if settings.BillingCycle.Kind != "" {
+		return settings.BillingCycle, nil
+	}
+	return models.DefaultBillingCycle, nil
+}
 
-	// End of the month
-	periodEnd := periodStart.AddDate(0, 1, 0).Add(-time.Second)
+// cycleFee prices one cycle from the monthly fee with BILLING_CYCLE_DISCOUNT percent off
+func cycleFee(cycle models.BillingCycle, monthlyFee, discount models.Money) models.Money {
+	return models.PercentOff(cycle.Fee(monthlyFee), discount)
+}
 
-	return periodStart, periodEnd
+// calculateBillingPeriod calculates the calendar month period for given date
+func (s *SubscriptionService) calculateBillingPeriod(targetDate time.Time) (time.Time, time.Time) {
+	return models.DefaultBillingCycle.Period(targetDate, targetDate)
 }
 
-// calculateProratedAmount calculates prorated amount for partial month
-func (s *SubscriptionService) calculateProratedAmount(monthlyFee float64, accountCreated, periodStart, periodEnd time.Time) float64 {
+// calculateProratedAmount calculates the part of the fee for the period from from to its end
+// from is the activation of a new account or the end of a period paid under a previous cycle.
+func (s *SubscriptionService) calculateProratedAmount(fee models.Money, from, periodStart, periodEnd time.Time) models.Money {
 	// If account was created before billing period, charge full amount
-	if accountCreated.Before(periodStart) {
-		return monthlyFee
+	if from.Before(periodStart) {
+		return fee
 	}
 
 	// If account was created after billing period, no charge
-	if accountCreated.After(periodEnd) {
-		return 0
+	if from.After(periodEnd) {
+		return models.Money{}
 	}
 
-	// Calculate proration
-	totalDays := periodEnd.Sub(periodStart).Hours() / 24
-	remainingDays := periodEnd.Sub(accountCreated).Hours() / 24
+	// Calculate proration by whole seconds so the result does not depend on float rounding
+	total := periodEnd.Sub(periodStart) / time.Second
+	remaining := periodEnd.Sub(from) / time.Second
 
-	if remainingDays <= 0 {
-		return 0
+	if remaining <= 0 || total <= 0 {
+		return models.Money{}
 	}
 
-	proratedAmount := monthlyFee * (remainingDays / totalDays)
-	return proratedAmount
+	return fee.MulDiv(uint64(remaining), uint64(total))
 }
 
-// isAlreadyCharged checks if account was already charged for the period
-func (s *SubscriptionService) isAlreadyCharged(accountID int, periodStart, periodEnd time.Time) (bool, error) {
-	// Check fin_transactions for subscription charges
-	var count int
+// paidUntil returns the end of other successfully charged periods overlapping the period
+// They were charged under another cycle or, after a plan change, for the rest of the period
+// under the new plan; zero time when there are none.
+func (s *SubscriptionService) paidUntil(accountID int, periodStart, periodEnd time.Time) (time.Time, error) {
+	var paidUntil sql.NullTime
 	err := s.db.GetDB().QueryRow(`
-		SELECT COUNT(*) FROM fin_transactions ft
-		JOIN accounts a ON ft.contract_id = (SELECT contract_id FROM accounts WHERE id = $1)
-		WHERE ft.comment LIKE 'Monthly subscription fee%'
-		AND ft.created_at >= $2 AND ft.created_at <= $3
-		AND ft.amount < 0`, // Debit transactions
-		accountID, periodStart, periodEnd).Scan(&count)
+		SELECT MAX(period_end) FROM subscription_charges
+		WHERE account_id = $1 AND status = 'success' AND period_start <> $2
+		AND period_start <= $3 AND period_end >= $2`,
+		accountID, periodStart, periodEnd).Scan(&paidUntil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return paidUntil.Time, nil
+}
 
-	return count > 0, err
+// claimCharge records the charge as pending in subscription_charges and counts the attempt
+// Returns false when the period is already charged successfully, or has a failed charge
+// and retryFailed is off. Interrupted (pending) charges are always claimed again.
+// The charge is attributed to charge run runID.
+func (s *SubscriptionService) claimCharge(charge *SubscriptionCharge, retryFailed bool, runID int) (bool, error) {
+	reclaim := `subscription_charges.status = 'pending'`
+	if retryFailed {
+		reclaim = `subscription_charges.status <> 'success'`
+	}
+
+	items, err := marshalChargeItems(charge.Items)
+	if err != nil {
+		return false, err
+	}
+
+	err = s.db.GetDB().QueryRow(`
+		INSERT INTO subscription_charges (account_id, plan_id, period_start, period_end, amount, currency_id, status, attempts, run_id, items)
+		VALUES ($1, $2, $3, $4, $5, $6, 'pending', 1, $7, $8)
+		ON CONFLICT (account_id, period_start) DO UPDATE SET
+			plan_id = EXCLUDED.plan_id, period_end = EXCLUDED.period_end,
+			amount = EXCLUDED.amount, currency_id = EXCLUDED.currency_id, items = EXCLUDED.items,
+			status = 'pending', failure_reason = '', run_id = EXCLUDED.run_id,
+			attempts = subscription_charges.attempts + 1, updated_at = NOW()
+		WHERE `+reclaim+`
+		RETURNING id, attempts`,
+		charge.AccountID, charge.PlanID, charge.PeriodStart, charge.PeriodEnd, charge.Amount, charge.Currency,
+		sql.NullInt64{Int64: int64(runID), Valid: runID != 0}, items,
+	).Scan(&charge.ID, &charge.Attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
 }
 
-// saveChargeRecord saves charge record to custom table (optional)
-func (s *SubscriptionService) saveChargeRecord(charge *SubscriptionCharge) error {
-	// This would save to a subscription_charges table if it exists
-	// For now, we rely on fin_transactions table
+// debitCharge debits the fee and marks the charge successful in one transaction
+// The ledger row is locked first, so concurrent runs cannot debit the same period twice.
+func (s *SubscriptionService) debitCharge(charge *SubscriptionCharge, comment string) error {
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(`SELECT status FROM subscription_charges WHERE id = $1 FOR UPDATE`, charge.ID).Scan(&status)
+	if err != nil {
+		return fmt.Errorf("failed to lock charge: %w", err)
+	}
+	if status == ChargeStatusSuccess {
+		charge.Status = ChargeStatusSuccess
+		return nil
+	}
+
+	_, transactionID, err := s.rates.DebitTx(tx, charge.AccountID, charge.Amount, charge.Currency, comment)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE subscription_charges SET status = 'success', failure_reason = '', transaction_id = $1, updated_at = NOW()
+		WHERE id = $2`, transactionID, charge.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update charge: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit charge: %w", err)
+	}
+
+	charge.Status = ChargeStatusSuccess
+	charge.TransactionID = &transactionID
 	return nil
 }
 
-// disableAccount disables account due to insufficient funds
-func (s *SubscriptionService) disableAccount(accountID int) error {
-	_, err := s.db.GetDB().Exec(`UPDATE accounts SET active = false WHERE id = $1`, accountID)
-	return err
+// failCharge marks the charge failed with reason, the next run retries it
+func (s *SubscriptionService) failCharge(charge *SubscriptionCharge, reason string) {
+	charge.Status = ChargeStatusFailed
+	charge.FailureReason = reason
+
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	_, err := s.db.GetDB().Exec(`
+		UPDATE subscription_charges SET status = 'failed', failure_reason = $1, updated_at = NOW()
+		WHERE id = $2`, reason, charge.ID)
+	if err != nil {
+		s.logger.Error("Failed to save charge record",
+			zap.Int("account_id", charge.AccountID),
+			zap.Error(err))
+	}
 }
 
-// GetAccountChargeHistory returns charge history for account
+// chargeColumns are the subscription_charges columns read by scanCharges
+const chargeColumns = `sc.id, sc.account_id, a.login, sc.plan_id, sc.amount, sc.currency_id, sc.updated_at,
+	sc.period_start, sc.period_end, sc.status, sc.failure_reason, sc.transaction_id, sc.attempts, sc.items`
+
+// GetAccountChargeHistory returns charge history for account, newest period first
 func (s *SubscriptionService) GetAccountChargeHistory(accountID int, limit int) ([]*SubscriptionCharge, error) {
-	query := `
-		SELECT ft.amount, ft.created_at, ft.comment, ft.balance_after
-		FROM fin_transactions ft
-		JOIN accounts a ON ft.contract_id = (SELECT contract_id FROM accounts WHERE id = $1)
-		WHERE ft.comment LIKE 'Monthly subscription fee%'
-		AND ft.amount < 0
-		ORDER BY ft.created_at DESC
-		LIMIT $2`
-
-	rows, err := s.db.GetDB().Query(query, accountID, limit)
+	rows, err := s.db.GetDB().Query(`
+		SELECT `+chargeColumns+`
+		FROM subscription_charges sc
+		JOIN accounts a ON a.id = sc.account_id
+		WHERE sc.account_id = $1
+		ORDER BY sc.period_start DESC
+		LIMIT $2`, accountID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanCharges(rows)
+}
+
+// GetFailedCharges returns failed charges and charges left pending, most recent first
+func (s *SubscriptionService) GetFailedCharges(limit int) ([]*SubscriptionCharge, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT `+chargeColumns+`
+		FROM subscription_charges sc
+		JOIN accounts a ON a.id = sc.account_id
+		WHERE sc.status <> 'success'
+		ORDER BY sc.updated_at DESC
+		LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanCharges(rows)
+}
+
+// GetChargeStats counts charges of periods starting in the calendar month containing targetDate
+// With anniversary and other cycles periods of different accounts start on different days.
+func (s *SubscriptionService) GetChargeStats(targetDate time.Time) (*ChargeStats, error) {
+	periodStart, periodEnd := s.calculateBillingPeriod(targetDate)
+	stats := &ChargeStats{PeriodStart: periodStart, Revenue: []CurrencyAmount{}}
+
+	rows, err := s.db.GetDB().Query(`
+		SELECT status, currency_id, COUNT(*), COALESCE(SUM(amount), 0)
+		FROM subscription_charges
+		WHERE period_start BETWEEN $1 AND $2
+		GROUP BY status, currency_id
+		ORDER BY currency_id`, periodStart, periodEnd)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var charges []*SubscriptionCharge
 	for rows.Next() {
-		charge := &SubscriptionCharge{}
-		var comment string
-		var balanceAfter float64
-
-		err := rows.Scan(&charge.Amount, &charge.ChargeDate, &comment, &balanceAfter)
-		if err != nil {
+		var status string
+		var currencyID, count int
+		var amount models.Money
+		if err := rows.Scan(&status, &currencyID, &count, &amount); err != nil {
 			return nil, err
 		}
 
-		charge.AccountID = accountID
-		charge.Amount = -charge.Amount // Convert to positive
-		charge.Status = "success"
+		switch status {
+		case ChargeStatusSuccess:
+			stats.Success += count
+			stats.Revenue = append(stats.Revenue, CurrencyAmount{Currency: currencyID, Amount: amount})
+		case ChargeStatusFailed:
+			stats.Failed += count
+		default:
+			stats.Pending += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if total := stats.Success + stats.Failed + stats.Pending; total > 0 {
+		stats.SuccessRate = float64(stats.Success) / float64(total) * 100
+	}
+	return stats, nil
+}
 
+func scanCharges(rows *sql.Rows) ([]*SubscriptionCharge, error) {
+	defer rows.Close()
+
+	charges := []*SubscriptionCharge{}
+	for rows.Next() {
+		charge := &SubscriptionCharge{}
+		var transactionID sql.NullInt64
+		var items string
+		err := rows.Scan(&charge.ID, &charge.AccountID, &charge.Login, &charge.PlanID, &charge.Amount,
+			&charge.Currency, &charge.ChargeDate, &charge.PeriodStart, &charge.PeriodEnd, &charge.Status,
+			&charge.FailureReason, &transactionID, &charge.Attempts, &items)
+		if err != nil {
+			return nil, err
+		}
+		if items != "" {
+			if err := json.Unmarshal([]byte(items), &charge.Items); err != nil {
+				return nil, fmt.Errorf("failed to parse items of charge %d: %w", charge.ID, err)
+			}
+		}
+		if transactionID.Valid {
+			id := int(transactionID.Int64)
+			charge.TransactionID = &id
+		}
 		charges = append(charges, charge)
 	}
 
@@ -394,7 +734,7 @@ func (p *ScheduledProcessor) RunMonthlyCharges(targetDate *time.Time) error {
 
 	p.logger.Info("Running scheduled monthly charges", zap.Time("date", processDate))
 
-	err := p.service.ProcessMonthlyCharges(processDate)
+	_, err := p.service.ProcessMonthlyCharges(processDate)
 	if err != nil {
 		p.logger.Error("Failed to process monthly charges", zap.Error(err))
 		return err
@@ -403,6 +743,20 @@ func (p *ScheduledProcessor) RunMonthlyCharges(targetDate *time.Time) error {
 	return nil
 }
 
+// RunDueCharges charges accounts whose billing period has started and is not charged yet
+func (p *ScheduledProcessor) RunDueCharges() error {
+	now := time.Now()
+	p.logger.Info("Running scheduled due charges", zap.Time("date", now))
+
+	_, err := p.service.ProcessDueCharges(now)
+	if err != nil {
+		p.logger.Error("Failed to process due charges", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
 // StartDailyScheduler starts daily scheduler for subscription charges
 func (p *ScheduledProcessor) StartDailyScheduler() {
 	go func() {
@@ -424,12 +778,9 @@ func (p *ScheduledProcessor) StartDailyScheduler() {
 
 			time.Sleep(sleepDuration)
 
-			// Check if it's the first day of the month
-			if nextRun.Day() == 1 {
-				err := p.RunMonthlyCharges(nil)
-				if err != nil {
-					p.logger.Error("Daily scheduled processing failed", zap.Error(err))
-				}
+			// Every day: accounts are due on the first day of their own billing period
+			if err := p.RunDueCharges(); err != nil {
+				p.logger.Error("Daily scheduled processing failed", zap.Error(err))
 			}
 		}
 	}()
@@ -0,0 +1,116 @@
+package billing
+
+import (
+	"strconv"
+	"time"
+
+	"netspire-go/internal/models"
+)
+
+// maxSessionTimeout is the longest Session-Timeout sent; a budget lasting longer sends none
+const maxSessionTimeout = 86400
+
+// TimeTrafficClass is the session detail class online time charges are recorded under
+const TimeTrafficClass = "time"
+
+// TimeAccounting is implemented by algorithms that charge online time
+// Sessions call AccountTime on interim updates and at stop with the seconds already paid.
+type TimeAccounting interface {
+	AccountTime(currency int, planData map[string]interface{}, sessionData map[string]interface{}, startedAt, now time.Time, billedSeconds int64) (*models.BillingResult, error)
+}
+
+// TimeAlgorithm charges by online time for hourly and daily passes: TIME_INTERVALS
+// prices per hour, billed in TIME_INCREMENT steps and capped by TIME_DAY_CAP. Traffic is free.
+type TimeAlgorithm struct{}
+
+func NewTimeAlgorithm() *TimeAlgorithm {
+	return &TimeAlgorithm{}
+}
+
+func (a *TimeAlgorithm) Authorize(currency int, balance models.Money, planData map[string]interface{}) (*models.BillingResult, error) {
+	now := time.Now()
+
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check access intervals
+	accept, shaper := settings.CheckAccessAt(now)
+	if !accept {
+		return &models.BillingResult{
+			Decision: "reject",
+			Reason:   "time_of_day",
+		}, nil
+	}
+
+	replies := shaperReplies(shaper)
+	if !settings.HasTimePrices() {
+		return &models.BillingResult{
+			Decision: "accept",
+			Replies:  replies,
+		}, nil
+	}
+
+	// Session-Timeout: how long balance + credit pays for
+	timeout := settings.AffordableSeconds(now, balance.Add(settings.Credit), maxSessionTimeout)
+	if timeout <= 0 {
+		return &models.BillingResult{
+			Decision: "reject",
+			Reason:   "low_balance",
+		}, nil
+	}
+	if timeout < maxSessionTimeout {
+		replies = append(replies, models.RADIUSReply{
+			Name:  "Session-Timeout",
+			Value: strconv.FormatInt(timeout, 10),
+		})
+	}
+
+	return &models.BillingResult{
+		Decision: "accept",
+		Replies:  replies,
+	}, nil
+}
+
+func (a *TimeAlgorithm) Account(currency int, planData map[string]interface{}, sessionData map[string]interface{}, direction string, targetIP string, octets uint64) (*models.BillingResult, error) {
+	// Traffic of time plans is not charged
+	return &models.BillingResult{
+		Decision:     "accept",
+		TrafficClass: trafficClass(sessionData, targetIP),
+		PlanData:     planData,
+	}, nil
+}
+
+// AccountTime charges online time from startedAt to now that is not paid yet
+// The started increment is charged in advance, so billedSeconds may run ahead of now.
+func (a *TimeAlgorithm) AccountTime(currency int, planData map[string]interface{}, sessionData map[string]interface{}, startedAt, now time.Time, billedSeconds int64) (*models.BillingResult, error) {
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &models.BillingResult{
+		Decision:     "accept",
+		TrafficClass: TimeTrafficClass,
+		PlanData:     planData,
+		Seconds:      billedSeconds,
+	}
+
+	billable := settings.BillableSeconds(int64(now.Sub(startedAt) / time.Second))
+	if billable <= billedSeconds {
+		return result, nil
+	}
+
+	from := startedAt.Add(time.Duration(billedSeconds) * time.Second)
+	to := startedAt.Add(time.Duration(billable) * time.Second)
+	amount, day, charged := settings.TimeCharge(from, to)
+
+	result.Amount = amount
+	result.Seconds = billable
+	if !settings.TimeDayCap.IsZero() {
+		result.PlanData = models.SetTimeDayCharged(planData, day, charged)
+	}
+
+	return result, nil
+}
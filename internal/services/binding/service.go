@@ -0,0 +1,289 @@
+package binding
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+)
+
+// Binding kinds
+const (
+	KindMAC = "mac" // Calling-Station-Id that parses as a MAC address
+	KindCID = "cid" // Any other Calling-Station-Id (phone number, circuit id)
+)
+
+// Binding policies, configured by BIND_POLICY in plan_data
+const (
+	PolicyOff    = "off"    // Bindings are not checked
+	PolicyReject = "reject" // Logins from unbound devices are rejected
+	PolicyFlag   = "flag"   // Logins from unbound devices are accepted and recorded
+)
+
+// History actions
+const (
+	ActionAdded    = "added"
+	ActionRemoved  = "removed"
+	ActionLearned  = "learned"
+	ActionRejected = "rejected"
+	ActionFlagged  = "flagged"
+)
+
+// ErrBindingNotFound is returned when a binding does not belong to the account
+var ErrBindingNotFound = errors.New("binding not found")
+
+// Service checks and manages account bindings to MAC addresses and Calling-Station-Ids
+type Service struct {
+	db     *database.PostgreSQL
+	logger *zap.Logger
+	config Config
+}
+
+// Config holds binding defaults, overridden by BIND_POLICY / BIND_AUTOLEARN in plan_data
+type Config struct {
+	DefaultPolicy string `yaml:"default_policy"` // off, reject or flag
+	AutoLearn     bool   `yaml:"auto_learn"`     // Bind the first seen device
+}
+
+// CheckResult describes the outcome of a binding check
+type CheckResult struct {
+	Allowed bool   `json:"allowed"`
+	Flagged bool   `json:"flagged"`
+	Learned bool   `json:"learned"`
+	Kind    string `json:"kind,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// New creates a new binding service
+func New(db *database.PostgreSQL, logger *zap.Logger, config Config) *Service {
+	if config.DefaultPolicy == "" {
+		config.DefaultPolicy = PolicyOff
+	}
+
+	return &Service{
+		db:     db,
+		logger: logger,
+		config: config,
+	}
+}
+
+// Normalize converts a Calling-Station-Id into binding kind and canonical value
+// MAC addresses in any common notation become lower-case colon separated.
+func Normalize(value string) (string, string) {
+	value = strings.TrimSpace(value)
+	if mac, err := net.ParseMAC(value); err == nil {
+		return KindMAC, mac.String()
+	}
+
+	// Bare 12 hex digits (aabbccddeeff) is a common NAS notation too
+	if len(value) == 12 {
+		if mac, err := net.ParseMAC(insertColons(value)); err == nil {
+			return KindMAC, mac.String()
+		}
+	}
+
+	return KindCID, value
+}
+
+// Check verifies the Calling-Station-Id of an authorize request against account bindings
+func (s *Service) Check(accountID int, planData map[string]interface{}, callingStationID string) (*CheckResult, error) {
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := s.config.DefaultPolicy
+	if settings.BindPolicy != "" {
+		policy = settings.BindPolicy
+	}
+	autoLearn := s.config.AutoLearn
+	if settings.BindAutoLearn != nil {
+		autoLearn = *settings.BindAutoLearn
+	}
+
+	if policy == PolicyOff {
+		return &CheckResult{Allowed: true}, nil
+	}
+
+	if callingStationID == "" {
+		if policy == PolicyReject {
+			return &CheckResult{Allowed: false, Reason: "Calling-Station-Id is missing"}, nil
+		}
+		return &CheckResult{Allowed: true, Flagged: true, Reason: "Calling-Station-Id is missing"}, nil
+	}
+
+	kind, value := Normalize(callingStationID)
+	result := &CheckResult{Kind: kind, Value: value}
+
+	bindings, err := s.List(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range bindings {
+		if b.Kind == kind && b.Value == value {
+			result.Allowed = true
+			return result, nil
+		}
+	}
+
+	// Auto-learn only the very first device
+	if len(bindings) == 0 && autoLearn {
+		if _, err := s.addBinding(accountID, kind, value, true, "auto-learn"); err != nil {
+			return nil, err
+		}
+		s.logger.Info("Device binding learned",
+			zap.Int("account_id", accountID),
+			zap.String("kind", kind),
+			zap.String("value", value))
+		result.Allowed = true
+		result.Learned = true
+		return result, nil
+	}
+
+	if policy == PolicyReject {
+		result.Reason = "Device is not bound to account"
+		s.recordHistory(accountID, ActionRejected, kind, value, "radius")
+		s.logger.Info("Login from unbound device rejected",
+			zap.Int("account_id", accountID),
+			zap.String("value", value))
+		return result, nil
+	}
+
+	result.Allowed = true
+	result.Flagged = true
+	result.Reason = "Device is not bound to account"
+	s.recordHistory(accountID, ActionFlagged, kind, value, "radius")
+	s.logger.Warn("Login from unbound device flagged",
+		zap.Int("account_id", accountID),
+		zap.String("value", value))
+	return result, nil
+}
+
+// List returns all bindings of an account
+func (s *Service) List(accountID int) ([]models.DBAccountBinding, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT id, account_id, kind, value, learned, created_at
+		FROM account_bindings WHERE account_id = $1 ORDER BY id`, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch bindings: %w", err)
+	}
+	defer rows.Close()
+
+	bindings := make([]models.DBAccountBinding, 0)
+	for rows.Next() {
+		var b models.DBAccountBinding
+		if err := rows.Scan(&b.ID, &b.AccountID, &b.Kind, &b.Value, &b.Learned, &b.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan binding: %w", err)
+		}
+		bindings = append(bindings, b)
+	}
+
+	return bindings, rows.Err()
+}
+
+// Add binds a MAC address or Calling-Station-Id to an account
+func (s *Service) Add(accountID int, value, actor string) (*models.DBAccountBinding, error) {
+	kind, normalized := Normalize(value)
+	if normalized == "" {
+		return nil, fmt.Errorf("binding value is empty")
+	}
+	return s.addBinding(accountID, kind, normalized, false, actor)
+}
+
+// Remove deletes a binding of an account
+func (s *Service) Remove(accountID, bindingID int, actor string) error {
+	var kind, value string
+	err := s.db.GetDB().QueryRow(`
+		DELETE FROM account_bindings WHERE id = $1 AND account_id = $2
+		RETURNING kind, value`, bindingID, accountID).Scan(&kind, &value)
+	if err == sql.ErrNoRows {
+		return ErrBindingNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove binding: %w", err)
+	}
+
+	s.recordHistory(accountID, ActionRemoved, kind, value, actor)
+	return nil
+}
+
+// History returns binding changes and flagged/rejected logins of an account, newest first
+func (s *Service) History(accountID, limit int) ([]models.DBAccountBindingHistory, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	rows, err := s.db.GetDB().Query(`
+		SELECT id, account_id, action, kind, value, actor, created_at
+		FROM account_binding_history WHERE account_id = $1
+		ORDER BY created_at DESC, id DESC LIMIT $2`, accountID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch binding history: %w", err)
+	}
+	defer rows.Close()
+
+	history := make([]models.DBAccountBindingHistory, 0)
+	for rows.Next() {
+		var h models.DBAccountBindingHistory
+		if err := rows.Scan(&h.ID, &h.AccountID, &h.Action, &h.Kind, &h.Value, &h.Actor, &h.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan binding history: %w", err)
+		}
+		history = append(history, h)
+	}
+
+	return history, rows.Err()
+}
+
+func (s *Service) addBinding(accountID int, kind, value string, learned bool, actor string) (*models.DBAccountBinding, error) {
+	b := &models.DBAccountBinding{
+		AccountID: accountID,
+		Kind:      kind,
+		Value:     value,
+		Learned:   learned,
+	}
+
+	err := s.db.GetDB().QueryRow(`
+		INSERT INTO account_bindings (account_id, kind, value, learned)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (account_id, kind, value) DO UPDATE SET learned = account_bindings.learned
+		RETURNING id, created_at`, accountID, kind, value, learned).Scan(&b.ID, &b.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add binding: %w", err)
+	}
+
+	action := ActionAdded
+	if learned {
+		action = ActionLearned
+	}
+	s.recordHistory(accountID, action, kind, value, actor)
+
+	return b, nil
+}
+
+func (s *Service) recordHistory(accountID int, action, kind, value, actor string) {
+	_, err := s.db.GetDB().Exec(`
+		INSERT INTO account_binding_history (account_id, action, kind, value, actor)
+		VALUES ($1, $2, $3, $4, $5)`, accountID, action, kind, value, actor)
+	if err != nil {
+		s.logger.Error("Failed to record binding history",
+			zap.Int("account_id", accountID),
+			zap.String("action", action),
+			zap.Error(err))
+	}
+}
+
+func insertColons(hex string) string {
+	parts := make([]string, 0, 6)
+	for i := 0; i < len(hex); i += 2 {
+		parts = append(parts, hex[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,549 @@
+package charges
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/billing"
+	"isp-billing/internal/services/currency"
+)
+
+// ErrInvalidCharge is returned for one-off charges with a bad kind, reason or amount
+var ErrInvalidCharge = errors.New("invalid charge")
+
+// ErrAddonNotFound is returned for unknown add-on IDs of the catalog
+var ErrAddonNotFound = errors.New("add-on not found")
+
+// ErrAddonInactive is returned when an inactive add-on is added to an account
+var ErrAddonInactive = errors.New("add-on is not active")
+
+// ErrAccountAddonNotFound is returned for unknown or ended account add-ons
+var ErrAccountAddonNotFound = errors.New("account add-on not found")
+
+// ErrInvalidAddon is returned for add-ons with a bad code, fee or quantity
+var ErrInvalidAddon = errors.New("invalid add-on")
+
+// ErrDiscountNotFound is returned for unknown discount IDs
+var ErrDiscountNotFound = errors.New("discount not found")
+
+// ErrInvalidDiscount is returned for discounts with a bad target, kind, value or validity
+var ErrInvalidDiscount = errors.New("invalid discount")
+
+// Service manages one-off charges and credits, recurring add-ons and discounts
+// One-off charges go through debit_transaction/credit_transaction right away and are kept
+// in account_charges with a reason code. Add-ons and discounts are priced into subscription
+// charges by billing.SubscriptionService.
+type Service struct {
+	db            *database.PostgreSQL
+	rates         *currency.Service
+	subscriptions *billing.SubscriptionService
+	logger        *zap.Logger
+}
+
+// ChargeRequest is a one-off debit or credit
+type ChargeRequest struct {
+	AccountID   int          `json:"account_id"`
+	Kind        string       `json:"kind"` // "debit" (default) or "credit"
+	Reason      string       `json:"reason" binding:"required"`
+	Amount      models.Money `json:"amount" binding:"required"`
+	Currency    int          `json:"currency"` // 0 - contract currency
+	Description string       `json:"description"`
+}
+
+// AddonRequest adds a catalog add-on to an account
+type AddonRequest struct {
+	AccountID  int           `json:"account_id"`
+	AddonID    int           `json:"addon_id" binding:"required"`
+	Quantity   int           `json:"quantity"`              // Default 1
+	MonthlyFee *models.Money `json:"monthly_fee,omitempty"` // Overrides the catalog fee, add-on currency
+	StartedAt  *time.Time    `json:"started_at,omitempty"`  // Default now
+}
+
+// New creates a new charges service
+func New(db *database.PostgreSQL, rates *currency.Service, subscriptions *billing.SubscriptionService, logger *zap.Logger) *Service {
+	return &Service{
+		db:            db,
+		rates:         rates,
+		subscriptions: subscriptions,
+		logger:        logger,
+	}
+}
+
+// Charge debits or credits an account once and records it with its reason code
+func (s *Service) Charge(req ChargeRequest) (*models.OneOffCharge, error) {
+	if req.Kind == "" {
+		req.Kind = models.OneOffDebit
+	}
+	if req.Kind != models.OneOffDebit && req.Kind != models.OneOffCredit {
+		return nil, fmt.Errorf("%w: unknown kind %q", ErrInvalidCharge, req.Kind)
+	}
+	if !models.ValidChargeReason(req.Reason) {
+		return nil, fmt.Errorf("%w: unknown reason %q", ErrInvalidCharge, req.Reason)
+	}
+	if req.Amount.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidCharge)
+	}
+
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	charge, err := s.chargeTx(tx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit charge: %w", err)
+	}
+	s.logCharge(charge)
+	return charge, nil
+}
+
+// chargeTx debits or credits a validated charge and records it within tx
+func (s *Service) chargeTx(tx *sql.Tx, req ChargeRequest) (*models.OneOffCharge, error) {
+	var contractCurrency int
+	err := tx.QueryRow(`
+		SELECT c.currency_id FROM accounts a JOIN contracts c ON c.id = a.contract_id
+		WHERE a.id = $1`, req.AccountID).Scan(&contractCurrency)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", billing.ErrAccountNotFound, req.AccountID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch contract currency: %w", err)
+	}
+	if req.Currency == 0 {
+		req.Currency = contractCurrency
+	}
+
+	comment := req.Reason
+	if req.Description != "" {
+		comment += ": " + req.Description
+	}
+	transact := s.rates.DebitTx
+	if req.Kind == models.OneOffCredit {
+		transact = s.rates.CreditTx
+	}
+	balance, transactionID, err := transact(tx, req.AccountID, req.Amount, req.Currency, comment)
+	if err != nil {
+		return nil, err
+	}
+
+	charge := &models.OneOffCharge{
+		AccountID:     req.AccountID,
+		Kind:          req.Kind,
+		Reason:        req.Reason,
+		Amount:        req.Amount,
+		Currency:      req.Currency,
+		Description:   req.Description,
+		TransactionID: transactionID,
+		Balance:       balance,
+	}
+	err = tx.QueryRow(`
+		INSERT INTO account_charges (account_id, kind, reason, amount, currency_id, description, transaction_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`,
+		charge.AccountID, charge.Kind, charge.Reason, charge.Amount, charge.Currency, charge.Description,
+		charge.TransactionID,
+	).Scan(&charge.ID, &charge.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record charge: %w", err)
+	}
+	return charge, nil
+}
+
+func (s *Service) logCharge(charge *models.OneOffCharge) {
+	s.logger.Info("One-off charge recorded",
+		zap.Int("charge_id", charge.ID),
+		zap.Int("account_id", charge.AccountID),
+		zap.String("kind", charge.Kind),
+		zap.String("reason", charge.Reason),
+		zap.Stringer("amount", charge.Amount),
+		zap.Int("currency", charge.Currency))
+}
+
+// AccountCharges returns one-off charges of the account, newest first
+func (s *Service) AccountCharges(accountID, limit int) ([]models.OneOffCharge, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT id, account_id, kind, reason, amount, currency_id, description, transaction_id, created_at
+		FROM account_charges
+		WHERE account_id = $1
+		ORDER BY id DESC LIMIT $2`, accountID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch charges: %w", err)
+	}
+	defer rows.Close()
+
+	charges := []models.OneOffCharge{}
+	for rows.Next() {
+		var c models.OneOffCharge
+		err := rows.Scan(&c.ID, &c.AccountID, &c.Kind, &c.Reason, &c.Amount, &c.Currency, &c.Description,
+			&c.TransactionID, &c.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan charge: %w", err)
+		}
+		charges = append(charges, c)
+	}
+	return charges, rows.Err()
+}
+
+// Addons returns the add-on catalog
+func (s *Service) Addons() ([]models.Addon, error) {
+	return s.queryAddons(`ORDER BY id`)
+}
+
+// Addon returns an add-on of the catalog
+func (s *Service) Addon(addonID int) (*models.Addon, error) {
+	addons, err := s.queryAddons(`WHERE id = $1`, addonID)
+	if err != nil {
+		return nil, err
+	}
+	if len(addons) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrAddonNotFound, addonID)
+	}
+	return &addons[0], nil
+}
+
+// SaveAddon creates a catalog add-on (addon.ID == 0) or updates one
+// A changed fee applies to billing periods charged afterwards.
+func (s *Service) SaveAddon(addon *models.Addon) error {
+	addon.Code = strings.TrimSpace(addon.Code)
+	if addon.Code == "" || addon.Name == "" {
+		return fmt.Errorf("%w: code and name are required", ErrInvalidAddon)
+	}
+	if addon.MonthlyFee.Sign() < 0 || addon.Currency == 0 {
+		return fmt.Errorf("%w: fee must not be negative and currency is required", ErrInvalidAddon)
+	}
+
+	if addon.ID == 0 {
+		err := s.db.GetDB().QueryRow(`
+			INSERT INTO addons (code, name, monthly_fee, currency_id, active)
+			VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+			addon.Code, addon.Name, addon.MonthlyFee, addon.Currency, addon.Active).Scan(&addon.ID)
+		if err != nil {
+			return fmt.Errorf("failed to create add-on: %w", err)
+		}
+		return nil
+	}
+
+	res, err := s.db.GetDB().Exec(`
+		UPDATE addons SET code = $1, name = $2, monthly_fee = $3, currency_id = $4, active = $5
+		WHERE id = $6`,
+		addon.Code, addon.Name, addon.MonthlyFee, addon.Currency, addon.Active, addon.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update add-on: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: %d", ErrAddonNotFound, addon.ID)
+	}
+	return nil
+}
+
+// AccountAddons returns add-ons of the account; ended ones only with all
+func (s *Service) AccountAddons(accountID int, all bool) ([]models.AccountAddon, error) {
+	where := `WHERE aa.account_id = $1 AND (aa.ended_at IS NULL OR aa.ended_at > NOW())`
+	if all {
+		where = `WHERE aa.account_id = $1`
+	}
+	return s.queryAccountAddons(where+` ORDER BY aa.id`, accountID)
+}
+
+// AddAccountAddon subscribes the account to a catalog add-on
+// Started within a period whose subscription charge is already paid, the add-on's fee for
+// the rest of that period is debited right away as a one-off "addon" charge; otherwise the
+// period charge includes it. The add-on is not added when that debit fails.
+func (s *Service) AddAccountAddon(req AddonRequest) (*models.AccountAddon, *models.OneOffCharge, error) {
+	addon, err := s.Addon(req.AddonID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !addon.Active {
+		return nil, nil, fmt.Errorf("%w: %s", ErrAddonInactive, addon.Code)
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	if req.Quantity < 0 {
+		return nil, nil, fmt.Errorf("%w: quantity must be positive", ErrInvalidAddon)
+	}
+	if req.MonthlyFee != nil && req.MonthlyFee.Sign() < 0 {
+		return nil, nil, fmt.Errorf("%w: fee must not be negative", ErrInvalidAddon)
+	}
+	startedAt := time.Now()
+	if req.StartedAt != nil {
+		startedAt = *req.StartedAt
+	}
+
+	accountAddon := &models.AccountAddon{
+		AccountID:  req.AccountID,
+		AddonID:    addon.ID,
+		Code:       addon.Code,
+		Name:       addon.Name,
+		Quantity:   req.Quantity,
+		MonthlyFee: addon.MonthlyFee,
+		Currency:   addon.Currency,
+		StartedAt:  startedAt,
+	}
+	var override interface{}
+	if req.MonthlyFee != nil {
+		accountAddon.MonthlyFee = *req.MonthlyFee
+		override = *req.MonthlyFee
+	}
+
+	// Priced before the insert: the add-on and its current-period fee are committed together,
+	// so a failed debit leaves no unpaid add-on behind and a retry does not add a second one
+	amount, periodEnd, err := s.subscriptions.AddonCharge(req.AccountID, *accountAddon, startedAt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to price add-on for the current period: %w", err)
+	}
+
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO account_addons (account_id, addon_id, quantity, monthly_fee, started_at)
+		SELECT $1, $2, $3, $4, $5 WHERE EXISTS (SELECT 1 FROM accounts WHERE id = $1)
+		RETURNING id`,
+		req.AccountID, addon.ID, req.Quantity, override, startedAt).Scan(&accountAddon.ID)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("%w: %d", billing.ErrAccountNotFound, req.AccountID)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to add add-on: %w", err)
+	}
+
+	var charge *models.OneOffCharge
+	if amount.Sign() > 0 {
+		charge, err = s.chargeTx(tx, ChargeRequest{
+			AccountID:   req.AccountID,
+			Kind:        models.OneOffDebit,
+			Reason:      models.ReasonAddon,
+			Amount:      amount,
+			Currency:    accountAddon.Currency,
+			Description: fmt.Sprintf("%s until %s", addon.Name, periodEnd.Format("2006-01-02")),
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to charge add-on for the current period: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit add-on: %w", err)
+	}
+
+	s.logger.Info("Add-on added to account",
+		zap.Int("account_id", req.AccountID),
+		zap.String("addon", addon.Code),
+		zap.Int("quantity", req.Quantity),
+		zap.Time("started_at", startedAt))
+	if charge != nil {
+		s.logCharge(charge)
+	}
+	return accountAddon, charge, nil
+}
+
+// EndAccountAddon stops an account add-on at endedAt (now when zero)
+// Periods starting after it are billed without the add-on; charged periods are not refunded.
+func (s *Service) EndAccountAddon(accountAddonID int, endedAt time.Time) (*models.AccountAddon, error) {
+	if endedAt.IsZero() {
+		endedAt = time.Now()
+	}
+	res, err := s.db.GetDB().Exec(`
+		UPDATE account_addons SET ended_at = GREATEST($1, started_at)
+		WHERE id = $2 AND (ended_at IS NULL OR ended_at > $1)`, endedAt, accountAddonID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to end add-on: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrAccountAddonNotFound, accountAddonID)
+	}
+
+	addons, err := s.queryAccountAddons(`WHERE aa.id = $1`, accountAddonID)
+	if err != nil {
+		return nil, err
+	}
+	if len(addons) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrAccountAddonNotFound, accountAddonID)
+	}
+	return &addons[0], nil
+}
+
+// Discounts returns discounts of an account and/or a plan (0 - any), newest first
+// Expired discounts are included with all.
+func (s *Service) Discounts(accountID, planID int, all bool) ([]models.Discount, error) {
+	where := `WHERE ($1 = 0 OR account_id = $1) AND ($2 = 0 OR plan_id = $2)`
+	if !all {
+		where += ` AND (valid_until IS NULL OR valid_until >= CURRENT_DATE)`
+	}
+	return s.queryDiscounts(where+` ORDER BY id DESC`, accountID, planID)
+}
+
+// CreateDiscount records a discount of one account or of every account of a plan
+func (s *Service) CreateDiscount(d *models.Discount) error {
+	if (d.AccountID == nil) == (d.PlanID == nil) {
+		return fmt.Errorf("%w: exactly one of account_id and plan_id is required", ErrInvalidDiscount)
+	}
+	switch d.Kind {
+	case models.DiscountPercent:
+		if d.Value.Sign() <= 0 || d.Value.Cmp(models.NewMoney(100)) > 0 {
+			return fmt.Errorf("%w: percent must be within 0..100", ErrInvalidDiscount)
+		}
+		d.Currency = 0
+	case models.DiscountFixed:
+		if d.Value.Sign() <= 0 {
+			return fmt.Errorf("%w: amount must be positive", ErrInvalidDiscount)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidDiscount, d.Kind)
+	}
+	if d.ValidFrom.IsZero() {
+		d.ValidFrom = time.Now()
+	}
+	if d.ValidUntil != nil && d.ValidUntil.Before(d.ValidFrom) {
+		return fmt.Errorf("%w: valid_until is before valid_from", ErrInvalidDiscount)
+	}
+
+	var currencyID, validUntil interface{}
+	if d.Currency != 0 {
+		currencyID = d.Currency
+	}
+	if d.ValidUntil != nil {
+		validUntil = *d.ValidUntil
+	}
+	err := s.db.GetDB().QueryRow(`
+		INSERT INTO discounts (account_id, plan_id, kind, value, currency_id, description, valid_from, valid_until)
+		VALUES ($1, $2, $3, $4, $5, $6, $7::date, $8::date)
+		RETURNING id, valid_from, created_at`,
+		d.AccountID, d.PlanID, d.Kind, d.Value, currencyID, d.Description, d.ValidFrom, validUntil,
+	).Scan(&d.ID, &d.ValidFrom, &d.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create discount: %w", err)
+	}
+
+	s.logger.Info("Discount created",
+		zap.Int("discount_id", d.ID),
+		zap.String("kind", d.Kind),
+		zap.Stringer("value", d.Value))
+	return nil
+}
+
+// EndDiscount makes the discount valid until the given date; periods starting later are billed without it
+func (s *Service) EndDiscount(discountID int, until time.Time) (*models.Discount, error) {
+	if until.IsZero() {
+		until = time.Now()
+	}
+	res, err := s.db.GetDB().Exec(`
+		UPDATE discounts SET valid_until = GREATEST($1::date, valid_from)
+		WHERE id = $2 AND (valid_until IS NULL OR valid_until > $1::date)`, until, discountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to end discount: %w", err)
+	}
+
+	discounts, err := s.queryDiscounts(`WHERE id = $1`, discountID)
+	if err != nil {
+		return nil, err
+	}
+	if len(discounts) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrDiscountNotFound, discountID)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.logger.Info("Discount ended", zap.Int("discount_id", discountID), zap.Time("until", until))
+	}
+	return &discounts[0], nil
+}
+
+func (s *Service) queryAddons(where string, args ...interface{}) ([]models.Addon, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT id, code, name, monthly_fee, currency_id, active FROM addons
+		`+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch add-ons: %w", err)
+	}
+	defer rows.Close()
+
+	addons := []models.Addon{}
+	for rows.Next() {
+		var a models.Addon
+		if err := rows.Scan(&a.ID, &a.Code, &a.Name, &a.MonthlyFee, &a.Currency, &a.Active); err != nil {
+			return nil, fmt.Errorf("failed to scan add-on: %w", err)
+		}
+		addons = append(addons, a)
+	}
+	return addons, rows.Err()
+}
+
+func (s *Service) queryAccountAddons(where string, args ...interface{}) ([]models.AccountAddon, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT aa.id, aa.account_id, aa.addon_id, ad.code, ad.name, aa.quantity,
+			COALESCE(aa.monthly_fee, ad.monthly_fee), ad.currency_id, aa.started_at, aa.ended_at
+		FROM account_addons aa
+		JOIN addons ad ON ad.id = aa.addon_id
+		`+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch account add-ons: %w", err)
+	}
+	defer rows.Close()
+
+	addons := []models.AccountAddon{}
+	for rows.Next() {
+		var a models.AccountAddon
+		var endedAt sql.NullTime
+		err := rows.Scan(&a.ID, &a.AccountID, &a.AddonID, &a.Code, &a.Name, &a.Quantity,
+			&a.MonthlyFee, &a.Currency, &a.StartedAt, &endedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan account add-on: %w", err)
+		}
+		if endedAt.Valid {
+			a.EndedAt = &endedAt.Time
+		}
+		addons = append(addons, a)
+	}
+	return addons, rows.Err()
+}
+
+func (s *Service) queryDiscounts(where string, args ...interface{}) ([]models.Discount, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT id, account_id, plan_id, kind, value, COALESCE(currency_id, 0), description,
+			valid_from, valid_until, created_at
+		FROM discounts
+		`+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch discounts: %w", err)
+	}
+	defer rows.Close()
+
+	discounts := []models.Discount{}
+	for rows.Next() {
+		var d models.Discount
+		var accountID, planID sql.NullInt64
+		var validUntil sql.NullTime
+		err := rows.Scan(&d.ID, &accountID, &planID, &d.Kind, &d.Value, &d.Currency, &d.Description,
+			&d.ValidFrom, &validUntil, &d.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan discount: %w", err)
+		}
+		if accountID.Valid {
+			id := int(accountID.Int64)
+			d.AccountID = &id
+		}
+		if planID.Valid {
+			id := int(planID.Int64)
+			d.PlanID = &id
+		}
+		if validUntil.Valid {
+			d.ValidUntil = &validUntil.Time
+		}
+		discounts = append(discounts, d)
+	}
+	return discounts, rows.Err()
+}
@@ -0,0 +1,384 @@
+package currency
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+)
+
+// ErrNoRate is returned when neither the pair nor its inverse has a rate
+var ErrNoRate = errors.New("no exchange rate")
+
+// ErrReadOnlySource is returned when rates are changed with the static rate source
+var ErrReadOnlySource = errors.New("rate source is read-only")
+
+// Service converts amounts between currencies through currencies_rate
+// Equivalent of the currency conversion done by make_transaction in the database.
+type Service struct {
+	db     *database.PostgreSQL
+	logger *zap.Logger
+	config Config
+	source RateSource
+
+	cacheMux sync.Mutex
+	cache    map[[2]int]cachedRate
+}
+
+// Config holds currency conversion settings
+type Config struct {
+	RateSource string        `yaml:"rate_source"` // db or static
+	CacheTTL   time.Duration `yaml:"cache_ttl"`   // How long a looked up rate is reused
+	Rates      []StaticRate  `yaml:"rates"`       // Rates of the static source
+}
+
+// StaticRate is a configured rate: 1 FromID = Rate ToID
+type StaticRate struct {
+	FromID int          `yaml:"from_id"`
+	ToID   int          `yaml:"to_id"`
+	Rate   models.Money `yaml:"rate"`
+}
+
+type cachedRate struct {
+	rate    *big.Rat // nil when the pair has no rate
+	expires time.Time
+}
+
+// New creates a new currency service
+func New(db *database.PostgreSQL, logger *zap.Logger, config Config) (*Service, error) {
+	if config.RateSource == "" {
+		config.RateSource = SourceDB
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = 5 * time.Minute
+	}
+
+	s := &Service{
+		db:     db,
+		logger: logger,
+		config: config,
+		cache:  make(map[[2]int]cachedRate),
+	}
+
+	switch config.RateSource {
+	case SourceDB:
+		s.source = &dbRateSource{db: db}
+	case SourceStatic:
+		source, err := newStaticRateSource(config.Rates)
+		if err != nil {
+			return nil, err
+		}
+		s.source = source
+	default:
+		return nil, fmt.Errorf("unknown rate source %q", config.RateSource)
+	}
+
+	return s, nil
+}
+
+// Rate returns the current rate of 1 fromID in toID, using the inverse pair when only it is set
+func (s *Service) Rate(fromID, toID int) (*big.Rat, error) {
+	if fromID == toID {
+		return big.NewRat(1, 1), nil
+	}
+
+	key := [2]int{fromID, toID}
+	now := time.Now()
+
+	s.cacheMux.Lock()
+	cached, ok := s.cache[key]
+	s.cacheMux.Unlock()
+	if ok && now.Before(cached.expires) {
+		if cached.rate == nil {
+			return nil, fmt.Errorf("%w %d->%d", ErrNoRate, fromID, toID)
+		}
+		return cached.rate, nil
+	}
+
+	rate, validUntil, err := s.lookup(fromID, toID, now)
+	if err != nil && !errors.Is(err, ErrNoRate) {
+		return nil, err
+	}
+
+	expires := now.Add(s.config.CacheTTL)
+	if !validUntil.IsZero() && validUntil.Before(expires) {
+		expires = validUntil
+	}
+	s.cacheMux.Lock()
+	s.cache[key] = cachedRate{rate: rate, expires: expires}
+	s.cacheMux.Unlock()
+
+	return rate, err
+}
+
+// RateAt returns the rate in effect at the given time, bypassing the cache
+func (s *Service) RateAt(fromID, toID int, at time.Time) (*big.Rat, error) {
+	if fromID == toID {
+		return big.NewRat(1, 1), nil
+	}
+	rate, _, err := s.lookup(fromID, toID, at)
+	return rate, err
+}
+
+func (s *Service) lookup(fromID, toID int, at time.Time) (*big.Rat, time.Time, error) {
+	rate, found, validUntil, err := s.source.Rate(fromID, toID, at)
+	if err != nil {
+		return nil, validUntil, err
+	}
+	if found && rate.Sign() > 0 {
+		return rate.Rat(), validUntil, nil
+	}
+
+	// 1 to = rate from, so 1 from = 1/rate to
+	inverse, found, inverseUntil, err := s.source.Rate(toID, fromID, at)
+	if err != nil {
+		return nil, validUntil, err
+	}
+	if !inverseUntil.IsZero() && (validUntil.IsZero() || inverseUntil.Before(validUntil)) {
+		validUntil = inverseUntil
+	}
+	if found && inverse.Sign() > 0 {
+		return new(big.Rat).Inv(inverse.Rat()), validUntil, nil
+	}
+
+	return nil, validUntil, fmt.Errorf("%w %d->%d", ErrNoRate, fromID, toID)
+}
+
+// Convert converts amount from fromID into toID at the current rate
+// Currency 0 means "same currency" and is never converted.
+func (s *Service) Convert(amount models.Money, fromID, toID int) (models.Money, error) {
+	if fromID == 0 || toID == 0 || fromID == toID {
+		return amount, nil
+	}
+
+	rate, err := s.Rate(fromID, toID)
+	if err != nil {
+		return models.Money{}, err
+	}
+	return amount.MulRat(rate), nil
+}
+
+// ConvertAt converts amount at the rate in effect at the given time
+func (s *Service) ConvertAt(amount models.Money, fromID, toID int, at time.Time) (models.Money, error) {
+	if fromID == 0 || toID == 0 || fromID == toID {
+		return amount, nil
+	}
+
+	rate, err := s.RateAt(fromID, toID, at)
+	if err != nil {
+		return models.Money{}, err
+	}
+	return amount.MulRat(rate), nil
+}
+
+// Debit charges an account amount in currencyID and returns the balance after
+// The amount is converted into the contract currency and debited with debit_transaction;
+// fin_transactions keeps the original amount and currency next to amount_in_contract_currency.
+func (s *Service) Debit(accountID int, amount models.Money, currencyID int, comment string) (models.Money, error) {
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return models.Money{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	balance, _, err := s.DebitTx(tx, accountID, amount, currencyID, comment)
+	if err != nil {
+		return balance, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return balance, fmt.Errorf("failed to commit debit: %w", err)
+	}
+	return balance, nil
+}
+
+// DebitTx is Debit within the caller's transaction, it also returns the fin_transactions ID
+// Callers record the debit in their own tables atomically with it.
+func (s *Service) DebitTx(tx *sql.Tx, accountID int, amount models.Money, currencyID int, comment string) (models.Money, int, error) {
+	return s.transactTx(tx, models.DebitTransactionQuery, "debit", accountID, amount, currencyID, comment)
+}
+
+// CreditTx credits an account amount in currencyID within the caller's transaction
+// Like DebitTx, through credit_transaction; returns the balance after and the fin_transactions ID.
+func (s *Service) CreditTx(tx *sql.Tx, accountID int, amount models.Money, currencyID int, comment string) (models.Money, int, error) {
+	return s.transactTx(tx, models.CreditTransactionQuery, "credit", accountID, amount, currencyID, comment)
+}
+
+// transactTx converts amount into the contract currency and runs the debit/credit DB function
+func (s *Service) transactTx(tx *sql.Tx, query, kind string, accountID int, amount models.Money, currencyID int, comment string) (models.Money, int, error) {
+	var balance models.Money
+
+	// Lock the contract so the ledger row found below is ours
+	var contractID, contractCurrency int
+	err := tx.QueryRow(`
+		SELECT c.id, c.currency_id FROM accounts a
+		JOIN contracts c ON c.id = a.contract_id
+		WHERE a.id = $1 FOR UPDATE OF c`, accountID).Scan(&contractID, &contractCurrency)
+	if err != nil {
+		return balance, 0, fmt.Errorf("failed to fetch contract of account %d: %w", accountID, err)
+	}
+
+	if currencyID == 0 {
+		currencyID = contractCurrency
+	}
+	converted, err := s.Convert(amount, currencyID, contractCurrency)
+	if err != nil {
+		return balance, 0, err
+	}
+
+	if err := tx.QueryRow(query, accountID, converted, comment, nil).Scan(&balance); err != nil {
+		return balance, 0, fmt.Errorf("failed to %s transaction: %w", kind, err)
+	}
+
+	var transactionID int
+	if err := tx.QueryRow(`SELECT MAX(id) FROM fin_transactions WHERE contract_id = $1`, contractID).Scan(&transactionID); err != nil {
+		return balance, 0, fmt.Errorf("failed to find %s transaction: %w", kind, err)
+	}
+
+	if currencyID != contractCurrency {
+		// debit/credit_transaction record the contract currency; keep what was actually charged
+		_, err = tx.Exec(`
+			UPDATE fin_transactions SET currency_id = $1, amount = SIGN(amount) * $2,
+				amount_in_contract_currency = SIGN(amount) * $3
+			WHERE id = $4`,
+			currencyID, amount, converted, transactionID)
+		if err != nil {
+			return balance, 0, fmt.Errorf("failed to record transaction currency: %w", err)
+		}
+	}
+
+	s.logger.Debug("Account transaction recorded",
+		zap.String("kind", kind),
+		zap.Int("account_id", accountID),
+		zap.Int("transaction_id", transactionID),
+		zap.Stringer("amount", amount),
+		zap.Int("currency", currencyID),
+		zap.Stringer("amount_in_contract_currency", converted),
+		zap.Int("contract_currency", contractCurrency))
+
+	return balance, transactionID, nil
+}
+
+// Rates returns current rates from currencies_rate (or config for the static source)
+func (s *Service) Rates() ([]models.DBCurrencyRate, error) {
+	rates := []models.DBCurrencyRate{}
+
+	if s.config.RateSource == SourceStatic {
+		for _, r := range s.config.Rates {
+			rates = append(rates, models.DBCurrencyRate{FromID: r.FromID, ToID: r.ToID, Rate: r.Rate})
+		}
+		return rates, nil
+	}
+
+	rows, err := s.db.GetDB().Query(`SELECT from_id, to_id, rate FROM currencies_rate ORDER BY from_id, to_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch rates: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.DBCurrencyRate
+		if err := rows.Scan(&r.FromID, &r.ToID, &r.Rate); err != nil {
+			return nil, fmt.Errorf("failed to scan rate: %w", err)
+		}
+		rates = append(rates, r)
+	}
+	return rates, rows.Err()
+}
+
+// History returns rates of a pair ordered by effective date, newest first
+func (s *Service) History(fromID, toID int, limit int) ([]models.DBCurrencyRateHistory, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT id, from_id, to_id, rate, effective_from, comment, created_at
+		FROM currency_rate_history
+		WHERE from_id = $1 AND to_id = $2
+		ORDER BY effective_from DESC, id DESC LIMIT $3`, fromID, toID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch rate history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []models.DBCurrencyRateHistory{}
+	for rows.Next() {
+		var h models.DBCurrencyRateHistory
+		if err := rows.Scan(&h.ID, &h.FromID, &h.ToID, &h.Rate, &h.EffectiveFrom, &h.Comment, &h.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan rate history: %w", err)
+		}
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+// SetRate records a rate effective from the given time
+// A rate already in effect is also written to currencies_rate for database functions.
+func (s *Service) SetRate(fromID, toID int, rate models.Money, effectiveFrom time.Time, comment string) (*models.DBCurrencyRateHistory, error) {
+	if s.config.RateSource != SourceDB {
+		return nil, ErrReadOnlySource
+	}
+	if fromID == toID {
+		return nil, fmt.Errorf("rate of a currency to itself is always 1")
+	}
+	if rate.Sign() <= 0 {
+		return nil, fmt.Errorf("rate must be positive")
+	}
+
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	h := &models.DBCurrencyRateHistory{
+		FromID:        fromID,
+		ToID:          toID,
+		Rate:          rate,
+		EffectiveFrom: effectiveFrom,
+		Comment:       comment,
+	}
+	err = tx.QueryRow(`
+		INSERT INTO currency_rate_history (from_id, to_id, rate, effective_from, comment)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		fromID, toID, rate, effectiveFrom, comment).Scan(&h.ID, &h.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert rate: %w", err)
+	}
+
+	if !effectiveFrom.After(time.Now()) {
+		res, err := tx.Exec(`UPDATE currencies_rate SET rate = $3 WHERE from_id = $1 AND to_id = $2`, fromID, toID, rate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update current rate: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			if _, err := tx.Exec(`INSERT INTO currencies_rate (from_id, to_id, rate) VALUES ($1, $2, $3)`, fromID, toID, rate); err != nil {
+				return nil, fmt.Errorf("failed to insert current rate: %w", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit rate: %w", err)
+	}
+
+	s.invalidate(fromID, toID)
+	s.logger.Info("Currency rate set",
+		zap.Int("from_id", fromID),
+		zap.Int("to_id", toID),
+		zap.Stringer("rate", rate),
+		zap.Time("effective_from", effectiveFrom))
+
+	return h, nil
+}
+
+func (s *Service) invalidate(fromID, toID int) {
+	s.cacheMux.Lock()
+	delete(s.cache, [2]int{fromID, toID})
+	delete(s.cache, [2]int{toID, fromID})
+	s.cacheMux.Unlock()
+}
@@ -0,0 +1,91 @@
+package currency
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+)
+
+// Rate sources
+const (
+	SourceDB     = "db"     // currency_rate_history, falling back to currencies_rate
+	SourceStatic = "static" // Rates from config, for installations without currencies_rate
+)
+
+// RateSource provides the rate of a currency pair at a given time
+// validUntil is when the rate changes next (a scheduled rate), zero if unknown.
+type RateSource interface {
+	Rate(fromID, toID int, at time.Time) (rate models.Money, found bool, validUntil time.Time, err error)
+}
+
+// dbRateSource reads currency_rate_history and currencies_rate
+type dbRateSource struct {
+	db *database.PostgreSQL
+}
+
+func (s *dbRateSource) Rate(fromID, toID int, at time.Time) (models.Money, bool, time.Time, error) {
+	var rate models.Money
+	var validUntil time.Time
+
+	// Rate in effect at the given time
+	err := s.db.GetDB().QueryRow(`
+		SELECT rate FROM currency_rate_history
+		WHERE from_id = $1 AND to_id = $2 AND effective_from <= $3
+		ORDER BY effective_from DESC, id DESC LIMIT 1`, fromID, toID, at).Scan(&rate)
+	found := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return rate, false, validUntil, fmt.Errorf("failed to fetch rate history: %w", err)
+	}
+
+	// Next scheduled change limits how long the rate may be cached
+	var next sql.NullTime
+	err = s.db.GetDB().QueryRow(`
+		SELECT MIN(effective_from) FROM currency_rate_history
+		WHERE from_id = $1 AND to_id = $2 AND effective_from > $3`, fromID, toID, at).Scan(&next)
+	if err != nil {
+		return rate, false, validUntil, fmt.Errorf("failed to fetch next rate: %w", err)
+	}
+	if next.Valid {
+		validUntil = next.Time
+	}
+
+	if found {
+		return rate, true, validUntil, nil
+	}
+
+	// Without history the current currencies_rate applies
+	err = s.db.GetDB().QueryRow(`SELECT rate FROM currencies_rate WHERE from_id = $1 AND to_id = $2`,
+		fromID, toID).Scan(&rate)
+	if err == sql.ErrNoRows {
+		return rate, false, validUntil, nil
+	}
+	if err != nil {
+		return rate, false, validUntil, fmt.Errorf("failed to fetch rate: %w", err)
+	}
+
+	return rate, true, validUntil, nil
+}
+
+// staticRateSource serves rates from config
+type staticRateSource struct {
+	rates map[[2]int]models.Money
+}
+
+func newStaticRateSource(rates []StaticRate) (*staticRateSource, error) {
+	s := &staticRateSource{rates: make(map[[2]int]models.Money)}
+	for _, r := range rates {
+		if r.Rate.Sign() <= 0 {
+			return nil, fmt.Errorf("static rate %d->%d must be positive", r.FromID, r.ToID)
+		}
+		s.rates[[2]int{r.FromID, r.ToID}] = r.Rate
+	}
+	return s, nil
+}
+
+func (s *staticRateSource) Rate(fromID, toID int, at time.Time) (models.Money, bool, time.Time, error) {
+	rate, ok := s.rates[[2]int{fromID, toID}]
+	return rate, ok, time.Time{}, nil
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -31,6 +32,8 @@ const (
 	AttrNASIPAddress         = 4
 	AttrNASPort              = 5
 	AttrFramedIPAddress      = 8
+	AttrFilterId             = 11
+	AttrVendorSpecific       = 26
 	AttrCallingStationId     = 31
 	AttrNASIdentifier        = 32
 	AttrAcctSessionId        = 44
@@ -58,6 +61,18 @@ const (
 	ErrorRequestInitiated              = 507
 )
 
+// CoA shaper attributes
+const (
+	ShaperAttrFilterId          = "Filter-Id"           // Filter-Id (11), the NAS maps it to a policy
+	ShaperAttrMikrotikRateLimit = "Mikrotik-Rate-Limit" // Mikrotik VSA 14988/8, e.g. "1M/1M"
+
+	vendorMikrotik        = 14988
+	mikrotikRateLimitType = 8
+)
+
+// ErrCoADisabled is returned by ChangeShaper when CoA is not enabled; the shaper applies on next authorization
+var ErrCoADisabled = errors.New("CoA is disabled")
+
 // Service handles disconnect operations
 // Full equivalent to mod_disconnect_script.erl and mod_disconnect_pod.erl functionality
 type Service struct {
@@ -84,6 +99,10 @@ type Config struct {
 	PodEnabled  bool          `yaml:"pod_enabled"`
 	PodEndpoint string        `yaml:"pod_endpoint"`
 	PodTimeout  time.Duration `yaml:"pod_timeout"`
+
+	// CoA-Request (RFC 5176) settings for changing the shaper of a running session
+	CoAEnabled         bool   `yaml:"coa_enabled"`
+	CoAShaperAttribute string `yaml:"coa_shaper_attribute"` // Filter-Id or Mikrotik-Rate-Limit
 }
 
 // New creates a new disconnect service
@@ -101,6 +120,9 @@ func New(logger *zap.Logger, config Config) *Service {
 	if config.PodTimeout == 0 {
 		config.PodTimeout = 3 * time.Second
 	}
+	if config.CoAShaperAttribute == "" {
+		config.CoAShaperAttribute = ShaperAttrFilterId
+	}
 
 	return &Service{
 		logger: logger,
@@ -167,28 +189,9 @@ func (s *Service) DisconnectSession(userName, sid string, ip net.IP, nasSpec map
 // sendRADIUSDisconnect sends RADIUS Disconnect-Request
 // Equivalent to disconnect/5 in mod_disconnect_pod.erl
 func (s *Service) sendRADIUSDisconnect(userName, sid string, ip net.IP, nasSpec map[string]interface{}) error {
-	if nasSpec == nil {
-		return fmt.Errorf("no NAS specification provided")
-	}
-
-	// Extract NAS IP
-	nasIPRaw, exists := nasSpec["nas_ip"]
-	if !exists {
-		return fmt.Errorf("no NAS IP in specification")
-	}
-
-	var nasIP net.IP
-	switch v := nasIPRaw.(type) {
-	case string:
-		nasIP = net.ParseIP(v)
-	case net.IP:
-		nasIP = v
-	default:
-		return fmt.Errorf("invalid NAS IP type: %T", nasIPRaw)
-	}
-
-	if nasIP == nil {
-		return fmt.Errorf("invalid NAS IP address")
+	nasIP, err := nasAddress(nasSpec)
+	if err != nil {
+		return err
 	}
 
 	// Build RADIUS Disconnect-Request packet
@@ -224,13 +227,19 @@ func (s *Service) sendRADIUSDisconnect(userName, sid string, ip net.IP, nasSpec
 // buildDisconnectRequest builds RADIUS Disconnect-Request packet
 // Equivalent to building attributes list in mod_disconnect_pod.erl
 func (s *Service) buildDisconnectRequest(userName, sid string, ip net.IP, nasSpec map[string]interface{}) ([]byte, error) {
+	return s.buildRequest(RADIUSDisconnectRequest, userName, sid, ip, nasSpec, nil)
+}
+
+// buildRequest builds a Disconnect-Request or CoA-Request identifying the session
+// extra adds request specific attributes (CoA changes).
+func (s *Service) buildRequest(code uint8, userName, sid string, ip net.IP, nasSpec map[string]interface{}, extra func(buf *bytes.Buffer)) ([]byte, error) {
 	var buf bytes.Buffer
 
 	// RADIUS Header: Code(1) + Identifier(1) + Length(2) + Authenticator(16)
-	buf.WriteByte(RADIUSDisconnectRequest) // Code
-	buf.WriteByte(1)                       // Identifier (should be random)
-	buf.WriteByte(0)                       // Length (will be filled later)
-	buf.WriteByte(0)                       // Length (will be filled later)
+	buf.WriteByte(code) // Code
+	buf.WriteByte(1)    // Identifier (should be random)
+	buf.WriteByte(0)    // Length (will be filled later)
+	buf.WriteByte(0)    // Length (will be filled later)
 
 	// Request Authenticator (16 bytes - will be calculated with MD5)
 	authenticatorPos := buf.Len()
@@ -273,6 +282,10 @@ func (s *Service) buildDisconnectRequest(userName, sid string, ip net.IP, nasSpe
 		}
 	}
 
+	if extra != nil {
+		extra(&buf)
+	}
+
 	packet := buf.Bytes()
 
 	// Update length in header
@@ -358,6 +371,82 @@ func (s *Service) processDisconnectResponse(response []byte, userName, sid strin
 	}
 }
 
+// ChangeShaper sends a CoA-Request setting a new shaper for a running session
+// Used by volume quota plans when the fair use threshold is crossed.
+func (s *Service) ChangeShaper(userName, sid string, ip net.IP, nasSpec map[string]interface{}, shaper string) error {
+	if !s.config.CoAEnabled {
+		return ErrCoADisabled
+	}
+
+	nasIP, err := nasAddress(nasSpec)
+	if err != nil {
+		return err
+	}
+
+	packet, err := s.buildRequest(RADIUSCoARequest, userName, sid, ip, nasSpec, func(buf *bytes.Buffer) {
+		switch s.config.CoAShaperAttribute {
+		case ShaperAttrMikrotikRateLimit:
+			s.addVendorAttribute(buf, vendorMikrotik, mikrotikRateLimitType, shaper)
+		default:
+			s.addStringAttribute(buf, AttrFilterId, shaper)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build CoA request: %w", err)
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= s.config.Retries; attempt++ {
+		response, err := s.sendRADIUSPacket(nasIP, packet)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch response[0] {
+		case RADIUSCoAACK:
+			s.logger.Info("CoA ACK received",
+				zap.String("username", userName),
+				zap.String("sid", sid),
+				zap.String("shaper", shaper))
+			return nil
+		case RADIUSCoANAK:
+			return fmt.Errorf("CoA rejected: %s", s.formatRADIUSError(s.parseErrorCause(response)))
+		default:
+			return fmt.Errorf("unknown response code: %d", response[0])
+		}
+	}
+
+	return fmt.Errorf("failed to send CoA request after %d attempts: %w", s.config.Retries, lastErr)
+}
+
+// nasAddress extracts the NAS IP address from the session NAS specification
+func nasAddress(nasSpec map[string]interface{}) (net.IP, error) {
+	if nasSpec == nil {
+		return nil, fmt.Errorf("no NAS specification provided")
+	}
+
+	nasIPRaw, exists := nasSpec["nas_ip"]
+	if !exists {
+		return nil, fmt.Errorf("no NAS IP in specification")
+	}
+
+	var nasIP net.IP
+	switch v := nasIPRaw.(type) {
+	case string:
+		nasIP = net.ParseIP(v)
+	case net.IP:
+		nasIP = v
+	default:
+		return nil, fmt.Errorf("invalid NAS IP type: %T", nasIPRaw)
+	}
+
+	if nasIP == nil {
+		return nil, fmt.Errorf("invalid NAS IP address")
+	}
+	return nasIP, nil
+}
+
 // executeDisconnectScript runs external disconnect script
 // Equivalent to disconnect/5 in mod_disconnect_script.erl
 func (s *Service) executeDisconnectScript(userName, sid string, ip net.IP, nasSpec map[string]interface{}) error {
@@ -463,6 +552,17 @@ func (s *Service) addStringAttribute(buf *bytes.Buffer, attrType uint8, value st
 	buf.Write(valueBytes)
 }
 
+func (s *Service) addVendorAttribute(buf *bytes.Buffer, vendorID uint32, vendorType uint8, value string) {
+	valueBytes := []byte(value)
+
+	buf.WriteByte(AttrVendorSpecific)
+	buf.WriteByte(uint8(2 + 4 + 2 + len(valueBytes)))
+	binary.Write(buf, binary.BigEndian, vendorID)
+	buf.WriteByte(vendorType)
+	buf.WriteByte(uint8(2 + len(valueBytes)))
+	buf.Write(valueBytes)
+}
+
 func (s *Service) addIPAttribute(buf *bytes.Buffer, attrType uint8, ip net.IP) {
 	ip4 := ip.To4()
 	if ip4 == nil {
@@ -0,0 +1,685 @@
+package dunning
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/billing"
+	"isp-billing/internal/services/session"
+)
+
+// ErrCaseNotFound is returned for unknown dunning case IDs
+var ErrCaseNotFound = errors.New("dunning case not found")
+
+// ErrNoOpenCase is returned when the account has no unpaid charge in dunning
+var ErrNoOpenCase = errors.New("account has no open dunning case")
+
+// ErrCaseClosed is returned when a closed case is changed
+var ErrCaseClosed = errors.New("dunning case is closed")
+
+// escalation lists the open states in order; a case only moves forward until it is closed
+var escalation = []string{models.DunningGrace, models.DunningWarned, models.DunningThrottled, models.DunningSuspended}
+
+// Service follows failed subscription charges: retries them when a payment arrives and
+// escalates unpaid ones from a warning to a throttled shaper to suspension
+type Service struct {
+	db            *database.PostgreSQL
+	subscriptions *billing.SubscriptionService
+	sessions      *session.Service
+	logger        *zap.Logger
+	config        Config
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Config holds dunning settings
+// Offsets count from the moment the case is opened for a failed charge.
+type Config struct {
+	CheckInterval  time.Duration `yaml:"check_interval"`  // How often cases are retried and escalated
+	WarnAfter      time.Duration `yaml:"warn_after"`      // Warning, 0 - right away
+	WarnScript     string        `yaml:"warn_script"`     // Called as: script account_id login amount currency
+	ThrottleAfter  time.Duration `yaml:"throttle_after"`  // Captive portal shaper
+	ThrottleShaper string        `yaml:"throttle_shaper"` // Empty - no throttling step
+	SuspendAfter   time.Duration `yaml:"suspend_after"`   // 0 - subscription grace_period_days
+	ScriptTimeout  time.Duration `yaml:"script_timeout"`
+}
+
+// RunResult counts what a dunning run did
+type RunResult struct {
+	Opened    int `json:"opened"`
+	Retried   int `json:"retried"`
+	Resolved  int `json:"resolved"`
+	Escalated int `json:"escalated"`
+}
+
+// openCase is a dunning case with the moment payments were last looked for
+type openCase struct {
+	models.DunningCase
+	retriedAt time.Time
+}
+
+// New creates a new dunning service
+// Suspension follows the subscription settings: disable_on_insufficient_funds enables it and
+// grace_period_days is the default SuspendAfter.
+func New(db *database.PostgreSQL, subscriptions *billing.SubscriptionService, sessions *session.Service, logger *zap.Logger, config Config) *Service {
+	if config.CheckInterval == 0 {
+		config.CheckInterval = 15 * time.Minute
+	}
+	if config.ThrottleAfter == 0 {
+		config.ThrottleAfter = 24 * time.Hour
+	}
+	if config.SuspendAfter == 0 {
+		config.SuspendAfter = subscriptions.GracePeriod()
+	}
+	if config.ScriptTimeout == 0 {
+		config.ScriptTimeout = 30 * time.Second
+	}
+
+	return &Service{
+		db:            db,
+		subscriptions: subscriptions,
+		sessions:      sessions,
+		logger:        logger,
+		config:        config,
+		stopChan:      make(chan struct{}),
+	}
+}
+
+// Start runs dunning checks in background
+func (s *Service) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.config.CheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.Run(time.Now()); err != nil {
+					s.logger.Error("Dunning run failed", zap.Error(err))
+				}
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background task
+func (s *Service) Stop() {
+	close(s.stopChan)
+	s.wg.Wait()
+}
+
+// Run opens cases for new failed charges, retries charges of accounts that received a payment
+// and escalates the rest according to the configured offsets
+func (s *Service) Run(now time.Time) (*RunResult, error) {
+	result := &RunResult{}
+
+	opened, err := s.openCases(now)
+	if err != nil {
+		return result, err
+	}
+	result.Opened = opened
+
+	cases, err := s.fetchOpenCases()
+	if err != nil {
+		return result, err
+	}
+
+	for _, c := range cases {
+		if c.ChargeStatus != billing.ChargeStatusSuccess {
+			paid, err := s.paymentSince(c.AccountID, c.retriedAt)
+			if err != nil {
+				s.logger.Error("Failed to look for payments", zap.Int("case_id", c.ID), zap.Error(err))
+				continue
+			}
+			if paid {
+				result.Retried++
+				if err := s.retry(&c.DunningCase, now, "payment received"); err != nil {
+					s.logger.Error("Failed to retry charge", zap.Int("case_id", c.ID), zap.Error(err))
+					continue
+				}
+			}
+		}
+
+		if c.ChargeStatus == billing.ChargeStatusSuccess {
+			if err := s.close(&c.DunningCase, now, models.DunningResolved, "charge paid"); err != nil {
+				s.logger.Error("Failed to resolve dunning case", zap.Int("case_id", c.ID), zap.Error(err))
+				continue
+			}
+			result.Resolved++
+			continue
+		}
+
+		escalated, err := s.escalate(&c.DunningCase, now)
+		if err != nil {
+			s.logger.Error("Failed to escalate dunning case", zap.Int("case_id", c.ID), zap.Error(err))
+		}
+		result.Escalated += escalated
+	}
+
+	if result.Opened+result.Retried+result.Resolved+result.Escalated > 0 {
+		s.logger.Info("Dunning run finished",
+			zap.Int("opened", result.Opened),
+			zap.Int("retried", result.Retried),
+			zap.Int("resolved", result.Resolved),
+			zap.Int("escalated", result.Escalated))
+	}
+
+	return result, nil
+}
+
+// OnPayment retries the unpaid charge of the account right away, payment handlers call it
+// A paid charge closes the case and lifts throttling and suspension.
+func (s *Service) OnPayment(accountID int) (*models.DunningCase, error) {
+	c, err := s.openCaseOf(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if c.ChargeStatus != billing.ChargeStatusSuccess {
+		if err := s.retry(c, now, "payment"); err != nil {
+			return nil, err
+		}
+	}
+	if c.ChargeStatus == billing.ChargeStatusSuccess {
+		if err := s.close(c, now, models.DunningResolved, "charge paid"); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.Case(c.ID)
+}
+
+// Cancel closes a case without payment and lifts its restrictions; the charge stays failed
+func (s *Service) Cancel(caseID int, reason string) (*models.DunningCase, error) {
+	c, err := s.Case(caseID)
+	if err != nil {
+		return nil, err
+	}
+	if c.ClosedAt != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCaseClosed, c.State)
+	}
+	if reason == "" {
+		reason = "cancelled by operator"
+	}
+
+	if err := s.close(c, time.Now(), models.DunningCancelled, reason); err != nil {
+		return nil, err
+	}
+	return s.Case(caseID)
+}
+
+// Case returns a dunning case with its transitions
+func (s *Service) Case(caseID int) (*models.DunningCase, error) {
+	cases, err := s.queryCases(`WHERE d.id = $1`, caseID)
+	if err != nil {
+		return nil, err
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrCaseNotFound, caseID)
+	}
+
+	c := &cases[0].DunningCase
+	if c.Events, err = s.events(c.ID); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AccountCases returns dunning cases of the account with their transitions, newest first
+func (s *Service) AccountCases(accountID int) ([]models.DunningCase, error) {
+	cases, err := s.queryCases(`WHERE d.account_id = $1 ORDER BY d.id DESC`, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]models.DunningCase, 0, len(cases))
+	for _, c := range cases {
+		if c.Events, err = s.events(c.ID); err != nil {
+			return nil, err
+		}
+		list = append(list, c.DunningCase)
+	}
+	return list, nil
+}
+
+// Cases returns open cases, or all cases with all, most recently changed first
+func (s *Service) Cases(all bool, limit int) ([]models.DunningCase, error) {
+	where := `WHERE d.closed_at IS NULL`
+	if all {
+		where = `WHERE TRUE`
+	}
+	cases, err := s.queryCases(where+` ORDER BY d.updated_at DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]models.DunningCase, 0, len(cases))
+	for _, c := range cases {
+		list = append(list, c.DunningCase)
+	}
+	return list, nil
+}
+
+// openCases starts a case for the oldest failed charge of every account without an open case
+func (s *Service) openCases(now time.Time) (int, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT DISTINCT ON (sc.account_id) sc.account_id, sc.id
+		FROM subscription_charges sc
+		WHERE sc.status = 'failed'
+		AND NOT EXISTS (SELECT 1 FROM dunning_cases d WHERE d.charge_id = sc.id)
+		AND NOT EXISTS (SELECT 1 FROM dunning_cases d WHERE d.account_id = sc.account_id AND d.closed_at IS NULL)
+		ORDER BY sc.account_id, sc.period_start`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch failed charges: %w", err)
+	}
+
+	type failed struct{ accountID, chargeID int }
+	var charges []failed
+	for rows.Next() {
+		var f failed
+		if err := rows.Scan(&f.accountID, &f.chargeID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan charge: %w", err)
+		}
+		charges = append(charges, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read failed charges: %w", err)
+	}
+
+	opened := 0
+	for _, f := range charges {
+		tx, err := s.db.GetDB().Begin()
+		if err != nil {
+			return opened, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+
+		var caseID int
+		err = tx.QueryRow(`
+			INSERT INTO dunning_cases (account_id, charge_id, state, opened_at, updated_at, retried_at)
+			VALUES ($1, $2, $3, $4, $4, $4)
+			ON CONFLICT DO NOTHING
+			RETURNING id`, f.accountID, f.chargeID, models.DunningGrace, now).Scan(&caseID)
+		if err == sql.ErrNoRows {
+			tx.Rollback()
+			continue // Opened concurrently
+		}
+		if err == nil {
+			err = recordEvent(tx, caseID, "", models.DunningGrace, "subscription charge failed", now)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return opened, fmt.Errorf("failed to open dunning case: %w", err)
+		}
+
+		opened++
+		s.logger.Info("Dunning case opened",
+			zap.Int("case_id", caseID),
+			zap.Int("account_id", f.accountID),
+			zap.Int("charge_id", f.chargeID))
+	}
+
+	return opened, nil
+}
+
+// retry charges the case again and records when payments were last looked at
+func (s *Service) retry(c *models.DunningCase, now time.Time, reason string) error {
+	charge, err := s.subscriptions.RetryCharge(c.ChargeID)
+	if err != nil {
+		return err
+	}
+	c.ChargeStatus = charge.Status
+
+	if _, err := s.db.GetDB().Exec(`UPDATE dunning_cases SET retried_at = $1 WHERE id = $2`, now, c.ID); err != nil {
+		return fmt.Errorf("failed to update dunning case: %w", err)
+	}
+
+	s.logger.Info("Subscription charge retried",
+		zap.Int("case_id", c.ID),
+		zap.Int("account_id", c.AccountID),
+		zap.String("reason", reason),
+		zap.String("status", charge.Status),
+		zap.String("failure_reason", charge.FailureReason))
+	return nil
+}
+
+// escalate moves the case through every step that is due, applying each in order
+func (s *Service) escalate(c *models.DunningCase, now time.Time) (int, error) {
+	target := s.dueState(now.Sub(c.OpenedAt))
+
+	escalated := 0
+	for i := rank(c.State) + 1; i <= rank(target); i++ {
+		next := escalation[i]
+		if !s.stepEnabled(next) {
+			continue
+		}
+
+		if err := s.apply(c, next); err != nil {
+			return escalated, err
+		}
+		if err := s.transition(c, next, s.reason(next), now, false); err != nil {
+			return escalated, err
+		}
+		escalated++
+	}
+
+	return escalated, nil
+}
+
+// dueState returns the furthest enabled state whose offset has passed
+func (s *Service) dueState(elapsed time.Duration) string {
+	state := models.DunningGrace
+	if elapsed >= s.config.WarnAfter {
+		state = models.DunningWarned
+	}
+	if s.stepEnabled(models.DunningThrottled) && elapsed >= s.config.ThrottleAfter {
+		state = models.DunningThrottled
+	}
+	if s.stepEnabled(models.DunningSuspended) && elapsed >= s.config.SuspendAfter {
+		state = models.DunningSuspended
+	}
+	return state
+}
+
+func (s *Service) stepEnabled(state string) bool {
+	switch state {
+	case models.DunningThrottled:
+		return s.config.ThrottleShaper != ""
+	case models.DunningSuspended:
+		return s.subscriptions.SuspendOnInsufficientFunds()
+	}
+	return true
+}
+
+func (s *Service) reason(state string) string {
+	switch state {
+	case models.DunningWarned:
+		return fmt.Sprintf("unpaid after %s", s.config.WarnAfter)
+	case models.DunningThrottled:
+		return fmt.Sprintf("unpaid after %s, shaper %s", s.config.ThrottleAfter, s.config.ThrottleShaper)
+	case models.DunningSuspended:
+		return fmt.Sprintf("unpaid after %s", s.config.SuspendAfter)
+	}
+	return ""
+}
+
+// apply performs the action of entering state
+func (s *Service) apply(c *models.DunningCase, state string) error {
+	switch state {
+	case models.DunningWarned:
+		s.warn(c)
+	case models.DunningThrottled:
+		return s.setShaper(c.AccountID, s.config.ThrottleShaper)
+	case models.DunningSuspended:
+		if _, err := s.db.GetDB().Exec(`UPDATE accounts SET active = false WHERE id = $1`, c.AccountID); err != nil {
+			return fmt.Errorf("failed to suspend account: %w", err)
+		}
+		if s.sessions != nil {
+			if _, err := s.sessions.DisconnectAccount(c.AccountID); err != nil {
+				s.logger.Warn("Failed to disconnect suspended account", zap.Int("account_id", c.AccountID), zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// close lifts the restrictions of the case and closes it with state
+func (s *Service) close(c *models.DunningCase, now time.Time, state, reason string) error {
+	if rank(c.State) >= rank(models.DunningSuspended) {
+		if _, err := s.db.GetDB().Exec(`UPDATE accounts SET active = true WHERE id = $1`, c.AccountID); err != nil {
+			return fmt.Errorf("failed to reactivate account: %w", err)
+		}
+	}
+	if rank(c.State) >= rank(models.DunningThrottled) && s.config.ThrottleShaper != "" {
+		if err := s.setShaper(c.AccountID, ""); err != nil {
+			return err
+		}
+	}
+
+	return s.transition(c, state, reason, now, true)
+}
+
+// transition records the state change of the case
+func (s *Service) transition(c *models.DunningCase, state, reason string, now time.Time, closed bool) error {
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE dunning_cases SET state = $1, updated_at = $2 WHERE id = $3 AND closed_at IS NULL`
+	if closed {
+		query = `UPDATE dunning_cases SET state = $1, updated_at = $2, closed_at = $2 WHERE id = $3 AND closed_at IS NULL`
+	}
+	res, err := tx.Exec(query, state, now, c.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update dunning case: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: %d", ErrCaseClosed, c.ID)
+	}
+	if err := recordEvent(tx, c.ID, c.State, state, reason, now); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit dunning transition: %w", err)
+	}
+
+	s.logger.Info("Dunning case transition",
+		zap.Int("case_id", c.ID),
+		zap.Int("account_id", c.AccountID),
+		zap.String("from", c.State),
+		zap.String("to", state),
+		zap.String("reason", reason))
+
+	c.State = state
+	c.UpdatedAt = now
+	if closed {
+		c.ClosedAt = &now
+	}
+	return nil
+}
+
+// setShaper sets DUNNING_SHAPER (or removes it for "") in accounts.plan_data and running sessions
+// Sessions get the new shaper through CoA; without DUNNING_SHAPER the plan shaper is restored.
+func (s *Service) setShaper(accountID int, shaper string) error {
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var planDataJSON string
+	if err := tx.QueryRow(`SELECT plan_data FROM accounts WHERE id = $1 FOR UPDATE`, accountID).Scan(&planDataJSON); err != nil {
+		return fmt.Errorf("failed to fetch plan data: %w", err)
+	}
+	planData, err := database.ParsePlanDataFromJSON(planDataJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse plan data: %w", err)
+	}
+
+	data, err := json.Marshal(models.SetDunningShaper(planData, shaper))
+	if err != nil {
+		return fmt.Errorf("failed to marshal plan data: %w", err)
+	}
+	if _, err := tx.Exec(models.UpdateAccountPlanDataQuery, string(data), accountID); err != nil {
+		return fmt.Errorf("failed to update plan data: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit plan data: %w", err)
+	}
+
+	if s.sessions == nil {
+		return nil
+	}
+	_, err = s.sessions.UpdateAccountSessions(accountID, func(sess *models.IPTrafficSession) error {
+		sess.UpdatePlanData(models.SetDunningShaper(sess.PlanData, shaper))
+		sessionShaper := shaper
+		if sessionShaper == "" {
+			sessionShaper = planShaper(sess.PlanData)
+		}
+		if sessionShaper != "" {
+			s.sessions.ChangeShaper(sess, sessionShaper)
+		}
+		return nil
+	})
+	return err
+}
+
+// planShaper returns the shaper the plan gives now
+func planShaper(planData map[string]interface{}) string {
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return ""
+	}
+	return settings.ShaperAt(time.Now())
+}
+
+// warn runs the warning script in background
+func (s *Service) warn(c *models.DunningCase) {
+	s.logger.Warn("Subscription fee unpaid, subscriber warned",
+		zap.Int("case_id", c.ID),
+		zap.Int("account_id", c.AccountID),
+		zap.String("login", c.Login),
+		zap.Stringer("amount", c.Amount),
+		zap.Int("currency", c.Currency))
+
+	if s.config.WarnScript == "" {
+		return
+	}
+	args := []string{strconv.Itoa(c.AccountID), c.Login, c.Amount.String(), strconv.Itoa(c.Currency)}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.ScriptTimeout)
+		defer cancel()
+
+		if output, err := exec.CommandContext(ctx, s.config.WarnScript, args...).CombinedOutput(); err != nil {
+			s.logger.Error("Dunning warn script failed",
+				zap.String("script", s.config.WarnScript),
+				zap.Strings("args", args),
+				zap.String("output", string(output)),
+				zap.Error(err))
+		}
+	}()
+}
+
+// paymentSince reports whether the contract of the account was credited after since
+func (s *Service) paymentSince(accountID int, since time.Time) (bool, error) {
+	var paid bool
+	err := s.db.GetDB().QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM fin_transactions ft
+			JOIN accounts a ON a.contract_id = ft.contract_id
+			WHERE a.id = $1 AND ft.amount > 0 AND ft.created_at > $2
+		)`, accountID, since).Scan(&paid)
+	return paid, err
+}
+
+func (s *Service) openCaseOf(accountID int) (*models.DunningCase, error) {
+	cases, err := s.queryCases(`WHERE d.account_id = $1 AND d.closed_at IS NULL`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("%w: account %d", ErrNoOpenCase, accountID)
+	}
+	return &cases[0].DunningCase, nil
+}
+
+func (s *Service) fetchOpenCases() ([]openCase, error) {
+	return s.queryCases(`WHERE d.closed_at IS NULL ORDER BY d.id`)
+}
+
+func (s *Service) queryCases(where string, args ...interface{}) ([]openCase, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT d.id, d.account_id, a.login, d.charge_id, sc.amount, sc.currency_id, sc.status,
+			d.state, d.opened_at, d.updated_at, d.closed_at, d.retried_at
+		FROM dunning_cases d
+		JOIN accounts a ON a.id = d.account_id
+		JOIN subscription_charges sc ON sc.id = d.charge_id
+		`+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch dunning cases: %w", err)
+	}
+	defer rows.Close()
+
+	var cases []openCase
+	for rows.Next() {
+		var c openCase
+		var closedAt sql.NullTime
+		err := rows.Scan(&c.ID, &c.AccountID, &c.Login, &c.ChargeID, &c.Amount, &c.Currency, &c.ChargeStatus,
+			&c.State, &c.OpenedAt, &c.UpdatedAt, &closedAt, &c.retriedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dunning case: %w", err)
+		}
+		if closedAt.Valid {
+			c.ClosedAt = &closedAt.Time
+		}
+		cases = append(cases, c)
+	}
+	return cases, rows.Err()
+}
+
+func (s *Service) events(caseID int) ([]models.DunningEvent, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT id, case_id, from_state, to_state, reason, created_at
+		FROM dunning_events WHERE case_id = $1 ORDER BY id`, caseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch dunning events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []models.DunningEvent{}
+	for rows.Next() {
+		var e models.DunningEvent
+		if err := rows.Scan(&e.ID, &e.CaseID, &e.FromState, &e.ToState, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan dunning event: %w", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func recordEvent(tx *sql.Tx, caseID int, from, to, reason string, now time.Time) error {
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	_, err := tx.Exec(`
+		INSERT INTO dunning_events (case_id, from_state, to_state, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5)`, caseID, from, to, reason, now)
+	if err != nil {
+		return fmt.Errorf("failed to record dunning event: %w", err)
+	}
+	return nil
+}
+
+// rank is the position of an open state in escalation, closed states rank above all
+func rank(state string) int {
+	for i, s := range escalation {
+		if s == state {
+			return i
+		}
+	}
+	return len(escalation)
+}
@@ -0,0 +1,177 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"isp-billing/internal/models"
+)
+
+// fakeBackend keeps gateway transactions in memory with the semantics of Service: every
+// operation is idempotent on the provider transaction ID, perform books one payment and
+// cancel of a performed transaction reverses it
+type fakeBackend struct {
+	configs  map[string]ProviderConfig
+	accounts []Account
+	list     []*models.GatewayTransaction
+
+	payments  int // Booked
+	reversals int
+}
+
+func newFakeBackend(gateway string, config ProviderConfig) *fakeBackend {
+	return &fakeBackend{
+		configs: map[string]ProviderConfig{gateway: config},
+		accounts: []Account{
+			{ID: 1, Login: "test1", ContractID: 10, Currency: 1},
+			{ID: 2, Login: "test2", ContractID: 20, Currency: 1},
+		},
+	}
+}
+
+func (b *fakeBackend) Check(gateway string, ref AccountRef, amount models.Money) (*Account, error) {
+	config, ok := b.configs[gateway]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownGateway, gateway)
+	}
+	for i := range b.accounts {
+		a := &b.accounts[i]
+		if ref.Login != "" && a.Login == ref.Login || ref.Login == "" && a.ContractID == ref.ContractID {
+			if err := checkAmount(config, amount); err != nil {
+				return nil, err
+			}
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrAccountNotFound, ref)
+}
+
+func (b *fakeBackend) Create(gateway, externalID string, ref AccountRef, amount models.Money, providerTime time.Time) (*models.GatewayTransaction, error) {
+	account, err := b.Check(gateway, ref, amount)
+	if err != nil {
+		return nil, err
+	}
+	if providerTime.IsZero() {
+		providerTime = time.Now()
+	}
+	if t := b.find(gateway, externalID); t != nil {
+		if t.AccountID != account.ID || t.Amount.Cmp(amount) != 0 {
+			return nil, fmt.Errorf("%w: %s %s", ErrTransactionMismatch, gateway, externalID)
+		}
+		return copyTransaction(t), nil
+	}
+	t := &models.GatewayTransaction{
+		ID:           len(b.list) + 1,
+		Gateway:      gateway,
+		ExternalID:   externalID,
+		AccountID:    account.ID,
+		Login:        account.Login,
+		ContractID:   account.ContractID,
+		Amount:       amount,
+		Currency:     account.Currency,
+		State:        models.GatewayCreated,
+		ProviderTime: providerTime,
+		CreatedAt:    time.Now(),
+	}
+	b.list = append(b.list, t)
+	return copyTransaction(t), nil
+}
+
+func (b *fakeBackend) Perform(gateway, externalID string) (*models.GatewayTransaction, error) {
+	t := b.find(gateway, externalID)
+	if t == nil {
+		return nil, fmt.Errorf("%w: %s %s", ErrTransactionNotFound, gateway, externalID)
+	}
+	switch t.State {
+	case models.GatewayPerformed:
+		return copyTransaction(t), nil
+	case models.GatewayCancelled, models.GatewayReversed:
+		return nil, fmt.Errorf("%w: %s %s", ErrTransactionCancelled, gateway, externalID)
+	}
+	b.payments++
+	now := time.Now()
+	t.State = models.GatewayPerformed
+	t.PaymentID = 100 + b.payments
+	t.PerformedAt = &now
+	return copyTransaction(t), nil
+}
+
+func (b *fakeBackend) Cancel(gateway, externalID, reason string) (*models.GatewayTransaction, error) {
+	t := b.find(gateway, externalID)
+	if t == nil {
+		return nil, fmt.Errorf("%w: %s %s", ErrTransactionNotFound, gateway, externalID)
+	}
+	if t.State == models.GatewayCancelled || t.State == models.GatewayReversed {
+		return copyTransaction(t), nil
+	}
+	if t.State == models.GatewayPerformed {
+		b.reversals++
+		t.State = models.GatewayReversed
+	} else {
+		t.State = models.GatewayCancelled
+	}
+	now := time.Now()
+	t.CancelledAt = &now
+	t.CancelReason = reason
+	return copyTransaction(t), nil
+}
+
+func (b *fakeBackend) Transaction(gateway, externalID string) (*models.GatewayTransaction, error) {
+	t := b.find(gateway, externalID)
+	if t == nil {
+		return nil, fmt.Errorf("%w: %s %s", ErrTransactionNotFound, gateway, externalID)
+	}
+	return copyTransaction(t), nil
+}
+
+func (b *fakeBackend) TransactionByID(gateway string, id int) (*models.GatewayTransaction, error) {
+	for _, t := range b.list {
+		if t.Gateway == gateway && t.ID == id {
+			return copyTransaction(t), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s #%d", ErrTransactionNotFound, gateway, id)
+}
+
+func (b *fakeBackend) Transactions(gateway string, from, to time.Time) ([]models.GatewayTransaction, error) {
+	if _, ok := b.configs[gateway]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownGateway, gateway)
+	}
+	list := []models.GatewayTransaction{}
+	for _, t := range b.list {
+		if t.Gateway == gateway && !t.ProviderTime.Before(from) && t.ProviderTime.Before(to) {
+			list = append(list, *copyTransaction(t))
+		}
+	}
+	return list, nil
+}
+
+func (b *fakeBackend) find(gateway, externalID string) *models.GatewayTransaction {
+	for _, t := range b.list {
+		if t.Gateway == gateway && t.ExternalID == externalID {
+			return t
+		}
+	}
+	return nil
+}
+
+func copyTransaction(t *models.GatewayTransaction) *models.GatewayTransaction {
+	c := *t
+	return &c
+}
+
+// serve runs a provider behind an HTTP server the way the webhook handler does
+func serve(t *testing.T, p Provider) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, body := p.Handle(r)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
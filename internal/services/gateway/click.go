@@ -0,0 +1,210 @@
+package gateway
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/models"
+)
+
+// KindClick is the Click Shop API: form-encoded Prepare (action 0) and Complete (action 1)
+// requests signed with an MD5 sign_string
+const KindClick = "click"
+
+// Click error codes
+const (
+	clickOK             = 0
+	clickSignFailed     = -1
+	clickBadAmount      = -2
+	clickActionNotFound = -3
+	clickAlreadyPaid    = -4
+	clickUserNotFound   = -5
+	clickTransNotFound  = -6
+	clickBadRequest     = -8
+	clickTransCancelled = -9
+)
+
+const (
+	clickActionPrepare  = "0"
+	clickActionComplete = "1"
+
+	// Replayed requests are idempotent anyway, the limit only rejects stale signatures
+	clickMaxSignTimeDrift = 24 * time.Hour
+)
+
+type click struct {
+	name   string
+	config ProviderConfig
+	gw     backend
+	logger *zap.Logger
+}
+
+func newClick(name string, config ProviderConfig, gw backend, logger *zap.Logger) Provider {
+	return &click{name: name, config: config, gw: gw, logger: logger}
+}
+
+// clickResponse is the answer to Prepare and Complete; Click always expects HTTP 200
+type clickResponse struct {
+	ClickTransID      string `json:"click_trans_id"`
+	MerchantTransID   string `json:"merchant_trans_id"`
+	MerchantPrepareID int    `json:"merchant_prepare_id,omitempty"`
+	MerchantConfirmID int    `json:"merchant_confirm_id,omitempty"`
+	Error             int    `json:"error"`
+	ErrorNote         string `json:"error_note"`
+}
+
+func (p *click) Handle(r *http.Request) (int, interface{}) {
+	if err := r.ParseForm(); err != nil {
+		return http.StatusOK, clickResponse{Error: clickBadRequest, ErrorNote: "Error in request from click"}
+	}
+	form := r.PostForm
+	resp := clickResponse{
+		ClickTransID:    form.Get("click_trans_id"),
+		MerchantTransID: form.Get("merchant_trans_id"),
+	}
+	reply := func(code int, note string) (int, interface{}) {
+		resp.Error = code
+		resp.ErrorNote = note
+		return http.StatusOK, resp
+	}
+
+	action := form.Get("action")
+	if action != clickActionPrepare && action != clickActionComplete {
+		return reply(clickActionNotFound, "Action not found")
+	}
+	if resp.ClickTransID == "" || resp.MerchantTransID == "" || form.Get("amount") == "" {
+		return reply(clickBadRequest, "Error in request from click")
+	}
+	if p.config.ServiceID != "" && form.Get("service_id") != p.config.ServiceID {
+		return reply(clickBadRequest, "Unknown service_id")
+	}
+	if !p.verify(form.Get, action) {
+		p.logger.Warn("Click request with invalid signature",
+			zap.String("gateway", p.name),
+			zap.String("click_trans_id", resp.ClickTransID))
+		return reply(clickSignFailed, "SIGN CHECK FAILED!")
+	}
+
+	amount, err := models.ParseMoney(form.Get("amount"))
+	if err != nil {
+		return reply(clickBadAmount, "Incorrect parameter amount")
+	}
+
+	if action == clickActionPrepare {
+		ref, ok := accountRef(p.config.AccountField, resp.MerchantTransID)
+		if !ok {
+			return reply(clickUserNotFound, "User does not exist")
+		}
+		t, err := p.gw.Create(p.name, resp.ClickTransID, ref, amount, clickSignTime(form.Get("sign_time")))
+		if err != nil {
+			return reply(p.errorCode(err))
+		}
+		resp.MerchantPrepareID = t.ID
+		switch t.State {
+		case models.GatewayPerformed:
+			return reply(clickAlreadyPaid, "Already paid")
+		case models.GatewayCancelled, models.GatewayReversed:
+			return reply(clickTransCancelled, "Transaction cancelled")
+		}
+		return reply(clickOK, "Success")
+	}
+
+	prepareID, err := strconv.Atoi(form.Get("merchant_prepare_id"))
+	if err != nil {
+		return reply(clickTransNotFound, "Transaction does not exist")
+	}
+	t, err := p.gw.TransactionByID(p.name, prepareID)
+	if err != nil {
+		return reply(p.errorCode(err))
+	}
+	if t.ExternalID != resp.ClickTransID {
+		return reply(clickTransNotFound, "Transaction does not exist")
+	}
+	if t.Amount.Cmp(amount) != 0 {
+		return reply(clickBadAmount, "Incorrect parameter amount")
+	}
+
+	// A negative error means the payment failed on the Click side
+	if code, _ := strconv.Atoi(form.Get("error")); code < 0 {
+		if _, err := p.gw.Cancel(p.name, t.ExternalID, form.Get("error_note")); err != nil {
+			return reply(p.errorCode(err))
+		}
+		return reply(clickTransCancelled, "Transaction cancelled")
+	}
+
+	t, err = p.gw.Perform(p.name, t.ExternalID)
+	if err != nil {
+		return reply(p.errorCode(err))
+	}
+	resp.MerchantConfirmID = t.PaymentID
+	return reply(clickOK, "Success")
+}
+
+// verify checks sign_string: md5(click_trans_id service_id SECRET_KEY merchant_trans_id
+// [merchant_prepare_id] amount action sign_time)
+func (p *click) verify(get func(string) string, action string) bool {
+	signed := get("click_trans_id") + get("service_id") + p.config.Secret + get("merchant_trans_id")
+	if action == clickActionComplete {
+		signed += get("merchant_prepare_id")
+	}
+	signed += get("amount") + action + get("sign_time")
+
+	sum := md5.Sum([]byte(signed))
+	expected := hex.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(get("sign_string"))) != 1 {
+		return false
+	}
+
+	if at := clickSignTime(get("sign_time")); !at.IsZero() {
+		if d := time.Since(at); d > clickMaxSignTimeDrift || d < -clickMaxSignTimeDrift {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *click) errorCode(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrAccountNotFound):
+		return clickUserNotFound, "User does not exist"
+	case errors.Is(err, ErrInvalidAmount):
+		return clickBadAmount, "Incorrect parameter amount"
+	case errors.Is(err, ErrTransactionNotFound):
+		return clickTransNotFound, "Transaction does not exist"
+	case errors.Is(err, ErrTransactionCancelled):
+		return clickTransCancelled, "Transaction cancelled"
+	case errors.Is(err, ErrTransactionMismatch):
+		return clickBadRequest, "Error in request from click"
+	default:
+		p.logger.Error("Click request failed", zap.String("gateway", p.name), zap.Error(err))
+		return clickBadRequest, "Error in request from click"
+	}
+}
+
+// clickSignTime parses sign_time, "2006-01-02 15:04:05" in local time
+func clickSignTime(s string) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// accountRef interprets the payer field of a provider request
+func accountRef(field, value string) (AccountRef, bool) {
+	if field == AccountByContract {
+		id, err := strconv.Atoi(value)
+		if err != nil || id <= 0 {
+			return AccountRef{}, false
+		}
+		return AccountRef{ContractID: id}, true
+	}
+	return AccountRef{Login: value}, value != ""
+}
@@ -0,0 +1,198 @@
+package gateway
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/models"
+)
+
+const clickSecret = "click-test-secret"
+
+type clickClient struct {
+	t         *testing.T
+	url       string
+	secret    string
+	serviceID string
+	signTime  time.Time
+}
+
+func newClickTest(t *testing.T) (*fakeBackend, *clickClient) {
+	config := ProviderConfig{
+		Kind:         KindClick,
+		Secret:       clickSecret,
+		ServiceID:    "7",
+		AccountField: AccountByLogin,
+		MinAmount:    models.NewMoney(1000),
+	}
+	b := newFakeBackend("click", config)
+	srv := serve(t, newClick("click", config, b, zap.NewNop()))
+	return b, &clickClient{t: t, url: srv.URL, secret: clickSecret, serviceID: "7", signTime: time.Now()}
+}
+
+// send posts a signed Prepare (prepareID 0) or Complete request
+func (c *clickClient) send(clickTransID, account, amount string, prepareID int, extra url.Values) clickResponse {
+	c.t.Helper()
+	action := clickActionPrepare
+	form := url.Values{
+		"click_trans_id":    {clickTransID},
+		"service_id":        {c.serviceID},
+		"merchant_trans_id": {account},
+		"amount":            {amount},
+		"sign_time":         {c.signTime.Format("2006-01-02 15:04:05")},
+	}
+	signed := clickTransID + c.serviceID + c.secret + account
+	if prepareID != 0 {
+		action = clickActionComplete
+		form.Set("merchant_prepare_id", strconv.Itoa(prepareID))
+		signed += strconv.Itoa(prepareID)
+	}
+	form.Set("action", action)
+	sum := md5.Sum([]byte(signed + amount + action + form.Get("sign_time")))
+	form.Set("sign_string", hex.EncodeToString(sum[:]))
+	for k, v := range extra {
+		form[k] = v
+	}
+
+	resp, err := http.PostForm(c.url, form)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("HTTP status %d, Click expects 200", resp.StatusCode)
+	}
+	var out clickResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		c.t.Fatal(err)
+	}
+	return out
+}
+
+func expectClick(t *testing.T, step string, resp clickResponse, code int) {
+	t.Helper()
+	if resp.Error != code {
+		t.Fatalf("%s: error %d (%s), want %d", step, resp.Error, resp.ErrorNote, code)
+	}
+}
+
+func TestClickPrepareComplete(t *testing.T) {
+	b, c := newClickTest(t)
+
+	prepared := c.send("c-1", "test1", "5000.00", 0, nil)
+	expectClick(t, "prepare", prepared, clickOK)
+	if prepared.MerchantPrepareID == 0 || prepared.ClickTransID != "c-1" || prepared.MerchantTransID != "test1" {
+		t.Fatalf("prepare response %+v", prepared)
+	}
+
+	completed := c.send("c-1", "test1", "5000.00", prepared.MerchantPrepareID, nil)
+	expectClick(t, "complete", completed, clickOK)
+	if completed.MerchantConfirmID == 0 {
+		t.Fatal("complete did not return the payment as merchant_confirm_id")
+	}
+	if b.payments != 1 {
+		t.Fatalf("%d payments booked, want 1", b.payments)
+	}
+
+	// Redelivered Complete answers the same, without a second payment
+	again := c.send("c-1", "test1", "5000.00", prepared.MerchantPrepareID, nil)
+	expectClick(t, "redelivered complete", again, clickOK)
+	if again.MerchantConfirmID != completed.MerchantConfirmID || b.payments != 1 {
+		t.Fatalf("redelivery confirm %d (want %d), %d payments", again.MerchantConfirmID, completed.MerchantConfirmID, b.payments)
+	}
+
+	// Prepare of a paid transaction
+	expectClick(t, "prepare after complete", c.send("c-1", "test1", "5000.00", 0, nil), clickAlreadyPaid)
+}
+
+func TestClickRedeliveredPrepare(t *testing.T) {
+	b, c := newClickTest(t)
+
+	first := c.send("c-2", "test1", "2000", 0, nil)
+	expectClick(t, "prepare", first, clickOK)
+	second := c.send("c-2", "test1", "2000", 0, nil)
+	expectClick(t, "redelivered prepare", second, clickOK)
+	if second.MerchantPrepareID != first.MerchantPrepareID || len(b.list) != 1 {
+		t.Fatalf("redelivered prepare created another transaction: %d vs %d", second.MerchantPrepareID, first.MerchantPrepareID)
+	}
+
+	// Same click_trans_id with another amount
+	expectClick(t, "prepare with other amount", c.send("c-2", "test1", "3000", 0, nil), clickBadRequest)
+}
+
+func TestClickBadSignature(t *testing.T) {
+	b, c := newClickTest(t)
+
+	c.secret = "forged"
+	expectClick(t, "forged prepare", c.send("c-3", "test1", "5000", 0, nil), clickSignFailed)
+	if len(b.list) != 0 {
+		t.Fatal("forged prepare created a transaction")
+	}
+
+	c.secret = clickSecret
+	prepared := c.send("c-3", "test1", "5000", 0, nil)
+	expectClick(t, "prepare", prepared, clickOK)
+
+	c.secret = "forged"
+	expectClick(t, "forged complete", c.send("c-3", "test1", "5000", prepared.MerchantPrepareID, nil), clickSignFailed)
+	if b.payments != 0 {
+		t.Fatal("forged complete booked a payment")
+	}
+
+	// Signature of another amount
+	c.secret = clickSecret
+	expectClick(t, "tampered amount", c.send("c-3", "test1", "5000", prepared.MerchantPrepareID,
+		url.Values{"amount": {"50000"}}), clickSignFailed)
+
+	// Stale sign_time
+	c.signTime = time.Now().Add(-2 * clickMaxSignTimeDrift)
+	expectClick(t, "stale signature", c.send("c-4", "test1", "5000", 0, nil), clickSignFailed)
+}
+
+func TestClickRejects(t *testing.T) {
+	b, c := newClickTest(t)
+
+	expectClick(t, "unknown user", c.send("c-5", "nobody", "5000", 0, nil), clickUserNotFound)
+	expectClick(t, "below minimum", c.send("c-5", "test1", "999.99", 0, nil), clickBadAmount)
+	expectClick(t, "unknown prepare id", c.send("c-5", "test1", "5000", 42, nil), clickTransNotFound)
+
+	c.serviceID = "8"
+	expectClick(t, "other service", c.send("c-5", "test1", "5000", 0, nil), clickBadRequest)
+	c.serviceID = "7"
+
+	prepared := c.send("c-6", "test1", "5000", 0, nil)
+	expectClick(t, "prepare", prepared, clickOK)
+	expectClick(t, "complete with other amount", c.send("c-6", "test1", "6000", prepared.MerchantPrepareID, nil), clickBadAmount)
+	expectClick(t, "complete of other transaction", c.send("c-7", "test1", "5000", prepared.MerchantPrepareID, nil), clickTransNotFound)
+	if b.payments != 0 {
+		t.Fatalf("%d payments booked by rejected requests", b.payments)
+	}
+}
+
+func TestClickFailedPayment(t *testing.T) {
+	b, c := newClickTest(t)
+
+	prepared := c.send("c-8", "test1", "5000", 0, nil)
+	expectClick(t, "prepare", prepared, clickOK)
+
+	// Click reports the payment failed on its side
+	failed := url.Values{"error": {"-5017"}, "error_note": {"Insufficient funds"}}
+	expectClick(t, "failed complete", c.send("c-8", "test1", "5000", prepared.MerchantPrepareID, failed), clickTransCancelled)
+	if tr := b.find("click", "c-8"); tr.State != models.GatewayCancelled || tr.CancelReason != "Insufficient funds" {
+		t.Fatalf("transaction %s (%q), want cancelled", tr.State, tr.CancelReason)
+	}
+
+	expectClick(t, "complete after cancel", c.send("c-8", "test1", "5000", prepared.MerchantPrepareID, nil), clickTransCancelled)
+	expectClick(t, "prepare after cancel", c.send("c-8", "test1", "5000", 0, nil), clickTransCancelled)
+	if b.payments != 0 {
+		t.Fatal("cancelled transaction booked a payment")
+	}
+}
@@ -0,0 +1,353 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/models"
+)
+
+// KindPayme is the Payme Merchant API: JSON-RPC requests authenticated with HTTP Basic
+// "Paycom:<key>", amounts in tiyin (1/100), times in Unix milliseconds
+const KindPayme = "payme"
+
+// Payme error codes
+const (
+	paymeAuthFailed       = -32504
+	paymeParseError       = -32700
+	paymeInvalidRequest   = -32600
+	paymeMethodNotFound   = -32601
+	paymeSystemError      = -32400
+	paymeWrongAmount      = -31001
+	paymeTransNotFound    = -31003
+	paymeCannotPerform    = -31008
+	paymeAccountNotFound  = -31050
+	paymeCancelledTimeout = "4" // CancelTransaction reason: transaction timed out
+)
+
+// Payme transaction states
+const (
+	paymeStateCreated            = 1
+	paymeStatePerformed          = 2
+	paymeStateCancelled          = -1
+	paymeStateCancelledAfterPaid = -2
+)
+
+type payme struct {
+	name   string
+	config ProviderConfig
+	gw     backend
+	logger *zap.Logger
+}
+
+func newPayme(name string, config ProviderConfig, gw backend, logger *zap.Logger) Provider {
+	return &payme{name: name, config: config, gw: gw, logger: logger}
+}
+
+type paymeRequest struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params paymeParams     `json:"params"`
+}
+
+type paymeParams struct {
+	ID      string            `json:"id"`
+	Time    int64             `json:"time"`
+	Amount  int64             `json:"amount"`
+	Account map[string]string `json:"account"`
+	Reason  *int              `json:"reason"`
+	From    int64             `json:"from"`
+	To      int64             `json:"to"`
+}
+
+type paymeError struct {
+	Code    int               `json:"code"`
+	Message map[string]string `json:"message"`
+	Data    string            `json:"data,omitempty"`
+}
+
+type paymeResponse struct {
+	ID     json.RawMessage `json:"id"`
+	Result interface{}     `json:"result,omitempty"`
+	Error  *paymeError     `json:"error,omitempty"`
+}
+
+// paymeTransaction is a transaction in CheckTransaction and GetStatement results
+type paymeTransaction struct {
+	ID          string            `json:"id,omitempty"`
+	Time        int64             `json:"time,omitempty"`
+	Amount      int64             `json:"amount,omitempty"`
+	Account     map[string]string `json:"account,omitempty"`
+	CreateTime  int64             `json:"create_time"`
+	PerformTime int64             `json:"perform_time"`
+	CancelTime  int64             `json:"cancel_time"`
+	Transaction string            `json:"transaction"`
+	State       int               `json:"state"`
+	Reason      *int              `json:"reason"`
+}
+
+func (p *payme) Handle(r *http.Request) (int, interface{}) {
+	var req paymeRequest
+	if !p.authorized(r.Header.Get("Authorization")) {
+		p.logger.Warn("Payme request with invalid authorization", zap.String("gateway", p.name))
+		return http.StatusOK, p.fail(req, paymeAuthFailed, "Insufficient privileges", "")
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return http.StatusOK, p.fail(req, paymeParseError, "Parse error", "")
+	}
+
+	var result interface{}
+	var err error
+	switch req.Method {
+	case "CheckPerformTransaction":
+		result, err = p.checkPerform(req.Params)
+	case "CreateTransaction":
+		result, err = p.create(req.Params)
+	case "PerformTransaction":
+		result, err = p.perform(req.Params)
+	case "CancelTransaction":
+		result, err = p.cancel(req.Params)
+	case "CheckTransaction":
+		result, err = p.check(req.Params)
+	case "GetStatement":
+		result, err = p.statement(req.Params)
+	default:
+		return http.StatusOK, p.fail(req, paymeMethodNotFound, "Method not found", req.Method)
+	}
+	if err != nil {
+		return http.StatusOK, p.errorResponse(req, err)
+	}
+	return http.StatusOK, paymeResponse{ID: req.ID, Result: result}
+}
+
+func (p *payme) checkPerform(params paymeParams) (interface{}, error) {
+	ref, err := p.accountRef(params.Account)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.gw.Check(p.name, ref, fromTiyin(params.Amount)); err != nil {
+		return nil, err
+	}
+	return map[string]bool{"allow": true}, nil
+}
+
+func (p *payme) create(params paymeParams) (interface{}, error) {
+	if params.ID == "" {
+		return nil, errPaymeInvalidParams
+	}
+	ref, err := p.accountRef(params.Account)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := p.gw.Create(p.name, params.ID, ref, fromTiyin(params.Amount), fromMillis(params.Time))
+	if err != nil {
+		return nil, err
+	}
+	if t.State != models.GatewayCreated {
+		return nil, ErrTransactionCancelled
+	}
+	if t, err = p.expire(t); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"create_time": millis(&t.CreatedAt),
+		"transaction": strconv.Itoa(t.ID),
+		"state":       paymeStateCreated,
+	}, nil
+}
+
+func (p *payme) perform(params paymeParams) (interface{}, error) {
+	t, err := p.gw.Transaction(p.name, params.ID)
+	if err != nil {
+		return nil, err
+	}
+	if t.State == models.GatewayCreated {
+		if t, err = p.expire(t); err != nil {
+			return nil, err
+		}
+	}
+
+	if t, err = p.gw.Perform(p.name, params.ID); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"transaction":  strconv.Itoa(t.ID),
+		"perform_time": millis(t.PerformedAt),
+		"state":        paymeStatePerformed,
+	}, nil
+}
+
+func (p *payme) cancel(params paymeParams) (interface{}, error) {
+	reason := ""
+	if params.Reason != nil {
+		reason = strconv.Itoa(*params.Reason)
+	}
+	t, err := p.gw.Cancel(p.name, params.ID, reason)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"transaction": strconv.Itoa(t.ID),
+		"cancel_time": millis(t.CancelledAt),
+		"state":       paymeState(t.State),
+	}, nil
+}
+
+func (p *payme) check(params paymeParams) (interface{}, error) {
+	t, err := p.gw.Transaction(p.name, params.ID)
+	if err != nil {
+		return nil, err
+	}
+	return p.transaction(t, false), nil
+}
+
+func (p *payme) statement(params paymeParams) (interface{}, error) {
+	if params.From == 0 || params.To <= params.From {
+		return nil, errPaymeInvalidParams
+	}
+	list, err := p.gw.Transactions(p.name, fromMillis(params.From), fromMillis(params.To))
+	if err != nil {
+		return nil, err
+	}
+	transactions := make([]paymeTransaction, 0, len(list))
+	for i := range list {
+		transactions = append(transactions, p.transaction(&list[i], true))
+	}
+	return map[string]interface{}{"transactions": transactions}, nil
+}
+
+// expire cancels a created transaction older than the timeout, Payme never performs those
+func (p *payme) expire(t *models.GatewayTransaction) (*models.GatewayTransaction, error) {
+	if time.Since(t.CreatedAt) <= p.config.Timeout {
+		return t, nil
+	}
+	if _, err := p.gw.Cancel(p.name, t.ExternalID, paymeCancelledTimeout); err != nil {
+		return nil, err
+	}
+	return nil, ErrTransactionCancelled
+}
+
+func (p *payme) transaction(t *models.GatewayTransaction, full bool) paymeTransaction {
+	pt := paymeTransaction{
+		CreateTime:  millis(&t.CreatedAt),
+		PerformTime: millis(t.PerformedAt),
+		CancelTime:  millis(t.CancelledAt),
+		Transaction: strconv.Itoa(t.ID),
+		State:       paymeState(t.State),
+	}
+	if reason, err := strconv.Atoi(t.CancelReason); err == nil {
+		pt.Reason = &reason
+	}
+	if full {
+		pt.ID = t.ExternalID
+		pt.Time = millis(&t.ProviderTime)
+		pt.Amount = toTiyin(t.Amount)
+		if p.config.AccountField == AccountByContract {
+			pt.Account = map[string]string{AccountByContract: strconv.Itoa(t.ContractID)}
+		} else {
+			pt.Account = map[string]string{AccountByLogin: t.Login}
+		}
+	}
+	return pt
+}
+
+func (p *payme) accountRef(account map[string]string) (AccountRef, error) {
+	ref, ok := accountRef(p.config.AccountField, account[p.config.AccountField])
+	if !ok {
+		return ref, ErrAccountNotFound
+	}
+	return ref, nil
+}
+
+// authorized checks the Basic credentials Paycom:<key>
+func (p *payme) authorized(header string) bool {
+	encoded := strings.TrimPrefix(header, "Basic ")
+	if encoded == header {
+		return false
+	}
+	credentials, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(credentials, []byte("Paycom:"+p.config.Secret)) == 1
+}
+
+var errPaymeInvalidParams = errors.New("invalid params")
+
+func (p *payme) errorResponse(req paymeRequest, err error) paymeResponse {
+	switch {
+	case errors.Is(err, errPaymeInvalidParams):
+		return p.fail(req, paymeInvalidRequest, "Invalid request", "")
+	case errors.Is(err, ErrAccountNotFound):
+		return p.fail(req, paymeAccountNotFound, "Account not found", p.config.AccountField)
+	case errors.Is(err, ErrInvalidAmount):
+		return p.fail(req, paymeWrongAmount, "Wrong amount", "")
+	case errors.Is(err, ErrTransactionNotFound):
+		return p.fail(req, paymeTransNotFound, "Transaction not found", "")
+	case errors.Is(err, ErrTransactionCancelled), errors.Is(err, ErrTransactionMismatch):
+		return p.fail(req, paymeCannotPerform, "Unable to perform operation", "")
+	default:
+		p.logger.Error("Payme request failed",
+			zap.String("gateway", p.name),
+			zap.String("method", req.Method),
+			zap.Error(err))
+		return p.fail(req, paymeSystemError, "System error", "")
+	}
+}
+
+func (p *payme) fail(req paymeRequest, code int, message, data string) paymeResponse {
+	return paymeResponse{
+		ID: req.ID,
+		Error: &paymeError{
+			Code:    code,
+			Message: map[string]string{"en": message, "ru": message, "uz": message},
+			Data:    data,
+		},
+	}
+}
+
+func paymeState(state string) int {
+	switch state {
+	case models.GatewayPerformed:
+		return paymeStatePerformed
+	case models.GatewayCancelled:
+		return paymeStateCancelled
+	case models.GatewayReversed:
+		return paymeStateCancelledAfterPaid
+	default:
+		return paymeStateCreated
+	}
+}
+
+func fromTiyin(amount int64) models.Money {
+	return models.NewMoney(amount).MulDiv(1, 100)
+}
+
+func toTiyin(amount models.Money) int64 {
+	n, _ := strconv.ParseInt(amount.Mul(100).StringFixed(0), 10, 64)
+	return n
+}
+
+func fromMillis(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+func millis(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixMilli()
+}
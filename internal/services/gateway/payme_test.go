@@ -0,0 +1,249 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/models"
+)
+
+const paymeKey = "payme-test-key"
+
+type paymeClient struct {
+	t   *testing.T
+	url string
+	key string
+}
+
+// paymeReply is a JSON-RPC response with the result left raw
+type paymeReply struct {
+	Result json.RawMessage `json:"result"`
+	Error  *paymeError     `json:"error"`
+}
+
+func newPaymeTest(t *testing.T) (*fakeBackend, *paymeClient) {
+	config := ProviderConfig{
+		Kind:         KindPayme,
+		Secret:       paymeKey,
+		AccountField: AccountByLogin,
+		MinAmount:    models.NewMoney(1000),
+		Timeout:      12 * time.Hour,
+	}
+	b := newFakeBackend("payme", config)
+	srv := serve(t, newPayme("payme", config, b, zap.NewNop()))
+	return b, &paymeClient{t: t, url: srv.URL, key: paymeKey}
+}
+
+func (c *paymeClient) call(method string, params map[string]interface{}) paymeReply {
+	c.t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"id": 1, "method": method, "params": params})
+	req, _ := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if c.key != "" {
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("Paycom:"+c.key)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("HTTP status %d, Payme expects 200", resp.StatusCode)
+	}
+	var out paymeReply
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		c.t.Fatal(err)
+	}
+	return out
+}
+
+// result calls a method expected to succeed
+func (c *paymeClient) result(method string, params map[string]interface{}) paymeTransaction {
+	c.t.Helper()
+	reply := c.call(method, params)
+	if reply.Error != nil {
+		c.t.Fatalf("%s: error %d %s", method, reply.Error.Code, reply.Error.Message["en"])
+	}
+	var out paymeTransaction
+	json.Unmarshal(reply.Result, &out)
+	return out
+}
+
+func expectPaymeError(t *testing.T, step string, reply paymeReply, code int) {
+	t.Helper()
+	if reply.Error == nil {
+		t.Fatalf("%s: succeeded with %s, want error %d", step, reply.Result, code)
+	}
+	if reply.Error.Code != code {
+		t.Fatalf("%s: error %d (%s), want %d", step, reply.Error.Code, reply.Error.Message["en"], code)
+	}
+}
+
+func createParams(id, login string, tiyin int64) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      id,
+		"time":    time.Now().UnixMilli(),
+		"amount":  tiyin,
+		"account": map[string]string{"login": login},
+	}
+}
+
+func TestPaymeCreatePerform(t *testing.T) {
+	b, c := newPaymeTest(t)
+
+	reply := c.call("CheckPerformTransaction", createParams("", "test1", 500000))
+	if reply.Error != nil || string(reply.Result) != `{"allow":true}` {
+		t.Fatalf("CheckPerformTransaction: %s %+v", reply.Result, reply.Error)
+	}
+
+	created := c.result("CreateTransaction", createParams("p-1", "test1", 500000))
+	if created.State != paymeStateCreated || created.Transaction == "" || created.CreateTime == 0 {
+		t.Fatalf("CreateTransaction result %+v", created)
+	}
+	// Redelivered create returns the same transaction
+	if again := c.result("CreateTransaction", createParams("p-1", "test1", 500000)); again.Transaction != created.Transaction {
+		t.Fatalf("redelivered create returned transaction %s, want %s", again.Transaction, created.Transaction)
+	}
+
+	performed := c.result("PerformTransaction", map[string]interface{}{"id": "p-1"})
+	if performed.State != paymeStatePerformed || performed.PerformTime == 0 {
+		t.Fatalf("PerformTransaction result %+v", performed)
+	}
+	again := c.result("PerformTransaction", map[string]interface{}{"id": "p-1"})
+	if again.PerformTime != performed.PerformTime || again.Transaction != performed.Transaction {
+		t.Fatalf("redelivered perform %+v, want %+v", again, performed)
+	}
+	if b.payments != 1 {
+		t.Fatalf("%d payments booked, want 1", b.payments)
+	}
+	if tr := b.find("payme", "p-1"); tr.Amount.Cmp(models.NewMoney(5000)) != 0 {
+		t.Fatalf("amount %s, want 5000 (500000 tiyin)", tr.Amount)
+	}
+
+	checked := c.result("CheckTransaction", map[string]interface{}{"id": "p-1"})
+	if checked.State != paymeStatePerformed || checked.PerformTime != performed.PerformTime {
+		t.Fatalf("CheckTransaction result %+v", checked)
+	}
+
+	// A performed transaction cannot be created again
+	expectPaymeError(t, "create after perform", c.call("CreateTransaction", createParams("p-1", "test1", 500000)), paymeCannotPerform)
+}
+
+func TestPaymeCancel(t *testing.T) {
+	b, c := newPaymeTest(t)
+
+	// Before perform
+	c.result("CreateTransaction", createParams("p-2", "test1", 200000))
+	cancelled := c.result("CancelTransaction", map[string]interface{}{"id": "p-2", "reason": 3})
+	if cancelled.State != paymeStateCancelled || cancelled.CancelTime == 0 {
+		t.Fatalf("CancelTransaction result %+v", cancelled)
+	}
+	expectPaymeError(t, "perform after cancel", c.call("PerformTransaction", map[string]interface{}{"id": "p-2"}), paymeCannotPerform)
+	if b.payments != 0 {
+		t.Fatal("cancelled transaction booked a payment")
+	}
+
+	// After perform: the payment is reversed once
+	c.result("CreateTransaction", createParams("p-3", "test1", 200000))
+	c.result("PerformTransaction", map[string]interface{}{"id": "p-3"})
+	reversed := c.result("CancelTransaction", map[string]interface{}{"id": "p-3", "reason": 5})
+	if reversed.State != paymeStateCancelledAfterPaid {
+		t.Fatalf("cancel after perform state %d, want %d", reversed.State, paymeStateCancelledAfterPaid)
+	}
+	again := c.result("CancelTransaction", map[string]interface{}{"id": "p-3", "reason": 5})
+	if again.State != paymeStateCancelledAfterPaid || again.CancelTime != reversed.CancelTime {
+		t.Fatalf("redelivered cancel %+v, want %+v", again, reversed)
+	}
+	if b.reversals != 1 {
+		t.Fatalf("%d reversals, want 1", b.reversals)
+	}
+
+	checked := c.result("CheckTransaction", map[string]interface{}{"id": "p-3"})
+	if checked.Reason == nil || *checked.Reason != 5 {
+		t.Fatalf("CheckTransaction reason %v, want 5", checked.Reason)
+	}
+}
+
+func TestPaymeTimeout(t *testing.T) {
+	b, c := newPaymeTest(t)
+
+	c.result("CreateTransaction", createParams("p-4", "test1", 200000))
+	b.find("payme", "p-4").CreatedAt = time.Now().Add(-13 * time.Hour)
+
+	expectPaymeError(t, "perform after timeout", c.call("PerformTransaction", map[string]interface{}{"id": "p-4"}), paymeCannotPerform)
+	if tr := b.find("payme", "p-4"); tr.State != models.GatewayCancelled || tr.CancelReason != paymeCancelledTimeout {
+		t.Fatalf("expired transaction %s (%q), want cancelled with reason %s", tr.State, tr.CancelReason, paymeCancelledTimeout)
+	}
+	if b.payments != 0 {
+		t.Fatal("expired transaction booked a payment")
+	}
+}
+
+func TestPaymeAuthorization(t *testing.T) {
+	b, c := newPaymeTest(t)
+
+	c.key = "forged"
+	expectPaymeError(t, "forged key", c.call("CreateTransaction", createParams("p-5", "test1", 200000)), paymeAuthFailed)
+	c.key = ""
+	expectPaymeError(t, "no authorization", c.call("CreateTransaction", createParams("p-5", "test1", 200000)), paymeAuthFailed)
+	if len(b.list) != 0 {
+		t.Fatal("unauthorized request created a transaction")
+	}
+
+	c.key = paymeKey
+	c.result("CreateTransaction", createParams("p-5", "test1", 200000))
+	c.key = "forged"
+	expectPaymeError(t, "forged perform", c.call("PerformTransaction", map[string]interface{}{"id": "p-5"}), paymeAuthFailed)
+	if b.payments != 0 {
+		t.Fatal("unauthorized perform booked a payment")
+	}
+}
+
+func TestPaymeRejects(t *testing.T) {
+	_, c := newPaymeTest(t)
+
+	expectPaymeError(t, "unknown account", c.call("CheckPerformTransaction", createParams("", "nobody", 200000)), paymeAccountNotFound)
+	expectPaymeError(t, "below minimum", c.call("CreateTransaction", createParams("p-6", "test1", 99999)), paymeWrongAmount)
+	expectPaymeError(t, "unknown transaction", c.call("PerformTransaction", map[string]interface{}{"id": "p-missing"}), paymeTransNotFound)
+	expectPaymeError(t, "unknown method", c.call("ChangePassword", nil), paymeMethodNotFound)
+	expectPaymeError(t, "create without id", c.call("CreateTransaction", createParams("", "test1", 200000)), paymeInvalidRequest)
+
+	c.result("CreateTransaction", createParams("p-7", "test1", 200000))
+	expectPaymeError(t, "same id, other amount", c.call("CreateTransaction", createParams("p-7", "test1", 300000)), paymeCannotPerform)
+}
+
+func TestPaymeStatement(t *testing.T) {
+	_, c := newPaymeTest(t)
+
+	from := time.Now().Add(-time.Minute)
+	c.result("CreateTransaction", createParams("p-8", "test1", 200000))
+	c.result("CreateTransaction", createParams("p-9", "test2", 300000))
+	c.result("PerformTransaction", map[string]interface{}{"id": "p-9"})
+
+	reply := c.call("GetStatement", map[string]interface{}{
+		"from": from.UnixMilli(),
+		"to":   time.Now().Add(time.Minute).UnixMilli(),
+	})
+	if reply.Error != nil {
+		t.Fatalf("GetStatement: error %d", reply.Error.Code)
+	}
+	var statement struct {
+		Transactions []paymeTransaction `json:"transactions"`
+	}
+	json.Unmarshal(reply.Result, &statement)
+	if len(statement.Transactions) != 2 {
+		t.Fatalf("statement has %d transactions, want 2", len(statement.Transactions))
+	}
+	last := statement.Transactions[1]
+	if last.ID != "p-9" || last.Amount != 300000 || last.State != paymeStatePerformed || last.Account["login"] != "test2" {
+		t.Fatalf("statement transaction %+v", last)
+	}
+
+	expectPaymeError(t, "empty period", c.call("GetStatement", map[string]interface{}{"from": 2000, "to": 1000}), paymeInvalidRequest)
+}
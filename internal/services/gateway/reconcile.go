@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"fmt"
+	"time"
+
+	"isp-billing/internal/models"
+)
+
+// ProviderRecord is a transaction as the provider's report shows it
+// State is performed or cancelled; transactions the provider never completed are left out.
+type ProviderRecord struct {
+	ExternalID string       `json:"external_id"`
+	Amount     models.Money `json:"amount"`
+	State      string       `json:"state"`
+	Time       time.Time    `json:"time"`
+}
+
+// Discrepancy is a transaction that differs between the provider's report and our records
+type Discrepancy struct {
+	ExternalID    string                     `json:"external_id"`
+	Problem       string                     `json:"problem"`
+	Provider      *ProviderRecord            `json:"provider,omitempty"`
+	Local         *models.GatewayTransaction `json:"local,omitempty"`
+	AmountDiffers bool                       `json:"amount_differs,omitempty"`
+}
+
+// Reconciliation problems
+const (
+	MissingLocal    = "missing_local"    // Paid at the provider, not booked here
+	MissingProvider = "missing_provider" // Booked here, not paid at the provider
+	AmountMismatch  = "amount_mismatch"
+	StateMismatch   = "state_mismatch" // Performed on one side, cancelled on the other
+)
+
+// ReconcileReport compares a provider report with the gateway transactions of a period
+type ReconcileReport struct {
+	Gateway       string        `json:"gateway"`
+	From          time.Time     `json:"from"`
+	To            time.Time     `json:"to"`
+	Matched       int           `json:"matched"`
+	ProviderTotal models.Money  `json:"provider_total"` // Performed at the provider
+	LocalTotal    models.Money  `json:"local_total"`    // Performed here
+	Discrepancies []Discrepancy `json:"discrepancies"`
+}
+
+// Summary counts the gateway transactions of a period by state
+type Summary struct {
+	Gateway string                   `json:"gateway"`
+	From    time.Time                `json:"from"`
+	To      time.Time                `json:"to"`
+	States  map[string]*SummaryState `json:"states"`
+}
+
+// SummaryState is the count and total of transactions in one state
+type SummaryState struct {
+	Count int          `json:"count"`
+	Total models.Money `json:"total"`
+}
+
+// Reconcile compares the provider's report of [from, to) with our transactions
+// Only performed transactions carry money: a transaction is matched when both sides performed
+// it for the same amount, or both sides did not.
+func (s *Service) Reconcile(gateway string, from, to time.Time, records []ProviderRecord) (*ReconcileReport, error) {
+	return reconcile(s, gateway, from, to, records)
+}
+
+func reconcile(gw backend, gateway string, from, to time.Time, records []ProviderRecord) (*ReconcileReport, error) {
+	local, err := gw.Transactions(gateway, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{Gateway: gateway, From: from, To: to, Discrepancies: []Discrepancy{}}
+	byID := make(map[string]*models.GatewayTransaction, len(local))
+	for i := range local {
+		t := &local[i]
+		byID[t.ExternalID] = t
+		if t.State == models.GatewayPerformed {
+			report.LocalTotal = report.LocalTotal.Add(t.Amount)
+		}
+	}
+
+	seen := make(map[string]bool, len(records))
+	for i := range records {
+		r := &records[i]
+		if r.State != models.GatewayPerformed && r.State != models.GatewayCancelled {
+			return nil, fmt.Errorf("%w: %s: state %q", ErrInvalidRecord, r.ExternalID, r.State)
+		}
+		if seen[r.ExternalID] {
+			return nil, fmt.Errorf("%w: %s listed twice", ErrInvalidRecord, r.ExternalID)
+		}
+		seen[r.ExternalID] = true
+		paid := r.State == models.GatewayPerformed
+		if paid {
+			report.ProviderTotal = report.ProviderTotal.Add(r.Amount)
+		}
+
+		t, ok := byID[r.ExternalID]
+		if !ok {
+			// Transactions of the report can be created here just before from; look them up
+			if found, err := gw.Transaction(gateway, r.ExternalID); err == nil {
+				t, ok = found, true
+				if t.State == models.GatewayPerformed {
+					report.LocalTotal = report.LocalTotal.Add(t.Amount)
+				}
+			}
+		}
+		if !ok {
+			if paid {
+				report.Discrepancies = append(report.Discrepancies, Discrepancy{ExternalID: r.ExternalID, Problem: MissingLocal, Provider: r})
+			} else {
+				report.Matched++
+			}
+			continue
+		}
+
+		performed := t.State == models.GatewayPerformed
+		switch {
+		case paid != performed:
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				ExternalID: r.ExternalID, Problem: StateMismatch, Provider: r, Local: t,
+				AmountDiffers: t.Amount.Cmp(r.Amount) != 0,
+			})
+		case paid && t.Amount.Cmp(r.Amount) != 0:
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				ExternalID: r.ExternalID, Problem: AmountMismatch, Provider: r, Local: t, AmountDiffers: true,
+			})
+		default:
+			report.Matched++
+		}
+	}
+
+	for i := range local {
+		t := &local[i]
+		if !seen[t.ExternalID] && t.State == models.GatewayPerformed {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{ExternalID: t.ExternalID, Problem: MissingProvider, Local: t})
+		}
+	}
+
+	return report, nil
+}
+
+// Summarize counts the gateway transactions of [from, to) by state
+func (s *Service) Summarize(gateway string, from, to time.Time) (*Summary, error) {
+	list, err := s.Transactions(gateway, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{Gateway: gateway, From: from, To: to, States: make(map[string]*SummaryState)}
+	for _, t := range list {
+		st, ok := summary.States[t.State]
+		if !ok {
+			st = &SummaryState{}
+			summary.States[t.State] = st
+		}
+		st.Count++
+		st.Total = st.Total.Add(t.Amount)
+	}
+	return summary, nil
+}
@@ -0,0 +1,99 @@
+package gateway
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"isp-billing/internal/models"
+)
+
+func TestReconcile(t *testing.T) {
+	b := newFakeBackend("payme", ProviderConfig{Kind: KindPayme})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	at := from.Add(24 * time.Hour)
+
+	add := func(id string, amount int64, state string, providerTime time.Time) {
+		b.list = append(b.list, &models.GatewayTransaction{
+			ID: len(b.list) + 1, Gateway: "payme", ExternalID: id, AccountID: 1, Login: "test1",
+			Amount: models.NewMoney(amount), State: state, ProviderTime: providerTime,
+		})
+	}
+	add("ok", 5000, models.GatewayPerformed, at)
+	add("amount", 3000, models.GatewayPerformed, at)
+	add("state", 2000, models.GatewayCancelled, at)
+	add("local-only", 1000, models.GatewayPerformed, at)
+	add("created", 700, models.GatewayCreated, at)
+	add("early", 4000, models.GatewayPerformed, from.Add(-time.Minute)) // Created here before from
+	add("later", 9000, models.GatewayPerformed, to)                     // Outside the period
+
+	records := []ProviderRecord{
+		{ExternalID: "ok", Amount: models.NewMoney(5000), State: models.GatewayPerformed},
+		{ExternalID: "amount", Amount: models.NewMoney(3500), State: models.GatewayPerformed},
+		{ExternalID: "state", Amount: models.NewMoney(2000), State: models.GatewayPerformed},
+		{ExternalID: "provider-only", Amount: models.NewMoney(800), State: models.GatewayPerformed},
+		{ExternalID: "provider-cancelled", Amount: models.NewMoney(600), State: models.GatewayCancelled},
+		{ExternalID: "early", Amount: models.NewMoney(4000), State: models.GatewayPerformed},
+	}
+
+	report, err := reconcile(b, "payme", from, to, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ok, early and provider-cancelled match; created is unperformed on both sides
+	if report.Matched != 3 {
+		t.Errorf("matched %d, want 3", report.Matched)
+	}
+	if want := models.NewMoney(5000 + 3500 + 2000 + 800 + 4000); report.ProviderTotal.Cmp(want) != 0 {
+		t.Errorf("provider total %s, want %s", report.ProviderTotal, want)
+	}
+	if want := models.NewMoney(5000 + 3000 + 1000 + 4000); report.LocalTotal.Cmp(want) != 0 {
+		t.Errorf("local total %s, want %s", report.LocalTotal, want)
+	}
+
+	want := map[string]string{
+		"amount":        AmountMismatch,
+		"state":         StateMismatch,
+		"provider-only": MissingLocal,
+		"local-only":    MissingProvider,
+	}
+	if len(report.Discrepancies) != len(want) {
+		t.Errorf("%d discrepancies, want %d: %+v", len(report.Discrepancies), len(want), report.Discrepancies)
+	}
+	for _, d := range report.Discrepancies {
+		if want[d.ExternalID] != d.Problem {
+			t.Errorf("%s: problem %q, want %q", d.ExternalID, d.Problem, want[d.ExternalID])
+		}
+		if d.ExternalID == "amount" && !d.AmountDiffers {
+			t.Error("amount mismatch without AmountDiffers")
+		}
+		if d.ExternalID == "state" && d.AmountDiffers {
+			t.Error("state mismatch of equal amounts reported AmountDiffers")
+		}
+	}
+}
+
+func TestReconcileInvalidRecords(t *testing.T) {
+	b := newFakeBackend("payme", ProviderConfig{Kind: KindPayme})
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	tests := map[string][]ProviderRecord{
+		"unknown state": {{ExternalID: "a", Amount: models.NewMoney(1), State: "pending"}},
+		"listed twice": {
+			{ExternalID: "a", Amount: models.NewMoney(1), State: models.GatewayPerformed},
+			{ExternalID: "a", Amount: models.NewMoney(1), State: models.GatewayCancelled},
+		},
+	}
+	for name, records := range tests {
+		if _, err := reconcile(b, "payme", from, to, records); !errors.Is(err, ErrInvalidRecord) {
+			t.Errorf("%s: error %v, want ErrInvalidRecord", name, err)
+		}
+	}
+
+	if _, err := reconcile(b, "click", from, to, nil); !errors.Is(err, ErrUnknownGateway) {
+		t.Errorf("unknown gateway: error %v, want ErrUnknownGateway", err)
+	}
+}
@@ -0,0 +1,450 @@
+package gateway
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/payment"
+)
+
+// ErrUnknownGateway is returned for gateways missing from the configuration
+var ErrUnknownGateway = errors.New("unknown payment gateway")
+
+// ErrAccountNotFound is returned when the account of a payment cannot be found
+var ErrAccountNotFound = errors.New("account not found")
+
+// ErrInvalidAmount is returned for amounts outside the gateway limits
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// ErrTransactionNotFound is returned for unknown provider transactions
+var ErrTransactionNotFound = errors.New("transaction not found")
+
+// ErrTransactionMismatch is returned when a provider transaction ID is reused with another
+// account or amount
+var ErrTransactionMismatch = errors.New("transaction exists with different parameters")
+
+// ErrTransactionCancelled is returned when a cancelled transaction is performed
+var ErrTransactionCancelled = errors.New("transaction is cancelled")
+
+// ErrInvalidRecord is returned for malformed provider report records
+var ErrInvalidRecord = errors.New("invalid provider record")
+
+// Provider speaks the webhook protocol of one payment aggregator
+// Handle verifies the signature of the request, runs the operation through the Service and
+// returns the HTTP status and the response body in the provider's format. Protocol errors
+// (bad signature, unknown account) are answered in that format too, never as Go errors.
+type Provider interface {
+	Handle(r *http.Request) (int, interface{})
+}
+
+// backend runs provider operations, *Service in production
+// Every operation is idempotent on the provider transaction ID, see Service.
+type backend interface {
+	Check(gateway string, ref AccountRef, amount models.Money) (*Account, error)
+	Create(gateway, externalID string, ref AccountRef, amount models.Money, providerTime time.Time) (*models.GatewayTransaction, error)
+	Perform(gateway, externalID string) (*models.GatewayTransaction, error)
+	Cancel(gateway, externalID, reason string) (*models.GatewayTransaction, error)
+	Transaction(gateway, externalID string) (*models.GatewayTransaction, error)
+	TransactionByID(gateway string, id int) (*models.GatewayTransaction, error)
+	Transactions(gateway string, from, to time.Time) ([]models.GatewayTransaction, error)
+}
+
+// providerFactory creates a provider of a kind for a configured gateway
+type providerFactory func(name string, config ProviderConfig, gw backend, logger *zap.Logger) Provider
+
+var providerKinds = map[string]providerFactory{
+	KindClick: newClick,
+	KindPayme: newPayme,
+}
+
+// Account fields identifying the payer in provider requests
+const (
+	AccountByLogin    = "login"
+	AccountByContract = "contract_id"
+)
+
+// Config holds payment gateway settings, one entry per configured gateway
+type Config struct {
+	Providers map[string]ProviderConfig `yaml:"providers"`
+}
+
+// ProviderConfig holds the settings of one gateway
+type ProviderConfig struct {
+	Kind         string        `yaml:"kind"`          // click, payme
+	Secret       string        `yaml:"secret"`        // Click SECRET_KEY, Payme merchant key
+	ServiceID    string        `yaml:"service_id"`    // Click service_id, checked when set
+	AccountField string        `yaml:"account_field"` // login (default) or contract_id
+	Currency     int           `yaml:"currency"`      // Currency of gateway amounts, 0 - contract currency
+	MinAmount    models.Money  `yaml:"min_amount"`
+	MaxAmount    models.Money  `yaml:"max_amount"` // 0 - no limit
+	Timeout      time.Duration `yaml:"timeout"`    // Unperformed transactions expire, Payme 12h
+}
+
+// AccountRef identifies the payer as the provider sent it
+type AccountRef struct {
+	Login      string
+	ContractID int
+}
+
+func (r AccountRef) String() string {
+	if r.Login != "" {
+		return r.Login
+	}
+	return fmt.Sprintf("contract %d", r.ContractID)
+}
+
+// Account is the account a gateway payment is credited to
+type Account struct {
+	ID         int    `json:"id"`
+	Login      string `json:"login"`
+	ContractID int    `json:"contract_id"`
+	Currency   int    `json:"currency"` // Contract currency
+}
+
+// Service runs payment aggregator webhooks on top of the payments flow
+// A provider transaction is created on check/prepare, turns into a payment on perform and is
+// cancelled (reversing the payment when it was performed) on cancel. Every step is idempotent
+// on the provider transaction ID, so redelivered webhooks return the first answer.
+type Service struct {
+	db        *database.PostgreSQL
+	payments  *payment.Service
+	logger    *zap.Logger
+	providers map[string]Provider
+	configs   map[string]ProviderConfig
+}
+
+// New creates a new gateway service
+// Gateways without a secret are skipped: their webhooks could not be authenticated.
+func New(db *database.PostgreSQL, payments *payment.Service, logger *zap.Logger, config Config) (*Service, error) {
+	s := &Service{
+		db:        db,
+		payments:  payments,
+		logger:    logger,
+		providers: make(map[string]Provider),
+		configs:   make(map[string]ProviderConfig),
+	}
+
+	for name, pc := range config.Providers {
+		factory, ok := providerKinds[pc.Kind]
+		if !ok {
+			return nil, fmt.Errorf("gateway %s: unknown kind %q", name, pc.Kind)
+		}
+		if pc.Secret == "" {
+			// Without a secret anyone could forge webhooks
+			logger.Warn("Payment gateway has no secret, not registered", zap.String("gateway", name))
+			continue
+		}
+		if pc.AccountField == "" {
+			pc.AccountField = AccountByLogin
+		}
+		if pc.AccountField != AccountByLogin && pc.AccountField != AccountByContract {
+			return nil, fmt.Errorf("gateway %s: unknown account_field %q", name, pc.AccountField)
+		}
+		if pc.Kind == KindPayme && pc.Timeout == 0 {
+			pc.Timeout = 12 * time.Hour
+		}
+		s.configs[name] = pc
+		s.providers[name] = factory(name, pc, s, logger)
+	}
+
+	return s, nil
+}
+
+// Gateways returns the names of the configured gateways
+func (s *Service) Gateways() []string {
+	names := make([]string, 0, len(s.configs))
+	for name := range s.configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handle serves a webhook request of the gateway
+func (s *Service) Handle(gateway string, r *http.Request) (int, interface{}, error) {
+	provider, ok := s.providers[gateway]
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: %s", ErrUnknownGateway, gateway)
+	}
+	status, response := provider.Handle(r)
+	return status, response, nil
+}
+
+// Check finds the account of a payment and validates the amount against the gateway limits
+func (s *Service) Check(gateway string, ref AccountRef, amount models.Money) (*Account, error) {
+	config, ok := s.configs[gateway]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownGateway, gateway)
+	}
+
+	account, err := s.lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAmount(config, amount); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// checkAmount validates an amount against the gateway limits
+func checkAmount(config ProviderConfig, amount models.Money) error {
+	if amount.Sign() <= 0 || amount.Cmp(config.MinAmount) < 0 ||
+		config.MaxAmount.Sign() > 0 && amount.Cmp(config.MaxAmount) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidAmount, amount)
+	}
+	return nil
+}
+
+// Create records a provider transaction after checking it
+// Creating an existing transaction returns it unless the account or amount differ.
+func (s *Service) Create(gateway, externalID string, ref AccountRef, amount models.Money, providerTime time.Time) (*models.GatewayTransaction, error) {
+	account, err := s.Check(gateway, ref, amount)
+	if err != nil {
+		return nil, err
+	}
+	if providerTime.IsZero() {
+		providerTime = time.Now()
+	}
+	currency := s.configs[gateway].Currency
+	if currency == 0 {
+		currency = account.Currency
+	}
+
+	_, err = s.db.GetDB().Exec(`
+		INSERT INTO gateway_transactions (gateway, external_id, account_id, amount, currency_id, state, provider_time)
+		VALUES ($1, $2, $3, $4, $5, 'created', $6)
+		ON CONFLICT (gateway, external_id) DO NOTHING`,
+		gateway, externalID, account.ID, amount, currency, providerTime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transaction: %w", err)
+	}
+
+	t, err := s.Transaction(gateway, externalID)
+	if err != nil {
+		return nil, err
+	}
+	if t.AccountID != account.ID || t.Amount.Cmp(amount) != 0 {
+		return nil, fmt.Errorf("%w: %s %s", ErrTransactionMismatch, gateway, externalID)
+	}
+	return t, nil
+}
+
+// Perform books the payment of a created transaction; performing it again returns it as is
+func (s *Service) Perform(gateway, externalID string) (*models.GatewayTransaction, error) {
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	t, err := s.lockTransaction(tx, gateway, externalID)
+	if err != nil {
+		return nil, err
+	}
+	switch t.State {
+	case models.GatewayPerformed:
+		return t, nil
+	case models.GatewayCancelled, models.GatewayReversed:
+		return nil, fmt.Errorf("%w: %s %s", ErrTransactionCancelled, gateway, externalID)
+	}
+
+	// The payment key is the provider transaction, so a perform interrupted after booking
+	// finds the same payment when the provider retries
+	p, _, err := s.payments.Record(payment.Request{
+		AccountID:      t.AccountID,
+		Amount:         t.Amount,
+		Currency:       t.Currency,
+		Source:         gateway,
+		ExternalRef:    externalID,
+		IdempotencyKey: gateway + ":" + externalID,
+		PaidAt:         t.ProviderTime,
+		Comment:        "gateway " + gateway,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(`
+		UPDATE gateway_transactions SET state = 'performed', payment_id = $1, performed_at = NOW()
+		WHERE id = $2
+		RETURNING performed_at`, p.ID, t.ID).Scan(&t.PerformedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform transaction: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	t.State = models.GatewayPerformed
+	t.PaymentID = p.ID
+
+	s.logger.Info("Gateway payment performed",
+		zap.String("gateway", gateway),
+		zap.String("external_id", externalID),
+		zap.Int("account_id", t.AccountID),
+		zap.Int("payment_id", p.ID),
+		zap.Stringer("amount", t.Amount))
+	return t, nil
+}
+
+// Cancel cancels a transaction, reversing its payment when it was performed
+// Cancelling it again returns it as is.
+func (s *Service) Cancel(gateway, externalID, reason string) (*models.GatewayTransaction, error) {
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	t, err := s.lockTransaction(tx, gateway, externalID)
+	if err != nil {
+		return nil, err
+	}
+	if t.State == models.GatewayCancelled || t.State == models.GatewayReversed {
+		return t, nil
+	}
+
+	state := models.GatewayCancelled
+	if t.State == models.GatewayPerformed {
+		if _, _, err := s.payments.Reverse(t.PaymentID, "gateway "+gateway+" cancel: "+reason); err != nil {
+			return nil, err
+		}
+		state = models.GatewayReversed
+	}
+
+	err = tx.QueryRow(`
+		UPDATE gateway_transactions SET state = $1, cancelled_at = NOW(), cancel_reason = $2
+		WHERE id = $3
+		RETURNING cancelled_at`, state, reason, t.ID).Scan(&t.CancelledAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel transaction: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	t.State = state
+	t.CancelReason = reason
+
+	s.logger.Info("Gateway transaction cancelled",
+		zap.String("gateway", gateway),
+		zap.String("external_id", externalID),
+		zap.String("state", state),
+		zap.String("reason", reason))
+	return t, nil
+}
+
+// Transaction returns a provider transaction
+func (s *Service) Transaction(gateway, externalID string) (*models.GatewayTransaction, error) {
+	list, err := queryTransactions(s.db.GetDB(), `WHERE t.gateway = $1 AND t.external_id = $2`, gateway, externalID)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("%w: %s %s", ErrTransactionNotFound, gateway, externalID)
+	}
+	return &list[0], nil
+}
+
+// TransactionByID returns a transaction of the gateway by our ID (Click merchant_prepare_id)
+func (s *Service) TransactionByID(gateway string, id int) (*models.GatewayTransaction, error) {
+	list, err := queryTransactions(s.db.GetDB(), `WHERE t.gateway = $1 AND t.id = $2`, gateway, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("%w: %s #%d", ErrTransactionNotFound, gateway, id)
+	}
+	return &list[0], nil
+}
+
+// Transactions returns transactions of the gateway created by the provider in [from, to)
+func (s *Service) Transactions(gateway string, from, to time.Time) ([]models.GatewayTransaction, error) {
+	if _, ok := s.configs[gateway]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownGateway, gateway)
+	}
+	return queryTransactions(s.db.GetDB(), `
+		WHERE t.gateway = $1 AND t.provider_time >= $2 AND t.provider_time < $3
+		ORDER BY t.provider_time, t.id`, gateway, from, to)
+}
+
+// lookup finds the account by login or, for contracts, its first active account
+func (s *Service) lookup(ref AccountRef) (*Account, error) {
+	account := &Account{}
+	var err error
+	if ref.Login != "" {
+		err = s.db.GetDB().QueryRow(`
+			SELECT a.id, a.login, a.contract_id, c.currency_id
+			FROM accounts a JOIN contracts c ON c.id = a.contract_id
+			WHERE a.login = $1`, ref.Login).Scan(&account.ID, &account.Login, &account.ContractID, &account.Currency)
+	} else {
+		err = s.db.GetDB().QueryRow(`
+			SELECT a.id, a.login, a.contract_id, c.currency_id
+			FROM accounts a JOIN contracts c ON c.id = a.contract_id
+			WHERE a.contract_id = $1
+			ORDER BY a.active DESC, a.id LIMIT 1`, ref.ContractID).Scan(&account.ID, &account.Login, &account.ContractID, &account.Currency)
+	}
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrAccountNotFound, ref)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch account: %w", err)
+	}
+	return account, nil
+}
+
+func (s *Service) lockTransaction(tx *sql.Tx, gateway, externalID string) (*models.GatewayTransaction, error) {
+	list, err := queryTransactions(tx, `WHERE t.gateway = $1 AND t.external_id = $2 FOR UPDATE OF t`, gateway, externalID)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("%w: %s %s", ErrTransactionNotFound, gateway, externalID)
+	}
+	return &list[0], nil
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryTransactions(q queryer, where string, args ...interface{}) ([]models.GatewayTransaction, error) {
+	rows, err := q.Query(`
+		SELECT t.id, t.gateway, t.external_id, t.account_id, a.login, a.contract_id, t.amount, t.currency_id,
+			t.state, COALESCE(t.payment_id, 0), t.provider_time, t.created_at, t.performed_at, t.cancelled_at,
+			t.cancel_reason
+		FROM gateway_transactions t
+		JOIN accounts a ON a.id = t.account_id
+		`+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch gateway transactions: %w", err)
+	}
+	defer rows.Close()
+
+	list := []models.GatewayTransaction{}
+	for rows.Next() {
+		var t models.GatewayTransaction
+		var performedAt, cancelledAt sql.NullTime
+		err := rows.Scan(&t.ID, &t.Gateway, &t.ExternalID, &t.AccountID, &t.Login, &t.ContractID, &t.Amount, &t.Currency,
+			&t.State, &t.PaymentID, &t.ProviderTime, &t.CreatedAt, &performedAt, &cancelledAt,
+			&t.CancelReason)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan gateway transaction: %w", err)
+		}
+		if performedAt.Valid {
+			t.PerformedAt = &performedAt.Time
+		}
+		if cancelledAt.Valid {
+			t.CancelledAt = &cancelledAt.Time
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
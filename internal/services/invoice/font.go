@@ -0,0 +1,434 @@
+package invoice
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// errBadFont is wrapped by all font parsing errors
+var errBadFont = errors.New("malformed TrueType font")
+
+// ttfFont is a TrueType font embedded into invoices as a CIDFontType2 font
+// Only what PDF needs is parsed: metrics, the Unicode cmap and glyph locations for subsetting.
+type ttfFont struct {
+	name       string // BaseFont, from the file name
+	tables     map[string][]byte
+	unitsPerEm int
+	bbox       [4]int
+	ascent     int
+	descent    int
+	advances   []uint16 // Per glyph, font units
+	glyphs     map[rune]uint16
+	loca       []uint32 // Glyph offsets into glyf, one more than glyphs
+}
+
+// loadFont reads and parses a TrueType font file
+func loadFont(path string) (*ttfFont, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	f, err := parseFont(data, name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+func parseFont(data []byte, name string) (*ttfFont, error) {
+	if len(data) < 12 || binary.BigEndian.Uint32(data) != 0x00010000 {
+		return nil, fmt.Errorf("%w: not a TrueType outline font", errBadFont)
+	}
+
+	f := &ttfFont{
+		name:   sanitizeFontName(name),
+		tables: make(map[string][]byte),
+	}
+	numTables := int(binary.BigEndian.Uint16(data[4:]))
+	if len(data) < 12+16*numTables {
+		return nil, fmt.Errorf("%w: truncated table directory", errBadFont)
+	}
+	for i := 0; i < numTables; i++ {
+		rec := data[12+16*i:]
+		offset, length := binary.BigEndian.Uint32(rec[8:]), binary.BigEndian.Uint32(rec[12:])
+		if uint64(offset)+uint64(length) > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: table %q out of bounds", errBadFont, rec[:4])
+		}
+		f.tables[string(rec[:4])] = data[offset : offset+length]
+	}
+
+	head, err := f.table("head", 54)
+	if err != nil {
+		return nil, err
+	}
+	hhea, err := f.table("hhea", 36)
+	if err != nil {
+		return nil, err
+	}
+	maxp, err := f.table("maxp", 6)
+	if err != nil {
+		return nil, err
+	}
+
+	f.unitsPerEm = int(binary.BigEndian.Uint16(head[18:]))
+	if f.unitsPerEm == 0 {
+		return nil, fmt.Errorf("%w: zero unitsPerEm", errBadFont)
+	}
+	for i := range f.bbox {
+		f.bbox[i] = int(int16(binary.BigEndian.Uint16(head[36+2*i:])))
+	}
+	f.ascent = int(int16(binary.BigEndian.Uint16(hhea[4:])))
+	f.descent = int(int16(binary.BigEndian.Uint16(hhea[6:])))
+	numGlyphs := int(binary.BigEndian.Uint16(maxp[4:]))
+
+	if err := f.parseMetrics(numGlyphs, int(binary.BigEndian.Uint16(hhea[34:]))); err != nil {
+		return nil, err
+	}
+	if err := f.parseLoca(numGlyphs, binary.BigEndian.Uint16(head[50:]) == 1); err != nil {
+		return nil, err
+	}
+	if err := f.parseCmap(numGlyphs); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *ttfFont) table(tag string, minLen int) ([]byte, error) {
+	t, ok := f.tables[tag]
+	if !ok || len(t) < minLen {
+		return nil, fmt.Errorf("%w: missing or short %s table", errBadFont, tag)
+	}
+	return t, nil
+}
+
+// parseMetrics reads advance widths; glyphs past numberOfHMetrics repeat the last one
+func (f *ttfFont) parseMetrics(numGlyphs, numMetrics int) error {
+	if numMetrics == 0 || numMetrics > numGlyphs {
+		return fmt.Errorf("%w: bad numberOfHMetrics", errBadFont)
+	}
+	hmtx, err := f.table("hmtx", 4*numMetrics)
+	if err != nil {
+		return err
+	}
+	f.advances = make([]uint16, numGlyphs)
+	for i := range f.advances {
+		if i < numMetrics {
+			f.advances[i] = binary.BigEndian.Uint16(hmtx[4*i:])
+		} else {
+			f.advances[i] = f.advances[numMetrics-1]
+		}
+	}
+	return nil
+}
+
+func (f *ttfFont) parseLoca(numGlyphs int, long bool) error {
+	size := 2
+	if long {
+		size = 4
+	}
+	loca, err := f.table("loca", size*(numGlyphs+1))
+	if err != nil {
+		return err
+	}
+	glyf, err := f.table("glyf", 0)
+	if err != nil {
+		return err
+	}
+	f.loca = make([]uint32, numGlyphs+1)
+	for i := range f.loca {
+		if long {
+			f.loca[i] = binary.BigEndian.Uint32(loca[4*i:])
+		} else {
+			f.loca[i] = 2 * uint32(binary.BigEndian.Uint16(loca[2*i:]))
+		}
+		if f.loca[i] > uint32(len(glyf)) || i > 0 && f.loca[i] < f.loca[i-1] {
+			return fmt.Errorf("%w: bad glyph location %d", errBadFont, i)
+		}
+	}
+	return nil
+}
+
+// parseCmap maps runes to glyphs from the Windows Unicode subtable, full repertoire
+// (format 12) preferred over BMP (format 4)
+func (f *ttfFont) parseCmap(numGlyphs int) error {
+	cmap, err := f.table("cmap", 4)
+	if err != nil {
+		return err
+	}
+	var bmp, full []byte
+	n := int(binary.BigEndian.Uint16(cmap[2:]))
+	for i := 0; i < n && 4+8*i+8 <= len(cmap); i++ {
+		rec := cmap[4+8*i:]
+		platform, encoding := binary.BigEndian.Uint16(rec), binary.BigEndian.Uint16(rec[2:])
+		offset := int(binary.BigEndian.Uint32(rec[4:]))
+		if offset+2 > len(cmap) {
+			continue
+		}
+		sub := cmap[offset:]
+		format := binary.BigEndian.Uint16(sub)
+		switch {
+		case format == 12 && (platform == 3 && encoding == 10 || platform == 0):
+			full = sub
+		case format == 4 && (platform == 3 && encoding == 1 || platform == 0):
+			bmp = sub
+		}
+	}
+
+	f.glyphs = make(map[rune]uint16)
+	add := func(r rune, gid uint32) {
+		if gid != 0 && gid < uint32(numGlyphs) {
+			f.glyphs[r] = uint16(gid)
+		}
+	}
+
+	switch {
+	case full != nil:
+		if len(full) < 16 {
+			return fmt.Errorf("%w: short cmap format 12", errBadFont)
+		}
+		groups := int(binary.BigEndian.Uint32(full[12:]))
+		if len(full) < 16+12*groups {
+			return fmt.Errorf("%w: short cmap format 12", errBadFont)
+		}
+		for i := 0; i < groups; i++ {
+			g := full[16+12*i:]
+			start, end, gid := binary.BigEndian.Uint32(g), binary.BigEndian.Uint32(g[4:]), binary.BigEndian.Uint32(g[8:])
+			for c := start; c <= end && c <= 0x10ffff; c++ {
+				add(rune(c), gid+c-start)
+			}
+		}
+	case bmp != nil:
+		if len(bmp) < 14 {
+			return fmt.Errorf("%w: short cmap format 4", errBadFont)
+		}
+		segs := int(binary.BigEndian.Uint16(bmp[6:])) / 2
+		if len(bmp) < 16+8*segs {
+			return fmt.Errorf("%w: short cmap format 4", errBadFont)
+		}
+		ends, starts := bmp[14:], bmp[16+2*segs:]
+		deltas, rangeOffsets := bmp[16+4*segs:], bmp[16+6*segs:]
+		for i := 0; i < segs; i++ {
+			start, end := uint32(binary.BigEndian.Uint16(starts[2*i:])), uint32(binary.BigEndian.Uint16(ends[2*i:]))
+			delta := uint32(binary.BigEndian.Uint16(deltas[2*i:]))
+			rangeOffset := int(binary.BigEndian.Uint16(rangeOffsets[2*i:]))
+			for c := start; c <= end && c != 0xffff; c++ {
+				if rangeOffset == 0 {
+					add(rune(c), (c+delta)&0xffff)
+					continue
+				}
+				// idRangeOffset is relative to its own slot in the subtable
+				at := 16 + 6*segs + 2*i + rangeOffset + 2*int(c-start)
+				if at+2 > len(bmp) {
+					break
+				}
+				if gid := uint32(binary.BigEndian.Uint16(bmp[at:])); gid != 0 {
+					add(rune(c), (gid+delta)&0xffff)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("%w: no Unicode cmap", errBadFont)
+	}
+	return nil
+}
+
+// glyph returns the glyph of r, 0 (.notdef) when the font has none
+func (f *ttfFont) glyph(r rune) uint16 {
+	return f.glyphs[r]
+}
+
+// width returns the advance of a glyph in thousandths of the font size
+func (f *ttfFont) width(gid uint16) int {
+	return int(f.advances[gid]) * 1000 / f.unitsPerEm
+}
+
+// scale converts font units to thousandths of the font size
+func (f *ttfFont) scale(v int) int {
+	return v * 1000 / f.unitsPerEm
+}
+
+// subset returns the font program with outlines of only the given glyphs, plus .notdef and
+// components of composite glyphs. Glyph IDs are kept, so text encoded for the full font
+// works with the subset.
+func (f *ttfFont) subset(used map[uint16]rune) []byte {
+	keep := map[uint16]bool{0: true}
+	queue := []uint16{0}
+	for gid := range used {
+		if !keep[gid] {
+			keep[gid] = true
+			queue = append(queue, gid)
+		}
+	}
+	for len(queue) > 0 {
+		gid := queue[0]
+		queue = queue[1:]
+		for _, c := range f.components(gid) {
+			if int(c) < len(f.advances) && !keep[c] {
+				keep[c] = true
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	glyf := f.tables["glyf"]
+	var newGlyf bytes.Buffer
+	newLoca := make([]byte, 4*len(f.loca))
+	for gid := 0; gid < len(f.advances); gid++ {
+		if keep[uint16(gid)] {
+			newGlyf.Write(glyf[f.loca[gid]:f.loca[gid+1]])
+			for newGlyf.Len()%4 != 0 {
+				newGlyf.WriteByte(0)
+			}
+		}
+		binary.BigEndian.PutUint32(newLoca[4*(gid+1):], uint32(newGlyf.Len()))
+	}
+
+	head := append([]byte(nil), f.tables["head"]...)
+	binary.BigEndian.PutUint32(head[8:], 0)  // checkSumAdjustment, set below
+	binary.BigEndian.PutUint16(head[50:], 1) // long loca
+
+	tables := map[string][]byte{
+		"head": head,
+		"hhea": f.tables["hhea"],
+		"maxp": f.tables["maxp"],
+		"hmtx": f.tables["hmtx"],
+		"loca": newLoca,
+		"glyf": newGlyf.Bytes(),
+	}
+	// Hinting programs are referenced by the glyph instructions
+	for _, tag := range []string{"cvt ", "fpgm", "prep"} {
+		if t, ok := f.tables[tag]; ok {
+			tables[tag] = t
+		}
+	}
+	out := writeFont(tables)
+	binary.BigEndian.PutUint32(out[headOffset(out)+8:], 0xb1b0afba-checksum(out))
+	return out
+}
+
+// components returns the glyphs a composite glyph is built from
+func (f *ttfFont) components(gid uint16) []uint16 {
+	g := f.tables["glyf"][f.loca[gid]:f.loca[gid+1]]
+	if len(g) < 10 || int16(binary.BigEndian.Uint16(g)) >= 0 {
+		return nil
+	}
+	var out []uint16
+	for at := 10; at+4 <= len(g); {
+		flags := binary.BigEndian.Uint16(g[at:])
+		out = append(out, binary.BigEndian.Uint16(g[at+2:]))
+		at += 4
+		if flags&0x0001 != 0 { // ARG_1_AND_2_ARE_WORDS
+			at += 4
+		} else {
+			at += 2
+		}
+		switch {
+		case flags&0x0008 != 0: // WE_HAVE_A_SCALE
+			at += 2
+		case flags&0x0040 != 0: // WE_HAVE_AN_X_AND_Y_SCALE
+			at += 4
+		case flags&0x0080 != 0: // WE_HAVE_A_TWO_BY_TWO
+			at += 8
+		}
+		if flags&0x0020 == 0 { // MORE_COMPONENTS
+			break
+		}
+	}
+	return out
+}
+
+// writeFont assembles an sfnt file from tables
+func writeFont(tables map[string][]byte) []byte {
+	tags := make([]string, 0, len(tables))
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	n := len(tags)
+	searchRange, entrySelector := 1, 0
+	for searchRange*2 <= n {
+		searchRange *= 2
+		entrySelector++
+	}
+	var out bytes.Buffer
+	header := make([]byte, 12+16*n)
+	binary.BigEndian.PutUint32(header, 0x00010000)
+	binary.BigEndian.PutUint16(header[4:], uint16(n))
+	binary.BigEndian.PutUint16(header[6:], uint16(16*searchRange))
+	binary.BigEndian.PutUint16(header[8:], uint16(entrySelector))
+	binary.BigEndian.PutUint16(header[10:], uint16(16*(n-searchRange)))
+
+	offset := len(header)
+	for i, tag := range tags {
+		t := tables[tag]
+		rec := header[12+16*i:]
+		copy(rec, tag)
+		binary.BigEndian.PutUint32(rec[4:], checksum(t))
+		binary.BigEndian.PutUint32(rec[8:], uint32(offset))
+		binary.BigEndian.PutUint32(rec[12:], uint32(len(t)))
+		offset += (len(t) + 3) &^ 3
+	}
+	out.Write(header)
+	for _, tag := range tags {
+		out.Write(tables[tag])
+		for out.Len()%4 != 0 {
+			out.WriteByte(0)
+		}
+	}
+	return out.Bytes()
+}
+
+// headOffset returns where the head table starts in a font written by writeFont
+func headOffset(font []byte) int {
+	n := int(binary.BigEndian.Uint16(font[4:]))
+	for i := 0; i < n; i++ {
+		rec := font[12+16*i:]
+		if string(rec[:4]) == "head" {
+			return int(binary.BigEndian.Uint32(rec[8:]))
+		}
+	}
+	return 0
+}
+
+// checksum is the sfnt checksum: the sum of big-endian uint32s, the tail padded with zeros
+func checksum(b []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(b); i += 4 {
+		var word [4]byte
+		copy(word[:], b[i:])
+		sum += binary.BigEndian.Uint32(word[:])
+	}
+	return sum
+}
+
+// deflate compresses a stream for /FlateDecode
+func deflate(b []byte) []byte {
+	var out bytes.Buffer
+	w := zlib.NewWriter(&out)
+	w.Write(b)
+	w.Close()
+	return out.Bytes()
+}
+
+// sanitizeFontName keeps characters allowed in a PDF name without escaping
+func sanitizeFontName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return -1
+	}, name)
+	if name == "" {
+		return "Font"
+	}
+	return name
+}
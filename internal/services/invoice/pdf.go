@@ -0,0 +1,301 @@
+package invoice
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"isp-billing/internal/models"
+)
+
+// A4 page in points and layout of the rendered invoice
+const (
+	pageWidth    = 595
+	pageHeight   = 842
+	marginLeft   = 50
+	marginTop    = 60
+	marginBottom = 60
+	lineHeight   = 14
+	amountRight  = 545 // Right edge of the amount column
+	maxLineRunes = 70  // Descriptions are cut to fit before the amount column
+)
+
+// RenderPDF renders an invoice to a PDF document
+// Text is set in the configured TrueType fonts, embedded as subsets of the glyphs used, so
+// names and contract_info in any script are reproduced as stored.
+func (s *Service) RenderPDF(inv *models.Invoice) []byte {
+	p := &pdfPages{fonts: [2]*pdfFont{
+		{ttfFont: s.fonts[0], used: make(map[uint16]rune)},
+		{ttfFont: s.fonts[1], used: make(map[uint16]rune)},
+	}}
+	p.newPage()
+
+	title := "INVOICE " + inv.Number
+	if inv.State == models.InvoiceVoid {
+		title += " (VOID)"
+	}
+	p.text(marginLeft, 16, true, title)
+	p.skip(8)
+
+	if inv.Issuer.Name != "" {
+		p.text(marginLeft, 10, true, inv.Issuer.Name)
+	}
+	for _, line := range inv.Issuer.Details {
+		p.text(marginLeft, 10, false, line)
+	}
+	p.skip(6)
+
+	p.text(marginLeft, 10, false, "Issued: "+inv.IssuedAt.Format("2006-01-02"))
+	p.text(marginLeft, 10, false, "Due: "+inv.DueAt.Format("2006-01-02"))
+	p.text(marginLeft, 10, false, fmt.Sprintf("Period: %s - %s",
+		inv.PeriodStart.Format("2006-01-02"), inv.PeriodEnd.Format("2006-01-02")))
+	p.text(marginLeft, 10, false, fmt.Sprintf("Contract: %d", inv.ContractID))
+	p.skip(6)
+
+	if len(inv.Customer) > 0 {
+		p.text(marginLeft, 10, true, "Customer")
+		for _, f := range inv.Customer {
+			label := f.Description
+			if label == "" {
+				label = f.Name
+			}
+			p.text(marginLeft, 10, false, label+": "+f.Value)
+		}
+		p.skip(6)
+	}
+
+	p.row(true, "Description", "Amount")
+	for _, line := range inv.Lines {
+		description := line.Description
+		if line.Login != "" {
+			description = line.Login + " - " + description
+		}
+		p.row(false, description, line.Amount.StringFixed(2))
+	}
+	p.skip(6)
+
+	p.row(true, "Total, "+inv.CurrencyCode, inv.Total.StringFixed(2))
+	if inv.TaxRate > 0 {
+		p.row(false, fmt.Sprintf("Including VAT %g%%", inv.TaxRate), inv.Tax.StringFixed(2))
+	}
+	if inv.State == models.InvoiceVoid {
+		p.skip(6)
+		p.text(marginLeft, 10, false, "Voided: "+inv.VoidReason)
+	}
+
+	return p.bytes()
+}
+
+// pdfPages accumulates content streams of pages, starting a new page when one is full
+type pdfPages struct {
+	pages []*bytes.Buffer
+	y     int
+	fonts [2]*pdfFont // Regular and bold
+}
+
+// pdfFont is a font of one document and the glyphs drawn with it
+type pdfFont struct {
+	*ttfFont
+	used map[uint16]rune
+}
+
+// encode returns s as a hex string of glyph IDs for the Identity-H encoding
+func (f *pdfFont) encode(s string) string {
+	var b strings.Builder
+	b.WriteByte('<')
+	for _, r := range s {
+		gid := f.glyph(r)
+		if _, ok := f.used[gid]; !ok {
+			f.used[gid] = r
+		}
+		fmt.Fprintf(&b, "%04X", gid)
+	}
+	b.WriteByte('>')
+	return b.String()
+}
+
+// textWidth returns the width of s in points
+func (f *pdfFont) textWidth(s string, size int) int {
+	width := 0
+	for _, r := range s {
+		width += f.width(f.glyph(r))
+	}
+	return width * size / 1000
+}
+
+func (p *pdfPages) newPage() {
+	p.pages = append(p.pages, &bytes.Buffer{})
+	p.y = pageHeight - marginTop
+}
+
+func (p *pdfPages) skip(points int) {
+	p.y -= points
+}
+
+func (p *pdfPages) advance(size int) {
+	if p.y-size < marginBottom {
+		p.newPage()
+	}
+	p.y -= lineHeight + size - 10
+}
+
+// text writes a line at x
+func (p *pdfPages) text(x, size int, bold bool, s string) {
+	p.advance(size)
+	p.put(x, size, bold, s)
+}
+
+// row writes a description and a right-aligned amount on one line
+func (p *pdfPages) row(bold bool, description, amount string) {
+	p.advance(10)
+	if utf8.RuneCountInString(description) > maxLineRunes {
+		description = string([]rune(description)[:maxLineRunes-3]) + "..."
+	}
+	p.put(marginLeft, 10, bold, description)
+	p.put(amountRight-p.font(bold).textWidth(amount, 10), 10, bold, amount)
+}
+
+func (p *pdfPages) font(bold bool) *pdfFont {
+	if bold {
+		return p.fonts[1]
+	}
+	return p.fonts[0]
+}
+
+func (p *pdfPages) put(x, size int, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(p.pages[len(p.pages)-1], "BT /%s %d Tf %d %d Td %s Tj ET\n", font, size, x, p.y, p.font(bold).encode(s))
+}
+
+// Objects of an embedded font, in order from its first object number
+const (
+	fontType0 = iota
+	fontCID
+	fontDescriptor
+	fontFile
+	fontToUnicode
+	fontObjects
+)
+
+// bytes assembles the document: catalog, page tree, fonts, then a page and its content per page
+func (p *pdfPages) bytes() []byte {
+	firstPage := 3 + fontObjects*len(p.fonts)
+
+	var objects []string
+	kids := make([]string, len(p.pages))
+	for i := range p.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)),
+	)
+	for i, f := range p.fonts {
+		objects = append(objects, f.objects(3+fontObjects*i)...)
+	}
+	for i, content := range p.pages {
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] "+
+				"/Resources << /Font << /F1 3 0 R /F2 %d 0 R >> >> /Contents %d 0 R >>",
+				pageWidth, pageHeight, 3+fontObjects, firstPage+2*i+1),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+		)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// objects returns the Type0 font and its parts, numbered from first
+func (f *pdfFont) objects(first int) []string {
+	gids := make([]int, 0, len(f.used))
+	for gid := range f.used {
+		gids = append(gids, int(gid))
+	}
+	sort.Ints(gids)
+
+	// Subset fonts are named with a tag unique to the glyph set
+	h := crc32.NewIEEE()
+	for _, gid := range gids {
+		fmt.Fprintf(h, "%d,", gid)
+	}
+	tag := make([]byte, 6)
+	for i, sum := 0, h.Sum32(); i < len(tag); i, sum = i+1, sum/26 {
+		tag[i] = 'A' + byte(sum%26)
+	}
+	name := string(tag) + "+" + f.name
+
+	var widths, cmap strings.Builder
+	for _, gid := range gids {
+		fmt.Fprintf(&widths, "%d [%d] ", gid, f.width(uint16(gid)))
+	}
+	cmap.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+		"/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n" +
+		"1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	var mapped []int
+	for _, gid := range gids {
+		if gid != 0 {
+			mapped = append(mapped, gid)
+		}
+	}
+	for len(mapped) > 0 {
+		// At most 100 entries per block
+		n := len(mapped)
+		if n > 100 {
+			n = 100
+		}
+		fmt.Fprintf(&cmap, "%d beginbfchar\n", n)
+		for _, gid := range mapped[:n] {
+			fmt.Fprintf(&cmap, "<%04X> <", gid)
+			for _, unit := range utf16.Encode([]rune{f.used[uint16(gid)]}) {
+				fmt.Fprintf(&cmap, "%04X", unit)
+			}
+			cmap.WriteString(">\n")
+		}
+		cmap.WriteString("endbfchar\n")
+		mapped = mapped[n:]
+	}
+	cmap.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+
+	program := f.subset(f.used)
+	compressed := deflate(program)
+
+	return []string{
+		fontType0: fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H "+
+			"/DescendantFonts [%d 0 R] /ToUnicode %d 0 R >>", name, first+fontCID, first+fontToUnicode),
+		fontCID: fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont /%s "+
+			"/CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> "+
+			"/FontDescriptor %d 0 R /DW %d /W [%s] /CIDToGIDMap /Identity >>",
+			name, first+fontDescriptor, f.width(0), widths.String()),
+		fontDescriptor: fmt.Sprintf("<< /Type /FontDescriptor /FontName /%s /Flags 32 "+
+			"/FontBBox [%d %d %d %d] /ItalicAngle 0 /Ascent %d /Descent %d /CapHeight %d /StemV 80 "+
+			"/FontFile2 %d 0 R >>", name,
+			f.scale(f.bbox[0]), f.scale(f.bbox[1]), f.scale(f.bbox[2]), f.scale(f.bbox[3]),
+			f.scale(f.ascent), f.scale(f.descent), f.scale(f.ascent), first+fontFile),
+		fontFile: fmt.Sprintf("<< /Length %d /Length1 %d /Filter /FlateDecode >>\nstream\n%s\nendstream",
+			len(compressed), len(program), compressed),
+		fontToUnicode: fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", cmap.Len(), cmap.String()),
+	}
+}
@@ -0,0 +1,595 @@
+package invoice
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/currency"
+)
+
+// ErrInvoiceNotFound is returned for unknown invoice IDs
+var ErrInvoiceNotFound = errors.New("invoice not found")
+
+// ErrContractNotFound is returned for unknown contract IDs
+var ErrContractNotFound = errors.New("contract not found")
+
+// ErrAlreadyIssued is returned when the contract already has an invoice for the period
+var ErrAlreadyIssued = errors.New("invoice already issued for the period")
+
+// ErrNothingToInvoice is returned when the contract has no charges in the period
+var ErrNothingToInvoice = errors.New("nothing to invoice for the period")
+
+// ErrInvoiceVoid is returned when a void invoice is voided again
+var ErrInvoiceVoid = errors.New("invoice is void")
+
+// Service issues monthly invoices of contracts
+// An invoice groups what the contract was charged in a calendar month: subscription fees,
+// traffic of finished sessions, one-off charges and credits. It is stored as an immutable
+// JSON document (see migrations/010_invoices.sql) and rendered to PDF from it.
+type Service struct {
+	db     *database.PostgreSQL
+	rates  *currency.Service
+	logger *zap.Logger
+	config Config
+	fonts  [2]*ttfFont // Regular and bold, for RenderPDF
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Config holds invoicing settings
+type Config struct {
+	NumberPrefix  string        `yaml:"number_prefix"`  // Numbers are <prefix><year>-<sequence>, default "INV-"
+	DueDays       int           `yaml:"due_days"`       // Payment term, default 14
+	TaxRate       float64       `yaml:"tax_rate"`       // VAT percent included in amounts, 0 - none
+	IssuerName    string        `yaml:"issuer_name"`    // Company name printed on invoices
+	IssuerDetails []string      `yaml:"issuer_details"` // Address, tax ID, bank account lines
+	ContractKinds []int         `yaml:"contract_kinds"` // Kinds invoiced by IssueMonth, empty - all
+	AutoIssue     bool          `yaml:"auto_issue"`     // Issue the previous month in background
+	CheckInterval time.Duration `yaml:"check_interval"` // How often AutoIssue looks for unissued invoices
+	FontFile      string        `yaml:"font_file"`      // TrueType font of PDF invoices, default DejaVu Sans
+	BoldFontFile  string        `yaml:"bold_font_file"` // Bold TrueType font, default DejaVu Sans Bold
+}
+
+// IssueResult counts what IssueMonth did
+type IssueResult struct {
+	Issued  int `json:"issued"`
+	Skipped int `json:"skipped"` // Already issued or nothing to invoice
+	Failed  int `json:"failed"`
+}
+
+// New creates a new invoice service
+// Fonts are loaded here so that a missing font file fails at startup rather than on the first PDF.
+func New(db *database.PostgreSQL, rates *currency.Service, logger *zap.Logger, config Config) (*Service, error) {
+	if config.NumberPrefix == "" {
+		config.NumberPrefix = "INV-"
+	}
+	if config.DueDays == 0 {
+		config.DueDays = 14
+	}
+	if config.CheckInterval == 0 {
+		config.CheckInterval = time.Hour
+	}
+	if config.FontFile == "" {
+		config.FontFile = "/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf"
+	}
+	if config.BoldFontFile == "" {
+		config.BoldFontFile = "/usr/share/fonts/truetype/dejavu/DejaVuSans-Bold.ttf"
+	}
+
+	s := &Service{
+		db:       db,
+		rates:    rates,
+		logger:   logger,
+		config:   config,
+		stopChan: make(chan struct{}),
+	}
+	for i, path := range []string{config.FontFile, config.BoldFontFile} {
+		font, err := loadFont(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load invoice font: %w", err)
+		}
+		s.fonts[i] = font
+	}
+	return s, nil
+}
+
+// Start issues invoices of the previous month in background when AutoIssue is on
+// IssueMonth skips issued invoices, so every check after the month ends is safe.
+func (s *Service) Start() {
+	if !s.config.AutoIssue {
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.config.CheckInterval)
+		defer ticker.Stop()
+
+		// Month issued without failures, rechecked only after a restart
+		var done time.Time
+
+		for {
+			select {
+			case <-ticker.C:
+				month, _ := monthPeriod(time.Now().AddDate(0, 0, -time.Now().Day()))
+				if month.Equal(done) {
+					continue
+				}
+				result, err := s.IssueMonth(month)
+				if err != nil {
+					s.logger.Error("Failed to issue monthly invoices", zap.Error(err))
+					continue
+				}
+				if result.Failed == 0 {
+					done = month
+				}
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background task
+func (s *Service) Stop() {
+	close(s.stopChan)
+	s.wg.Wait()
+}
+
+// IssueMonth issues invoices of the calendar month containing month for all contracts
+// (of ContractKinds) that were charged in it
+func (s *Service) IssueMonth(month time.Time) (*IssueResult, error) {
+	periodStart, _ := monthPeriod(month)
+
+	rows, err := s.db.GetDB().Query(`
+		SELECT c.id FROM contracts c
+		WHERE (cardinality($1::int[]) = 0 OR c.kind_id = ANY($1::int[]))
+		AND NOT EXISTS (SELECT 1 FROM invoices i
+			WHERE i.contract_id = c.id AND i.period_start = $2 AND i.state = 'issued')
+		ORDER BY c.id`, intArray(s.config.ContractKinds), periodStart)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch contracts: %w", err)
+	}
+	var contractIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		contractIDs = append(contractIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &IssueResult{}
+	for _, contractID := range contractIDs {
+		_, err := s.Issue(contractID, periodStart)
+		switch {
+		case errors.Is(err, ErrAlreadyIssued), errors.Is(err, ErrNothingToInvoice):
+			result.Skipped++
+		case err != nil:
+			s.logger.Error("Failed to issue invoice",
+				zap.Int("contract_id", contractID),
+				zap.Time("period_start", periodStart),
+				zap.Error(err))
+			result.Failed++
+		default:
+			result.Issued++
+		}
+	}
+
+	if result.Issued > 0 || result.Failed > 0 {
+		s.logger.Info("Monthly invoices issued",
+			zap.Time("period_start", periodStart),
+			zap.Int("issued", result.Issued),
+			zap.Int("failed", result.Failed))
+	}
+	return result, nil
+}
+
+// Issue issues the invoice of the contract for the calendar month containing month
+// The number is taken from a per-year counter locked in the same transaction, so numbers
+// have no gaps.
+func (s *Service) Issue(contractID int, month time.Time) (*models.Invoice, error) {
+	periodStart, periodEnd := monthPeriod(month)
+
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	inv := &models.Invoice{
+		ContractID:  contractID,
+		PeriodStart: periodStart,
+		PeriodEnd:   periodEnd,
+		IssuedAt:    time.Now(),
+		TaxRate:     s.config.TaxRate,
+		State:       models.InvoiceIssued,
+		Issuer: models.InvoiceIssuer{
+			Name:    s.config.IssuerName,
+			Details: s.config.IssuerDetails,
+		},
+	}
+	inv.DueAt = inv.IssuedAt.AddDate(0, 0, s.config.DueDays)
+
+	// Lock the contract: one invoice per period even when issued concurrently
+	err = tx.QueryRow(`
+		SELECT c.currency_id, COALESCE(cur.short_name, '')
+		FROM contracts c LEFT JOIN currencies cur ON cur.id = c.currency_id
+		WHERE c.id = $1 FOR UPDATE OF c`, contractID).Scan(&inv.Currency, &inv.CurrencyCode)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrContractNotFound, contractID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock contract: %w", err)
+	}
+
+	var issued bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM invoices WHERE contract_id = $1 AND period_start = $2 AND state = 'issued')`,
+		contractID, periodStart).Scan(&issued)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check invoices: %w", err)
+	}
+	if issued {
+		return nil, fmt.Errorf("%w: contract %d, %s", ErrAlreadyIssued, contractID, periodStart.Format("2006-01"))
+	}
+
+	if inv.Lines, err = s.collectLines(tx, inv); err != nil {
+		return nil, err
+	}
+	if len(inv.Lines) == 0 {
+		return nil, fmt.Errorf("%w: contract %d, %s", ErrNothingToInvoice, contractID, periodStart.Format("2006-01"))
+	}
+	for _, line := range inv.Lines {
+		inv.Total = inv.Total.Add(line.Amount)
+	}
+	inv.Tax = includedTax(inv.Total, inv.TaxRate)
+
+	if inv.Customer, err = customerFields(tx, contractID); err != nil {
+		return nil, err
+	}
+
+	if inv.Number, err = s.nextNumber(tx, inv.IssuedAt.Year()); err != nil {
+		return nil, err
+	}
+
+	document, err := json.Marshal(inv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal invoice: %w", err)
+	}
+	hash := sha256.Sum256(document)
+
+	err = tx.QueryRow(`
+		INSERT INTO invoices (number, contract_id, period_start, period_end, issued_at, due_at,
+			currency_id, total, tax, state, document, document_sha256)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id`,
+		inv.Number, inv.ContractID, inv.PeriodStart, inv.PeriodEnd, inv.IssuedAt, inv.DueAt,
+		inv.Currency, inv.Total, inv.Tax, inv.State, string(document), hex.EncodeToString(hash[:]),
+	).Scan(&inv.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store invoice: %w", err)
+	}
+
+	for i, line := range inv.Lines {
+		var accountID interface{}
+		if line.AccountID != 0 {
+			accountID = line.AccountID
+		}
+		_, err := tx.Exec(`
+			INSERT INTO invoice_lines (invoice_id, line_no, kind, account_id, description, amount)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			inv.ID, i+1, line.Kind, accountID, line.Description, line.Amount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store invoice line: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit invoice: %w", err)
+	}
+
+	s.logger.Info("Invoice issued",
+		zap.Int("invoice_id", inv.ID),
+		zap.String("number", inv.Number),
+		zap.Int("contract_id", contractID),
+		zap.Stringer("total", inv.Total))
+	return inv, nil
+}
+
+// Get returns an invoice as issued, with its current state
+func (s *Service) Get(invoiceID int) (*models.Invoice, error) {
+	invoices, err := s.queryInvoices(`WHERE id = $1`, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	if len(invoices) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvoiceNotFound, invoiceID)
+	}
+	return invoices[0], nil
+}
+
+// ContractInvoices returns invoices of the contract, newest period first
+func (s *Service) ContractInvoices(contractID, limit int) ([]*models.Invoice, error) {
+	return s.queryInvoices(`WHERE contract_id = $1 ORDER BY period_start DESC, id DESC LIMIT $2`, contractID, limit)
+}
+
+// Void cancels an issued invoice; its number stays used and the period can be issued again
+func (s *Service) Void(invoiceID int, reason string) (*models.Invoice, error) {
+	if reason == "" {
+		reason = "voided by operator"
+	}
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+
+	res, err := s.db.GetDB().Exec(`
+		UPDATE invoices SET state = 'void', voided_at = NOW(), void_reason = $1
+		WHERE id = $2 AND state = 'issued'`, reason, invoiceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to void invoice: %w", err)
+	}
+
+	inv, err := s.Get(invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvoiceVoid, inv.Number)
+	}
+
+	s.logger.Info("Invoice voided", zap.Int("invoice_id", invoiceID), zap.String("number", inv.Number))
+	return inv, nil
+}
+
+// collectLines gathers what the contract was charged in the invoice period
+func (s *Service) collectLines(tx *sql.Tx, inv *models.Invoice) ([]models.InvoiceLine, error) {
+	var lines []models.InvoiceLine
+	periodEnd := inv.PeriodEnd.Add(time.Second)
+
+	// Subscription fees debited in the period
+	rows, err := tx.Query(`
+		SELECT a.id, a.login, sc.period_start, sc.period_end, ABS(ft.amount_in_contract_currency)
+		FROM subscription_charges sc
+		JOIN accounts a ON a.id = sc.account_id
+		JOIN fin_transactions ft ON ft.id = sc.transaction_id
+		WHERE a.contract_id = $1 AND sc.status = 'success'
+		AND ft.created_at >= $2 AND ft.created_at < $3
+		ORDER BY a.id, sc.period_start`, inv.ContractID, inv.PeriodStart, periodEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch subscription charges: %w", err)
+	}
+	for rows.Next() {
+		line := models.InvoiceLine{Kind: models.InvoiceLineSubscription}
+		var from, to time.Time
+		if err := rows.Scan(&line.AccountID, &line.Login, &from, &to, &line.Amount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		line.Description = fmt.Sprintf("Subscription fee %s - %s", from.Format("2006-01-02"), to.Format("2006-01-02"))
+		lines = append(lines, line)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Unused parts of periods returned on plan changes
+	rows, err = tx.Query(`
+		SELECT a.id, a.login, pc.credit, pc.credit_currency, pc.applied_at
+		FROM plan_changes pc
+		JOIN accounts a ON a.id = pc.account_id
+		WHERE a.contract_id = $1 AND pc.state = 'applied' AND pc.credit > 0
+		AND pc.applied_at >= $2 AND pc.applied_at < $3
+		ORDER BY pc.applied_at, pc.id`, inv.ContractID, inv.PeriodStart, periodEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch plan change credits: %w", err)
+	}
+	type planCredit struct {
+		line      models.InvoiceLine
+		currency  int
+		appliedAt time.Time
+	}
+	var credits []planCredit
+	for rows.Next() {
+		c := planCredit{line: models.InvoiceLine{Kind: models.InvoiceLineCredit, Description: "Plan change: unused part of period"}}
+		if err := rows.Scan(&c.line.AccountID, &c.line.Login, &c.line.Amount, &c.currency, &c.appliedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		credits = append(credits, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, c := range credits {
+		amount, err := s.rates.ConvertAt(c.line.Amount, c.currency, inv.Currency, c.appliedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert plan change credit: %w", err)
+		}
+		c.line.Amount = amount.Neg()
+		lines = append(lines, c.line)
+	}
+
+	// Traffic of sessions finished in the period
+	rows, err = tx.Query(`
+		SELECT a.id, a.login, COUNT(*), COALESCE(SUM(s.octets_in + s.octets_out), 0), SUM(s.amount)
+		FROM iptraffic_sessions s
+		JOIN accounts a ON a.id = s.account_id
+		WHERE a.contract_id = $1 AND s.finished_at >= $2 AND s.finished_at < $3
+		GROUP BY a.id, a.login
+		HAVING SUM(s.amount) > 0
+		ORDER BY a.id`, inv.ContractID, inv.PeriodStart, periodEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch traffic: %w", err)
+	}
+	for rows.Next() {
+		line := models.InvoiceLine{Kind: models.InvoiceLineTraffic}
+		var sessions int
+		var octets int64
+		if err := rows.Scan(&line.AccountID, &line.Login, &sessions, &octets, &line.Amount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		line.Description = fmt.Sprintf("Internet traffic: %d sessions, %.1f MB", sessions, float64(octets)/1e6)
+		lines = append(lines, line)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// One-off charges and credits
+	rows, err = tx.Query(`
+		SELECT a.id, a.login, ac.kind, ac.reason, ac.description, ABS(ft.amount_in_contract_currency)
+		FROM account_charges ac
+		JOIN accounts a ON a.id = ac.account_id
+		JOIN fin_transactions ft ON ft.id = ac.transaction_id
+		WHERE a.contract_id = $1 AND ac.created_at >= $2 AND ac.created_at < $3
+		ORDER BY ac.id`, inv.ContractID, inv.PeriodStart, periodEnd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch one-off charges: %w", err)
+	}
+	for rows.Next() {
+		line := models.InvoiceLine{Kind: models.InvoiceLineCharge}
+		var kind, reason, description string
+		if err := rows.Scan(&line.AccountID, &line.Login, &kind, &reason, &description, &line.Amount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		line.Description = reason
+		if description != "" {
+			line.Description += ": " + description
+		}
+		if kind == models.OneOffCredit {
+			line.Kind = models.InvoiceLineCredit
+			line.Amount = line.Amount.Neg()
+		}
+		lines = append(lines, line)
+	}
+	rows.Close()
+	return lines, rows.Err()
+}
+
+// customerFields returns contract_info values of the contract in contract_info_items order
+func customerFields(tx *sql.Tx, contractID int) ([]models.InvoiceField, error) {
+	rows, err := tx.Query(`
+		SELECT cii.field_name, cii.field_description, ci.info_value
+		FROM contract_info ci
+		JOIN contract_info_items cii ON cii.id = ci.info_id
+		WHERE ci.contract_id = $1
+		ORDER BY cii.sort_order, cii.id`, contractID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch contract info: %w", err)
+	}
+	defer rows.Close()
+
+	fields := []models.InvoiceField{}
+	for rows.Next() {
+		var f models.InvoiceField
+		if err := rows.Scan(&f.Name, &f.Description, &f.Value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, rows.Err()
+}
+
+// nextNumber takes the next number of the year's sequence
+func (s *Service) nextNumber(tx *sql.Tx, year int) (string, error) {
+	var n int
+	err := tx.QueryRow(`
+		INSERT INTO invoice_counters (prefix, year, last_number) VALUES ($1, $2, 1)
+		ON CONFLICT (prefix, year) DO UPDATE SET last_number = invoice_counters.last_number + 1
+		RETURNING last_number`, s.config.NumberPrefix, year).Scan(&n)
+	if err != nil {
+		return "", fmt.Errorf("failed to take invoice number: %w", err)
+	}
+	return fmt.Sprintf("%s%d-%06d", s.config.NumberPrefix, year, n), nil
+}
+
+func (s *Service) queryInvoices(where string, args ...interface{}) ([]*models.Invoice, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT id, document, document_sha256, state, voided_at, void_reason
+		FROM invoices
+		`+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch invoices: %w", err)
+	}
+	defer rows.Close()
+
+	invoices := []*models.Invoice{}
+	for rows.Next() {
+		var id int
+		var document, hash, state, voidReason string
+		var voidedAt sql.NullTime
+		if err := rows.Scan(&id, &document, &hash, &state, &voidedAt, &voidReason); err != nil {
+			return nil, fmt.Errorf("failed to scan invoice: %w", err)
+		}
+
+		sum := sha256.Sum256([]byte(document))
+		if hex.EncodeToString(sum[:]) != hash {
+			return nil, fmt.Errorf("invoice %d: document does not match its checksum", id)
+		}
+		inv := &models.Invoice{}
+		if err := json.Unmarshal([]byte(document), inv); err != nil {
+			return nil, fmt.Errorf("failed to parse invoice %d: %w", id, err)
+		}
+		inv.ID = id
+		inv.State = state
+		inv.VoidReason = voidReason
+		if voidedAt.Valid {
+			inv.VoidedAt = &voidedAt.Time
+		}
+		invoices = append(invoices, inv)
+	}
+	return invoices, rows.Err()
+}
+
+// monthPeriod returns the calendar month containing t; end is its last second
+func monthPeriod(t time.Time) (time.Time, time.Time) {
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	return start, start.AddDate(0, 1, 0).Add(-time.Second)
+}
+
+// includedTax is the tax included in total at rate percent: total * rate / (100 + rate)
+func includedTax(total models.Money, rate float64) models.Money {
+	if rate <= 0 || total.Sign() <= 0 {
+		return models.Money{}
+	}
+	// Rate in hundredths of a percent keeps the multiplication exact
+	r := uint64(math.Round(rate * 100))
+	return total.MulDiv(r, 10000+r).Round(2)
+}
+
+// intArray formats ints as a PostgreSQL array literal
+func intArray(values []int) string {
+	s := "{"
+	for i, v := range values {
+		if i > 0 {
+			s += ","
+		}
+		s += fmt.Sprint(v)
+	}
+	return s + "}"
+}
@@ -0,0 +1,236 @@
+package payment
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"isp-billing/internal/models"
+)
+
+// ErrInvalidImport is returned for statements that cannot be read at all
+var ErrInvalidImport = errors.New("invalid payment statement")
+
+// ImportResult is the outcome of a statement import
+// Rows already booked by an earlier import are Duplicates; outgoing (negative) rows are Skipped.
+type ImportResult struct {
+	Source     string        `json:"source"`
+	Rows       int           `json:"rows"`
+	Imported   int           `json:"imported"`
+	Duplicates int           `json:"duplicates"`
+	Skipped    int           `json:"skipped"`
+	Failed     int           `json:"failed"`
+	Errors     []ImportError `json:"errors,omitempty"`
+}
+
+// ImportError is a statement row that was not booked
+type ImportError struct {
+	Line        int    `json:"line"`
+	ExternalRef string `json:"external_ref,omitempty"`
+	Error       string `json:"error"`
+}
+
+// Column names accepted in the header of a statement, lowercase
+var importColumns = map[string][]string{
+	"reference":  {"reference", "ref", "external_ref", "transaction_id", "document"},
+	"account_id": {"account_id"},
+	"login":      {"login", "account"},
+	"amount":     {"amount", "sum"},
+	"currency":   {"currency", "currency_id"},
+	"date":       {"date", "paid_at", "value_date"},
+	"comment":    {"comment", "purpose", "description"},
+}
+
+var importDateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02", "02.01.2006 15:04:05", "02.01.2006"}
+
+// Import books the payments of a CSV bank statement
+// The first row names the columns: reference, amount and login or account_id are required,
+// currency (ID), date and comment are optional. Fields are separated by commas or semicolons.
+// Each row is booked under the key source:reference, so importing a statement again, or one
+// that overlaps an earlier statement, books only the new rows.
+func (s *Service) Import(r io.Reader, source string) (*ImportResult, error) {
+	if source == "" {
+		source = "import"
+	}
+	result := &ImportResult{Source: source}
+
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(4096)
+	reader := csv.NewReader(br)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if firstLine := strings.SplitN(string(head), "\n", 2)[0]; strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		reader.Comma = ';'
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: no header: %v", ErrInvalidImport, err)
+	}
+	columns := mapColumns(header)
+	if _, ok := columns["reference"]; !ok {
+		return nil, fmt.Errorf("%w: reference column required", ErrInvalidImport)
+	}
+	if _, ok := columns["amount"]; !ok {
+		return nil, fmt.Errorf("%w: amount column required", ErrInvalidImport)
+	}
+	_, hasLogin := columns["login"]
+	_, hasAccountID := columns["account_id"]
+	if !hasLogin && !hasAccountID {
+		return nil, fmt.Errorf("%w: login or account_id column required", ErrInvalidImport)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			return result, fmt.Errorf("%w: line %d: %v", ErrInvalidImport, line, err)
+		}
+		if isBlank(record) {
+			continue
+		}
+		result.Rows++
+		if result.Rows > s.config.MaxImportRows {
+			return result, fmt.Errorf("%w: more than %d rows", ErrInvalidImport, s.config.MaxImportRows)
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		fail := func(err error) {
+			result.Failed++
+			result.Errors = append(result.Errors, ImportError{Line: line, ExternalRef: field("reference"), Error: err.Error()})
+		}
+
+		req, err := importRequest(field, source)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		if req.Amount.Sign() < 0 {
+			// Outgoing transfer in a full bank statement
+			result.Skipped++
+			continue
+		}
+
+		_, duplicate, err := s.Record(req)
+		switch {
+		case err != nil:
+			fail(err)
+		case duplicate:
+			result.Duplicates++
+		default:
+			result.Imported++
+		}
+	}
+
+	return result, nil
+}
+
+// importRequest builds the payment of a statement row
+func importRequest(field func(string) string, source string) (Request, error) {
+	req := Request{
+		Source:      source,
+		ExternalRef: field("reference"),
+		Login:       field("login"),
+		Comment:     field("comment"),
+	}
+	if req.ExternalRef == "" {
+		return req, fmt.Errorf("%w: empty reference", ErrInvalidPayment)
+	}
+
+	var err error
+	if v := field("account_id"); v != "" {
+		if req.AccountID, err = strconv.Atoi(v); err != nil {
+			return req, fmt.Errorf("%w: account_id %q", ErrInvalidPayment, v)
+		}
+	}
+	if v := field("currency"); v != "" {
+		if req.Currency, err = strconv.Atoi(v); err != nil {
+			return req, fmt.Errorf("%w: currency %q", ErrInvalidPayment, v)
+		}
+	}
+	if req.Amount, err = parseAmount(field("amount")); err != nil {
+		return req, err
+	}
+	if v := field("date"); v != "" {
+		if req.PaidAt, err = parseDate(v); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// Amount notations of bank statements once spaces are removed
+var (
+	decimalComma   = regexp.MustCompile(`^-?[0-9]+,[0-9]{1,2}$`)                 // 1234,50
+	groupedDecimal = regexp.MustCompile(`^-?[0-9]{1,3}(,[0-9]{3})+(\.[0-9]+)?$`) // 1,234.50
+)
+
+// parseAmount accepts bank formats: "1 234,50", "1234.50", "1,234.50", "-100"
+// A comma is a decimal separator only with 1-2 digits after it; "1,234" is ambiguous and rejected.
+func parseAmount(s string) (models.Money, error) {
+	v := strings.NewReplacer(" ", "", "\u00a0", "", "'", "").Replace(s)
+	v = strings.TrimPrefix(v, "+")
+	switch {
+	case !strings.Contains(v, ","):
+	case decimalComma.MatchString(v):
+		v = strings.Replace(v, ",", ".", 1)
+	case groupedDecimal.MatchString(v) && strings.Contains(v, "."):
+		v = strings.ReplaceAll(v, ",", "")
+	default:
+		return models.Money{}, fmt.Errorf("%w: amount %q, ambiguous separators", ErrInvalidPayment, s)
+	}
+	amount, err := models.ParseMoney(v)
+	if err != nil {
+		return amount, fmt.Errorf("%w: amount %q", ErrInvalidPayment, s)
+	}
+	return amount, nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range importDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: date %q", ErrInvalidPayment, s)
+}
+
+func mapColumns(header []string) map[string]int {
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		for column, aliases := range importColumns {
+			for _, alias := range aliases {
+				if name == alias {
+					if _, seen := columns[column]; !seen {
+						columns[column] = i
+					}
+				}
+			}
+		}
+	}
+	return columns
+}
+
+func isBlank(record []string) bool {
+	for _, f := range record {
+		if strings.TrimSpace(f) != "" {
+			return false
+		}
+	}
+	return true
+}
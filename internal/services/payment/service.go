@@ -0,0 +1,473 @@
+package payment
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/billing"
+	"isp-billing/internal/services/currency"
+	"isp-billing/internal/services/dunning"
+)
+
+// ErrPaymentNotFound is returned for unknown payment IDs
+var ErrPaymentNotFound = errors.New("payment not found")
+
+// ErrInvalidPayment is returned for malformed payment requests
+var ErrInvalidPayment = errors.New("invalid payment")
+
+// ErrIdempotencyConflict is returned when an idempotency key or external reference is reused
+// for a different payment
+var ErrIdempotencyConflict = errors.New("idempotency key reused with different parameters")
+
+// ErrNotRefundable is returned when a payment cannot be refunded or reversed (any more)
+var ErrNotRefundable = errors.New("payment cannot be refunded")
+
+// Service books customer payments
+// Payments credit the contract through credit_transaction; refunds and reversals take money back
+// through debit_transaction. Every payment has an idempotency key, so a retried API call, a
+// gateway notification delivered twice or a bank statement imported again books nothing new.
+// After a payment, unpaid subscription charges of the contract are retried right away, which
+// lifts throttling and suspension once the balance covers them.
+type Service struct {
+	db      *database.PostgreSQL
+	rates   *currency.Service
+	dunning *dunning.Service
+	logger  *zap.Logger
+	config  Config
+}
+
+// Config holds payment settings
+type Config struct {
+	MaxImportRows int `yaml:"max_import_rows"` // Rows per imported statement, default 10000
+}
+
+// Request is an incoming payment
+// The account is given by AccountID or Login. Without IdempotencyKey the key is
+// Source:ExternalRef, so one of them is required.
+type Request struct {
+	AccountID      int          `json:"account_id"`
+	Login          string       `json:"login"`
+	Amount         models.Money `json:"amount" binding:"required"`
+	Currency       int          `json:"currency"` // 0 - contract currency
+	Source         string       `json:"source"`   // Default "api"
+	ExternalRef    string       `json:"external_ref"`
+	IdempotencyKey string       `json:"idempotency_key"`
+	PaidAt         time.Time    `json:"paid_at"` // Default now
+	Comment        string       `json:"comment"`
+}
+
+// Filter selects payments for Payments
+type Filter struct {
+	AccountID  int
+	ContractID int
+	Source     string
+	Limit      int
+}
+
+// New creates a new payment service
+// dunning may be nil, then payments only credit the balance.
+func New(db *database.PostgreSQL, rates *currency.Service, dunningService *dunning.Service, logger *zap.Logger, config Config) *Service {
+	if config.MaxImportRows == 0 {
+		config.MaxImportRows = 10000
+	}
+
+	return &Service{
+		db:      db,
+		rates:   rates,
+		dunning: dunningService,
+		logger:  logger,
+		config:  config,
+	}
+}
+
+// Record books an incoming payment
+// A request repeating an idempotency key (or source and external reference) of a booked payment
+// returns that payment with duplicate set; with a different account or amount it fails with
+// ErrIdempotencyConflict.
+func (s *Service) Record(req Request) (payment *models.Payment, duplicate bool, err error) {
+	if req.Amount.Sign() <= 0 {
+		return nil, false, fmt.Errorf("%w: amount must be positive", ErrInvalidPayment)
+	}
+	if req.Source == "" {
+		req.Source = "api"
+	}
+	if req.IdempotencyKey == "" {
+		if req.ExternalRef == "" {
+			return nil, false, fmt.Errorf("%w: idempotency key or external reference required", ErrInvalidPayment)
+		}
+		req.IdempotencyKey = req.Source + ":" + req.ExternalRef
+	}
+	if req.PaidAt.IsZero() {
+		req.PaidAt = time.Now()
+	}
+
+	payment = &models.Payment{
+		Kind:           models.PaymentIncoming,
+		State:          models.PaymentPosted,
+		AccountID:      req.AccountID,
+		Amount:         req.Amount,
+		Currency:       req.Currency,
+		Source:         req.Source,
+		ExternalRef:    req.ExternalRef,
+		IdempotencyKey: req.IdempotencyKey,
+		Comment:        req.Comment,
+		PaidAt:         req.PaidAt,
+	}
+	if payment.AccountID, payment.ContractID, err = s.resolveAccount(req.AccountID, req.Login); err != nil {
+		return nil, false, err
+	}
+
+	comment := "payment " + req.Source
+	if req.ExternalRef != "" {
+		comment += " " + req.ExternalRef
+	}
+	booked, err := s.book(payment, comment)
+	if err != nil {
+		return nil, false, err
+	}
+	if booked == nil {
+		existing, err := s.existing(payment)
+		if err != nil {
+			return nil, false, err
+		}
+		return existing, true, nil
+	}
+
+	s.logger.Info("Payment booked",
+		zap.Int("payment_id", payment.ID),
+		zap.Int("account_id", payment.AccountID),
+		zap.String("source", payment.Source),
+		zap.String("external_ref", payment.ExternalRef),
+		zap.Stringer("amount", payment.Amount),
+		zap.Int("currency", payment.Currency))
+
+	s.retryUnpaid(payment.ContractID)
+	return payment, false, nil
+}
+
+// Refund returns amount of an incoming payment to the customer; several partial refunds
+// may follow each other up to the payment amount
+func (s *Service) Refund(paymentID int, amount models.Money, idempotencyKey, comment string) (*models.Payment, bool, error) {
+	if amount.Sign() <= 0 {
+		return nil, false, fmt.Errorf("%w: amount must be positive", ErrInvalidPayment)
+	}
+	if idempotencyKey == "" {
+		return nil, false, fmt.Errorf("%w: idempotency key required", ErrInvalidPayment)
+	}
+	return s.takeBack(paymentID, models.PaymentRefund, amount, idempotencyKey, comment)
+}
+
+// Reverse cancels an incoming payment: what is not refunded yet is debited and the payment
+// is marked reversed. Reversing the same payment again returns the recorded reversal.
+func (s *Service) Reverse(paymentID int, comment string) (*models.Payment, bool, error) {
+	return s.takeBack(paymentID, models.PaymentReversal, models.Money{}, fmt.Sprintf("reversal:%d", paymentID), comment)
+}
+
+// Get returns a payment
+func (s *Service) Get(paymentID int) (*models.Payment, error) {
+	payments, err := s.queryPayments(s.db.GetDB(), `WHERE p.id = $1`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	if len(payments) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrPaymentNotFound, paymentID)
+	}
+	return &payments[0], nil
+}
+
+// Payments returns payments, refunds and reversals matching the filter, newest first
+func (s *Service) Payments(filter Filter) ([]models.Payment, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 50
+	}
+	return s.queryPayments(s.db.GetDB(), `
+		WHERE ($1 = 0 OR p.account_id = $1) AND ($2 = 0 OR p.contract_id = $2) AND ($3 = '' OR p.source = $3)
+		ORDER BY p.id DESC LIMIT $4`, filter.AccountID, filter.ContractID, filter.Source, filter.Limit)
+}
+
+// takeBack books a refund or reversal of an incoming payment
+// amount is ignored for reversals, they take back the rest of the payment.
+func (s *Service) takeBack(paymentID int, kind string, amount models.Money, idempotencyKey, comment string) (*models.Payment, bool, error) {
+	original, err := s.Get(paymentID)
+	if err != nil {
+		return nil, false, err
+	}
+	if original.Kind != models.PaymentIncoming {
+		return nil, false, fmt.Errorf("%w: %d is a %s", ErrNotRefundable, paymentID, original.Kind)
+	}
+
+	back := &models.Payment{
+		Kind:           kind,
+		State:          models.PaymentPosted,
+		AccountID:      original.AccountID,
+		ContractID:     original.ContractID,
+		Amount:         amount,
+		Currency:       original.Currency,
+		Source:         original.Source,
+		IdempotencyKey: idempotencyKey,
+		OriginalID:     original.ID,
+		Comment:        comment,
+		PaidAt:         time.Now(),
+	}
+
+	if existing, err := s.existing(back); err == nil {
+		return existing, true, nil
+	} else if !errors.Is(err, ErrPaymentNotFound) {
+		return nil, false, err
+	}
+
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the original so concurrent refunds cannot exceed it
+	locked, err := s.queryPayments(tx, `WHERE p.id = $1 FOR UPDATE OF p`, paymentID)
+	if err != nil {
+		return nil, false, err
+	}
+	original = &locked[0]
+	rest := original.Amount.Sub(original.Refunded)
+	if original.State != models.PaymentPosted || rest.Sign() <= 0 {
+		return nil, false, fmt.Errorf("%w: %d is %s, refunded %s of %s", ErrNotRefundable,
+			paymentID, original.State, original.Refunded, original.Amount)
+	}
+	if kind == models.PaymentReversal {
+		back.Amount = rest
+	} else if back.Amount.Cmp(rest) > 0 {
+		return nil, false, fmt.Errorf("%w: %s exceeds the refundable %s", ErrNotRefundable, back.Amount, rest)
+	}
+
+	balance, transactionID, err := s.rates.DebitTx(tx, back.AccountID, back.Amount, back.Currency,
+		fmt.Sprintf("%s of payment %d", kind, original.ID))
+	if err != nil {
+		return nil, false, err
+	}
+	back.TransactionID = transactionID
+	back.Balance = balance
+
+	if inserted, err := insertPayment(tx, back); err != nil {
+		return nil, false, err
+	} else if !inserted {
+		// Booked concurrently under the same key
+		tx.Rollback()
+		existing, err := s.existing(back)
+		return existing, err == nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE payments SET refunded = refunded + $1,
+			state = CASE WHEN $2 THEN 'reversed' ELSE state END,
+			reversed_at = CASE WHEN $2 THEN NOW() ELSE reversed_at END
+		WHERE id = $3`, back.Amount, kind == models.PaymentReversal, original.ID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to update payment: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("failed to commit %s: %w", kind, err)
+	}
+
+	s.logger.Info("Payment taken back",
+		zap.String("kind", kind),
+		zap.Int("payment_id", back.ID),
+		zap.Int("original_id", original.ID),
+		zap.Int("account_id", back.AccountID),
+		zap.Stringer("amount", back.Amount))
+	return back, false, nil
+}
+
+// book credits the payment and records it in one transaction
+// Returns nil when a payment with the same key or reference is already booked.
+func (s *Service) book(payment *models.Payment, comment string) (*models.Payment, error) {
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if payment.Currency == 0 {
+		if err := tx.QueryRow(`SELECT currency_id FROM contracts WHERE id = $1`, payment.ContractID).Scan(&payment.Currency); err != nil {
+			return nil, fmt.Errorf("failed to fetch contract currency: %w", err)
+		}
+	}
+
+	balance, transactionID, err := s.rates.CreditTx(tx, payment.AccountID, payment.Amount, payment.Currency, comment)
+	if err != nil {
+		return nil, err
+	}
+	payment.TransactionID = transactionID
+	payment.Balance = balance
+
+	// The credit above waited for the contract lock, so a concurrent request with the same key
+	// is committed by now and the insert finds it
+	inserted, err := insertPayment(tx, payment)
+	if err != nil || !inserted {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit payment: %w", err)
+	}
+	return payment, nil
+}
+
+// existing returns the booked payment with the key (or source and reference) of payment,
+// ErrIdempotencyConflict when it is not the same payment
+func (s *Service) existing(payment *models.Payment) (*models.Payment, error) {
+	payments, err := s.queryPayments(s.db.GetDB(), `
+		WHERE p.idempotency_key = $1
+		OR (p.kind = 'payment' AND $2 = 'payment' AND $4 <> '' AND p.source = $3 AND p.external_ref = $4)
+		ORDER BY p.id LIMIT 1`,
+		payment.IdempotencyKey, payment.Kind, payment.Source, payment.ExternalRef)
+	if err != nil {
+		return nil, err
+	}
+	if len(payments) == 0 {
+		return nil, fmt.Errorf("%w: key %s", ErrPaymentNotFound, payment.IdempotencyKey)
+	}
+
+	found := &payments[0]
+	same := found.Kind == payment.Kind && found.AccountID == payment.AccountID &&
+		found.OriginalID == payment.OriginalID && found.Currency == payment.Currency
+	if payment.Kind != models.PaymentReversal {
+		// A reversal takes back whatever is left, its amount is not known in advance
+		same = same && found.Amount.Cmp(payment.Amount) == 0
+	}
+	if !same {
+		return nil, fmt.Errorf("%w: key %s is payment %d", ErrIdempotencyConflict, payment.IdempotencyKey, found.ID)
+	}
+	return found, nil
+}
+
+// retryUnpaid retries unpaid subscription charges of the contract's accounts
+// A failure does not undo the payment, it is only logged; the dunning loop retries later.
+func (s *Service) retryUnpaid(contractID int) {
+	if s.dunning == nil {
+		return
+	}
+
+	rows, err := s.db.GetDB().Query(`
+		SELECT d.account_id FROM dunning_cases d
+		JOIN accounts a ON a.id = d.account_id
+		WHERE a.contract_id = $1 AND d.closed_at IS NULL
+		ORDER BY d.opened_at`, contractID)
+	if err != nil {
+		s.logger.Error("Failed to fetch unpaid accounts", zap.Int("contract_id", contractID), zap.Error(err))
+		return
+	}
+	var accountIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			s.logger.Error("Failed to scan unpaid account", zap.Error(err))
+			break
+		}
+		accountIDs = append(accountIDs, id)
+	}
+	rows.Close()
+
+	for _, accountID := range accountIDs {
+		c, err := s.dunning.OnPayment(accountID)
+		if errors.Is(err, dunning.ErrNoOpenCase) {
+			continue
+		}
+		if err != nil {
+			s.logger.Error("Failed to retry unpaid charge after payment",
+				zap.Int("account_id", accountID),
+				zap.Error(err))
+			continue
+		}
+		s.logger.Info("Unpaid charge retried after payment",
+			zap.Int("account_id", accountID),
+			zap.String("state", c.State))
+	}
+}
+
+// resolveAccount returns the account and its contract by ID or login
+func (s *Service) resolveAccount(accountID int, login string) (int, int, error) {
+	if accountID == 0 && login == "" {
+		return 0, 0, fmt.Errorf("%w: account_id or login required", ErrInvalidPayment)
+	}
+
+	var contractID int
+	err := s.db.GetDB().QueryRow(`
+		SELECT id, contract_id FROM accounts
+		WHERE ($1 <> 0 AND id = $1) OR ($1 = 0 AND login = $2)`, accountID, login).Scan(&accountID, &contractID)
+	if err == sql.ErrNoRows && accountID == 0 {
+		return 0, 0, fmt.Errorf("%w: %s", billing.ErrAccountNotFound, login)
+	}
+	if err == sql.ErrNoRows {
+		return 0, 0, fmt.Errorf("%w: %d", billing.ErrAccountNotFound, accountID)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to fetch account: %w", err)
+	}
+	return accountID, contractID, nil
+}
+
+// insertPayment records a booked payment; false when its key or reference is already taken
+func insertPayment(tx *sql.Tx, p *models.Payment) (bool, error) {
+	var originalID interface{}
+	if p.OriginalID != 0 {
+		originalID = p.OriginalID
+	}
+
+	err := tx.QueryRow(`
+		INSERT INTO payments (kind, state, account_id, contract_id, amount, currency_id, source, external_ref,
+			idempotency_key, original_id, comment, transaction_id, balance_after, paid_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT DO NOTHING
+		RETURNING id, created_at`,
+		p.Kind, p.State, p.AccountID, p.ContractID, p.Amount, p.Currency, p.Source, p.ExternalRef,
+		p.IdempotencyKey, originalID, p.Comment, p.TransactionID, p.Balance, p.PaidAt,
+	).Scan(&p.ID, &p.CreatedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record payment: %w", err)
+	}
+	return true, nil
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (s *Service) queryPayments(q queryer, where string, args ...interface{}) ([]models.Payment, error) {
+	rows, err := q.Query(`
+		SELECT p.id, p.kind, p.state, p.account_id, p.contract_id, p.amount, p.currency_id, p.refunded,
+			p.source, p.external_ref, p.idempotency_key, COALESCE(p.original_id, 0), p.comment,
+			p.transaction_id, p.balance_after, p.paid_at, p.created_at, p.reversed_at
+		FROM payments p
+		`+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch payments: %w", err)
+	}
+	defer rows.Close()
+
+	payments := []models.Payment{}
+	for rows.Next() {
+		var p models.Payment
+		var reversedAt sql.NullTime
+		err := rows.Scan(&p.ID, &p.Kind, &p.State, &p.AccountID, &p.ContractID, &p.Amount, &p.Currency, &p.Refunded,
+			&p.Source, &p.ExternalRef, &p.IdempotencyKey, &p.OriginalID, &p.Comment,
+			&p.TransactionID, &p.Balance, &p.PaidAt, &p.CreatedAt, &reversedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan payment: %w", err)
+		}
+		if reversedAt.Valid {
+			p.ReversedAt = &reversedAt.Time
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
@@ -0,0 +1,332 @@
+package planchange
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/billing"
+	"isp-billing/internal/services/session"
+)
+
+// ErrChangeNotFound is returned for unknown plan change IDs
+var ErrChangeNotFound = errors.New("plan change not found")
+
+// ErrAlreadyScheduled is returned when the account already has a scheduled plan change
+var ErrAlreadyScheduled = errors.New("account already has a scheduled plan change")
+
+// Service moves accounts between plans, now or at the start of the next billing period
+// Money and the account row are changed by billing.SubscriptionService.ChangePlan in one
+// transaction; this service refreshes running sessions and applies scheduled changes.
+type Service struct {
+	db            *database.PostgreSQL
+	subscriptions *billing.SubscriptionService
+	sessions      *session.Service
+	logger        *zap.Logger
+	config        Config
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Config holds plan change settings
+type Config struct {
+	CheckInterval time.Duration `yaml:"check_interval"` // How often scheduled changes are applied
+}
+
+// Request is a plan change request
+type Request struct {
+	AccountID int                    `json:"account_id"`
+	PlanID    int                    `json:"plan_id" binding:"required"`
+	PlanData  map[string]interface{} `json:"plan_data,omitempty"` // Overrides plans.settings of the new plan
+	NextCycle bool                   `json:"next_cycle"`          // Schedule for the start of the next billing period
+}
+
+// New creates a new plan change service
+func New(db *database.PostgreSQL, subscriptions *billing.SubscriptionService, sessions *session.Service, logger *zap.Logger, config Config) *Service {
+	if config.CheckInterval == 0 {
+		config.CheckInterval = 5 * time.Minute
+	}
+
+	return &Service{
+		db:            db,
+		subscriptions: subscriptions,
+		sessions:      sessions,
+		logger:        logger,
+		config:        config,
+		stopChan:      make(chan struct{}),
+	}
+}
+
+// Start applies scheduled plan changes in background
+func (s *Service) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.config.CheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.ApplyDue(time.Now()); err != nil {
+					s.logger.Error("Failed to apply scheduled plan changes", zap.Error(err))
+				}
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background task
+func (s *Service) Stop() {
+	close(s.stopChan)
+	s.wg.Wait()
+}
+
+// Change moves the account to another plan now, or schedules it with req.NextCycle
+func (s *Service) Change(req Request) (*models.PlanChange, error) {
+	if req.NextCycle {
+		return s.schedule(req)
+	}
+
+	change := &models.PlanChange{
+		AccountID:   req.AccountID,
+		ToPlanID:    req.PlanID,
+		PlanData:    req.PlanData,
+		EffectiveAt: time.Now(),
+	}
+	if err := s.apply(change); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// ApplyDue applies scheduled changes whose effective time has come
+// A change that cannot be applied is marked failed with the error.
+func (s *Service) ApplyDue(now time.Time) (int, error) {
+	changes, err := s.queryChanges(`WHERE state = 'scheduled' AND effective_at <= $1 ORDER BY effective_at, id`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for i := range changes {
+		change := &changes[i]
+		err := s.apply(change)
+		if errors.Is(err, billing.ErrPlanChangeNotScheduled) {
+			continue // Cancelled meanwhile
+		}
+		if err != nil {
+			s.logger.Error("Failed to apply scheduled plan change",
+				zap.Int("change_id", change.ID),
+				zap.Int("account_id", change.AccountID),
+				zap.Error(err))
+			s.fail(change.ID, err)
+			continue
+		}
+		applied++
+	}
+
+	return applied, nil
+}
+
+// Cancel cancels a scheduled plan change
+func (s *Service) Cancel(changeID int) (*models.PlanChange, error) {
+	res, err := s.db.GetDB().Exec(`UPDATE plan_changes SET state = 'cancelled' WHERE id = $1 AND state = 'scheduled'`, changeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel plan change: %w", err)
+	}
+
+	change, err := s.Get(changeID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("%w: %s", billing.ErrPlanChangeNotScheduled, change.State)
+	}
+	return change, nil
+}
+
+// Get returns a plan change
+func (s *Service) Get(changeID int) (*models.PlanChange, error) {
+	changes, err := s.queryChanges(`WHERE id = $1`, changeID)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrChangeNotFound, changeID)
+	}
+	return &changes[0], nil
+}
+
+// AccountChanges returns plan changes of the account, newest first
+func (s *Service) AccountChanges(accountID, limit int) ([]models.PlanChange, error) {
+	return s.queryChanges(`WHERE account_id = $1 ORDER BY id DESC LIMIT $2`, accountID, limit)
+}
+
+// schedule records a change for the start of the account's next billing period
+func (s *Service) schedule(req Request) (*models.PlanChange, error) {
+	_, periodEnd, err := s.subscriptions.CurrentPeriod(req.AccountID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var fromPlanID int
+	if err := s.db.GetDB().QueryRow(`SELECT plan_id FROM accounts WHERE id = $1`, req.AccountID).Scan(&fromPlanID); err != nil {
+		return nil, fmt.Errorf("failed to fetch account plan: %w", err)
+	}
+	if err := s.db.GetDB().QueryRow(`SELECT 1 FROM plans WHERE id = $1`, req.PlanID).Scan(new(int)); err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", billing.ErrPlanNotFound, req.PlanID)
+	}
+
+	planData := ""
+	if req.PlanData != nil {
+		if _, err := models.ParsePlanSettings(req.PlanData); err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(req.PlanData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal plan data: %w", err)
+		}
+		planData = string(data)
+	}
+
+	change := &models.PlanChange{
+		AccountID:   req.AccountID,
+		FromPlanID:  fromPlanID,
+		ToPlanID:    req.PlanID,
+		PlanData:    req.PlanData,
+		State:       models.PlanChangeScheduled,
+		EffectiveAt: periodEnd.Add(time.Second),
+	}
+	err = s.db.GetDB().QueryRow(`
+		INSERT INTO plan_changes (account_id, from_plan_id, to_plan_id, plan_data, state, effective_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT DO NOTHING
+		RETURNING id, created_at`,
+		change.AccountID, change.FromPlanID, change.ToPlanID, planData, change.State, change.EffectiveAt,
+	).Scan(&change.ID, &change.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: account %d", ErrAlreadyScheduled, req.AccountID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to schedule plan change: %w", err)
+	}
+
+	s.logger.Info("Plan change scheduled",
+		zap.Int("change_id", change.ID),
+		zap.Int("account_id", change.AccountID),
+		zap.Int("to_plan_id", change.ToPlanID),
+		zap.Time("effective_at", change.EffectiveAt))
+	return change, nil
+}
+
+// apply changes the plan and refreshes the running sessions of the account
+func (s *Service) apply(change *models.PlanChange) error {
+	planData, err := s.subscriptions.ChangePlan(change)
+	if err != nil {
+		return err
+	}
+
+	if s.sessions == nil {
+		return nil
+	}
+	// Running sessions go on accounting with the new plan's algorithms
+	var authAlgo, acctAlgo string
+	err = s.db.GetDB().QueryRow(`SELECT auth_algo, acct_algo FROM plans WHERE id = $1`, change.ToPlanID).
+		Scan(&authAlgo, &acctAlgo)
+	if err != nil {
+		s.logger.Warn("Failed to load plan algorithms, sessions pick the plan up on next authorization",
+			zap.Int("account_id", change.AccountID),
+			zap.Int("plan_id", change.ToPlanID),
+			zap.Error(err))
+		return nil
+	}
+	updated, err := s.sessions.UpdateAccountSessions(change.AccountID, func(sess *models.IPTrafficSession) error {
+		sess.PlanID = change.ToPlanID
+		sess.AuthAlgo = authAlgo
+		sess.AcctAlgo = acctAlgo
+		sess.UpdatePlanData(models.CarryPlanData(sess.PlanData, planData))
+		if settings, err := models.ParsePlanSettings(sess.PlanData); err == nil {
+			if shaper := settings.ShaperAt(time.Now()); shaper != "" {
+				s.sessions.ChangeShaper(sess, shaper)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// The plan is changed in the DB, sessions pick it up on next authorization
+		s.logger.Warn("Failed to refresh sessions after plan change",
+			zap.Int("account_id", change.AccountID),
+			zap.Error(err))
+		return nil
+	}
+
+	s.logger.Debug("Sessions refreshed after plan change",
+		zap.Int("account_id", change.AccountID),
+		zap.Int("sessions", updated))
+	return nil
+}
+
+func (s *Service) fail(changeID int, cause error) {
+	reason := cause.Error()
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	_, err := s.db.GetDB().Exec(`UPDATE plan_changes SET state = 'failed', error = $1 WHERE id = $2 AND state = 'scheduled'`,
+		reason, changeID)
+	if err != nil {
+		s.logger.Error("Failed to mark plan change failed", zap.Int("change_id", changeID), zap.Error(err))
+	}
+}
+
+func (s *Service) queryChanges(where string, args ...interface{}) ([]models.PlanChange, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT id, account_id, from_plan_id, to_plan_id, plan_data, state, effective_at, created_at,
+			applied_at, credit, COALESCE(credit_currency, 0), charge, COALESCE(charge_currency, 0), charge_id,
+			COALESCE((SELECT status FROM subscription_charges sc WHERE sc.id = charge_id), ''), error
+		FROM plan_changes
+		`+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch plan changes: %w", err)
+	}
+	defer rows.Close()
+
+	changes := []models.PlanChange{}
+	for rows.Next() {
+		var c models.PlanChange
+		var planData string
+		var appliedAt sql.NullTime
+		var chargeID sql.NullInt64
+		err := rows.Scan(&c.ID, &c.AccountID, &c.FromPlanID, &c.ToPlanID, &planData, &c.State, &c.EffectiveAt,
+			&c.CreatedAt, &appliedAt, &c.Credit, &c.CreditCurrency, &c.Charge, &c.ChargeCurrency, &chargeID,
+			&c.ChargeStatus, &c.Error)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan plan change: %w", err)
+		}
+		if planData != "" {
+			if c.PlanData, err = database.ParsePlanDataFromJSON(planData); err != nil {
+				return nil, fmt.Errorf("failed to parse plan data of change %d: %w", c.ID, err)
+			}
+		}
+		if appliedAt.Valid {
+			c.AppliedAt = &appliedAt.Time
+		}
+		if chargeID.Valid {
+			id := int(chargeID.Int64)
+			c.ChargeID = &id
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,471 @@
+package promised
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/currency"
+	"isp-billing/internal/services/dunning"
+	"isp-billing/internal/services/session"
+)
+
+// ErrPromisedNotFound is returned for unknown promised payment IDs
+var ErrPromisedNotFound = errors.New("promised payment not found")
+
+// ErrAccountNotFound is returned when the account does not exist
+var ErrAccountNotFound = errors.New("account not found")
+
+// ErrInvalidRequest is returned for amounts and terms outside the configured limits
+var ErrInvalidRequest = errors.New("invalid promised payment request")
+
+// ErrNotAllowed is returned when the account cannot take a promised payment now: one is
+// active already or the limit of the period is used up
+var ErrNotAllowed = errors.New("promised payment not allowed")
+
+// ErrNotActive is returned when an expired or cancelled promised payment is cancelled
+var ErrNotActive = errors.New("promised payment is not active")
+
+// Service grants promised payments: temporary credits that keep a subscriber with an empty
+// balance online until payday
+// The amount is added to service_params.credit, which authorization and the balance check of
+// sessions already count with the balance. When the term ends the amount is taken back and
+// active sessions of the account are checked against the balance that is left.
+type Service struct {
+	db       *database.PostgreSQL
+	rates    *currency.Service
+	sessions *session.Service
+	dunning  *dunning.Service
+	logger   *zap.Logger
+	config   Config
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Config holds promised payment limits
+type Config struct {
+	MaxAmount     models.Money  `yaml:"max_amount"`     // Per promised payment
+	Currency      int           `yaml:"currency"`       // Currency of MaxAmount, 0 - contract currency
+	MaxDays       int           `yaml:"max_days"`       // Longest term, also the default, default 3
+	Period        time.Duration `yaml:"period"`         // Window of the PerPeriod limit, default 30 days
+	PerPeriod     int           `yaml:"per_period"`     // Promised payments per Period, default 1
+	CheckInterval time.Duration `yaml:"check_interval"` // How often expired credits are taken back
+}
+
+// Offer tells whether the account can take a promised payment now and how much
+type Offer struct {
+	AccountID   int                     `json:"account_id"`
+	Allowed     bool                    `json:"allowed"`
+	Reason      string                  `json:"reason,omitempty"`
+	MaxAmount   models.Money            `json:"max_amount"` // In the contract currency
+	Currency    int                     `json:"currency"`
+	MaxDays     int                     `json:"max_days"`
+	AvailableAt *time.Time              `json:"available_at,omitempty"` // When the period limit frees up
+	Active      *models.PromisedPayment `json:"active,omitempty"`
+}
+
+// account is the account a promised payment is granted to
+type account struct {
+	id         int
+	login      string
+	contractID int
+	currency   int
+}
+
+// New creates a new promised payment service
+// dunning may be nil; otherwise an unpaid subscription charge is retried with the new credit,
+// which lifts throttling and suspension like a payment does.
+func New(db *database.PostgreSQL, rates *currency.Service, sessions *session.Service, dunningService *dunning.Service, logger *zap.Logger, config Config) *Service {
+	if config.MaxDays == 0 {
+		config.MaxDays = 3
+	}
+	if config.Period == 0 {
+		config.Period = 30 * 24 * time.Hour
+	}
+	if config.PerPeriod == 0 {
+		config.PerPeriod = 1
+	}
+	if config.CheckInterval == 0 {
+		config.CheckInterval = 5 * time.Minute
+	}
+
+	return &Service{
+		db:       db,
+		rates:    rates,
+		sessions: sessions,
+		dunning:  dunningService,
+		logger:   logger,
+		config:   config,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Start takes back expired credits in background
+func (s *Service) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.config.CheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.Expire(time.Now()); err != nil {
+					s.logger.Error("Promised payment expiry failed", zap.Error(err))
+				}
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background task
+func (s *Service) Stop() {
+	close(s.stopChan)
+	s.wg.Wait()
+}
+
+// Offer returns what the account can take now
+func (s *Service) Offer(accountID int) (*Offer, error) {
+	acc, err := s.fetchAccount(s.db.GetDB(), accountID, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.offer(s.db.GetDB(), acc, time.Now())
+}
+
+// Grant adds a promised payment to the credit of the account
+// A zero amount takes the maximum, zero days the longest term.
+func (s *Service) Grant(accountID int, amount models.Money, days int) (*models.PromisedPayment, error) {
+	if amount.Sign() < 0 {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidRequest)
+	}
+	if days < 0 || days > s.config.MaxDays {
+		return nil, fmt.Errorf("%w: term must be 1..%d days", ErrInvalidRequest, s.config.MaxDays)
+	}
+	if days == 0 {
+		days = s.config.MaxDays
+	}
+
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The account lock serializes grants, so two requests cannot both pass the limits
+	acc, err := s.fetchAccount(tx, accountID, true)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	offer, err := s.offer(tx, acc, now)
+	if err != nil {
+		return nil, err
+	}
+	if !offer.Allowed {
+		return nil, fmt.Errorf("%w: %s", ErrNotAllowed, offer.Reason)
+	}
+	if amount.IsZero() {
+		amount = offer.MaxAmount
+	}
+	if amount.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: no amount is available", ErrNotAllowed)
+	}
+	if amount.Cmp(offer.MaxAmount) > 0 {
+		return nil, fmt.Errorf("%w: %s exceeds the limit %s", ErrInvalidRequest, amount, offer.MaxAmount)
+	}
+
+	p := &models.PromisedPayment{
+		AccountID:  acc.id,
+		Login:      acc.login,
+		ContractID: acc.contractID,
+		Amount:     amount,
+		Currency:   acc.currency,
+		State:      models.PromisedActive,
+		GrantedAt:  now,
+		ExpiresAt:  now.AddDate(0, 0, days),
+	}
+	if err := addCredit(tx, acc.id, amount); err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(`
+		INSERT INTO promised_payments (account_id, amount, currency_id, state, granted_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		p.AccountID, p.Amount, p.Currency, p.State, p.GrantedAt, p.ExpiresAt).Scan(&p.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record promised payment: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit promised payment: %w", err)
+	}
+
+	s.logger.Info("Promised payment granted",
+		zap.Int("promised_id", p.ID),
+		zap.Int("account_id", p.AccountID),
+		zap.Stringer("amount", p.Amount),
+		zap.Time("expires_at", p.ExpiresAt))
+
+	if s.dunning != nil {
+		if _, err := s.dunning.OnPayment(acc.id); err != nil && !errors.Is(err, dunning.ErrNoOpenCase) {
+			s.logger.Error("Failed to retry unpaid charge with promised payment",
+				zap.Int("account_id", acc.id), zap.Error(err))
+		}
+	}
+
+	return p, nil
+}
+
+// Cancel takes the credit of an active promised payment back before its term
+func (s *Service) Cancel(id int, reason string) (*models.PromisedPayment, error) {
+	if reason == "" {
+		reason = "cancelled by operator"
+	}
+	return s.close(id, models.PromisedCancelled, reason, time.Now())
+}
+
+// Expire takes back the credits whose term ended by now
+// Returns how many promised payments expired.
+func (s *Service) Expire(now time.Time) (int, error) {
+	due, err := s.query(s.db.GetDB(), `WHERE p.state = 'active' AND p.expires_at <= $1 ORDER BY p.expires_at`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, p := range due {
+		if _, err := s.close(p.ID, models.PromisedExpired, "term ended", now); err != nil {
+			if !errors.Is(err, ErrNotActive) {
+				s.logger.Error("Failed to expire promised payment", zap.Int("promised_id", p.ID), zap.Error(err))
+			}
+			continue
+		}
+		expired++
+	}
+
+	if expired > 0 {
+		s.logger.Info("Promised payments expired", zap.Int("count", expired))
+	}
+	return expired, nil
+}
+
+// Get returns a promised payment
+func (s *Service) Get(id int) (*models.PromisedPayment, error) {
+	list, err := s.query(s.db.GetDB(), `WHERE p.id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrPromisedNotFound, id)
+	}
+	return &list[0], nil
+}
+
+// AccountPromised returns the promised payments of the account, newest first
+func (s *Service) AccountPromised(accountID int, limit int) ([]models.PromisedPayment, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	return s.query(s.db.GetDB(), `WHERE p.account_id = $1 ORDER BY p.id DESC LIMIT $2`, accountID, limit)
+}
+
+// Active returns the active promised payments, soonest expiry first
+func (s *Service) Active() ([]models.PromisedPayment, error) {
+	return s.query(s.db.GetDB(), `WHERE p.state = 'active' ORDER BY p.expires_at`)
+}
+
+// close takes the credit back and re-evaluates active sessions of the account with what is left
+func (s *Service) close(id int, state, reason string, now time.Time) (*models.PromisedPayment, error) {
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	list, err := s.query(tx, `WHERE p.id = $1 FOR UPDATE OF p`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrPromisedNotFound, id)
+	}
+	p := &list[0]
+	if p.State != models.PromisedActive {
+		return nil, fmt.Errorf("%w: %d is %s", ErrNotActive, id, p.State)
+	}
+
+	_, err = tx.Exec(`UPDATE service_params SET credit = GREATEST(credit - $1, 0) WHERE account_id = $2`,
+		p.Amount, p.AccountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take back credit: %w", err)
+	}
+	_, err = tx.Exec(`UPDATE promised_payments SET state = $1, closed_at = $2, close_reason = $3 WHERE id = $4`,
+		state, now, reason, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to close promised payment: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit promised payment: %w", err)
+	}
+	p.State = state
+	p.ClosedAt = &now
+	p.CloseReason = reason
+
+	disconnected := 0
+	if s.sessions != nil {
+		var balance, credit models.Money
+		err := s.db.GetDB().QueryRow(`
+			SELECT c.balance, COALESCE(sp.credit, 0.0)
+			FROM accounts a
+			JOIN contracts c ON c.id = a.contract_id
+			LEFT OUTER JOIN service_params sp ON a.id = sp.account_id
+			WHERE a.id = $1`, p.AccountID).Scan(&balance, &credit)
+		if err != nil {
+			s.logger.Error("Failed to fetch balance after promised payment",
+				zap.Int("account_id", p.AccountID), zap.Error(err))
+		} else {
+			disconnected = s.sessions.RecheckBalance(p.AccountID, balance.Add(credit))
+		}
+	}
+
+	s.logger.Info("Promised payment closed",
+		zap.Int("promised_id", p.ID),
+		zap.Int("account_id", p.AccountID),
+		zap.String("state", state),
+		zap.String("reason", reason),
+		zap.Int("disconnected", disconnected))
+	return p, nil
+}
+
+// offer checks the limits for the account at now
+func (s *Service) offer(q queryer, acc *account, now time.Time) (*Offer, error) {
+	offer := &Offer{
+		AccountID: acc.id,
+		MaxAmount: s.config.MaxAmount,
+		Currency:  acc.currency,
+		MaxDays:   s.config.MaxDays,
+	}
+	if s.config.Currency != 0 && s.config.Currency != acc.currency {
+		converted, err := s.rates.Convert(s.config.MaxAmount, s.config.Currency, acc.currency)
+		if err != nil {
+			return nil, err
+		}
+		offer.MaxAmount = converted
+	}
+
+	active, err := s.query(q, `WHERE p.account_id = $1 AND p.state = 'active'`, acc.id)
+	if err != nil {
+		return nil, err
+	}
+	if len(active) > 0 {
+		offer.Active = &active[0]
+		offer.Reason = fmt.Sprintf("promised payment %d is active until %s",
+			active[0].ID, active[0].ExpiresAt.Format("2006-01-02 15:04"))
+		return offer, nil
+	}
+
+	// Cancelled promised payments do not count against the limit
+	var count int
+	var oldest sql.NullTime
+	err = q.QueryRow(`
+		SELECT COUNT(*), MIN(granted_at) FROM promised_payments
+		WHERE account_id = $1 AND state <> 'cancelled' AND granted_at > $2`,
+		acc.id, now.Add(-s.config.Period)).Scan(&count, &oldest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count promised payments: %w", err)
+	}
+	if count >= s.config.PerPeriod {
+		availableAt := oldest.Time.Add(s.config.Period)
+		offer.AvailableAt = &availableAt
+		offer.Reason = fmt.Sprintf("limit of %d per %s is used", s.config.PerPeriod, s.config.Period)
+		return offer, nil
+	}
+
+	offer.Allowed = offer.MaxAmount.Sign() > 0
+	if !offer.Allowed {
+		offer.Reason = "promised payments are disabled"
+	}
+	return offer, nil
+}
+
+// fetchAccount returns the account with its contract, locking the account row when lock is set
+func (s *Service) fetchAccount(q queryer, accountID int, lock bool) (*account, error) {
+	query := `
+		SELECT a.id, a.login, a.contract_id, c.currency_id
+		FROM accounts a JOIN contracts c ON c.id = a.contract_id
+		WHERE a.id = $1`
+	if lock {
+		query += ` FOR UPDATE OF a`
+	}
+
+	acc := &account{}
+	err := q.QueryRow(query, accountID).Scan(&acc.id, &acc.login, &acc.contractID, &acc.currency)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrAccountNotFound, accountID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch account: %w", err)
+	}
+	return acc, nil
+}
+
+// addCredit adds amount to service_params.credit, creating the row for accounts without one
+// The caller holds the account lock.
+func addCredit(tx *sql.Tx, accountID int, amount models.Money) error {
+	res, err := tx.Exec(`UPDATE service_params SET credit = COALESCE(credit, 0) + $1 WHERE account_id = $2`, amount, accountID)
+	if err != nil {
+		return fmt.Errorf("failed to add credit: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	if _, err := tx.Exec(`INSERT INTO service_params (account_id, credit) VALUES ($1, $2)`, accountID, amount); err != nil {
+		return fmt.Errorf("failed to add credit: %w", err)
+	}
+	return nil
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *Service) query(q queryer, where string, args ...interface{}) ([]models.PromisedPayment, error) {
+	rows, err := q.Query(`
+		SELECT p.id, p.account_id, a.login, a.contract_id, p.amount, p.currency_id, p.state,
+			p.granted_at, p.expires_at, p.closed_at, p.close_reason
+		FROM promised_payments p
+		JOIN accounts a ON a.id = p.account_id
+		`+where, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch promised payments: %w", err)
+	}
+	defer rows.Close()
+
+	var list []models.PromisedPayment
+	for rows.Next() {
+		var p models.PromisedPayment
+		var closedAt sql.NullTime
+		err := rows.Scan(&p.ID, &p.AccountID, &p.Login, &p.ContractID, &p.Amount, &p.Currency, &p.State,
+			&p.GrantedAt, &p.ExpiresAt, &closedAt, &p.CloseReason)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan promised payment: %w", err)
+		}
+		if closedAt.Valid {
+			p.ClosedAt = &closedAt.Time
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,417 @@
+package quota
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/currency"
+	"isp-billing/internal/services/session"
+)
+
+// ErrUnknownPack is returned when a top-up references a pack that is not configured
+var ErrUnknownPack = errors.New("unknown top-up pack")
+
+// ErrNoQuota is returned when the account plan has no QUOTA
+var ErrNoQuota = errors.New("plan has no volume quota")
+
+// ErrAccountNotFound is returned for unknown account IDs
+var ErrAccountNotFound = errors.New("account not found")
+
+// ErrIdempotencyConflict is returned when a top-up idempotency key is reused for another top-up
+var ErrIdempotencyConflict = errors.New("idempotency key reused with a different top-up")
+
+// Service manages volume quotas: usage, top-up packs and cycle resets
+// Counting and throttling happen in the quota_auth billing algorithm.
+type Service struct {
+	db       *database.PostgreSQL
+	sessions *session.Service
+	rates    *currency.Service
+	logger   *zap.Logger
+	config   Config
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Config holds quota settings
+type Config struct {
+	ResetInterval time.Duration `yaml:"reset_interval"` // How often finished cycles are looked for
+	Packs         []Pack        `yaml:"packs"`          // Top-up packs for sale
+}
+
+// Pack is an add-on volume for the current cycle
+type Pack struct {
+	Name     string       `yaml:"name" json:"name"`
+	Class    string       `yaml:"class" json:"class"` // Quota class, "all" for any traffic
+	Bytes    float64      `yaml:"bytes" json:"bytes"`
+	Price    models.Money `yaml:"price" json:"price"`
+	Currency int          `yaml:"currency" json:"currency"` // 0 - contract currency
+}
+
+// TopUpRequest adds a configured pack or, without a pack, a free grant of Bytes to Class
+type TopUpRequest struct {
+	Pack           string  `json:"pack"`
+	Class          string  `json:"class"`
+	Bytes          float64 `json:"bytes"`
+	IdempotencyKey string  `json:"idempotency_key"` // A retry with the same key is not applied twice
+}
+
+// Status is the quota usage of an account
+type Status struct {
+	AccountID  int                       `json:"account_id"`
+	CycleStart string                    `json:"cycle_start"`
+	Exceeded   bool                      `json:"exceeded"`
+	FUPShaper  string                    `json:"fup_shaper,omitempty"`
+	Classes    []models.QuotaClassStatus `json:"classes"`
+}
+
+// New creates a new quota service
+func New(db *database.PostgreSQL, sessions *session.Service, rates *currency.Service, logger *zap.Logger, config Config) *Service {
+	if config.ResetInterval == 0 {
+		config.ResetInterval = time.Hour
+	}
+
+	return &Service{
+		db:       db,
+		sessions: sessions,
+		rates:    rates,
+		logger:   logger,
+		config:   config,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Start runs the cycle reset task in background
+func (s *Service) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.config.ResetInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.ResetCycles(time.Now()); err != nil {
+					s.logger.Error("Quota cycle reset failed", zap.Error(err))
+				}
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background task
+func (s *Service) Stop() {
+	close(s.stopChan)
+	s.wg.Wait()
+}
+
+// Packs returns configured top-up packs
+func (s *Service) Packs() []Pack {
+	return s.config.Packs
+}
+
+// Status returns quota usage of the account, from its running session when there is one
+func (s *Service) Status(accountID int) (*Status, error) {
+	planData, ok := s.sessions.AccountPlanData(accountID)
+	if !ok {
+		var err error
+		if planData, err = s.fetchPlanData(s.db.GetDB(), accountID, false); err != nil {
+			return nil, err
+		}
+	}
+
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return nil, err
+	}
+	if !settings.HasQuota() {
+		return nil, ErrNoQuota
+	}
+
+	status := &Status{
+		AccountID:  accountID,
+		CycleStart: settings.QuotaCycleStart,
+		FUPShaper:  settings.FUPShaper,
+	}
+
+	// Counters of a finished cycle no longer apply
+	if settings.QuotaCycleExpired(time.Now()) {
+		if settings, err = models.ParsePlanSettings(models.ResetQuotaCycle(planData, time.Now(), settings.QuotaResetDay)); err != nil {
+			return nil, err
+		}
+		status.CycleStart = settings.QuotaCycleStart
+	}
+
+	status.Classes = settings.QuotaStatus()
+	status.Exceeded = settings.QuotaExceeded()
+	return status, nil
+}
+
+// TopUp adds volume to the current cycle, debiting the pack price
+// Running sessions get the volume immediately and full speed back through CoA. A request
+// repeating the idempotency key of a done top-up changes nothing and returns duplicate set;
+// with another account, pack or volume it fails with ErrIdempotencyConflict.
+func (s *Service) TopUp(accountID int, req TopUpRequest) (status *Status, duplicate bool, err error) {
+	class, bytes := req.Class, req.Bytes
+	var pack *Pack
+	if req.Pack != "" {
+		for i := range s.config.Packs {
+			if s.config.Packs[i].Name == req.Pack {
+				pack = &s.config.Packs[i]
+			}
+		}
+		if pack == nil {
+			return nil, false, fmt.Errorf("%w: %s", ErrUnknownPack, req.Pack)
+		}
+		class, bytes = pack.Class, pack.Bytes
+	}
+	if class == "" || bytes <= 0 {
+		return nil, false, fmt.Errorf("class and positive bytes are required")
+	}
+
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The account row lock taken here serializes retries of the same top-up
+	planData, err := s.fetchPlanData(tx, accountID, true)
+	if err != nil {
+		return nil, false, err
+	}
+	if req.IdempotencyKey != "" {
+		done, err := s.doneTopUp(tx, req.IdempotencyKey, accountID, req.Pack, class, bytes)
+		if err != nil {
+			return nil, false, err
+		}
+		if done {
+			tx.Rollback()
+			status, err := s.Status(accountID)
+			return status, true, err
+		}
+	}
+
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, ok := settings.Quota[class]; !ok {
+		return nil, false, fmt.Errorf("%w for class %q", ErrNoQuota, class)
+	}
+
+	if err := s.savePlanData(tx, accountID, models.AddQuotaVolume(planData, models.QuotaTopUpKey, class, bytes)); err != nil {
+		return nil, false, err
+	}
+
+	// The price is debited in the same transaction, so the volume and the charge commit together
+	var transactionID interface{}
+	if pack != nil && pack.Price.Sign() > 0 {
+		comment := fmt.Sprintf("Quota top-up %s", pack.Name)
+		_, id, err := s.rates.DebitTx(tx, accountID, pack.Price, pack.Currency, comment)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to charge top-up: %w", err)
+		}
+		transactionID = id
+	}
+
+	var key interface{}
+	if req.IdempotencyKey != "" {
+		key = req.IdempotencyKey
+	}
+	_, err = tx.Exec(`
+		INSERT INTO quota_topups (account_id, idempotency_key, pack, class, bytes, transaction_id)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		accountID, key, req.Pack, class, bytes, transactionID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to record top-up: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("failed to commit top-up: %w", err)
+	}
+
+	s.logger.Info("Quota topped up",
+		zap.Int("account_id", accountID),
+		zap.String("pack", req.Pack),
+		zap.String("class", class),
+		zap.Float64("bytes", bytes))
+
+	// The top-up is committed: a failure here must not make the client retry and pay again.
+	// Sessions left behind pick the volume up at the next authorization.
+	_, err = s.sessions.UpdateAccountSessions(accountID, func(sess *models.IPTrafficSession) error {
+		sess.UpdatePlanData(models.AddQuotaVolume(sess.PlanData, models.QuotaTopUpKey, class, bytes))
+		s.restoreShaper(sess)
+		return nil
+	})
+	if err != nil {
+		s.logger.Error("Failed to apply top-up to running sessions",
+			zap.Int("account_id", accountID),
+			zap.Error(err))
+	}
+
+	status, err = s.Status(accountID)
+	if err != nil {
+		s.logger.Error("Failed to read quota after top-up", zap.Int("account_id", accountID), zap.Error(err))
+	}
+	return status, false, nil
+}
+
+// doneTopUp reports whether the top-up with key is already recorded,
+// ErrIdempotencyConflict when the key belongs to another top-up
+func (s *Service) doneTopUp(tx *sql.Tx, key string, accountID int, pack, class string, bytes float64) (bool, error) {
+	var foundAccount int
+	var foundPack, foundClass string
+	var foundBytes float64
+	err := tx.QueryRow(`
+		SELECT account_id, pack, class, bytes FROM quota_topups WHERE idempotency_key = $1`, key,
+	).Scan(&foundAccount, &foundPack, &foundClass, &foundBytes)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check top-up key: %w", err)
+	}
+	if foundAccount != accountID || foundPack != pack || foundClass != class || foundBytes != bytes {
+		return false, fmt.Errorf("%w: key %s", ErrIdempotencyConflict, key)
+	}
+	return true, nil
+}
+
+// ResetCycles starts a new cycle for accounts whose quota cycle has finished
+func (s *Service) ResetCycles(now time.Time) (int, error) {
+	rows, err := s.db.GetDB().Query(`SELECT id, plan_data FROM accounts WHERE active AND plan_data LIKE '%"QUOTA"%'`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch quota accounts: %w", err)
+	}
+
+	var due []int
+	for rows.Next() {
+		var id int
+		var planDataJSON string
+		if err := rows.Scan(&id, &planDataJSON); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan account: %w", err)
+		}
+		planData, err := database.ParsePlanDataFromJSON(planDataJSON)
+		if err != nil {
+			continue
+		}
+		if settings, err := models.ParsePlanSettings(planData); err == nil && settings.HasQuota() && settings.QuotaCycleExpired(now) {
+			due = append(due, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	reset := 0
+	for _, accountID := range due {
+		if err := s.resetAccount(accountID, now); err != nil {
+			s.logger.Error("Failed to reset quota cycle", zap.Int("account_id", accountID), zap.Error(err))
+			continue
+		}
+		reset++
+	}
+
+	if reset > 0 {
+		s.logger.Info("Quota cycles reset", zap.Int("accounts", reset))
+	}
+	return reset, nil
+}
+
+func (s *Service) resetAccount(accountID int, now time.Time) error {
+	tx, err := s.db.GetDB().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	planData, err := s.fetchPlanData(tx, accountID, true)
+	if err != nil {
+		return err
+	}
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return err
+	}
+	if !settings.QuotaCycleExpired(now) {
+		return nil // Reset by accounting meanwhile
+	}
+
+	if err := s.savePlanData(tx, accountID, models.ResetQuotaCycle(planData, now, settings.QuotaResetDay)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit reset: %w", err)
+	}
+
+	_, err = s.sessions.UpdateAccountSessions(accountID, func(sess *models.IPTrafficSession) error {
+		current, err := models.ParsePlanSettings(sess.PlanData)
+		if err != nil || !current.QuotaCycleExpired(now) {
+			return nil
+		}
+		sess.UpdatePlanData(models.ResetQuotaCycle(sess.PlanData, now, current.QuotaResetDay))
+		s.restoreShaper(sess)
+		return nil
+	})
+	return err
+}
+
+// restoreShaper switches a throttled session back to the plan shaper when quota is available again
+func (s *Service) restoreShaper(sess *models.IPTrafficSession) {
+	settings, err := models.ParsePlanSettings(sess.PlanData)
+	if err != nil || settings.FUPShaper == "" || sess.Shaper != settings.FUPShaper || settings.QuotaExceeded() {
+		return
+	}
+
+	if _, shaper := settings.CheckAccessAt(time.Now()); shaper != "" {
+		s.sessions.ChangeShaper(sess, shaper)
+	}
+}
+
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *Service) fetchPlanData(q queryer, accountID int, forUpdate bool) (map[string]interface{}, error) {
+	query := `SELECT plan_data FROM accounts WHERE id = $1`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+
+	var planDataJSON string
+	err := q.QueryRow(query, accountID).Scan(&planDataJSON)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch plan data: %w", err)
+	}
+
+	return database.ParsePlanDataFromJSON(planDataJSON)
+}
+
+func (s *Service) savePlanData(tx *sql.Tx, accountID int, planData map[string]interface{}) error {
+	planDataJSON, err := json.Marshal(planData)
+	if err != nil {
+		return fmt.Errorf("failed to marshal plan data: %w", err)
+	}
+	if _, err := tx.Exec(models.UpdateAccountPlanDataQuery, string(planDataJSON), accountID); err != nil {
+		return fmt.Errorf("failed to update plan data: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+package realm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RADIUS packet codes (RFC 2865, RFC 2866)
+const (
+	codeAccessRequest      = 1
+	codeAccessAccept       = 2
+	codeAccessReject       = 3
+	codeAccountingRequest  = 4
+	codeAccountingResponse = 5
+)
+
+// RADIUS attributes used by the proxy
+const (
+	attrUserName             = 1
+	attrUserPassword         = 2
+	attrCHAPPassword         = 3
+	attrNASIPAddress         = 4
+	attrNASPort              = 5
+	attrFramedIPAddress      = 8
+	attrReplyMessage         = 18
+	attrClass                = 25
+	attrVendorSpecific       = 26
+	attrSessionTimeout       = 27
+	attrIdleTimeout          = 28
+	attrCalledStationID      = 30
+	attrCallingStationID     = 31
+	attrAcctStatusType       = 40
+	attrAcctInputOctets      = 42
+	attrAcctOutputOctets     = 43
+	attrAcctSessionID        = 44
+	attrAcctSessionTime      = 46
+	attrAcctTerminateCause   = 49
+	attrAcctInputGigawords   = 52
+	attrAcctOutputGigawords  = 53
+	attrCHAPChallenge        = 60
+	attrMessageAuthenticator = 80
+	attrAcctInterimInterval  = 85
+)
+
+// Microsoft vendor attributes (RFC 2548)
+const (
+	vendorMicrosoft     = 311
+	msMPPESendKey       = 16
+	msMPPERecvKey       = 17
+	msCHAPChallenge     = 11
+	msCHAP2Response     = 25
+	msCHAP2Success      = 26
+	msMPPEEncPolicy     = 7
+	msMPPEEncTypes      = 8
+	maxRADIUSPacketSize = 4096
+)
+
+var acctStatusTypes = map[string]uint32{
+	"Start":          1,
+	"Stop":           2,
+	"Interim-Update": 3,
+	"Accounting-On":  7,
+	"Accounting-Off": 8,
+}
+
+var terminateCauses = map[string]uint32{
+	"User-Request":    1,
+	"Lost-Carrier":    2,
+	"Lost-Service":    3,
+	"Idle-Timeout":    4,
+	"Session-Timeout": 5,
+	"Admin-Reset":     6,
+	"Admin-Reboot":    7,
+	"Port-Error":      8,
+	"NAS-Error":       9,
+	"NAS-Request":     10,
+	"NAS-Reboot":      11,
+}
+
+// packet is a RADIUS packet under construction
+type packet struct {
+	code          byte
+	identifier    byte
+	authenticator [16]byte
+	attrs         bytes.Buffer
+}
+
+func newPacket(code byte) (*packet, error) {
+	p := &packet{code: code}
+	var id [1]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	p.identifier = id[0]
+	if code == codeAccessRequest {
+		if _, err := rand.Read(p.authenticator[:]); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *packet) add(attrType byte, value []byte) {
+	for len(value) > 0 {
+		chunk := value
+		if len(chunk) > 253 {
+			chunk = chunk[:253]
+		}
+		p.attrs.WriteByte(attrType)
+		p.attrs.WriteByte(byte(len(chunk) + 2))
+		p.attrs.Write(chunk)
+		value = value[len(chunk):]
+	}
+}
+
+func (p *packet) addString(attrType byte, value string) {
+	if value != "" {
+		p.add(attrType, []byte(value))
+	}
+}
+
+func (p *packet) addUint32(attrType byte, value uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], value)
+	p.add(attrType, b[:])
+}
+
+func (p *packet) addIP(attrType byte, value string) {
+	if ip := net.ParseIP(value).To4(); ip != nil {
+		p.add(attrType, ip)
+	}
+}
+
+func (p *packet) addVendor(vendorID uint32, vendorType byte, value []byte) {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, vendorID)
+	b.WriteByte(vendorType)
+	b.WriteByte(byte(len(value) + 2))
+	b.Write(value)
+	p.add(attrVendorSpecific, b.Bytes())
+}
+
+// addUserPassword hides User-Password as described in RFC 2865 section 5.2
+func (p *packet) addUserPassword(password, secret string) {
+	padded := []byte(password)
+	if rem := len(padded) % 16; rem != 0 || len(padded) == 0 {
+		padded = append(padded, make([]byte, 16-rem)...)
+	}
+
+	result := make([]byte, len(padded))
+	prev := p.authenticator[:]
+	for i := 0; i < len(padded); i += 16 {
+		h := md5.New()
+		h.Write([]byte(secret))
+		h.Write(prev)
+		b := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			result[i+j] = padded[i+j] ^ b[j]
+		}
+		prev = result[i : i+16]
+	}
+
+	p.add(attrUserPassword, result)
+}
+
+// encode serializes the packet and signs it with the shared secret
+func (p *packet) encode(secret string) []byte {
+	if p.code == codeAccessRequest {
+		// Message-Authenticator placeholder, required for EAP and recommended for all requests
+		p.add(attrMessageAuthenticator, make([]byte, 16))
+	}
+
+	attrs := p.attrs.Bytes()
+	buf := make([]byte, 20+len(attrs))
+	buf[0] = p.code
+	buf[1] = p.identifier
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)))
+	copy(buf[4:20], p.authenticator[:])
+	copy(buf[20:], attrs)
+
+	switch p.code {
+	case codeAccessRequest:
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(buf)
+		copy(buf[len(buf)-16:], mac.Sum(nil))
+	case codeAccountingRequest:
+		// Request Authenticator = MD5(Code+Identifier+Length+16 zero octets+Attributes+Secret)
+		h := md5.New()
+		h.Write(buf)
+		h.Write([]byte(secret))
+		copy(buf[4:20], h.Sum(nil))
+		copy(p.authenticator[:], buf[4:20])
+	}
+
+	return buf
+}
+
+// exchange sends the packet to the upstream server and returns a verified response
+func exchange(server, secret string, timeout time.Duration, retries int, p *packet) ([]byte, error) {
+	request := p.encode(secret)
+
+	var lastErr error
+	for attempt := 0; attempt < retries; attempt++ {
+		response, err := sendUDP(server, request, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if response[1] != p.identifier {
+			lastErr = fmt.Errorf("identifier mismatch")
+			continue
+		}
+		if !verifyResponse(response, p.authenticator[:], secret) {
+			return nil, fmt.Errorf("invalid response authenticator from %s", server)
+		}
+		return response, nil
+	}
+
+	return nil, fmt.Errorf("no response from %s after %d attempts: %w", server, retries, lastErr)
+}
+
+func sendUDP(server string, request []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("failed to send packet: %w", err)
+	}
+
+	response := make([]byte, maxRADIUSPacketSize)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if n < 20 || int(binary.BigEndian.Uint16(response[2:4])) > n {
+		return nil, fmt.Errorf("invalid response length: %d", n)
+	}
+
+	return response[:binary.BigEndian.Uint16(response[2:4])], nil
+}
+
+// verifyResponse checks Response Authenticator = MD5(Code+ID+Length+RequestAuth+Attributes+Secret)
+func verifyResponse(response, requestAuth []byte, secret string) bool {
+	h := md5.New()
+	h.Write(response[:4])
+	h.Write(requestAuth)
+	h.Write(response[20:])
+	h.Write([]byte(secret))
+	return hmac.Equal(h.Sum(nil), response[4:20])
+}
+
+// parseReply converts reply attributes into FreeRADIUS rest style name/value pairs
+func parseReply(response, requestAuth []byte, secret string) (map[string]string, string) {
+	attrs := make(map[string]string)
+	var message string
+
+	data := response[20:]
+	for len(data) >= 2 {
+		attrType, attrLen := data[0], int(data[1])
+		if attrLen < 2 || attrLen > len(data) {
+			break
+		}
+		value := data[2:attrLen]
+		data = data[attrLen:]
+
+		switch attrType {
+		case attrReplyMessage:
+			message += string(value)
+		case attrSessionTimeout:
+			attrs["Session-Timeout"] = uint32String(value)
+		case attrIdleTimeout:
+			attrs["Idle-Timeout"] = uint32String(value)
+		case attrAcctInterimInterval:
+			attrs["Acct-Interim-Interval"] = uint32String(value)
+		case attrFramedIPAddress:
+			if len(value) == 4 {
+				attrs["Framed-IP-Address"] = net.IP(value).String()
+			}
+		case attrClass:
+			attrs["Class"] = "0x" + hex.EncodeToString(value)
+		case attrVendorSpecific:
+			parseMicrosoftVSA(value, requestAuth, secret, attrs)
+		}
+	}
+
+	return attrs, message
+}
+
+func parseMicrosoftVSA(value, requestAuth []byte, secret string, attrs map[string]string) {
+	if len(value) < 6 || binary.BigEndian.Uint32(value[:4]) != vendorMicrosoft {
+		return
+	}
+	vendorType, vendorLen := value[4], int(value[5])
+	if vendorLen < 2 || vendorLen > len(value)-4 {
+		return
+	}
+	vendorValue := value[6 : 4+vendorLen]
+
+	switch vendorType {
+	case msCHAP2Success:
+		attrs["MS-CHAP2-Success"] = "0x" + hex.EncodeToString(vendorValue)
+	case msMPPESendKey:
+		if key := decryptMPPEKey(vendorValue, requestAuth, secret); key != nil {
+			attrs["MS-MPPE-Send-Key"] = "0x" + hex.EncodeToString(key)
+		}
+	case msMPPERecvKey:
+		if key := decryptMPPEKey(vendorValue, requestAuth, secret); key != nil {
+			attrs["MS-MPPE-Recv-Key"] = "0x" + hex.EncodeToString(key)
+		}
+	case msMPPEEncPolicy:
+		attrs["MS-MPPE-Encryption-Policy"] = uint32String(vendorValue)
+	case msMPPEEncTypes:
+		attrs["MS-MPPE-Encryption-Types"] = uint32String(vendorValue)
+	}
+}
+
+// decryptMPPEKey reverses the salt encryption of RFC 2548 section 2.4.2
+// so FreeRADIUS can re-encrypt the key with the NAS secret.
+func decryptMPPEKey(value, requestAuth []byte, secret string) []byte {
+	if len(value) < 18 || (len(value)-2)%16 != 0 {
+		return nil
+	}
+	salt, cipher := value[:2], value[2:]
+
+	plain := make([]byte, len(cipher))
+	prev := append(append([]byte{}, requestAuth...), salt...)
+	for i := 0; i < len(cipher); i += 16 {
+		h := md5.New()
+		h.Write([]byte(secret))
+		h.Write(prev)
+		b := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			plain[i+j] = cipher[i+j] ^ b[j]
+		}
+		prev = cipher[i : i+16]
+	}
+
+	keyLen := int(plain[0])
+	if keyLen == 0 || keyLen > len(plain)-1 {
+		return nil
+	}
+	return plain[1 : 1+keyLen]
+}
+
+func uint32String(value []byte) string {
+	if len(value) != 4 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(binary.BigEndian.Uint32(value)), 10)
+}
+
+// decodeOctets decodes a hex attribute value with optional 0x prefix
+func decodeOctets(value string) ([]byte, error) {
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+	return hex.DecodeString(value)
+}
@@ -0,0 +1,378 @@
+package realm
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+)
+
+// Realm targets
+const (
+	TargetLocal = "local" // Authorize and account in local billing
+	TargetProxy = "proxy" // Forward to the realm's upstream RADIUS server
+)
+
+// Service routes logins like user@partner to local billing or upstream RADIUS servers
+// and keeps per-partner session records for settlement.
+type Service struct {
+	db     *database.PostgreSQL
+	logger *zap.Logger
+	config Config
+	realms map[string]RealmConfig
+}
+
+// Config holds realm routing configuration
+type Config struct {
+	Delimiter     string        `yaml:"delimiter"`      // Realm delimiter, "@" by default
+	RejectUnknown bool          `yaml:"reject_unknown"` // Reject logins with unconfigured realms
+	Realms        []RealmConfig `yaml:"realms"`
+}
+
+// RealmConfig describes a single realm
+type RealmConfig struct {
+	Name       string        `yaml:"name" json:"name"`
+	Target     string        `yaml:"target" json:"target"`           // local or proxy
+	StripRealm bool          `yaml:"strip_realm" json:"strip_realm"` // Use "user" instead of "user@realm"
+	Partner    string        `yaml:"partner" json:"partner"`         // Roaming partner code used for settlement
+	AuthServer string        `yaml:"auth_server" json:"auth_server"` // host:port of upstream auth server
+	AcctServer string        `yaml:"acct_server" json:"acct_server"` // host:port of upstream accounting server
+	Secret     string        `yaml:"secret" json:"-"`                // Shared secret with upstream server
+	Timeout    time.Duration `yaml:"timeout" json:"timeout"`
+	Retries    int           `yaml:"retries" json:"retries"`
+
+	// Settlement rates in partner currency
+	PricePerMB   models.Money `yaml:"price_per_mb" json:"price_per_mb"`
+	PricePerHour models.Money `yaml:"price_per_hour" json:"price_per_hour"`
+}
+
+// Route is the routing decision for a login
+type Route struct {
+	Realm    string
+	Username string // Username to use in billing or upstream (stripped if configured)
+	Target   string
+	Partner  string
+	config   *RealmConfig
+}
+
+// IsProxy reports whether the login is handled by an upstream server
+func (r *Route) IsProxy() bool {
+	return r.Target == TargetProxy
+}
+
+// AccessRequest holds Access-Request attributes forwarded upstream
+type AccessRequest struct {
+	Password         string
+	NASIPAddress     string
+	NASPort          int
+	CallingStationID string
+	CalledStationID  string
+	Attributes       map[string]string // CHAP-Password, CHAP-Challenge, MS-CHAP-Challenge, MS-CHAP2-Response
+}
+
+// AccessReply is the upstream decision
+type AccessReply struct {
+	Accept     bool
+	Attributes map[string]string
+	Message    string
+}
+
+// AccountingRecord holds Accounting-Request attributes of a partner session
+type AccountingRecord struct {
+	StatusType       string
+	SessionID        string
+	NASIPAddress     string
+	NASPort          int
+	FramedIPAddress  string
+	CallingStationID string
+	InputOctets      int64
+	OutputOctets     int64
+	SessionTime      int
+	TerminateCause   string
+}
+
+// Settlement holds per-partner totals for a period
+type Settlement struct {
+	Partner     string       `json:"partner"`
+	Realm       string       `json:"realm"`
+	Target      string       `json:"target"`
+	Sessions    int          `json:"sessions"`
+	OctetsIn    int64        `json:"octets_in"`
+	OctetsOut   int64        `json:"octets_out"`
+	SessionTime int64        `json:"session_time"`
+	Amount      models.Money `json:"amount"` // Partner currency
+}
+
+// LoadConfig reads the realm section of a YAML configuration file
+func LoadConfig(filename string) (Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+
+	var file struct {
+		Realm Config `yaml:"realm"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return Config{}, fmt.Errorf("failed to parse YAML in %s: %w", filename, err)
+	}
+	return file.Realm, nil
+}
+
+// New creates a new realm routing service
+func New(db *database.PostgreSQL, logger *zap.Logger, config Config) *Service {
+	if config.Delimiter == "" {
+		config.Delimiter = "@"
+	}
+
+	realms := make(map[string]RealmConfig, len(config.Realms))
+	for _, r := range config.Realms {
+		if r.Target == "" {
+			r.Target = TargetLocal
+		}
+		if r.Timeout == 0 {
+			r.Timeout = 5 * time.Second
+		}
+		if r.Retries == 0 {
+			r.Retries = 3
+		}
+		realms[strings.ToLower(r.Name)] = r
+	}
+
+	return &Service{
+		db:     db,
+		logger: logger,
+		config: config,
+		realms: realms,
+	}
+}
+
+// Route resolves the realm of a login
+// Logins without realm and unknown realms (unless RejectUnknown) go to local billing unchanged.
+func (s *Service) Route(username string) (*Route, error) {
+	i := strings.LastIndex(username, s.config.Delimiter)
+	if i < 0 {
+		return &Route{Username: username, Target: TargetLocal}, nil
+	}
+
+	name := strings.ToLower(username[i+len(s.config.Delimiter):])
+	rc, ok := s.realms[name]
+	if !ok {
+		if s.config.RejectUnknown {
+			return nil, fmt.Errorf("unknown realm %q", name)
+		}
+		return &Route{Realm: name, Username: username, Target: TargetLocal}, nil
+	}
+
+	route := &Route{
+		Realm:    name,
+		Username: username,
+		Target:   rc.Target,
+		Partner:  rc.Partner,
+		config:   &rc,
+	}
+	if rc.StripRealm {
+		route.Username = username[:i]
+	}
+
+	return route, nil
+}
+
+// Realms returns configured realms (Secret is not serialized to JSON)
+func (s *Service) Realms() []RealmConfig {
+	realms := make([]RealmConfig, 0, len(s.realms))
+	for _, r := range s.realms {
+		realms = append(realms, r)
+	}
+	return realms
+}
+
+// ProxyAuthorize forwards an Access-Request to the realm's upstream server
+func (s *Service) ProxyAuthorize(route *Route, req AccessRequest) (*AccessReply, error) {
+	if !route.IsProxy() || route.config.AuthServer == "" {
+		return nil, fmt.Errorf("realm %s has no upstream auth server", route.Realm)
+	}
+	rc := route.config
+
+	p, err := newPacket(codeAccessRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	p.addString(attrUserName, route.Username)
+	if req.Password != "" {
+		p.addUserPassword(req.Password, rc.Secret)
+	}
+	if v, ok := req.Attributes["CHAP-Password"]; ok {
+		if b, err := decodeOctets(v); err == nil {
+			p.add(attrCHAPPassword, b)
+		}
+	}
+	if v, ok := req.Attributes["CHAP-Challenge"]; ok {
+		if b, err := decodeOctets(v); err == nil {
+			p.add(attrCHAPChallenge, b)
+		}
+	}
+	if v, ok := req.Attributes["MS-CHAP-Challenge"]; ok {
+		if b, err := decodeOctets(v); err == nil {
+			p.addVendor(vendorMicrosoft, msCHAPChallenge, b)
+		}
+	}
+	if v, ok := req.Attributes["MS-CHAP2-Response"]; ok {
+		if b, err := decodeOctets(v); err == nil {
+			p.addVendor(vendorMicrosoft, msCHAP2Response, b)
+		}
+	}
+	p.addIP(attrNASIPAddress, req.NASIPAddress)
+	if req.NASPort > 0 {
+		p.addUint32(attrNASPort, uint32(req.NASPort))
+	}
+	p.addString(attrCallingStationID, req.CallingStationID)
+	p.addString(attrCalledStationID, req.CalledStationID)
+
+	response, err := exchange(rc.AuthServer, rc.Secret, rc.Timeout, rc.Retries, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if response[0] != codeAccessAccept && response[0] != codeAccessReject {
+		return nil, fmt.Errorf("unexpected response code %d from %s", response[0], rc.AuthServer)
+	}
+
+	attrs, message := parseReply(response, p.authenticator[:], rc.Secret)
+	reply := &AccessReply{
+		Accept:     response[0] == codeAccessAccept,
+		Attributes: attrs,
+		Message:    message,
+	}
+
+	s.logger.Info("Proxied authorization",
+		zap.String("realm", route.Realm),
+		zap.String("username", route.Username),
+		zap.Bool("accept", reply.Accept))
+
+	return reply, nil
+}
+
+// ProxyAccounting forwards an Accounting-Request to the realm's upstream server
+func (s *Service) ProxyAccounting(route *Route, rec AccountingRecord) error {
+	if !route.IsProxy() || route.config.AcctServer == "" {
+		return fmt.Errorf("realm %s has no upstream accounting server", route.Realm)
+	}
+	rc := route.config
+
+	statusType, ok := acctStatusTypes[rec.StatusType]
+	if !ok {
+		return fmt.Errorf("unknown Acct-Status-Type %q", rec.StatusType)
+	}
+
+	p, err := newPacket(codeAccountingRequest)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	p.addString(attrUserName, route.Username)
+	p.addUint32(attrAcctStatusType, statusType)
+	p.addString(attrAcctSessionID, rec.SessionID)
+	p.addIP(attrNASIPAddress, rec.NASIPAddress)
+	if rec.NASPort > 0 {
+		p.addUint32(attrNASPort, uint32(rec.NASPort))
+	}
+	p.addIP(attrFramedIPAddress, rec.FramedIPAddress)
+	p.addString(attrCallingStationID, rec.CallingStationID)
+	p.addUint32(attrAcctInputOctets, uint32(rec.InputOctets))
+	p.addUint32(attrAcctOutputOctets, uint32(rec.OutputOctets))
+	p.addUint32(attrAcctInputGigawords, uint32(rec.InputOctets>>32))
+	p.addUint32(attrAcctOutputGigawords, uint32(rec.OutputOctets>>32))
+	p.addUint32(attrAcctSessionTime, uint32(rec.SessionTime))
+	if cause, ok := terminateCauses[rec.TerminateCause]; ok {
+		p.addUint32(attrAcctTerminateCause, cause)
+	}
+
+	response, err := exchange(rc.AcctServer, rc.Secret, rc.Timeout, rc.Retries, p)
+	if err != nil {
+		return err
+	}
+	if response[0] != codeAccountingResponse {
+		return fmt.Errorf("unexpected response code %d from %s", response[0], rc.AcctServer)
+	}
+
+	return nil
+}
+
+// RecordSession stores accounting of a partner session (proxied or hosted locally)
+func (s *Service) RecordSession(route *Route, rec AccountingRecord) error {
+	if route.Partner == "" || rec.SessionID == "" {
+		return nil
+	}
+
+	var err error
+	switch rec.StatusType {
+	case "Start":
+		_, err = s.db.GetDB().Exec(`
+			INSERT INTO realm_sessions (realm, partner, target, username, sid, nas_ip, started_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, NOW(), NOW())
+			ON CONFLICT (realm, sid) DO NOTHING`,
+			route.Realm, route.Partner, route.Target, route.Username, rec.SessionID, rec.NASIPAddress)
+	case "Interim-Update", "Stop":
+		finished := "NULL"
+		if rec.StatusType == "Stop" {
+			finished = "NOW()"
+		}
+		// Upsert: the Start may have been lost
+		_, err = s.db.GetDB().Exec(fmt.Sprintf(`
+			INSERT INTO realm_sessions (realm, partner, target, username, sid, nas_ip,
+				octets_in, octets_out, session_time, started_at, updated_at, finished_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW() - make_interval(secs => $9), NOW(), %[1]s)
+			ON CONFLICT (realm, sid) DO UPDATE SET
+				octets_in = EXCLUDED.octets_in, octets_out = EXCLUDED.octets_out,
+				session_time = EXCLUDED.session_time, updated_at = NOW(),
+				finished_at = COALESCE(realm_sessions.finished_at, %[1]s)`, finished),
+			route.Realm, route.Partner, route.Target, route.Username, rec.SessionID, rec.NASIPAddress,
+			rec.InputOctets, rec.OutputOctets, rec.SessionTime)
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to record partner session: %w", err)
+	}
+	return nil
+}
+
+// Settlement returns per-partner totals of sessions started in [from, to)
+func (s *Service) Settlement(from, to time.Time) ([]Settlement, error) {
+	rows, err := s.db.GetDB().Query(`
+		SELECT partner, realm, target, COUNT(*),
+			COALESCE(SUM(octets_in), 0), COALESCE(SUM(octets_out), 0), COALESCE(SUM(session_time), 0)
+		FROM realm_sessions
+		WHERE started_at >= $1 AND started_at < $2
+		GROUP BY partner, realm, target
+		ORDER BY partner, realm`, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch settlement: %w", err)
+	}
+	defer rows.Close()
+
+	result := make([]Settlement, 0)
+	for rows.Next() {
+		var st Settlement
+		if err := rows.Scan(&st.Partner, &st.Realm, &st.Target, &st.Sessions,
+			&st.OctetsIn, &st.OctetsOut, &st.SessionTime); err != nil {
+			return nil, fmt.Errorf("failed to scan settlement: %w", err)
+		}
+		if rc, ok := s.realms[st.Realm]; ok {
+			st.Amount = rc.PricePerMB.MulDiv(uint64(st.OctetsIn+st.OctetsOut), 1024*1024).
+				Add(rc.PricePerHour.MulDiv(uint64(st.SessionTime), 3600))
+		}
+		result = append(result, st)
+	}
+
+	return result, rows.Err()
+}
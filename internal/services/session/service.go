@@ -2,9 +2,12 @@ package session
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -62,8 +65,24 @@ type Config struct {
 	DisconnectOnShutdown bool `yaml:"disconnect_on_shutdown"` // Disconnect clients on shutdown
 	MaxSessions          int  `yaml:"max_sessions"`           // Maximum concurrent sessions
 	CleanupInterval      int  `yaml:"cleanup_interval"`       // Cleanup interval in seconds
+
+	// Simultaneous-Use defaults, overridden by SIMULTANEOUS_USE / SIMULTANEOUS_USE_POLICY in plan_data
+	MaxSessionsPerUser    int    `yaml:"max_sessions_per_user"`   // 0 = unlimited
+	SimultaneousUsePolicy string `yaml:"simultaneous_use_policy"` // "reject" or "kick_oldest"
+
+	// Disconnect a session as soon as its Amount uses up balance + credit
+	DisconnectOnLowBalance bool `yaml:"disconnect_on_low_balance"`
 }
 
+// Simultaneous-Use policies
+const (
+	SimultaneousUseReject     = "reject"      // Reject the new login
+	SimultaneousUseKickOldest = "kick_oldest" // Disconnect the oldest session and accept the new one
+)
+
+// ErrSimultaneousUse is returned when the account has reached its session limit
+var ErrSimultaneousUse = errors.New("simultaneous use limit reached")
+
 // SessionWorker represents a worker for individual session
 // Equivalent to individual session process in Erlang
 type SessionWorker struct {
@@ -90,6 +109,9 @@ func New(redisClient *redis.Client, db *database.PostgreSQL, billingService *bil
 	if config.CleanupInterval == 0 {
 		config.CleanupInterval = 30
 	}
+	if config.SimultaneousUsePolicy == "" {
+		config.SimultaneousUsePolicy = SimultaneousUseReject
+	}
 
 	return &Service{
 		redis:      redisClient,
@@ -161,13 +183,11 @@ func (s *Service) InitSession(username string) (*models.IPTrafficSession, error)
 	s.sessionsMux.Lock()
 	defer s.sessionsMux.Unlock()
 
-	// Check if user already has a session
-	if existingSession := s.findSessionByUsername(username); existingSession != nil {
-		if existingSession.IsActive() {
-			return nil, fmt.Errorf("user %s already has an active session", username)
-		}
-		// Clean up old session
+	// Clean up a stale prepared session; active sessions are limited by CheckSimultaneousUse
+	if existingSession := s.findSessionByUsername(username); existingSession != nil && existingSession.IsNew() {
+		s.sessionsMux.Unlock()
 		s.cleanupSession(existingSession.UUID)
+		s.sessionsMux.Lock()
 	}
 
 	// Create new session
@@ -191,6 +211,179 @@ func (s *Service) InitSession(username string) (*models.IPTrafficSession, error)
 	return session, nil
 }
 
+// CheckSimultaneousUse enforces the concurrent session limit of an account during authorize
+// Both local sessions and open iptraffic_sessions rows (other nodes) are counted.
+// With the kick_oldest policy the oldest sessions are disconnected instead of rejecting: local
+// ones directly, those of other nodes through their NAS. When not enough of them can be
+// disconnected the new session is rejected.
+func (s *Service) CheckSimultaneousUse(username string, accountID int, planData map[string]interface{}) error {
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return err
+	}
+
+	limit := s.config.MaxSessionsPerUser
+	if settings.SimultaneousUse != nil {
+		limit = *settings.SimultaneousUse
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	policy := s.config.SimultaneousUsePolicy
+	if settings.SimultaneousUsePolicy != "" {
+		policy = settings.SimultaneousUsePolicy
+	}
+
+	local := s.activeSessionsByUsername(username)
+	count := len(local)
+
+	if s.db != nil {
+		var dbCount int
+		err := s.db.GetDB().QueryRow(`SELECT COUNT(*) FROM iptraffic_sessions
+			WHERE account_id = $1 AND finished_at IS NULL`, accountID).Scan(&dbCount)
+		if err != nil {
+			return fmt.Errorf("failed to count open sessions: %w", err)
+		}
+		if dbCount > count {
+			count = dbCount
+		}
+	}
+
+	if count < limit {
+		return nil
+	}
+
+	if policy != SimultaneousUseKickOldest {
+		s.logger.Info("Simultaneous use limit reached",
+			zap.String("username", username),
+			zap.Int("sessions", count),
+			zap.Int("limit", limit))
+		return fmt.Errorf("%w: %d of %d sessions in use", ErrSimultaneousUse, count, limit)
+	}
+
+	// Kick the oldest sessions we can reach, on this node or another, so that the new one fits
+	candidates, err := s.kickCandidates(accountID, local)
+	if err != nil {
+		return err
+	}
+	toKick := count - limit + 1
+	kicked := 0
+	for _, c := range candidates {
+		if kicked == toKick {
+			break
+		}
+		if err := s.kick(username, c); err != nil {
+			s.logger.Warn("Failed to kick oldest session",
+				zap.String("username", username),
+				zap.String("sid", c.sid),
+				zap.Error(err))
+			continue
+		}
+
+		kicked++
+		s.logger.Info("Oldest session kicked by simultaneous use policy",
+			zap.String("username", username),
+			zap.String("sid", c.sid),
+			zap.Bool("local", c.local != nil))
+	}
+
+	if kicked < toKick {
+		return fmt.Errorf("%w: unable to disconnect oldest session", ErrSimultaneousUse)
+	}
+
+	return nil
+}
+
+// kickCandidate is an open session of the account the kick_oldest policy may disconnect
+type kickCandidate struct {
+	sid       string
+	ip        net.IP
+	nasSpec   map[string]interface{}
+	startedAt int64
+	local     *models.IPTrafficSession // nil for a session of another node
+}
+
+// kickCandidates returns the account's sessions that can be disconnected, oldest first:
+// local ones not asked to disconnect yet and open iptraffic_sessions rows of other nodes
+// with a known NAS
+func (s *Service) kickCandidates(accountID int, local []*models.IPTrafficSession) ([]kickCandidate, error) {
+	candidates := make([]kickCandidate, 0, len(local))
+	localSIDs := make(map[string]bool, len(local))
+	for _, session := range local {
+		localSIDs[session.SID] = true
+		if session.IP == nil || session.DiscReqSent {
+			continue
+		}
+		candidates = append(candidates, kickCandidate{
+			sid:       session.SID,
+			ip:        session.IP,
+			nasSpec:   session.NASSpec,
+			startedAt: session.StartedAt,
+			local:     session,
+		})
+	}
+
+	if s.db != nil {
+		rows, err := s.db.GetDB().Query(`
+			SELECT sid, ip, nas_ip, COALESCE(nas_port, 0), started_at
+			FROM iptraffic_sessions
+			WHERE account_id = $1 AND finished_at IS NULL AND nas_ip IS NOT NULL`, accountID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch open sessions: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var sid, nasIP string
+			var ip sql.NullString
+			var nasPort int
+			var startedAt time.Time
+			if err := rows.Scan(&sid, &ip, &nasIP, &nasPort, &startedAt); err != nil {
+				return nil, fmt.Errorf("failed to scan open session: %w", err)
+			}
+			if localSIDs[sid] {
+				continue
+			}
+			nasSpec := map[string]interface{}{"nas_ip": nasIP}
+			if nasPort != 0 {
+				nasSpec["nas_port"] = nasPort
+			}
+			candidates = append(candidates, kickCandidate{
+				sid:       sid,
+				ip:        net.ParseIP(ip.String),
+				nasSpec:   nasSpec,
+				startedAt: startedAt.Unix(),
+			})
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to fetch open sessions: %w", err)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].startedAt < candidates[j].startedAt })
+	return candidates, nil
+}
+
+// kick sends a disconnect for a candidate session
+// A session of another node is finished by that node when its Accounting-Stop arrives.
+func (s *Service) kick(username string, c kickCandidate) error {
+	if s.disconnect == nil {
+		return fmt.Errorf("no disconnect service")
+	}
+	if err := s.disconnect.DisconnectSession(username, c.sid, c.ip, c.nasSpec); err != nil {
+		return err
+	}
+
+	if c.local != nil {
+		s.sessionsMux.Lock()
+		c.local.DiscReqSent = true
+		s.saveSessionToRedis(c.local)
+		s.sessionsMux.Unlock()
+	}
+	return nil
+}
+
 // PrepareSession prepares session with context data
 // Equivalent to prepare/5 in iptraffic_session.erl
 func (s *Service) PrepareSession(sessionUUID string, ctx *models.SessionContext) error {
@@ -275,11 +468,22 @@ func (s *Service) InterimUpdate(sid string) error {
 	}
 
 	s.sessionsMux.Lock()
-	defer s.sessionsMux.Unlock()
+	defer func() {
+		s.sessionsMux.Unlock()
+		// Outside the lock: the balance may be refreshed from the database
+		s.checkBalance(session)
+	}()
 
 	// Renew session timeout
 	session.RenewTimeout(s.config.SessionTimeout)
 
+	// Charge online time of time-based plans
+	if err := s.accountTime(session, time.Now()); err != nil {
+		s.logger.Error("Time accounting failed",
+			zap.String("sid", sid),
+			zap.Error(err))
+	}
+
 	// Renew IP lease if IP pool is configured
 	if s.ippool != nil && session.IP != nil {
 		if err := s.ippool.Renew(session.IP); err != nil {
@@ -316,6 +520,13 @@ func (s *Service) StopSession(sid string) error {
 	// Mark session as stopping
 	session.Status = models.StatusStopping
 
+	// Charge online time up to the stop
+	if err := s.accountTime(session, time.Now()); err != nil {
+		s.logger.Error("Time accounting failed",
+			zap.String("sid", sid),
+			zap.Error(err))
+	}
+
 	// Save final session state to database
 	if err := s.syncSessionToDB(session); err != nil {
 		s.logger.Error("Failed to sync session before stop", zap.Error(err))
@@ -370,9 +581,104 @@ func (s *Service) ExpireSession(sessionUUID string) error {
 	return nil
 }
 
+// StopNASSessions closes every session that belongs to the given NAS
+// Called on Accounting-On/Off when a NAS reboots and drops all its subscribers
+func (s *Service) StopNASSessions(nasIP string) (int, error) {
+	s.sessionsMux.RLock()
+	sessions := make([]*models.IPTrafficSession, 0)
+	for _, session := range s.sessions {
+		if session.Status == models.StatusStopped || session.Status == models.StatusExpired {
+			continue
+		}
+		if sessionNASIP(session) == nasIP {
+			sessions = append(sessions, session)
+		}
+	}
+	s.sessionsMux.RUnlock()
+
+	var lastErr error
+	for _, session := range sessions {
+		// Flush traffic details collected so far before closing the record
+		if err := s.syncSessionToDB(session); err != nil {
+			s.logger.Error("Failed to sync session on NAS reboot",
+				zap.String("uuid", session.UUID),
+				zap.Error(err))
+		}
+
+		s.sessionsMux.Lock()
+		session.Stop()
+		s.sessionsMux.Unlock()
+
+		if s.ippool != nil && session.IP != nil {
+			if err := s.ippool.Release(session.IP); err != nil {
+				s.logger.Error("Failed to release IP on NAS reboot",
+					zap.String("ip", session.IP.String()),
+					zap.Error(err))
+			}
+		}
+
+		if err := s.finishDBSession(session); err != nil {
+			s.logger.Error("Failed to finish DB session on NAS reboot",
+				zap.String("uuid", session.UUID),
+				zap.Error(err))
+			lastErr = err
+		}
+
+		s.cleanupSession(session.UUID)
+	}
+
+	s.logger.Info("NAS sessions closed",
+		zap.String("nas_ip", nasIP),
+		zap.Int("count", len(sessions)))
+
+	if lastErr != nil {
+		return len(sessions), fmt.Errorf("failed to finish some sessions of NAS %s: %w", nasIP, lastErr)
+	}
+	return len(sessions), nil
+}
+
+// SetNASSpec records NAS information for the session identified by SID
+func (s *Service) SetNASSpec(sid, nasIP string, nasPort int) error {
+	session := s.findSessionBySID(sid)
+	if session == nil {
+		return fmt.Errorf("session not found for SID: %s", sid)
+	}
+
+	s.sessionsMux.Lock()
+	defer s.sessionsMux.Unlock()
+
+	if session.NASSpec == nil {
+		session.NASSpec = make(map[string]interface{})
+	}
+	session.NASSpec["nas_ip"] = nasIP
+	if nasPort != 0 {
+		session.NASSpec["nas_port"] = nasPort
+	}
+
+	if err := s.saveSessionToRedis(session); err != nil {
+		return err
+	}
+
+	// Other nodes find the NAS here to disconnect the session (simultaneous use kick_oldest)
+	if s.db != nil && session.DBSessionID != 0 {
+		var port interface{}
+		if nasPort != 0 {
+			port = nasPort
+		}
+		_, err := s.db.GetDB().Exec(`UPDATE iptraffic_sessions SET nas_ip = $1, nas_port = $2 WHERE id = $3`,
+			nasIP, port, session.DBSessionID)
+		if err != nil {
+			return fmt.Errorf("failed to store NAS of session: %w", err)
+		}
+	}
+	return nil
+}
+
 // HandleNetFlow processes NetFlow data for session
 // Equivalent to handle_cast({netflow, Dir, {H, Rec}}) in iptraffic_session.erl
-func (s *Service) HandleNetFlow(direction string, srcIP, dstIP net.IP, octets, packets uint64) error {
+// The flow is billed at the tariff in effect when it was seen, from first to last;
+// a flow crossing a tariff boundary is split in proportion to time. Zero times mean now.
+func (s *Service) HandleNetFlow(direction string, srcIP, dstIP net.IP, octets, packets uint64, first, last time.Time) error {
 	// Determine target IP and find session
 	var targetIP net.IP
 	if direction == "in" {
@@ -388,26 +694,54 @@ func (s *Service) HandleNetFlow(direction string, srcIP, dstIP net.IP, octets, p
 	}
 
 	s.sessionsMux.Lock()
-	defer s.sessionsMux.Unlock()
+	defer func() {
+		s.sessionsMux.Unlock()
+		// Prepaid balance used up - do not wait for the next authorize; outside the lock
+		// because the balance may be refreshed from the database
+		s.checkBalance(session)
+	}()
+
+	// Every part is billed before any is applied, so a failure leaves the session untouched
+	// and the flow is either billed whole or not at all. Parts see the plan data of the
+	// previous part (prepaid counters, quota).
+	parts := splitFlow(session.PlanData, octets, packets, first, last)
+	results := make([]*models.BillingResult, len(parts))
+	planData, changed := session.PlanData, false
+	for i, part := range parts {
+		result, err := s.performAccounting(session, planData, direction, targetIP.String(), part.octets, part.at)
+		if err != nil {
+			s.logger.Error("Billing accounting failed",
+				zap.String("session", session.UUID),
+				zap.Error(err))
+			return err
+		}
+		if result.PlanData != nil {
+			planData, changed = result.PlanData, true
+		}
+		results[i] = result
+	}
 
-	// Classify traffic
-	class := s.classifyTraffic(targetIP.String())
+	var amount models.Money
+	var shaper, class string
+	for i, part := range parts {
+		result := results[i]
+		amount = amount.Add(result.Amount)
 
-	// Call billing algorithm for this traffic
-	amount, newPlanData, err := s.performAccounting(session, direction, targetIP.String(), octets, class)
-	if err != nil {
-		s.logger.Error("Billing accounting failed",
-			zap.String("session", session.UUID),
-			zap.Error(err))
-		return err
+		// Session details keep the class billing priced the part with, so replays of them
+		// (simulator) price it the same way
+		class = result.TrafficClass
+		session.UpdateTrafficByClass(class, direction, part.octets, part.packets, result.Amount)
+		if result.Shaper != "" {
+			shaper = result.Shaper
+		}
+	}
+	if changed {
+		session.UpdatePlanData(planData)
 	}
 
-	// Update session with traffic and billing data
-	session.UpdateTrafficByClass(class, direction, octets, packets, amount)
-
-	// Update plan data if changed
-	if newPlanData != nil {
-		session.UpdatePlanData(newPlanData)
+	// Fair use threshold crossed - change the shaper of the running session
+	if shaper != "" && shaper != session.Shaper {
+		s.applyShaper(session, shaper)
 	}
 
 	// Save updated session
@@ -420,7 +754,7 @@ func (s *Service) HandleNetFlow(direction string, srcIP, dstIP net.IP, octets, p
 		zap.String("direction", direction),
 		zap.Uint64("octets", octets),
 		zap.String("class", class),
-		zap.Float64("amount", amount))
+		zap.Stringer("amount", amount))
 
 	return nil
 }
@@ -609,6 +943,160 @@ func (s *Service) cleanupExpiredSessions() {
 	}
 }
 
+// UpdateAccountSessions runs update on every active session of the account and saves them
+// Used to change plan data of running sessions (quota top-ups, cycle resets), which
+// would otherwise overwrite accounts.plan_data on the next sync.
+func (s *Service) UpdateAccountSessions(accountID int, update func(session *models.IPTrafficSession) error) (int, error) {
+	s.sessionsMux.Lock()
+	defer s.sessionsMux.Unlock()
+
+	updated := 0
+	for _, session := range s.sessions {
+		if !session.IsActive() || sessionAccountID(session) != accountID {
+			continue
+		}
+		if err := update(session); err != nil {
+			return updated, err
+		}
+		if err := s.saveSessionToRedis(session); err != nil {
+			s.logger.Error("Failed to save session after update", zap.String("session", session.UUID), zap.Error(err))
+		}
+		updated++
+	}
+
+	return updated, nil
+}
+
+// RecheckBalance sets the balance + credit of active sessions of the account and disconnects
+// those that exhausted it, for changes made outside the session such as an expired credit
+// Returns how many sessions were asked to disconnect.
+func (s *Service) RecheckBalance(accountID int, balance models.Money) int {
+	s.sessionsMux.RLock()
+	var sessions []*models.IPTrafficSession
+	for _, session := range s.sessions {
+		if session.IsActive() && sessionAccountID(session) == accountID {
+			sessions = append(sessions, session)
+		}
+	}
+	s.sessionsMux.RUnlock()
+
+	disconnected := 0
+	for _, session := range sessions {
+		s.sessionsMux.Lock()
+		session.Balance = balance
+		if err := s.saveSessionToRedis(session); err != nil {
+			s.logger.Error("Failed to save session after balance check", zap.String("session", session.UUID), zap.Error(err))
+		}
+		s.sessionsMux.Unlock()
+
+		if s.checkBalance(session) {
+			disconnected++
+		}
+	}
+
+	return disconnected
+}
+
+// DisconnectAccount sends Disconnect-Request for every active session of the account
+// Returns how many sessions were asked to disconnect.
+func (s *Service) DisconnectAccount(accountID int) (int, error) {
+	if s.disconnect == nil {
+		return 0, fmt.Errorf("disconnect service is not configured")
+	}
+
+	s.sessionsMux.RLock()
+	var sessions []*models.IPTrafficSession
+	for _, session := range s.sessions {
+		if session.IsActive() && sessionAccountID(session) == accountID && session.IP != nil && !session.DiscReqSent {
+			sessions = append(sessions, session)
+		}
+	}
+	s.sessionsMux.RUnlock()
+
+	disconnected := 0
+	for _, session := range sessions {
+		if err := s.disconnect.DisconnectSession(session.Username, session.SID, session.IP, session.NASSpec); err != nil {
+			s.logger.Warn("Failed to disconnect account session",
+				zap.Int("account_id", accountID),
+				zap.String("sid", session.SID),
+				zap.Error(err))
+			continue
+		}
+
+		s.sessionsMux.Lock()
+		session.DiscReqSent = true
+		s.saveSessionToRedis(session)
+		s.sessionsMux.Unlock()
+		disconnected++
+	}
+
+	return disconnected, nil
+}
+
+// AccountPlanData returns plan data of an active session of the account
+// Running sessions hold newer counters than accounts.plan_data until the next sync.
+func (s *Service) AccountPlanData(accountID int) (map[string]interface{}, bool) {
+	s.sessionsMux.RLock()
+	defer s.sessionsMux.RUnlock()
+
+	for _, session := range s.sessions {
+		if session.IsActive() && sessionAccountID(session) == accountID {
+			return session.PlanData, true
+		}
+	}
+	return nil, false
+}
+
+// ChangeShaper sets the shaper of a running session and pushes it to the NAS with CoA
+// Without CoA the shaper applies on next authorization. Must be called from UpdateAccountSessions.
+func (s *Service) ChangeShaper(session *models.IPTrafficSession, shaper string) {
+	if shaper != session.Shaper {
+		s.applyShaper(session, shaper)
+	}
+}
+
+// applyShaper records the new shaper and sends CoA in background, the caller holds sessionsMux
+func (s *Service) applyShaper(session *models.IPTrafficSession, shaper string) {
+	session.SetShaper(shaper)
+	if s.disconnect == nil {
+		return
+	}
+
+	username, sid, ip := session.Username, session.SID, session.IP
+	nasSpec := make(map[string]interface{}, len(session.NASSpec))
+	for k, v := range session.NASSpec {
+		nasSpec[k] = v
+	}
+	go func() {
+		err := s.disconnect.ChangeShaper(username, sid, ip, nasSpec, shaper)
+		switch {
+		case errors.Is(err, disconnect.ErrCoADisabled):
+			s.logger.Debug("Shaper change waits for next authorization",
+				zap.String("username", username),
+				zap.String("shaper", shaper))
+		case err != nil:
+			s.logger.Warn("Failed to change shaper with CoA",
+				zap.String("username", username),
+				zap.String("sid", sid),
+				zap.String("shaper", shaper),
+				zap.Error(err))
+		}
+	}()
+}
+
+func (s *Service) activeSessionsByUsername(username string) []*models.IPTrafficSession {
+	s.sessionsMux.RLock()
+	defer s.sessionsMux.RUnlock()
+
+	sessions := make([]*models.IPTrafficSession, 0)
+	for _, session := range s.sessions {
+		if session.Username == username && session.IsActive() {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
 func (s *Service) findSessionByIP(ip string) *models.IPTrafficSession {
 	ctx := context.Background()
 	sessionUUID, err := s.redis.Get(ctx, RedisSessionsByIP+ip).Result()
@@ -767,7 +1255,10 @@ func (s *Service) cleanupSession(sessionUUID string) {
 		s.redis.Del(ctx, RedisSessionsByIP+session.IP.String())
 	}
 	if session.Username != "" {
-		s.redis.Del(ctx, RedisSessionsByUser+session.Username)
+		// The user may already have a newer session indexed
+		if indexed, err := s.redis.Get(ctx, RedisSessionsByUser+session.Username).Result(); err == nil && indexed == sessionUUID {
+			s.redis.Del(ctx, RedisSessionsByUser+session.Username)
+		}
 	}
 	if session.SID != "" {
 		s.redis.Del(ctx, "session_by_sid:"+session.SID)
@@ -888,36 +1379,209 @@ func (s *Service) saveTrafficDetails(session *models.IPTrafficSession) error {
 	return nil
 }
 
-func (s *Service) performAccounting(session *models.IPTrafficSession, direction, targetIP string, octets uint64, class string) (float64, map[string]interface{}, error) {
-	// TODO: Implement proper billing integration
-	// For now, simple calculation based on octets
-	costPerMB := 0.01 // Default cost
+// performAccounting charges a portion of traffic with the session's acct algorithm
+// planData is the session's or, for later parts of a split flow, the one billing returned
+// for the previous part. Equivalent to the Algo:account call in iptraffic_session.erl
+func (s *Service) performAccounting(session *models.IPTrafficSession, planData map[string]interface{}, direction, targetIP string, octets uint64, flowTime time.Time) (*models.BillingResult, error) {
+	if s.billing == nil {
+		return nil, fmt.Errorf("billing service is not configured")
+	}
+
+	// No TrafficClassKey: billing classifies targetIP itself
+	sessionData := map[string]interface{}{
+		"uuid":     session.UUID,
+		"sid":      session.SID,
+		"username": session.Username,
+	}
+	if !flowTime.IsZero() {
+		sessionData[billing.FlowTimeKey] = flowTime
+	}
+
+	result, err := s.billing.Account(session.AcctAlgo, session.Currency, planData, sessionData, direction, targetIP, octets)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// accountTime charges online time not paid yet with the session's acct algorithm
+// Algorithms without time accounting leave the session untouched.
+func (s *Service) accountTime(session *models.IPTrafficSession, now time.Time) error {
+	if s.billing == nil {
+		return nil
+	}
+
+	sessionData := map[string]interface{}{
+		"uuid":     session.UUID,
+		"sid":      session.SID,
+		"username": session.Username,
+	}
+
+	result, err := s.billing.AccountTime(session.AcctAlgo, session.Currency, session.PlanData, sessionData,
+		time.Unix(session.StartedAt, 0), now, session.BilledTime)
+	if err != nil || result == nil {
+		return err
+	}
+
+	if result.Seconds != session.BilledTime {
+		session.AddCharge(result.TrafficClass, result.Amount)
+		session.BilledTime = result.Seconds
+		session.UpdatePlanData(result.PlanData)
+	}
+
+	return nil
+}
 
-	if cost, exists := session.PlanData["cost_per_mb"]; exists {
-		if costFloat, ok := cost.(float64); ok {
-			costPerMB = costFloat
+// checkBalance disconnects the session when its Amount exceeds balance + credit
+// The balance from authorize is refreshed from the database before disconnecting, so payments
+// made during the session are taken into account. Called without sessionsMux: the refresh and
+// the Disconnect-Request run outside the lock. A failed Disconnect-Request clears DiscReqSent,
+// so the next interim update or flow tries again. Returns whether a disconnect was requested.
+func (s *Service) checkBalance(session *models.IPTrafficSession) bool {
+	s.sessionsMux.RLock()
+	exhausted, username := s.balanceExhausted(session), session.Username
+	s.sessionsMux.RUnlock()
+	if !exhausted {
+		return false
+	}
+
+	var refreshed *models.Money
+	if s.db != nil {
+		account, err := s.db.FetchAccount(username)
+		if err != nil {
+			s.logger.Error("Failed to refresh balance", zap.String("username", username), zap.Error(err))
+		} else if account != nil {
+			balance := account.Balance.Add(account.Credit)
+			refreshed = &balance
 		}
 	}
 
-	amount := float64(octets) / 1024 / 1024 * costPerMB
+	s.sessionsMux.Lock()
+	if refreshed != nil {
+		session.Balance = *refreshed
+	}
+	// Checked again: the session may have been disconnected or topped up meanwhile
+	if !s.balanceExhausted(session) {
+		if refreshed != nil {
+			s.saveSessionToRedis(session)
+		}
+		s.sessionsMux.Unlock()
+		return false
+	}
 
-	// Return unchanged plan data for now
-	return amount, session.PlanData, nil
+	session.DiscReqSent = true
+	s.saveSessionToRedis(session)
+	s.logger.Info("Balance exhausted, disconnecting session",
+		zap.String("username", session.Username),
+		zap.String("sid", session.SID),
+		zap.Stringer("balance", session.Balance),
+		zap.Stringer("credit", s.sessionCredit(session)),
+		zap.Stringer("amount", session.Amount))
+	sid, ip, nasSpec := session.SID, session.IP, session.NASSpec
+	s.sessionsMux.Unlock()
+
+	go func() {
+		if err := s.disconnect.DisconnectSession(username, sid, ip, nasSpec); err != nil {
+			s.logger.Error("Failed to disconnect session with exhausted balance",
+				zap.String("username", username),
+				zap.String("sid", sid),
+				zap.Error(err))
+
+			s.sessionsMux.Lock()
+			session.DiscReqSent = false
+			s.saveSessionToRedis(session)
+			s.sessionsMux.Unlock()
+		}
+	}()
+	return true
 }
 
-func (s *Service) classifyTraffic(targetIP string) string {
-	// Simple classification - should use traffic classification service
-	ip := net.ParseIP(targetIP)
-	if ip == nil {
-		return "default"
+// balanceExhausted reports whether the session should be disconnected for its balance, the caller holds sessionsMux
+func (s *Service) balanceExhausted(session *models.IPTrafficSession) bool {
+	if !s.config.DisconnectOnLowBalance || s.disconnect == nil || session.DiscReqSent || session.IP == nil || !session.IsActive() {
+		return false
 	}
+	return session.Balance.Add(s.sessionCredit(session)).Cmp(session.Amount) <= 0
+}
 
-	// Check if it's local network
-	if ip.IsPrivate() {
-		return "local"
+// sessionCredit returns the CREDIT of the session plan
+func (s *Service) sessionCredit(session *models.IPTrafficSession) models.Money {
+	if settings, err := models.ParsePlanSettings(session.PlanData); err == nil {
+		return settings.Credit
 	}
+	return models.Money{}
+}
 
-	return "internet"
+// flowPart is the share of a flow billed at a single tariff interval
+type flowPart struct {
+	at      time.Time
+	octets  uint64
+	packets uint64
+}
+
+// splitFlow divides a flow seen from first to last at the tariff boundaries of the plan
+// Octets and packets are shared in proportion to time, the last part takes the remainder.
+func splitFlow(planData map[string]interface{}, octets, packets uint64, first, last time.Time) []flowPart {
+	if first.IsZero() {
+		first = last
+	}
+	whole := []flowPart{{at: first, octets: octets, packets: packets}}
+	if !first.Before(last) {
+		return whole
+	}
+
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return whole // Reported by the billing algorithm
+	}
+	boundaries := settings.TariffBoundaries(first, last)
+	if len(boundaries) == 0 {
+		return whole
+	}
+
+	total := float64(last.Sub(first))
+	parts := make([]flowPart, 0, len(boundaries)+1)
+	start := first
+	var usedOctets, usedPackets uint64
+	for _, end := range boundaries {
+		share := float64(end.Sub(start)) / total
+		part := flowPart{
+			at:      start,
+			octets:  uint64(float64(octets) * share),
+			packets: uint64(float64(packets) * share),
+		}
+		usedOctets += part.octets
+		usedPackets += part.packets
+		parts = append(parts, part)
+		start = end
+	}
+
+	return append(parts, flowPart{at: start, octets: octets - usedOctets, packets: packets - usedPackets})
+}
+
+func sessionAccountID(session *models.IPTrafficSession) int {
+	accountID, _ := session.GetContextValue("account_id")
+	switch v := accountID.(type) {
+	case int:
+		return v
+	case float64:
+		return int(v) // Sessions restored from Redis
+	}
+	return 0
+}
+
+func sessionNASIP(session *models.IPTrafficSession) string {
+	if session.NASSpec == nil {
+		return ""
+	}
+	switch v := session.NASSpec["nas_ip"].(type) {
+	case string:
+		return v
+	case net.IP:
+		return v.String()
+	}
+	return ""
 }
 
 // SessionWorker methods
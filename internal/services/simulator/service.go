@@ -0,0 +1,622 @@
+package simulator
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+
+	"isp-billing/internal/database"
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/billing"
+)
+
+// ErrPlanNotFound is returned for unknown plan IDs
+var ErrPlanNotFound = errors.New("plan not found")
+
+// ErrInvalidRequest is returned for simulation requests that cannot be run
+var ErrInvalidRequest = errors.New("invalid simulation request")
+
+// Sources of simulated usage
+const (
+	SourceHistory = "history" // iptraffic_sessions and session_details of the period
+	SourceProfile = "profile" // The same synthetic day repeated for every account
+)
+
+// Service replays usage through the billing algorithms with a candidate plan
+// Nothing is written: plan_data counters live only for the replay of one account.
+type Service struct {
+	db      *database.PostgreSQL
+	billing *billing.Service
+	logger  *zap.Logger
+	config  Config
+}
+
+// Config holds simulator settings
+type Config struct {
+	DefaultPeriod time.Duration `yaml:"default_period"` // History replayed when the request has no from
+	MaxAccounts   int           `yaml:"max_accounts"`   // Accounts per simulation, the rest is cut off
+}
+
+// Request describes a simulation: the candidate plan, the accounts and the usage to replay
+// The candidate is plan_id or a plan_data document; acct_algo defaults to the algorithm
+// of the plan, or of the current plan of each account for a bare document.
+type Request struct {
+	PlanID        int                    `json:"plan_id"`
+	PlanData      map[string]interface{} `json:"plan_data"`
+	AcctAlgo      string                 `json:"acct_algo"`
+	AccountIDs    []int                  `json:"account_ids"`
+	CurrentPlanID int                    `json:"current_plan_id"` // Only accounts now on this plan
+	From          time.Time              `json:"from"`
+	To            time.Time              `json:"to"`
+	Profile       *Profile               `json:"profile"` // Synthetic usage instead of history
+}
+
+// Profile is a synthetic day of usage repeated for Days days from the request from
+type Profile struct {
+	Days     int              `json:"days"`
+	Sessions []ProfileSession `json:"sessions"`
+}
+
+// ProfileSession is one session of the synthetic day
+type ProfileSession struct {
+	Start    string                  `json:"start"`    // HH:MM in the time zone of from
+	Duration int64                   `json:"duration"` // Seconds online
+	Traffic  map[string]ClassTraffic `json:"traffic"`  // Octets by traffic class
+}
+
+// ClassTraffic is the traffic of one class
+type ClassTraffic struct {
+	In  uint64 `json:"in"`
+	Out uint64 `json:"out"`
+}
+
+// Report is the result of a simulation
+type Report struct {
+	Plan      PlanInfo        `json:"plan"`
+	Source    string          `json:"source"`
+	From      time.Time       `json:"from"`
+	To        time.Time       `json:"to"`
+	Accounts  []AccountResult `json:"accounts"`
+	Totals    []Totals        `json:"totals"`
+	Failed    int             `json:"failed"`
+	Truncated bool            `json:"truncated,omitempty"`
+}
+
+// PlanInfo identifies the simulated plan
+type PlanInfo struct {
+	ID       int    `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	AcctAlgo string `json:"acct_algo,omitempty"`
+}
+
+// AccountResult compares the charges of an account under its current and the simulated plan
+// Both plans replay the same usage from fresh plan_data; Recorded is what history actually charged.
+type AccountResult struct {
+	AccountID int           `json:"account_id"`
+	Login     string        `json:"login"`
+	PlanID    int           `json:"plan_id"`
+	Currency  int           `json:"currency"`
+	Sessions  int           `json:"sessions"`
+	OctetsIn  uint64        `json:"octets_in"`
+	OctetsOut uint64        `json:"octets_out"`
+	Seconds   int64         `json:"seconds"`
+	Recorded  *models.Money `json:"recorded,omitempty"`
+	Current   models.Money  `json:"current"`
+	Simulated models.Money  `json:"simulated"`
+	Diff      models.Money  `json:"diff"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// Totals sums the account results of one contract currency
+type Totals struct {
+	Currency  int           `json:"currency"`
+	Accounts  int           `json:"accounts"`
+	Recorded  *models.Money `json:"recorded,omitempty"`
+	Current   models.Money  `json:"current"`
+	Simulated models.Money  `json:"simulated"`
+	Diff      models.Money  `json:"diff"`
+	Cheaper   int           `json:"cheaper"`
+	Dearer    int           `json:"dearer"`
+	Unchanged int           `json:"unchanged"`
+}
+
+// candidate is the plan being simulated
+type candidate struct {
+	info     PlanInfo
+	planData map[string]interface{}
+}
+
+// simAccount is an account with its current plan
+type simAccount struct {
+	id       int
+	login    string
+	planID   int
+	acctAlgo string
+	settings map[string]interface{}
+	currency int
+}
+
+// usage is one session to replay
+type usage struct {
+	startedAt  time.Time
+	finishedAt time.Time
+	classes    map[string]ClassTraffic
+	recorded   models.Money
+}
+
+// New creates a new simulator service
+func New(db *database.PostgreSQL, billingService *billing.Service, logger *zap.Logger, config Config) *Service {
+	if config.DefaultPeriod == 0 {
+		config.DefaultPeriod = 30 * 24 * time.Hour
+	}
+	if config.MaxAccounts == 0 {
+		config.MaxAccounts = 1000
+	}
+
+	return &Service{
+		db:      db,
+		billing: billingService,
+		logger:  logger,
+		config:  config,
+	}
+}
+
+// Simulate replays usage of the selected accounts with the candidate plan and their current plans
+func (s *Service) Simulate(req Request) (*Report, error) {
+	cand, err := s.candidate(req)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Plan: cand.info, Source: SourceHistory}
+	if req.Profile != nil {
+		report.Source = SourceProfile
+	}
+	report.From, report.To, err = s.period(req)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, truncated, err := s.fetchAccounts(req)
+	if err != nil {
+		return nil, err
+	}
+	report.Truncated = truncated
+
+	var usages map[int][]usage
+	if req.Profile != nil {
+		usages, err = profileUsage(req.Profile, accounts, report.From)
+	} else {
+		usages, err = s.fetchUsage(accounts, report.From, report.To)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report.Accounts = make([]AccountResult, 0, len(accounts))
+	for _, account := range accounts {
+		result := s.simulateAccount(account, cand, usages[account.id], report.Source == SourceHistory)
+		if result.Error != "" {
+			report.Failed++
+		}
+		report.Accounts = append(report.Accounts, result)
+	}
+	report.Totals = totals(report.Accounts)
+
+	s.logger.Info("Billing simulation finished",
+		zap.Int("plan_id", cand.info.ID),
+		zap.String("source", report.Source),
+		zap.Int("accounts", len(report.Accounts)),
+		zap.Int("failed", report.Failed))
+
+	return report, nil
+}
+
+// simulateAccount replays the usage of one account with its current plan and with the candidate
+func (s *Service) simulateAccount(account simAccount, cand candidate, sessions []usage, withRecorded bool) AccountResult {
+	result := AccountResult{
+		AccountID: account.id,
+		Login:     account.login,
+		PlanID:    account.planID,
+		Currency:  account.currency,
+		Sessions:  len(sessions),
+	}
+
+	var recorded models.Money
+	for _, u := range sessions {
+		for _, traffic := range u.classes {
+			result.OctetsIn += traffic.In
+			result.OctetsOut += traffic.Out
+		}
+		result.Seconds += int64(u.finishedAt.Sub(u.startedAt) / time.Second)
+		recorded = recorded.Add(u.recorded)
+	}
+	if withRecorded {
+		result.Recorded = &recorded
+	}
+
+	current, err := s.replay(account.acctAlgo, account.currency, account.settings, sessions)
+	if err != nil {
+		result.Error = fmt.Sprintf("current plan: %v", err)
+		return result
+	}
+
+	acctAlgo := cand.info.AcctAlgo
+	if acctAlgo == "" {
+		acctAlgo = account.acctAlgo
+	}
+	simulated, err := s.replay(acctAlgo, account.currency, cand.planData, sessions)
+	if err != nil {
+		result.Error = fmt.Sprintf("simulated plan: %v", err)
+		return result
+	}
+
+	result.Current = current
+	result.Simulated = simulated
+	result.Diff = simulated.Sub(current)
+	return result
+}
+
+// replay charges sessions one after another, carrying plan_data counters between them
+// Traffic of a session is spread evenly over its duration and split at tariff boundaries,
+// like flows of a running session; online time goes through AccountTime.
+func (s *Service) replay(acctAlgo string, currency int, planData map[string]interface{}, sessions []usage) (models.Money, error) {
+	var total models.Money
+
+	for _, u := range sessions {
+		classes := make([]string, 0, len(u.classes))
+		for class := range u.classes {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+
+		parts := splitPeriod(planData, u.startedAt, u.finishedAt)
+		for _, class := range classes {
+			traffic := u.classes[class]
+			for _, direction := range []string{"in", "out"} {
+				octets := traffic.In
+				if direction == "out" {
+					octets = traffic.Out
+				}
+				if octets == 0 {
+					continue
+				}
+
+				var used uint64
+				for i, part := range parts {
+					portion := uint64(float64(octets) * part.share)
+					if i == len(parts)-1 {
+						portion = octets - used
+					}
+					used += portion
+
+					sessionData := map[string]interface{}{
+						billing.TrafficClassKey: class,
+						billing.FlowTimeKey:     part.at,
+					}
+					result, err := s.billing.Account(acctAlgo, currency, planData, sessionData, direction, "", portion)
+					if err != nil {
+						return models.Money{}, err
+					}
+					total = total.Add(result.Amount)
+					planData = result.PlanData
+				}
+			}
+		}
+
+		result, err := s.billing.AccountTime(acctAlgo, currency, planData, map[string]interface{}{}, u.startedAt, u.finishedAt, 0)
+		if err != nil {
+			return models.Money{}, err
+		}
+		if result != nil {
+			total = total.Add(result.Amount)
+			planData = result.PlanData
+		}
+	}
+
+	return total, nil
+}
+
+// periodPart is a share of a session between two tariff boundaries
+type periodPart struct {
+	at    time.Time
+	share float64
+}
+
+// splitPeriod divides from..to at the tariff boundaries of the plan, shares are in proportion to time
+func splitPeriod(planData map[string]interface{}, from, to time.Time) []periodPart {
+	whole := []periodPart{{at: from, share: 1}}
+	if !from.Before(to) {
+		return whole
+	}
+
+	settings, err := models.ParsePlanSettings(planData)
+	if err != nil {
+		return whole // Reported by the billing algorithm
+	}
+	boundaries := settings.TariffBoundaries(from, to)
+	if len(boundaries) == 0 {
+		return whole
+	}
+
+	total := float64(to.Sub(from))
+	parts := make([]periodPart, 0, len(boundaries)+1)
+	start := from
+	for _, end := range append(boundaries, to) {
+		parts = append(parts, periodPart{at: start, share: float64(end.Sub(start)) / total})
+		start = end
+	}
+	return parts
+}
+
+// candidate resolves the plan to simulate
+func (s *Service) candidate(req Request) (candidate, error) {
+	if (req.PlanID == 0) == (req.PlanData == nil) {
+		return candidate{}, fmt.Errorf("%w: exactly one of plan_id and plan_data is required", ErrInvalidRequest)
+	}
+
+	cand := candidate{info: PlanInfo{ID: req.PlanID, AcctAlgo: req.AcctAlgo}, planData: req.PlanData}
+	if req.PlanID != 0 {
+		var acctAlgo, settings string
+		err := s.db.GetDB().QueryRow(
+			"SELECT name, acct_algo, COALESCE(settings, '') FROM plans WHERE id = $1", req.PlanID,
+		).Scan(&cand.info.Name, &acctAlgo, &settings)
+		if err == sql.ErrNoRows {
+			return candidate{}, fmt.Errorf("%w: %d", ErrPlanNotFound, req.PlanID)
+		}
+		if err != nil {
+			return candidate{}, fmt.Errorf("failed to fetch plan: %w", err)
+		}
+		if cand.info.AcctAlgo == "" {
+			cand.info.AcctAlgo = acctAlgo
+		}
+		if cand.planData, err = database.ParsePlanDataFromJSON(settings); err != nil {
+			return candidate{}, fmt.Errorf("plan %d settings: %w", req.PlanID, err)
+		}
+	}
+
+	if _, err := models.ParsePlanSettings(cand.planData); err != nil {
+		return candidate{}, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+	if cand.info.AcctAlgo != "" {
+		if _, err := billing.LookupAlgorithm(cand.info.AcctAlgo); err != nil {
+			return candidate{}, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+		}
+	}
+
+	return cand, nil
+}
+
+// period returns the replayed period: history defaults to DefaultPeriod before now,
+// a profile starts at midnight today
+func (s *Service) period(req Request) (time.Time, time.Time, error) {
+	from, to := req.From, req.To
+
+	if req.Profile != nil {
+		if req.Profile.Days <= 0 || len(req.Profile.Sessions) == 0 {
+			return from, to, fmt.Errorf("%w: profile needs positive days and sessions", ErrInvalidRequest)
+		}
+		if from.IsZero() {
+			now := time.Now()
+			from = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		}
+		return from, from.AddDate(0, 0, req.Profile.Days), nil
+	}
+
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-s.config.DefaultPeriod)
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("%w: from must be before to", ErrInvalidRequest)
+	}
+	return from, to, nil
+}
+
+// fetchAccounts loads active accounts of the request with settings of their current plans
+// Current plans start from plans.settings, the same fresh counters the candidate gets.
+func (s *Service) fetchAccounts(req Request) ([]simAccount, bool, error) {
+	query := `
+		SELECT a.id, a.login, a.plan_id, p.acct_algo, COALESCE(p.settings, ''), a.plan_data, c.currency_id
+		FROM accounts a
+		JOIN plans p ON a.plan_id = p.id
+		JOIN contracts c ON a.contract_id = c.id
+		WHERE a.active`
+	var args []interface{}
+	if len(req.AccountIDs) > 0 {
+		args = append(args, pq.Array(req.AccountIDs))
+		query += fmt.Sprintf(" AND a.id = ANY($%d)", len(args))
+	}
+	if req.CurrentPlanID != 0 {
+		args = append(args, req.CurrentPlanID)
+		query += fmt.Sprintf(" AND a.plan_id = $%d", len(args))
+	}
+	args = append(args, s.config.MaxAccounts+1)
+	query += fmt.Sprintf(" ORDER BY a.id LIMIT $%d", len(args))
+
+	rows, err := s.db.GetDB().Query(query, args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch accounts: %w", err)
+	}
+	defer rows.Close()
+
+	var accounts []simAccount
+	for rows.Next() {
+		var account simAccount
+		var settings, accountPlanData string
+		if err := rows.Scan(&account.id, &account.login, &account.planID, &account.acctAlgo,
+			&settings, &accountPlanData, &account.currency); err != nil {
+			return nil, false, fmt.Errorf("failed to scan account: %w", err)
+		}
+
+		// Plans without settings keep prices in accounts.plan_data only
+		if settings == "" {
+			settings = accountPlanData
+		}
+		if account.settings, err = database.ParsePlanDataFromJSON(settings); err != nil {
+			return nil, false, fmt.Errorf("account %d plan data: %w", account.id, err)
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("failed to read accounts: %w", err)
+	}
+
+	if len(accounts) > s.config.MaxAccounts {
+		return accounts[:s.config.MaxAccounts], true, nil
+	}
+	return accounts, false, nil
+}
+
+// fetchUsage loads sessions started within from..to with their traffic by class
+// Sessions without details (still running) are replayed as internet traffic.
+func (s *Service) fetchUsage(accounts []simAccount, from, to time.Time) (map[int][]usage, error) {
+	usages := make(map[int][]usage)
+	if len(accounts) == 0 {
+		return usages, nil
+	}
+
+	ids := make([]int, len(accounts))
+	for i, account := range accounts {
+		ids[i] = account.id
+	}
+
+	rows, err := s.db.GetDB().Query(`
+		SELECT s.id, s.account_id, s.started_at, COALESCE(s.finished_at, s.updated_at, s.started_at),
+			s.octets_in, s.octets_out, s.amount, d.traffic_class, d.octets_in, d.octets_out
+		FROM iptraffic_sessions s
+		LEFT JOIN session_details d ON d.id = s.id
+		WHERE s.account_id = ANY($1) AND s.started_at >= $2 AND s.started_at < $3
+		ORDER BY s.account_id, s.started_at, s.id`, pq.Array(ids), from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sessions: %w", err)
+	}
+	defer rows.Close()
+
+	lastID := 0
+	for rows.Next() {
+		var (
+			sessionID, accountID          int
+			startedAt, finishedAt         time.Time
+			octetsIn, octetsOut           int64
+			amount                        models.Money
+			class                         sql.NullString
+			classOctetsIn, classOctetsOut sql.NullInt64
+		)
+		if err := rows.Scan(&sessionID, &accountID, &startedAt, &finishedAt, &octetsIn, &octetsOut,
+			&amount, &class, &classOctetsIn, &classOctetsOut); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+
+		if sessionID != lastID {
+			lastID = sessionID
+			u := usage{
+				startedAt:  startedAt,
+				finishedAt: finishedAt,
+				classes:    make(map[string]ClassTraffic),
+				recorded:   amount,
+			}
+			if !class.Valid {
+				u.classes["internet"] = ClassTraffic{In: uint64(octetsIn), Out: uint64(octetsOut)}
+			}
+			usages[accountID] = append(usages[accountID], u)
+		}
+
+		// Online time charges are recorded as a class of their own, time is replayed from the duration
+		if class.Valid && class.String != billing.TimeTrafficClass {
+			sessions := usages[accountID]
+			sessions[len(sessions)-1].classes[class.String] = ClassTraffic{
+				In:  uint64(classOctetsIn.Int64),
+				Out: uint64(classOctetsOut.Int64),
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sessions: %w", err)
+	}
+
+	return usages, nil
+}
+
+// profileUsage builds the sessions of a synthetic profile, the same for every account
+func profileUsage(profile *Profile, accounts []simAccount, from time.Time) (map[int][]usage, error) {
+	var sessions []usage
+	for day := 0; day < profile.Days; day++ {
+		date := from.AddDate(0, 0, day)
+		for i, ps := range profile.Sessions {
+			start, err := time.Parse("15:04", ps.Start)
+			if err != nil {
+				return nil, fmt.Errorf("%w: profile.sessions[%d].start must be HH:MM", ErrInvalidRequest, i)
+			}
+			if ps.Duration < 0 {
+				return nil, fmt.Errorf("%w: profile.sessions[%d].duration must not be negative", ErrInvalidRequest, i)
+			}
+
+			startedAt := time.Date(date.Year(), date.Month(), date.Day(), start.Hour(), start.Minute(), 0, 0, from.Location())
+			sessions = append(sessions, usage{
+				startedAt:  startedAt,
+				finishedAt: startedAt.Add(time.Duration(ps.Duration) * time.Second),
+				classes:    ps.Traffic,
+			})
+		}
+	}
+
+	usages := make(map[int][]usage, len(accounts))
+	for _, account := range accounts {
+		usages[account.id] = sessions
+	}
+	return usages, nil
+}
+
+// totals sums successful account results by contract currency
+func totals(results []AccountResult) []Totals {
+	byCurrency := make(map[int]*Totals)
+	var currencies []int
+
+	for _, result := range results {
+		if result.Error != "" {
+			continue
+		}
+		t, ok := byCurrency[result.Currency]
+		if !ok {
+			t = &Totals{Currency: result.Currency}
+			byCurrency[result.Currency] = t
+			currencies = append(currencies, result.Currency)
+		}
+
+		t.Accounts++
+		t.Current = t.Current.Add(result.Current)
+		t.Simulated = t.Simulated.Add(result.Simulated)
+		t.Diff = t.Diff.Add(result.Diff)
+		if result.Recorded != nil {
+			recorded := *result.Recorded
+			if t.Recorded != nil {
+				recorded = t.Recorded.Add(recorded)
+			}
+			t.Recorded = &recorded
+		}
+
+		switch result.Diff.Sign() {
+		case -1:
+			t.Cheaper++
+		case 1:
+			t.Dearer++
+		default:
+			t.Unchanged++
+		}
+	}
+
+	sort.Ints(currencies)
+	list := make([]Totals, 0, len(currencies))
+	for _, currency := range currencies {
+		list = append(list, *byCurrency[currency])
+	}
+	return list
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -15,10 +16,24 @@ import (
 
 	"isp-billing/internal/database"
 	"isp-billing/internal/handlers"
+	"isp-billing/internal/models"
+	"isp-billing/internal/services/auth"
 	"isp-billing/internal/services/billing"
+	"isp-billing/internal/services/binding"
+	"isp-billing/internal/services/charges"
+	"isp-billing/internal/services/currency"
 	"isp-billing/internal/services/disconnect"
+	"isp-billing/internal/services/dunning"
+	"isp-billing/internal/services/gateway"
+	"isp-billing/internal/services/invoice"
 	"isp-billing/internal/services/ippool"
+	"isp-billing/internal/services/payment"
+	"isp-billing/internal/services/planchange"
+	"isp-billing/internal/services/promised"
+	"isp-billing/internal/services/quota"
+	"isp-billing/internal/services/realm"
 	"isp-billing/internal/services/session"
+	"isp-billing/internal/services/simulator"
 	"isp-billing/internal/services/tclass"
 )
 
@@ -61,7 +76,29 @@ func main() {
 	}
 
 	// Initialize services
-	billingService := billing.NewService(db, map[string]interface{}{})
+	currencyService, err := currency.New(db, logger, currency.Config{
+		RateSource: currency.SourceDB,
+		CacheTTL:   5 * time.Minute,
+	})
+	if err != nil {
+		logger.Fatal("Failed to initialize currency service", zap.Error(err))
+	}
+
+	billingService := billing.NewService(db, currencyService, map[string]interface{}{})
+
+	// Every plans.auth_algo / acct_algo must be registered, otherwise no account of the plan works.
+	// Bad plan_data only affects its own accounts: they are rejected at authorize, so it is
+	// reported here without stopping the server (validate-db validate-plans checks it strictly).
+	if err := billingService.ValidatePlans(); err != nil {
+		logger.Fatal("Invalid billing plans", zap.Error(err))
+	}
+	if problems, err := billingService.PlanDataProblems(); err != nil {
+		logger.Error("Failed to check plan data", zap.Error(err))
+	} else {
+		for _, problem := range problems {
+			logger.Warn("Invalid plan data, affected accounts are rejected at authorize", zap.String("problem", problem))
+		}
+	}
 
 	ippoolService := ippool.New(rdb, logger, ippool.Config{})
 
@@ -70,23 +107,127 @@ func main() {
 		Secret:        "secret",
 		ScriptEnabled: true,
 		ScriptPath:    "/opt/billing/scripts",
+		CoAEnabled:    true,
 	})
 
 	sessionService := session.New(rdb, db, billingService, ippoolService, disconnectService, logger, session.Config{
-		SessionTimeout: 3600,
-		SyncInterval:   30,
+		SessionTimeout:         3600,
+		SyncInterval:           30,
+		DisconnectOnLowBalance: true,
+	})
+
+	quotaService := quota.New(db, sessionService, currencyService, logger, quota.Config{
+		ResetInterval: time.Hour,
+	})
+	quotaService.Start()
+	defer quotaService.Stop()
+
+	subscriptionService := billing.NewSubscriptionService(db, currencyService, logger, &billing.SubscriptionConfig{
+		Enabled:                    true,
+		GracePeriodDays:            3,
+		DisableOnInsufficientFunds: true,
+	})
+
+	dunningService := dunning.New(db, subscriptionService, sessionService, logger, dunning.Config{
+		CheckInterval:  15 * time.Minute,
+		ThrottleAfter:  24 * time.Hour,
+		ThrottleShaper: "captive",
+	})
+	dunningService.Start()
+	defer dunningService.Stop()
+
+	planChangeService := planchange.New(db, subscriptionService, sessionService, logger, planchange.Config{
+		CheckInterval: 5 * time.Minute,
+	})
+	planChangeService.Start()
+	defer planChangeService.Stop()
+
+	chargesService := charges.New(db, currencyService, subscriptionService, logger)
+
+	invoiceService, err := invoice.New(db, currencyService, logger, invoice.Config{
+		DueDays:       14,
+		AutoIssue:     true,
+		CheckInterval: time.Hour,
+	})
+	if err != nil {
+		logger.Fatal("Failed to initialize invoice service", zap.Error(err))
+	}
+	invoiceService.Start()
+	defer invoiceService.Stop()
+
+	paymentService := payment.New(db, currencyService, dunningService, logger, payment.Config{
+		MaxImportRows: 10000,
+	})
+
+	// Gateways credit money on signed webhooks: secrets come from the environment and a
+	// gateway without one is not registered
+	gatewayService, err := gateway.New(db, paymentService, logger, gateway.Config{
+		Providers: map[string]gateway.ProviderConfig{
+			"click": {Kind: gateway.KindClick, Secret: os.Getenv("CLICK_SECRET_KEY"), ServiceID: os.Getenv("CLICK_SERVICE_ID")},
+			"payme": {Kind: gateway.KindPayme, Secret: os.Getenv("PAYME_MERCHANT_KEY")},
+		},
+	})
+	if err != nil {
+		logger.Fatal("Failed to initialize payment gateways", zap.Error(err))
+	}
+
+	promisedService := promised.New(db, currencyService, sessionService, dunningService, logger, promised.Config{
+		MaxAmount:     models.NewMoney(50),
+		MaxDays:       3,
+		Period:        30 * 24 * time.Hour,
+		PerPeriod:     1,
+		CheckInterval: 5 * time.Minute,
+	})
+	promisedService.Start()
+	defer promisedService.Stop()
+
+	simulatorService := simulator.New(db, billingService, logger, simulator.Config{
+		DefaultPeriod: 30 * 24 * time.Hour,
+		MaxAccounts:   1000,
+	})
+
+	bindingService := binding.New(db, logger, binding.Config{
+		DefaultPolicy: binding.PolicyOff,
 	})
 
+	authService := auth.New(logger, auth.Config{
+		Mode: auth.ModeFreeRADIUS,
+	})
+
+	// Realms and partner settlement rates come from the realm section of config.yaml
+	realmConfig, err := realm.LoadConfig("config.yaml")
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Warn("No realm configuration, all logins go to local billing", zap.Error(err))
+	} else if err != nil {
+		logger.Fatal("Invalid realm configuration", zap.Error(err))
+	}
+	realmService := realm.New(db, logger, realmConfig)
+
 	tclassService := tclass.New(logger, tclass.Config{
 		ConfigFile: "tclass.yaml",
 	})
 
 	// Initialize handlers
-	adminHandler := handlers.NewAdminHandler(db)
+	adminHandler := handlers.NewAdminHandler(db, chargesService)
 	sessionHandler := handlers.NewSessionHandler(sessionService, logger)
 	ippoolHandler := handlers.NewIPPoolHandler(ippoolService, logger)
 	disconnectHandler := handlers.NewDisconnectHandler(disconnectService, logger)
 	tclassHandler := handlers.NewTClassHandler(tclassService, logger)
+	radiusHandler := handlers.NewRADIUSHandler(logger, sessionService, ippoolService, billingService, bindingService, authService, realmService, db)
+	bindingHandler := handlers.NewBindingHandler(bindingService, logger)
+	realmHandler := handlers.NewRealmHandler(realmService, logger)
+	currencyHandler := handlers.NewCurrencyHandler(currencyService, logger)
+	quotaHandler := handlers.NewQuotaHandler(quotaService, logger)
+	simulatorHandler := handlers.NewSimulatorHandler(simulatorService, logger)
+	subscriptionHandler := handlers.NewSubscriptionHandler(subscriptionService, logger)
+	dunningHandler := handlers.NewDunningHandler(dunningService, logger)
+	planChangeHandler := handlers.NewPlanChangeHandler(planChangeService, logger)
+	chargesHandler := handlers.NewChargesHandler(chargesService, logger)
+	invoiceHandler := handlers.NewInvoiceHandler(invoiceService, logger)
+	paymentHandler := handlers.NewPaymentHandler(paymentService, logger)
+	gatewayHandler := handlers.NewGatewayHandler(gatewayService, logger)
+	promisedHandler := handlers.NewPromisedHandler(promisedService, logger)
+	netflowHandler := handlers.NewNetFlowHandler(db, billingService, sessionService)
 
 	// Setup Gin router
 	gin.SetMode(gin.ReleaseMode)
@@ -122,12 +263,58 @@ func main() {
 		api.POST("/disconnect/session", disconnectHandler.DisconnectSession)
 		api.POST("/disconnect/ip", disconnectHandler.DisconnectByIP)
 
+		// NetFlow collector routes
+		api.POST("/netflow/v5", netflowHandler.ProcessNetFlowV5)
+		api.POST("/netflow/v9", netflowHandler.ProcessNetFlowV9)
+
 		// Traffic Classification routes
 		api.GET("/tclass/classify/:ip", tclassHandler.ClassifyIP)
 		api.GET("/tclass/classes", tclassHandler.GetAllClasses)
 		api.POST("/tclass/reload", tclassHandler.ReloadConfig)
+
+		// FreeRADIUS REST routes
+		radiusHandler.RegisterRoutes(api)
+
+		// Device binding routes
+		bindingHandler.RegisterRoutes(api)
+
+		// Realm routing / partner settlement routes
+		realmHandler.RegisterRoutes(api)
+
+		// Exchange rate routes
+		currencyHandler.RegisterRoutes(api)
+
+		// Volume quota routes
+		quotaHandler.RegisterRoutes(api)
+
+		// Billing dry-run routes
+		simulatorHandler.RegisterRoutes(api)
+
+		// Unpaid subscription fee routes
+		dunningHandler.RegisterRoutes(api)
+
+		// Plan change routes
+		planChangeHandler.RegisterRoutes(api)
+
+		// One-off charge, add-on and discount routes
+		chargesHandler.RegisterRoutes(api)
+
+		// Invoice routes
+		invoiceHandler.RegisterRoutes(api)
+
+		// Payment routes
+		paymentHandler.RegisterRoutes(api)
+
+		// Payment gateway webhook and reconciliation routes
+		gatewayHandler.RegisterRoutes(api)
+
+		// Promised payment (temporary credit) routes
+		promisedHandler.RegisterRoutes(api)
 	}
 
+	// Subscription billing routes (registers its own /api/v1 group)
+	subscriptionHandler.RegisterRoutes(router)
+
 	// Start HTTP server
 	server := &http.Server{
 		Addr:         ":8080",
@@ -0,0 +1,26 @@
+-- Привязка аккаунтов к MAC адресам / Calling-Station-Id
+-- Хранится по аналогии с contract_info: отдельная таблица значений на аккаунт
+
+CREATE TABLE IF NOT EXISTS account_bindings (
+    id          SERIAL PRIMARY KEY,
+    account_id  INTEGER NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+    kind        VARCHAR(16) NOT NULL,          -- mac | cid
+    value       VARCHAR(128) NOT NULL,         -- нормализованное значение
+    learned     BOOLEAN NOT NULL DEFAULT FALSE, -- добавлено автоматически (auto-learn)
+    created_at  TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE (account_id, kind, value)
+);
+
+CREATE INDEX IF NOT EXISTS account_bindings_account_id_idx ON account_bindings(account_id);
+
+CREATE TABLE IF NOT EXISTS account_binding_history (
+    id          SERIAL PRIMARY KEY,
+    account_id  INTEGER NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+    action      VARCHAR(16) NOT NULL,          -- added | removed | learned | rejected | flagged
+    kind        VARCHAR(16) NOT NULL,
+    value       VARCHAR(128) NOT NULL,
+    actor       VARCHAR(128) NOT NULL DEFAULT '',
+    created_at  TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS account_binding_history_account_id_idx ON account_binding_history(account_id, created_at);
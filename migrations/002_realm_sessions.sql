@@ -0,0 +1,20 @@
+-- Сессии пользователей партнеров (роуминг по realm), для взаиморасчетов
+
+CREATE TABLE IF NOT EXISTS realm_sessions (
+    id            SERIAL PRIMARY KEY,
+    realm         VARCHAR(128) NOT NULL,
+    partner       VARCHAR(128) NOT NULL,
+    target        VARCHAR(16) NOT NULL,          -- local | proxy
+    username      VARCHAR(128) NOT NULL,
+    sid           VARCHAR(128) NOT NULL,
+    nas_ip        VARCHAR(64) NOT NULL DEFAULT '',
+    octets_in     BIGINT NOT NULL DEFAULT 0,
+    octets_out    BIGINT NOT NULL DEFAULT 0,
+    session_time  INTEGER NOT NULL DEFAULT 0,
+    started_at    TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at    TIMESTAMP NOT NULL DEFAULT NOW(),
+    finished_at   TIMESTAMP,
+    UNIQUE (realm, sid)
+);
+
+CREATE INDEX IF NOT EXISTS realm_sessions_partner_started_idx ON realm_sessions(partner, started_at);
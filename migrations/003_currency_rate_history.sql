@@ -0,0 +1,17 @@
+-- История курсов валют с датой вступления в силу.
+-- currencies_rate хранит текущий курс (для функций БД и совместимости с Erlang),
+-- currency_rate_history - все установленные курсы, в том числе будущие.
+
+CREATE TABLE IF NOT EXISTS currency_rate_history (
+    id             SERIAL PRIMARY KEY,
+    from_id        INTEGER NOT NULL REFERENCES currencies(id),
+    to_id          INTEGER NOT NULL REFERENCES currencies(id),
+    rate           NUMERIC(20,10) NOT NULL CHECK (rate > 0),
+    effective_from TIMESTAMP NOT NULL,
+    comment        VARCHAR(255) NOT NULL DEFAULT '',
+    created_at     TIMESTAMP NOT NULL DEFAULT NOW(),
+    CHECK (from_id <> to_id)
+);
+
+CREATE INDEX IF NOT EXISTS currency_rate_history_pair_idx
+    ON currency_rate_history(from_id, to_id, effective_from DESC);
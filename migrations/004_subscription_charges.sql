@@ -0,0 +1,38 @@
+-- Журнал списаний абонентской платы.
+-- Одна строка на аккаунт и расчетный период: успешные, неудачные и незавершенные списания.
+-- По нему проверяется повторное списание, строится история и отчет о неудачных списаниях.
+
+CREATE TABLE IF NOT EXISTS subscription_charges (
+    id             SERIAL PRIMARY KEY,
+    account_id     INTEGER NOT NULL REFERENCES accounts(id),
+    plan_id        INTEGER NOT NULL REFERENCES plans(id),
+    period_start   TIMESTAMP NOT NULL,
+    period_end     TIMESTAMP NOT NULL,
+    amount         NUMERIC(20,10) NOT NULL DEFAULT 0,
+    currency_id    INTEGER NOT NULL REFERENCES currencies(id),
+    status         VARCHAR(16) NOT NULL DEFAULT 'pending'
+                   CHECK (status IN ('pending', 'success', 'failed')),
+    failure_reason VARCHAR(255) NOT NULL DEFAULT '',
+    transaction_id INTEGER REFERENCES fin_transactions(id),
+    attempts       INTEGER NOT NULL DEFAULT 0,
+    created_at     TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at     TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE (account_id, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS subscription_charges_status_idx
+    ON subscription_charges(status, updated_at DESC);
+
+-- Списания, сделанные до появления журнала, искались по комментарию fin_transactions
+-- для всего договора - переносим их для всех аккаунтов договора, чтобы период не списался повторно.
+INSERT INTO subscription_charges (account_id, plan_id, period_start, period_end, amount, currency_id,
+                                  status, transaction_id, attempts, created_at, updated_at)
+SELECT a.id, a.plan_id,
+       substring(ft.comment from 'period (\d{4}-\d{2}-\d{2})')::timestamp,
+       substring(ft.comment from ' - (\d{4}-\d{2}-\d{2})$')::timestamp + INTERVAL '1 day' - INTERVAL '1 second',
+       ABS(ft.amount), ft.currency_id, 'success', ft.id, 1, ft.created_at, ft.created_at
+FROM fin_transactions ft
+JOIN accounts a ON a.contract_id = ft.contract_id
+WHERE ft.comment ~ '^Monthly subscription fee for period \d{4}-\d{2}-\d{2} - \d{4}-\d{2}-\d{2}$'
+  AND ft.amount < 0
+ON CONFLICT (account_id, period_start) DO NOTHING;
@@ -0,0 +1,31 @@
+-- Работа с неоплаченной абонентской платой (dunning).
+-- Неудачное списание из subscription_charges открывает случай: повтор при поступлении платежа,
+-- затем предупреждение, ограничение скорости (DUNNING_SHAPER) и отключение аккаунта.
+-- Каждый переход состояния записывается в dunning_events.
+
+CREATE TABLE IF NOT EXISTS dunning_cases (
+    id         SERIAL PRIMARY KEY,
+    account_id INTEGER NOT NULL REFERENCES accounts(id),
+    charge_id  INTEGER NOT NULL UNIQUE REFERENCES subscription_charges(id),
+    state      VARCHAR(16) NOT NULL
+               CHECK (state IN ('grace', 'warned', 'throttled', 'suspended', 'resolved', 'cancelled')),
+    opened_at  TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    retried_at TIMESTAMP NOT NULL DEFAULT NOW(), -- Платежи после этого момента вызывают повтор списания
+    closed_at  TIMESTAMP
+);
+
+-- Не больше одного открытого случая на аккаунт
+CREATE UNIQUE INDEX IF NOT EXISTS dunning_cases_open_idx
+    ON dunning_cases(account_id) WHERE closed_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS dunning_events (
+    id         SERIAL PRIMARY KEY,
+    case_id    INTEGER NOT NULL REFERENCES dunning_cases(id),
+    from_state VARCHAR(16) NOT NULL DEFAULT '',
+    to_state   VARCHAR(16) NOT NULL,
+    reason     VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS dunning_events_case_idx ON dunning_events(case_id, id);
@@ -0,0 +1,14 @@
+-- Расчетные периоды договоров.
+-- billing_cycle переопределяет BILLING_CYCLE плана для всех аккаунтов договора:
+-- 'monthly' (календарный месяц), 'anniversary', 'quarterly', 'yearly', 'days:N'.
+-- billing_anchor - дата, от которой считаются периоды; NULL - дата активации аккаунта.
+
+ALTER TABLE contracts ADD COLUMN IF NOT EXISTS billing_cycle VARCHAR(16)
+    CHECK (billing_cycle IS NULL OR billing_cycle IN ('monthly', 'anniversary', 'quarterly', 'yearly')
+           OR billing_cycle ~ '^days:[0-9]{1,3}$');
+
+ALTER TABLE contracts ADD COLUMN IF NOT EXISTS billing_anchor DATE;
+
+-- Поиск оплаченных периодов, перекрывающих период после смены расчетного цикла
+CREATE INDEX IF NOT EXISTS subscription_charges_account_period_idx
+    ON subscription_charges(account_id, period_end);
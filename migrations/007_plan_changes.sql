@@ -0,0 +1,32 @@
+-- Смена тарифного плана аккаунта.
+-- Немедленная смена закрывает период старого плана с возвратом неиспользованной части
+-- и списывает новый план пропорционально до конца его периода; отложенная ждет начала
+-- следующего расчетного периода (effective_at).
+
+CREATE TABLE IF NOT EXISTS plan_changes (
+    id              SERIAL PRIMARY KEY,
+    account_id      INTEGER NOT NULL REFERENCES accounts(id),
+    from_plan_id    INTEGER NOT NULL REFERENCES plans(id),
+    to_plan_id      INTEGER NOT NULL REFERENCES plans(id),
+    plan_data       TEXT NOT NULL DEFAULT '',      -- JSON, пусто - plans.settings нового плана
+    state           VARCHAR(16) NOT NULL
+                    CHECK (state IN ('scheduled', 'applied', 'cancelled', 'failed')),
+    effective_at    TIMESTAMP NOT NULL,
+    created_at      TIMESTAMP NOT NULL DEFAULT NOW(),
+    applied_at      TIMESTAMP,
+    credit          NUMERIC(20,10) NOT NULL DEFAULT 0, -- Возврат за неиспользованную часть периода
+    credit_currency INTEGER REFERENCES currencies(id),
+    charge          NUMERIC(20,10) NOT NULL DEFAULT 0, -- Списание за новый план до конца периода
+    charge_currency INTEGER REFERENCES currencies(id),
+    charge_id       INTEGER REFERENCES subscription_charges(id),
+    error           VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+-- Не больше одной отложенной смены на аккаунт
+CREATE UNIQUE INDEX IF NOT EXISTS plan_changes_scheduled_idx
+    ON plan_changes(account_id) WHERE state = 'scheduled';
+
+CREATE INDEX IF NOT EXISTS plan_changes_due_idx
+    ON plan_changes(effective_at) WHERE state = 'scheduled';
+CREATE INDEX IF NOT EXISTS plan_changes_account_idx
+    ON plan_changes(account_id, id DESC);
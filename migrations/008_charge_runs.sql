@@ -0,0 +1,45 @@
+-- Прогоны списаний абонентской платы.
+-- Аккаунты обрабатываются по возрастанию id пачками; после каждой пачки сохраняются
+-- счетчики и контрольная точка (checkpoint - последний id пачки), прерванный прогон
+-- продолжается с нее. Повторная обработка пачки безопасна: списания идемпотентны.
+
+CREATE TABLE IF NOT EXISTS charge_runs (
+    id               SERIAL PRIMARY KEY,
+    kind             VARCHAR(16) NOT NULL CHECK (kind IN ('monthly', 'due')),
+    target_date      TIMESTAMP NOT NULL,
+    state            VARCHAR(16) NOT NULL
+                     CHECK (state IN ('running', 'completed', 'cancelled', 'failed')),
+    total            INTEGER NOT NULL DEFAULT 0,   -- Активных аккаунтов при создании
+    processed        INTEGER NOT NULL DEFAULT 0,
+    succeeded        INTEGER NOT NULL DEFAULT 0,
+    failed           INTEGER NOT NULL DEFAULT 0,
+    skipped          INTEGER NOT NULL DEFAULT 0,
+    errors           INTEGER NOT NULL DEFAULT 0,
+    checkpoint       INTEGER NOT NULL DEFAULT 0,
+    cancel_requested BOOLEAN NOT NULL DEFAULT false,
+    started_at       TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP NOT NULL DEFAULT NOW(),
+    finished_at      TIMESTAMP,
+    error            VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS charge_runs_running_idx
+    ON charge_runs(updated_at) WHERE state = 'running';
+
+-- Аккаунты, которые прогон не смог обработать
+CREATE TABLE IF NOT EXISTS charge_run_errors (
+    id         SERIAL PRIMARY KEY,
+    run_id     INTEGER NOT NULL REFERENCES charge_runs(id) ON DELETE CASCADE,
+    account_id INTEGER NOT NULL REFERENCES accounts(id),
+    error      VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS charge_run_errors_run_idx
+    ON charge_run_errors(run_id, id DESC);
+
+-- Прогон, создавший или повторивший списание
+ALTER TABLE subscription_charges ADD COLUMN IF NOT EXISTS run_id INTEGER REFERENCES charge_runs(id);
+
+CREATE INDEX IF NOT EXISTS subscription_charges_run_idx
+    ON subscription_charges(run_id) WHERE run_id IS NOT NULL;
@@ -0,0 +1,65 @@
+-- Разовые начисления, дополнительные услуги и скидки.
+-- Разовые списания и зачисления проводятся через debit_transaction / credit_transaction
+-- и хранятся с кодом причины. Дополнительные услуги и скидки учитываются в списании
+-- абонентской платы за период; состав списания - subscription_charges.items (JSON).
+
+CREATE TABLE IF NOT EXISTS account_charges (
+    id             SERIAL PRIMARY KEY,
+    account_id     INTEGER NOT NULL REFERENCES accounts(id),
+    kind           VARCHAR(8) NOT NULL CHECK (kind IN ('debit', 'credit')),
+    reason         VARCHAR(32) NOT NULL,
+    amount         NUMERIC(20,10) NOT NULL CHECK (amount > 0),
+    currency_id    INTEGER NOT NULL REFERENCES currencies(id),
+    description    VARCHAR(255) NOT NULL DEFAULT '',
+    transaction_id INTEGER NOT NULL REFERENCES fin_transactions(id),
+    created_at     TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS account_charges_account_idx
+    ON account_charges(account_id, id DESC);
+
+-- Каталог дополнительных услуг (статический IP, пакет ТВ), цена за месяц
+CREATE TABLE IF NOT EXISTS addons (
+    id          SERIAL PRIMARY KEY,
+    code        VARCHAR(32) NOT NULL UNIQUE,
+    name        VARCHAR(128) NOT NULL,
+    monthly_fee NUMERIC(20,10) NOT NULL DEFAULT 0 CHECK (monthly_fee >= 0),
+    currency_id INTEGER NOT NULL REFERENCES currencies(id),
+    active      BOOLEAN NOT NULL DEFAULT true
+);
+
+CREATE TABLE IF NOT EXISTS account_addons (
+    id          SERIAL PRIMARY KEY,
+    account_id  INTEGER NOT NULL REFERENCES accounts(id),
+    addon_id    INTEGER NOT NULL REFERENCES addons(id),
+    quantity    INTEGER NOT NULL DEFAULT 1 CHECK (quantity > 0),
+    monthly_fee NUMERIC(20,10),                -- NULL - цена каталога
+    started_at  TIMESTAMP NOT NULL DEFAULT NOW(),
+    ended_at    TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS account_addons_account_idx
+    ON account_addons(account_id, started_at);
+
+-- Скидки аккаунта или всех аккаунтов плана на периоды, начинающиеся в valid_from..valid_until
+CREATE TABLE IF NOT EXISTS discounts (
+    id          SERIAL PRIMARY KEY,
+    account_id  INTEGER REFERENCES accounts(id),
+    plan_id     INTEGER REFERENCES plans(id),
+    kind        VARCHAR(8) NOT NULL CHECK (kind IN ('percent', 'fixed')),
+    value       NUMERIC(20,10) NOT NULL CHECK (value > 0),
+    currency_id INTEGER REFERENCES currencies(id), -- Для fixed, NULL - валюта списания
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    valid_from  DATE NOT NULL DEFAULT CURRENT_DATE,
+    valid_until DATE,
+    created_at  TIMESTAMP NOT NULL DEFAULT NOW(),
+    CHECK ((account_id IS NULL) <> (plan_id IS NULL)),
+    CHECK (kind <> 'percent' OR value <= 100),
+    CHECK (valid_until IS NULL OR valid_until >= valid_from)
+);
+
+CREATE INDEX IF NOT EXISTS discounts_account_idx ON discounts(account_id) WHERE account_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS discounts_plan_idx ON discounts(plan_id) WHERE plan_id IS NOT NULL;
+
+-- Состав списания абонентской платы: план, дополнительные услуги, скидки
+ALTER TABLE subscription_charges ADD COLUMN IF NOT EXISTS items TEXT NOT NULL DEFAULT '';
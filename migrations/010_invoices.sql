@@ -0,0 +1,80 @@
+-- Счета договоров за календарный месяц.
+-- Счет собирает абонентскую плату, трафик (iptraffic_sessions.amount) и разовые начисления
+-- договора за период. Документ (JSON) сохраняется при выставлении и больше не меняется:
+-- триггер запрещает изменения, кроме аннулирования (state, voided_at, void_reason).
+-- Номера счетов сквозные по году, без пропусков (invoice_counters).
+
+CREATE TABLE IF NOT EXISTS invoices (
+    id              SERIAL PRIMARY KEY,
+    number          VARCHAR(32) NOT NULL UNIQUE,
+    contract_id     INTEGER NOT NULL REFERENCES contracts(id),
+    period_start    TIMESTAMP NOT NULL,
+    period_end      TIMESTAMP NOT NULL,
+    issued_at       TIMESTAMP NOT NULL DEFAULT NOW(),
+    due_at          TIMESTAMP NOT NULL,
+    currency_id     INTEGER NOT NULL REFERENCES currencies(id),
+    total           NUMERIC(20,10) NOT NULL,
+    tax             NUMERIC(20,10) NOT NULL DEFAULT 0,
+    state           VARCHAR(8) NOT NULL DEFAULT 'issued' CHECK (state IN ('issued', 'void')),
+    document        TEXT NOT NULL,          -- JSON, models.Invoice на момент выставления
+    document_sha256 VARCHAR(64) NOT NULL,   -- Контрольная сумма документа
+    voided_at       TIMESTAMP,
+    void_reason     VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+-- Не больше одного действующего счета договора за период
+CREATE UNIQUE INDEX IF NOT EXISTS invoices_contract_period_idx
+    ON invoices(contract_id, period_start) WHERE state = 'issued';
+CREATE INDEX IF NOT EXISTS invoices_contract_idx
+    ON invoices(contract_id, period_start DESC);
+
+CREATE TABLE IF NOT EXISTS invoice_lines (
+    id          SERIAL PRIMARY KEY,
+    invoice_id  INTEGER NOT NULL REFERENCES invoices(id),
+    line_no     INTEGER NOT NULL,
+    kind        VARCHAR(16) NOT NULL CHECK (kind IN ('subscription', 'traffic', 'charge', 'credit')),
+    account_id  INTEGER REFERENCES accounts(id),
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    amount      NUMERIC(20,10) NOT NULL,
+    UNIQUE (invoice_id, line_no)
+);
+
+CREATE TABLE IF NOT EXISTS invoice_counters (
+    prefix      VARCHAR(16) NOT NULL,
+    year        INTEGER NOT NULL,
+    last_number INTEGER NOT NULL,
+    PRIMARY KEY (prefix, year)
+);
+
+-- Неизменяемость счетов: разрешено только аннулирование действующего счета
+CREATE OR REPLACE FUNCTION invoices_immutable() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        RAISE EXCEPTION 'invoice % cannot be deleted', OLD.number;
+    END IF;
+    IF OLD.state <> 'issued' OR NEW.state <> 'void'
+        OR (NEW.id, NEW.number, NEW.contract_id, NEW.period_start, NEW.period_end, NEW.issued_at,
+            NEW.due_at, NEW.currency_id, NEW.total, NEW.tax, NEW.document, NEW.document_sha256)
+        IS DISTINCT FROM
+           (OLD.id, OLD.number, OLD.contract_id, OLD.period_start, OLD.period_end, OLD.issued_at,
+            OLD.due_at, OLD.currency_id, OLD.total, OLD.tax, OLD.document, OLD.document_sha256)
+    THEN
+        RAISE EXCEPTION 'invoice % is immutable', OLD.number;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS invoices_immutable ON invoices;
+CREATE TRIGGER invoices_immutable BEFORE UPDATE OR DELETE ON invoices
+    FOR EACH ROW EXECUTE PROCEDURE invoices_immutable();
+
+CREATE OR REPLACE FUNCTION invoice_lines_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'invoice lines are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS invoice_lines_immutable ON invoice_lines;
+CREATE TRIGGER invoice_lines_immutable BEFORE UPDATE OR DELETE ON invoice_lines
+    FOR EACH ROW EXECUTE PROCEDURE invoice_lines_immutable();
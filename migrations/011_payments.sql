@@ -0,0 +1,37 @@
+-- Платежи абонентов.
+-- Платеж зачисляется через credit_transaction, возврат (refund) и отмена (reversal) списываются
+-- через debit_transaction и ссылаются на исходный платеж (original_id). Повторный запрос с тем же
+-- ключом идемпотентности или той же внешней ссылкой источника не проводит платеж второй раз.
+
+CREATE TABLE IF NOT EXISTS payments (
+    id              SERIAL PRIMARY KEY,
+    kind            VARCHAR(8) NOT NULL CHECK (kind IN ('payment', 'refund', 'reversal')),
+    state           VARCHAR(8) NOT NULL DEFAULT 'posted' CHECK (state IN ('posted', 'reversed')),
+    account_id      INTEGER NOT NULL REFERENCES accounts(id),
+    contract_id     INTEGER NOT NULL REFERENCES contracts(id),
+    amount          NUMERIC(20,10) NOT NULL CHECK (amount > 0),
+    currency_id     INTEGER NOT NULL REFERENCES currencies(id),
+    refunded        NUMERIC(20,10) NOT NULL DEFAULT 0, -- Возвращено и отменено из платежа
+    source          VARCHAR(32) NOT NULL,              -- api, import, банк, платежный шлюз
+    external_ref    VARCHAR(128) NOT NULL DEFAULT '',  -- Номер платежа в банке / шлюзе
+    idempotency_key VARCHAR(160) NOT NULL UNIQUE,
+    original_id     INTEGER REFERENCES payments(id),
+    comment         VARCHAR(255) NOT NULL DEFAULT '',
+    transaction_id  INTEGER NOT NULL REFERENCES fin_transactions(id),
+    balance_after   NUMERIC(20,10) NOT NULL,
+    paid_at         TIMESTAMP NOT NULL,                -- Дата оплаты по данным банка
+    created_at      TIMESTAMP NOT NULL DEFAULT NOW(),
+    reversed_at     TIMESTAMP,
+    CHECK (refunded <= amount)
+);
+
+-- Один платеж на внешнюю ссылку источника
+CREATE UNIQUE INDEX IF NOT EXISTS payments_external_ref_idx
+    ON payments(source, external_ref) WHERE kind = 'payment' AND external_ref <> '';
+
+CREATE INDEX IF NOT EXISTS payments_account_idx
+    ON payments(account_id, id DESC);
+CREATE INDEX IF NOT EXISTS payments_contract_idx
+    ON payments(contract_id, id DESC);
+CREATE INDEX IF NOT EXISTS payments_original_idx
+    ON payments(original_id) WHERE original_id IS NOT NULL;
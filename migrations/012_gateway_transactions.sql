@@ -0,0 +1,25 @@
+-- Транзакции платежных агрегаторов (Click, Payme).
+-- Протокол check / perform / cancel: транзакция создается при проверке (prepare / CreateTransaction),
+-- при проведении становится платежом (payments, источник - имя шлюза), при отмене после
+-- проведения платеж отменяется (reversal). Повторные запросы с тем же external_id идемпотентны.
+
+CREATE TABLE IF NOT EXISTS gateway_transactions (
+    id            SERIAL PRIMARY KEY,
+    gateway       VARCHAR(32) NOT NULL,              -- Имя шлюза из конфигурации
+    external_id   VARCHAR(64) NOT NULL,              -- ID транзакции у провайдера
+    account_id    INTEGER NOT NULL REFERENCES accounts(id),
+    amount        NUMERIC(20,10) NOT NULL CHECK (amount > 0),
+    currency_id   INTEGER NOT NULL REFERENCES currencies(id),
+    state         VARCHAR(16) NOT NULL
+                  CHECK (state IN ('created', 'performed', 'cancelled', 'reversed')),
+    payment_id    INTEGER REFERENCES payments(id),
+    provider_time TIMESTAMP NOT NULL,                -- Время создания у провайдера
+    created_at    TIMESTAMP NOT NULL DEFAULT NOW(),
+    performed_at  TIMESTAMP,
+    cancelled_at  TIMESTAMP,
+    cancel_reason VARCHAR(255) NOT NULL DEFAULT '',
+    UNIQUE (gateway, external_id)
+);
+
+CREATE INDEX IF NOT EXISTS gateway_transactions_time_idx
+    ON gateway_transactions(gateway, provider_time);
@@ -0,0 +1,26 @@
+-- Обещанные платежи (временный кредит).
+-- Пока обещанный платеж активен, его сумма прибавлена к service_params.credit аккаунта; по истечении
+-- срока (или при отмене оператором) сумма вычитается из кредита, активные сессии перепроверяются.
+
+CREATE TABLE IF NOT EXISTS promised_payments (
+    id           SERIAL PRIMARY KEY,
+    account_id   INTEGER NOT NULL REFERENCES accounts(id),
+    amount       NUMERIC(20,10) NOT NULL CHECK (amount > 0), -- В валюте договора
+    currency_id  INTEGER NOT NULL REFERENCES currencies(id),
+    state        VARCHAR(16) NOT NULL DEFAULT 'active'
+                 CHECK (state IN ('active', 'expired', 'cancelled')),
+    granted_at   TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at   TIMESTAMP NOT NULL,
+    closed_at    TIMESTAMP,
+    close_reason VARCHAR(255) NOT NULL DEFAULT '',
+    CHECK (expires_at > granted_at)
+);
+
+-- Не более одного активного обещанного платежа на аккаунт
+CREATE UNIQUE INDEX IF NOT EXISTS promised_payments_active_idx
+    ON promised_payments(account_id) WHERE state = 'active';
+
+CREATE INDEX IF NOT EXISTS promised_payments_account_idx
+    ON promised_payments(account_id, granted_at DESC);
+CREATE INDEX IF NOT EXISTS promised_payments_expires_idx
+    ON promised_payments(expires_at) WHERE state = 'active';
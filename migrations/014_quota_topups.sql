@@ -0,0 +1,15 @@
+-- Докупки объема квоты.
+-- Повтор запроса с тем же ключом идемпотентности не добавляет объем и не списывает цену повторно.
+
+CREATE TABLE IF NOT EXISTS quota_topups (
+    id              SERIAL PRIMARY KEY,
+    account_id      INTEGER NOT NULL REFERENCES accounts(id),
+    idempotency_key VARCHAR(160) UNIQUE,           -- NULL, если запрос пришел без ключа
+    pack            VARCHAR(64) NOT NULL DEFAULT '', -- Пусто для бесплатного объема
+    class           VARCHAR(64) NOT NULL,
+    bytes           DOUBLE PRECISION NOT NULL CHECK (bytes > 0),
+    transaction_id  INTEGER,                       -- Списание цены пакета
+    created_at      TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS quota_topups_account_idx ON quota_topups(account_id, created_at DESC);
@@ -0,0 +1,5 @@
+-- NAS сессии, чтобы любой узел мог отключить ее по NAS и Acct-Session-Id
+-- (политика simultaneous_use kick_oldest для сессий других узлов).
+
+ALTER TABLE iptraffic_sessions ADD COLUMN IF NOT EXISTS nas_ip VARCHAR(45);
+ALTER TABLE iptraffic_sessions ADD COLUMN IF NOT EXISTS nas_port INTEGER;